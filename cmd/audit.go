@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+// runAudit prints, for every user, the keys of authorized_keys that no source
+// returns. Nothing is written. Exits with ExitFailure if any user failed or
+// has unexpected keys.
+func runAudit(ctx context.Context, w io.Writer, logger *slog.Logger, syncer *sync.Syncer) int {
+	result := syncer.Audit(ctx)
+
+	unexpectedCount := 0
+	for _, userResult := range result.Users {
+		switch {
+		case userResult.Error != nil:
+			fmt.Fprintf(w, "%s: failed: %v\n", userResult.Username, userResult.Error)
+		case userResult.Skipped:
+			fmt.Fprintf(w, "%s: skipped: %s\n", userResult.Username, userResult.SkipReason)
+		case len(userResult.Unexpected) == 0:
+			fmt.Fprintf(w, "%s: no unexpected keys\n", userResult.Username)
+		default:
+			fmt.Fprintf(w, "%s: %d unexpected keys\n", userResult.Username, len(userResult.Unexpected))
+		}
+
+		for _, key := range userResult.Unexpected {
+			unexpectedCount++
+			verdict := "removed by next sync"
+			if key.Kept {
+				verdict = "kept as local key"
+			}
+			fields := []string{key.Fingerprint}
+			if key.Type != "" {
+				fields = append(fields, key.Type)
+			}
+			if key.Comment != "" {
+				fields = append(fields, key.Comment)
+			}
+			fmt.Fprintf(w, "  %s (%s)\n", strings.Join(fields, " "), verdict)
+		}
+	}
+
+	if result.HasErrors || unexpectedCount > 0 {
+		logger.Warn("audit complete",
+			"users", len(result.Users),
+			"unexpected_keys", unexpectedCount,
+			"failed", result.HasErrors)
+		return ExitFailure
+	}
+
+	logger.Info("audit complete",
+		"users", len(result.Users),
+		"unexpected_keys", 0)
+	return ExitSuccess
+}
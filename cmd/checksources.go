@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"text/tabwriter"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+// checkSources returns every distinct source of the configuration, using the
+// source template for users without explicit sources
+func checkSources(cfg *config.Config) ([]config.Source, error) {
+	var sources []config.Source
+	seen := make(map[string]bool)
+	for _, user := range cfg.Users {
+		userSources := user.Sources
+		// A template needs a concrete username, patterns and groups are
+		// resolved at sync time
+		if !user.IsPattern() && !user.IsGroup() {
+			var err error
+			userSources, err = cfg.Policy.ResolveSources(user.Username, user.Sources)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, source := range userSources {
+			// Without a concrete username a placeholder cannot be expanded
+			if source.HasPlaceholders() {
+				continue
+			}
+			key := fmt.Sprintf("%s\x00%v\x00%s", source.URL, source.Headers, source.BasicAuthUser)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			sources = append(sources, source)
+		}
+	}
+	return sources, nil
+}
+
+// runCheckSources sends a HEAD request to every configured source and prints
+// its status code. No body is downloaded and nothing is written.
+// A positive timeoutCap caps the timeout of every source in seconds.
+func runCheckSources(ctx context.Context, w io.Writer, logger *slog.Logger, cfg *config.Config, timeoutCap int) int {
+	sources, err := checkSources(cfg)
+	if err != nil {
+		logger.Error("failed to resolve sources", "error", err)
+		return ExitFailure
+	}
+	sources = config.CapTimeouts(sources, timeoutCap)
+
+	fetcher := sync.NewFetcher(cfg, logger)
+	failed := 0
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, source := range sources {
+		source.Method = http.MethodHead
+		source.Body = ""
+		source.Paginate = false
+
+		result := fetcher.Fetch(ctx, source)
+		status := "-"
+		if result.StatusCode != 0 {
+			status = fmt.Sprint(result.StatusCode)
+		}
+		outcome := "ok"
+		if result.Error != nil {
+			outcome = result.Error.Error()
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", status, source.URL, outcome)
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintf(w, "\n%d sources checked, %d failed\n", len(sources), failed)
+	if failed > 0 {
+		return ExitFailure
+	}
+	return ExitSuccess
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/sync"
+	"github.com/eduardolat/authkeysync/internal/userinfo"
+)
+
+// runConfigTestFetch checks a configuration that has already been loaded and
+// validated against the live system: every source is fetched as a sync would
+// fetch it, and every user is resolved on the system. Nothing is written.
+func runConfigTestFetch(ctx context.Context, w io.Writer, logger *slog.Logger, cfg *config.Config, syncer *sync.Syncer) int {
+	users, failedEntries, err := syncer.ResolveUsers()
+	if err != nil {
+		logger.Error("failed to resolve users", "error", err)
+		return ExitFailure
+	}
+
+	// Sources are taken from the resolved users, so templates, patterns and
+	// groups are checked with the users they expand to
+	var sources []config.Source
+	seen := make(map[string]bool)
+	for _, user := range users {
+		for _, source := range user.Sources {
+			key := fmt.Sprintf("%s\x00%v\x00%s", source.URL, source.Headers, source.BasicAuthUser)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			sources = append(sources, source)
+		}
+	}
+
+	fmt.Fprintf(w, "Configuration: ok\n")
+
+	fetcher := sync.NewFetcher(cfg, logger)
+	failedSources := 0
+
+	fmt.Fprintf(w, "\nSources:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, source := range sources {
+		result := fetcher.Fetch(ctx, source)
+		status := "-"
+		if result.StatusCode != 0 {
+			status = fmt.Sprint(result.StatusCode)
+		}
+		outcome := fmt.Sprintf("ok (%d keys)", len(result.Keys))
+		if result.Error != nil {
+			outcome = result.Error.Error()
+			failedSources++
+		}
+		label := source.GetMethod() + " " + source.URL
+		if source.IsFile() || source.IsS3() {
+			label = source.URL
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", status, label, outcome)
+	}
+	_ = tw.Flush()
+
+	failedUsers := len(failedEntries)
+
+	fmt.Fprintf(w, "\nUsers:\n")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, user := range users {
+		var outcome string
+		switch {
+		case user.LookupError == nil:
+			outcome = "ok (" + user.Info.SSHDir + ")"
+		case errors.Is(user.LookupError, userinfo.ErrSSHDirNotFound) && cfg.Policy.IsCreateSSHDir():
+			outcome = "no .ssh directory, create_ssh_dir may create it"
+		case errors.Is(user.LookupError, userinfo.ErrUserNotFound):
+			outcome = "not found, the user would be skipped"
+			failedUsers++
+		default:
+			outcome = user.LookupError.Error()
+			failedUsers++
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", user.Username, outcome)
+	}
+	for _, entry := range failedEntries {
+		fmt.Fprintf(tw, "  %s\t%s\n", entry.Username, entry.Error)
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintf(w, "\n%d sources checked, %d failed\n", len(sources), failedSources)
+	fmt.Fprintf(w, "%d users checked, %d with problems\n", len(users)+len(failedEntries), failedUsers)
+	if failedSources > 0 || failedUsers > 0 {
+		return ExitFailure
+	}
+	return ExitSuccess
+}
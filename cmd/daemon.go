@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/sync"
+	"github.com/eduardolat/authkeysync/internal/systemd"
+)
+
+// runDaemon synchronizes every interval until ctx is cancelled, then returns
+// the exit code of the last sync that ran to completion. The interval starts
+// once a sync has finished, so syncs never overlap.
+// SIGHUP reloads the configuration and triggers an immediate sync; if the new
+// configuration is invalid, the previous one is kept.
+func runDaemon(ctx context.Context, logger *slog.Logger, configPath string, cfg *config.Config, interval time.Duration, opts sync.Options, explain bool, metricsFile string) int {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	logger.Info("running as daemon",
+		"interval", interval.String())
+
+	// The syncer is reused between runs so that fetcher state, such as the
+	// negative cache and the validators of unchanged sources, survives until
+	// the configuration is reloaded
+	opts.Incremental = true
+	syncer := sync.NewWithOptions(cfg, logger, opts)
+
+	// Keep the systemd watchdog fed while the daemon is running
+	go runWatchdog(ctx, logger)
+
+	ready := false
+	exitCode := ExitSuccess
+	for {
+		start := time.Now()
+		result, ok := syncAndReport(ctx, logger, syncer, explain)
+		if metricsFile != "" {
+			writeMetricsFile(logger, metricsFile, result, ok, time.Since(start))
+		}
+		// A sync interrupted by the shutdown says nothing about the keys
+		if ctx.Err() == nil {
+			exitCode = ExitSuccess
+			if !ok {
+				exitCode = ExitFailure
+			}
+		}
+		if !ready {
+			notify(logger, systemd.StateReady)
+			ready = true
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			notify(logger, systemd.StateStopping)
+			logger.Info("daemon stopped",
+				"exit_code", exitCode)
+			return exitCode
+
+		case <-timer.C:
+
+		case <-hupChan:
+			timer.Stop()
+			logger.Info("received SIGHUP, reloading configuration",
+				"path", configPath)
+			notify(logger, systemd.StateReloading)
+			ready = false // READY=1 again once the reloaded config has synced
+
+			newCfg, err := config.Load(configPath)
+			if err != nil {
+				logger.Error("failed to reload configuration, keeping the previous one",
+					"path", configPath,
+					"error", err)
+				break
+			}
+
+			for _, warning := range newCfg.Warnings {
+				logger.Warn("configuration warning", "path", configPath, "warning", warning)
+			}
+
+			syncer = sync.NewWithOptions(newCfg, logger, opts)
+			logger.Info("configuration reloaded",
+				"users", len(newCfg.Users))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables that set flags,
+// e.g. AUTHKEYSYNC_DRY_RUN=true for --dry-run
+const envPrefix = "AUTHKEYSYNC_"
+
+// envLogLevel is the environment variable that sets the log level
+const envLogLevel = envPrefix + "LOG_LEVEL"
+
+// envIgnoredFlags are flags that cannot be set from the environment: the log
+// level flags are replaced by AUTHKEYSYNC_LOG_LEVEL, and a stray
+// AUTHKEYSYNC_VERSION must not turn every run into a version print
+var envIgnoredFlags = map[string]bool{
+	"debug":   true,
+	"quiet":   true,
+	"silent":  true,
+	"version": true,
+}
+
+// envName returns the environment variable of a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// repeatableValue is a flag that collects its values across repeated flags,
+// such as --user and --header
+type repeatableValue interface {
+	flag.Value
+	// Reset drops the values collected so far
+	Reset()
+}
+
+// envValue wraps a repeatable flag set from the environment, so that the
+// first value given on the command line replaces the environment ones
+// instead of adding to them
+type envValue struct {
+	repeatableValue
+	fromEnv bool
+}
+
+// String implements flag.Value. The flag package calls it on a zero value.
+func (v *envValue) String() string {
+	if v.repeatableValue == nil {
+		return ""
+	}
+	return v.repeatableValue.String()
+}
+
+// Set implements flag.Value
+func (v *envValue) Set(value string) error {
+	if v.fromEnv {
+		v.Reset()
+		v.fromEnv = false
+	}
+	return v.repeatableValue.Set(value)
+}
+
+// applyEnv sets flags from their environment variables. It must run before
+// flag.Parse, so that flags given on the command line take precedence.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || envIgnoredFlags[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), setErr)
+			return
+		}
+		if repeatable, ok := f.Value.(repeatableValue); ok {
+			f.Value = &envValue{repeatableValue: repeatable, fromEnv: true}
+		}
+	})
+	return err
+}
+
+// envLogLevelValue returns the log level set by AUTHKEYSYNC_LOG_LEVEL.
+// ok is false if the variable is not set.
+func envLogLevelValue() (level slog.Level, ok bool, err error) {
+	value, ok := os.LookupEnv(envLogLevel)
+	if !ok {
+		return 0, false, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return slog.LevelDebug, true, nil
+	case "info":
+		return slog.LevelInfo, true, nil
+	case "warn", "warning":
+		return slog.LevelWarn, true, nil
+	case "error":
+		return slog.LevelError, true, nil
+	default:
+		return 0, false, fmt.Errorf("invalid value %q for %s (supported: debug, info, warn, error)", value, envLogLevel)
+	}
+}
+
+// isFlagSet returns true if any of the named flags was given on the command line
+func isFlagSet(fs *flag.FlagSet, names ...string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			if f.Name == name {
+				set = true
+			}
+		}
+	})
+	return set
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "AUTHKEYSYNC_DRY_RUN", envName("dry-run"))
+	assert.Equal(t, "AUTHKEYSYNC_CONFIG", envName("config"))
+	assert.Equal(t, "AUTHKEYSYNC_BACKUP_RETENTION", envName("backup-retention"))
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		config string
+		dryRun bool
+		debug  bool
+		errMsg string
+	}{
+		{name: "no environment", config: "default.yaml"},
+		{
+			name:   "from the environment",
+			env:    map[string]string{"AUTHKEYSYNC_CONFIG": "env.yaml", "AUTHKEYSYNC_DRY_RUN": "true"},
+			config: "env.yaml",
+			dryRun: true,
+		},
+		{
+			name:   "command line takes precedence",
+			env:    map[string]string{"AUTHKEYSYNC_CONFIG": "env.yaml", "AUTHKEYSYNC_DRY_RUN": "true"},
+			args:   []string{"--config", "cli.yaml", "--dry-run=false"},
+			config: "cli.yaml",
+		},
+		{
+			name:   "ignored flags",
+			env:    map[string]string{"AUTHKEYSYNC_DEBUG": "true"},
+			config: "default.yaml",
+		},
+		{
+			name:   "invalid value",
+			env:    map[string]string{"AUTHKEYSYNC_DRY_RUN": "maybe"},
+			errMsg: `invalid value "maybe" for AUTHKEYSYNC_DRY_RUN`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			config := fs.String("config", "default.yaml", "")
+			dryRun := fs.Bool("dry-run", false, "")
+			debug := fs.Bool("debug", false, "")
+
+			err := applyEnv(fs)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, fs.Parse(tt.args))
+			assert.Equal(t, tt.config, *config)
+			assert.Equal(t, tt.dryRun, *dryRun)
+			assert.Equal(t, tt.debug, *debug)
+		})
+	}
+}
+
+func TestEnvLogLevelValue(t *testing.T) {
+	// Setenv restores the variable of the environment after the test
+	t.Setenv(envLogLevel, "")
+	require.NoError(t, os.Unsetenv(envLogLevel))
+	_, ok, err := envLogLevelValue()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	tests := []struct {
+		value    string
+		expected slog.Level
+		errMsg   string
+	}{
+		{value: "debug", expected: slog.LevelDebug},
+		{value: " INFO ", expected: slog.LevelInfo},
+		{value: "warn", expected: slog.LevelWarn},
+		{value: "warning", expected: slog.LevelWarn},
+		{value: "error", expected: slog.LevelError},
+		{value: "trace", errMsg: `invalid value "trace" for AUTHKEYSYNC_LOG_LEVEL`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv(envLogLevel, tt.value)
+			level, ok, err := envLogLevelValue()
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, tt.expected, level)
+		})
+	}
+}
+
+func TestApplyEnv_RepeatableFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		users   []string
+		headers headerFlags
+	}{
+		{
+			name:    "environment only",
+			users:   []string{"alice", "carol"},
+			headers: headerFlags{"X-Env": "1"},
+		},
+		{
+			name:    "command line replaces the environment",
+			args:    []string{"--user", "bob", "--header", "X-Cli: 2"},
+			users:   []string{"bob"},
+			headers: headerFlags{"X-Cli": "2"},
+		},
+		{
+			name:    "repeated on the command line",
+			args:    []string{"--user", "bob", "--user", "dave"},
+			users:   []string{"bob", "dave"},
+			headers: headerFlags{"X-Env": "1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AUTHKEYSYNC_USER", "alice,carol")
+			t.Setenv("AUTHKEYSYNC_HEADER", "X-Env: 1")
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			var users userFlags
+			headers := headerFlags{}
+			fs.Var(&users, "user", "")
+			fs.Var(headers, "header", "")
+
+			require.NoError(t, applyEnv(fs))
+			require.NoError(t, fs.Parse(tt.args))
+			assert.Equal(t, tt.users, []string(users))
+			assert.Equal(t, tt.headers, headers)
+		})
+	}
+}
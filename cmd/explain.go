@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+// printExplain prints the per-user decision log of a sync run
+func printExplain(w io.Writer, result *sync.SyncResult) {
+	for _, userResult := range result.Users {
+		fmt.Fprintf(w, "\nUser: %s\n", userResult.Username)
+
+		// A failed user still shows the decisions made before it failed, such
+		// as the keys withheld by min_keys
+		if userResult.Error != nil {
+			fmt.Fprintf(w, "  failed: %v\n", userResult.Error)
+		} else if userResult.Skipped {
+			fmt.Fprintf(w, "  skipped: %s\n", userResult.SkipReason)
+			continue
+		}
+		if len(userResult.Decisions) == 0 {
+			if userResult.Error == nil {
+				fmt.Fprintf(w, "  no candidate keys\n")
+			}
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, d := range userResult.Decisions {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", d.Verdict, d.Fingerprint, d.Source, d.Detail)
+		}
+		_ = tw.Flush()
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+func TestPrintExplain(t *testing.T) {
+	result := &sync.SyncResult{
+		Users: []sync.UserResult{
+			{
+				Username: "alice",
+				Decisions: []sync.KeyDecision{
+					{Source: "https://example.com/alice", Fingerprint: "SHA256:aaa", Verdict: sync.VerdictWritten},
+					{Source: "Local", Fingerprint: "SHA256:bbb", Verdict: sync.VerdictDeduped, Detail: "duplicate of https://example.com/alice"},
+				},
+			},
+			{
+				Username: "bob",
+				Error:    errors.New("too few keys"),
+				Decisions: []sync.KeyDecision{
+					{Source: "Local", Fingerprint: "SHA256:ccc", Verdict: sync.VerdictWithheld, Detail: "0 keys, min_keys is 1"},
+				},
+			},
+			{Username: "carol", Error: errors.New("source failed")},
+			{Username: "dave", Skipped: true, SkipReason: "home directory does not exist"},
+			{Username: "erin"},
+		},
+	}
+
+	var buf bytes.Buffer
+	printExplain(&buf, result)
+	assert.Equal(t, "\nUser: alice\n"+
+		"  written  SHA256:aaa  https://example.com/alice  \n"+
+		"  deduped  SHA256:bbb  Local                      duplicate of https://example.com/alice\n"+
+		"\nUser: bob\n"+
+		"  failed: too few keys\n"+
+		"  withheld  SHA256:ccc  Local  0 keys, min_keys is 1\n"+
+		"\nUser: carol\n"+
+		"  failed: source failed\n"+
+		"\nUser: dave\n"+
+		"  skipped: home directory does not exist\n"+
+		"\nUser: erin\n"+
+		"  no candidate keys\n", buf.String())
+}
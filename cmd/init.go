@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// initCommand is the name of the init subcommand
+const initCommand = "init"
+
+// initDefaultSourceURL is the source offered by the init subcommand
+const initDefaultSourceURL = "https://github.com/" + config.UsernamePlaceholder + ".keys"
+
+// initConfigHeader starts every config written by the init subcommand
+const initConfigHeader = `# AuthKeySync configuration generated by "authkeysync init".
+# See docs/configuration.md for every option.
+`
+
+// runInit runs the init subcommand: it asks for the users to sync and their
+// key source, then writes a config file with the usual policy defaults
+func runInit(args []string) int {
+	fs := flag.NewFlagSet(initCommand, flag.ContinueOnError)
+	configPath := fs.String("config", config.DefaultConfigPath, "Default path of the configuration file to write")
+	force := fs.Bool("force", false, "Overwrite the configuration file if it exists")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: authkeysync init [--config <path>] [--force]\n\n")
+		fmt.Fprintf(os.Stderr, "Asks for the users to sync and their key source, then writes a config file.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+
+	if err := applyEnv(fs); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return ExitSuccess
+		}
+		return ExitFailure
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return ExitFailure
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	path, err := prompt(in, os.Stdout, "Config file path", *configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+	if _, err := os.Lstat(path); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "Error: %s already exists (use --force to overwrite it)\n", path)
+		return ExitFailure
+	}
+
+	cfg, err := promptConfig(in, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+
+	data, err := cfg.Marshal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+	data = append([]byte(initConfigHeader), data...)
+	// The written file must load like any other
+	if _, err := config.Parse(data); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: generated config is invalid: %v\n", err)
+		return ExitFailure
+	}
+
+	if err := writeNewFile(path, data, *force); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+
+	fmt.Printf("\nWrote %s. Preview the first sync with:\n  authkeysync --config %s --dry-run\n", path, path)
+	return ExitSuccess
+}
+
+// promptConfig asks for the usernames and the source URL of a config until
+// they form a valid one
+func promptConfig(in *bufio.Reader, out io.Writer) (*config.Config, error) {
+	for {
+		answer, err := prompt(in, out, "Usernames to sync, separated by commas", "")
+		if err != nil {
+			return nil, err
+		}
+		var usernames []string
+		for username := range strings.SplitSeq(answer, ",") {
+			username = strings.TrimSpace(username)
+			if username != "" && !slices.Contains(usernames, username) {
+				usernames = append(usernames, username)
+			}
+		}
+		if len(usernames) == 0 {
+			fmt.Fprintf(out, "At least one username is required.\n")
+			continue
+		}
+
+		url, err := prompt(in, out, "Key source URL, "+config.UsernamePlaceholder+" is replaced by each username", initDefaultSourceURL)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := newInitConfig(usernames, url)
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintf(out, "%v\n", err)
+			continue
+		}
+		return cfg, nil
+	}
+}
+
+// newInitConfig returns a config syncing every username from url, with the
+// policy defaults spelled out so that they are easy to change
+func newInitConfig(usernames []string, url string) *config.Config {
+	backupEnabled, preserveLocalKeys := true, true
+	backupRetentionCount := config.DefaultBackupRetentionCount
+
+	cfg := &config.Config{
+		Policy: config.Policy{
+			BackupEnabled:        &backupEnabled,
+			BackupRetentionCount: &backupRetentionCount,
+			PreserveLocalKeys:    &preserveLocalKeys,
+		},
+	}
+	for _, username := range usernames {
+		cfg.Users = append(cfg.Users, config.User{
+			Username: username,
+			Sources:  []config.Source{{URL: url}},
+		})
+	}
+	return cfg
+}
+
+// prompt asks a question and returns the trimmed answer, or defaultValue if
+// the answer is empty. An empty answer to a question without a default is
+// asked again.
+func prompt(in *bufio.Reader, out io.Writer, question, defaultValue string) (string, error) {
+	for {
+		if defaultValue != "" {
+			fmt.Fprintf(out, "%s [%s]: ", question, defaultValue)
+		} else {
+			fmt.Fprintf(out, "%s: ", question)
+		}
+
+		line, err := in.ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+			if errors.Is(err, io.EOF) {
+				return "", errors.New("no answer given")
+			}
+			return "", fmt.Errorf("failed to read answer: %w", err)
+		}
+
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = defaultValue
+		}
+		if answer != "" {
+			return answer, nil
+		}
+	}
+}
+
+// writeNewFile writes a config file readable by its owner only, creating its
+// directory if needed. An existing file is only replaced with overwrite, by
+// renaming a new file over it so that it does not keep its old mode.
+func writeNewFile(path string, data []byte, overwrite bool) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	if !overwrite {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists (use --force to overwrite it)", path)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create config file: %w", err)
+		}
+		return writeAndClose(f, data)
+	}
+
+	// CreateTemp creates the file with mode 0600
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	if err := writeAndClose(f, data); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed to replace config file: %w", err)
+	}
+	return nil
+}
+
+// writeAndClose writes data to a new config file and closes it
+func writeAndClose(f *os.File, data []byte) error {
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
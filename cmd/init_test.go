@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteNewFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  bool
+		overwrite bool
+		errMsg    string
+	}{
+		{name: "new file", existing: false, overwrite: false},
+		{name: "new file with overwrite", existing: false, overwrite: true},
+		{name: "existing file", existing: true, overwrite: false, errMsg: "already exists (use --force to overwrite it)"},
+		{name: "existing file with overwrite", existing: true, overwrite: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "etc", "config.yaml")
+			if tt.existing {
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+				require.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+				// WriteFile does not change the mode of an existing file
+				require.NoError(t, os.Chmod(path, 0644))
+			}
+
+			err := writeNewFile(path, []byte("new"), tt.overwrite)
+			if tt.errMsg != "" {
+				require.ErrorContains(t, err, tt.errMsg)
+				content, err := os.ReadFile(path)
+				require.NoError(t, err)
+				assert.Equal(t, "old", string(content))
+				return
+			}
+			require.NoError(t, err)
+
+			content, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, "new", string(content))
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+			// No temp file is left behind
+			entries, err := os.ReadDir(filepath.Dir(path))
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+		})
+	}
+}
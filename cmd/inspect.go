@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/keyfetcher"
+	"github.com/eduardolat/authkeysync/internal/keyparser"
+)
+
+// inspectCommand is the name of the inspect subcommand
+const inspectCommand = "inspect"
+
+// runInspect runs the inspect subcommand: it fetches a single URL or file and
+// prints the type, size and fingerprints of every key it returns
+func runInspect(args []string) int {
+	fs := flag.NewFlagSet(inspectCommand, flag.ContinueOnError)
+	timeout := fs.Int("timeout", config.DefaultTimeoutSeconds, "Request timeout in seconds")
+	headers := headerFlags{}
+	fs.Var(headers, "header", "Request header \"Name: value\" (repeatable)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: authkeysync inspect [--header \"Name: value\"] [--timeout <seconds>] <url-or-file>\n\n")
+		fmt.Fprintf(os.Stderr, "Fetches a URL or reads a file and prints the type, size and SHA256 and MD5\n")
+		fmt.Fprintf(os.Stderr, "fingerprints of every key, as \"ssh-keygen -l\" does.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+
+	if err := applyEnv(fs); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+	// Flags may follow the URL as well as precede it
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return ExitSuccess
+			}
+			return ExitFailure
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return ExitFailure
+	}
+	if *timeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --timeout must be positive\n")
+		return ExitFailure
+	}
+
+	source := config.Source{URL: positional[0], TimeoutSeconds: timeout, Headers: headers}
+	if source.IsFile() {
+		if len(headers) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: --header cannot be used with a file\n")
+			return ExitFailure
+		}
+		// Unlike in the config, a relative path is relative to the working
+		// directory
+		if !strings.HasPrefix(source.URL, "file:") {
+			path, err := filepath.Abs(source.URL)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return ExitFailure
+			}
+			source.URL = path
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	result := keyfetcher.NewWithLogger(logger).Fetch(context.Background(), source)
+	return printInspect(os.Stdout, result)
+}
+
+// printInspect prints the keys of a fetch result with their fingerprints.
+// Returns the exit code of the inspect subcommand.
+func printInspect(w io.Writer, result *keyfetcher.FetchResult) int {
+	fmt.Fprintf(w, "Source:  %s\n", result.Source.URL)
+	if result.StatusCode != 0 {
+		fmt.Fprintf(w, "Status:  %d\n", result.StatusCode)
+	}
+	if result.Error != nil {
+		fmt.Fprintf(w, "Error:   %v\n", result.Error)
+		return ExitFailure
+	}
+	fmt.Fprintf(w, "Keys:    %d\n", len(result.Keys))
+	fmt.Fprintf(w, "Discarded lines: %d\n", result.DiscardedLines)
+	if len(result.Keys) == 0 {
+		return ExitSuccess
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "TYPE\tBITS\tSHA256\tMD5\tCOMMENT\n")
+	for _, key := range result.Keys {
+		keyType, bits, comment := "?", "?", ""
+		if parts, err := keyparser.SplitKey(key.Line); err == nil {
+			keyType, comment = parts.Type, parts.Comment
+			if info, err := keyparser.InspectBlob(parts.Blob); err == nil && info.Bits > 0 {
+				bits = strconv.Itoa(info.Bits)
+			}
+		}
+		sha256, err := keyparser.Fingerprint(key.Line)
+		if err != nil {
+			sha256 = "(invalid key blob)"
+		}
+		md5, err := keyparser.FingerprintMD5(key.Line)
+		if err != nil {
+			md5 = "(invalid key blob)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", keyType, bits, sha256, md5, comment)
+	}
+	_ = tw.Flush()
+	return ExitSuccess
+}
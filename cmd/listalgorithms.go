@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/keyparser"
+)
+
+// runListAlgorithms prints the key types that would be written, one per
+// line: those allowed by key_profile and allowed_key_types if set, or every
+// supported key type otherwise
+func runListAlgorithms(w io.Writer, cfg *config.Config) int {
+	algorithms := cfg.Policy.KeyPolicy().AllowedTypes()
+	if algorithms == nil {
+		algorithms = keyparser.SupportedAlgorithms()
+	}
+
+	for _, algorithm := range algorithms {
+		fmt.Fprintln(w, algorithm)
+	}
+	return ExitSuccess
+}
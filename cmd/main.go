@@ -4,16 +4,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
+	"time"
+	_ "time/tzdata" // time_zone must work on hosts without a zoneinfo database
 
 	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/logging"
+	"github.com/eduardolat/authkeysync/internal/runlock"
 	"github.com/eduardolat/authkeysync/internal/sync"
+	"github.com/eduardolat/authkeysync/internal/systemd"
+	"github.com/eduardolat/authkeysync/internal/tracing"
 	"github.com/eduardolat/authkeysync/internal/version"
 )
 
@@ -21,6 +30,10 @@ import (
 const (
 	ExitSuccess = 0
 	ExitFailure = 1
+	// ExitDrift is returned by --check when an authorized_keys would change
+	ExitDrift = 2
+	// ExitLocked is returned when another run holds the lock file
+	ExitLocked = 3
 )
 
 // ASCII art banner for the CLI
@@ -48,19 +61,68 @@ func run() int {
 		return ExitFailure
 	}
 
+	// Subcommands have their own flags
+	if len(os.Args) > 1 && os.Args[1] == restoreCommand {
+		return runRestore(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == initCommand {
+		return runInit(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == inspectCommand {
+		return runInspect(os.Args[2:])
+	}
+
 	// Define CLI flags
 	configPath := flag.String("config", config.DefaultConfigPath, "Path to the configuration file")
 	dryRun := flag.Bool("dry-run", false, "Simulate sync without modifying files")
+	check := flag.Bool("check", false, "Log a diff of every authorized_keys that would change and exit with code 2 if any would (no writes)")
+	noBackup := flag.Bool("no-backup", false, "Never create backups, overriding backup_enabled")
+	checkSourcesFlag := flag.Bool("check-sources", false, "Send a HEAD request to every configured source, print status codes and exit (no sync)")
+	validateConfig := flag.Bool("validate-config", false, "Load and validate the config, print a summary of users and sources and exit (no lookups, fetches or writes)")
+	configTestFetch := flag.Bool("config-test-fetch", false, "Validate the config, fetch every source and resolve every user on the system, print a report and exit (no writes)")
+	audit := flag.Bool("audit", false, "Fetch every source and print the keys of each authorized_keys that no source returns, then exit (no writes)")
+	pruneBackups := flag.Bool("prune-backups", false, "Apply backup_retention_count to every user's backups and exit (no sync)")
+	noRotate := flag.Bool("no-rotate", false, "Create backups but never delete old ones, overriding backup_retention_count")
+	backupRetention := flag.Int("backup-retention", config.DefaultBackupRetentionCount, "Keep this many backups per user for this run, overriding backup_retention_count (-1 = unlimited)")
+	sourceTimeout := flag.Int("source-timeout", 0, "Cap every source's timeout_seconds at this many seconds (never extends it)")
+	changedOnly := flag.Bool("changed-only", false, "Skip users whose sources all answered 304 Not Modified since the last run")
+	stateFile := flag.String("state-file", sync.DefaultStateFile, "State file remembering source validators for --changed-only")
+	lockFile := flag.String("lock-file", runlock.DefaultPath(), "Lock file preventing concurrent runs that write (not taken by --dry-run and --check)")
+	noLock := flag.Bool("no-lock", false, "Do not take the lock file, allowing concurrent runs")
+	dropPrivileges := flag.Bool("drop-privileges", false, "Write each authorized_keys as its owner instead of root, as drop_privileges does")
 	showVersion := flag.Bool("version", false, "Show version information and exit")
 	debug := flag.Bool("debug", false, "Enable debug logging (most verbose)")
 	quiet := flag.Bool("quiet", false, "Show only warnings and errors (for cron/scheduled tasks)")
 	silent := flag.Bool("silent", false, "Show only errors (most quiet)")
+	logFormat := flag.String("log-format", logging.FormatText, "Log format: text (key=value) or json (one JSON object per line)")
+	logSyslog := flag.Bool("log-syslog", false, "Send logs to the local syslog daemon instead of stdout")
+	syslogFacility := flag.String("syslog-facility", logging.DefaultSyslogFacility, "Syslog facility for --log-syslog")
+	syslogTag := flag.String("syslog-tag", logging.DefaultSyslogTag, "Syslog tag for --log-syslog")
+	listAlgorithms := flag.Bool("list-algorithms", false, "Print the key types that would be written, one per line, honoring key_profile and allowed_key_types, then exit (no sync)")
+	showUser := flag.String("show-user", "", "Print the effective sources of a user and whether it resolves on the system, then exit (no sync)")
+	output := flag.String("output", outputText, "Output format of the sync result: text (logs only) or json (a JSON summary on stdout, logs on stderr)")
+	explain := flag.Bool("explain", false, "Print why each key was written or dropped for every user")
+	metricsFile := flag.String("metrics-file", "", "After each sync, write Prometheus metrics to this file for the node_exporter textfile collector")
+	policyReportPath := flag.String("policy-report", "", "After the sync, write the authorized keys of every user and the policy rules they passed to this file (- for stdout)")
+	policyReportFormat := flag.String("policy-report-format", policyReportJSON, "Format for --policy-report: json or csv")
+	trace := flag.Bool("trace", false, "Export OpenTelemetry traces via OTLP (configured with OTEL_* env vars)")
+	interval := flag.Duration("interval", 0, "Keep running and sync every interval, e.g. 5m (SIGHUP reloads config and syncs now)")
+	testSource := flag.String("test-source", "", "Fetch a single source URL, print what was received and exit (no config, no writes)")
+	testMethod := flag.String("method", config.DefaultMethod, "HTTP method for --test-source")
+	testBody := flag.String("body", "", "Request body for --test-source")
+	testHeaders := headerFlags{}
+	flag.Var(testHeaders, "header", "Request header \"Name: value\" for --test-source (repeatable)")
+	var onlyUsers userFlags
+	flag.Var(&onlyUsers, "user", "Only process this configured user, after wildcard and group entries are expanded (repeatable)")
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, banner)
 		fmt.Fprintf(os.Stderr, "\nSSH Public Key Synchronization Tool\n\n")
 		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  authkeysync [options]\n\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync [options]\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync restore --user <name> [--backup <filename>]\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync init [--config <path>] [--force]\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync inspect <url-or-file>\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nLog Levels:\n")
@@ -73,12 +135,45 @@ func run() int {
 		fmt.Fprintf(os.Stderr, "  authkeysync --config /path/to/config  # Use custom config\n")
 		fmt.Fprintf(os.Stderr, "  authkeysync --dry-run                 # Simulate without changes\n")
 		fmt.Fprintf(os.Stderr, "  authkeysync --quiet                   # Run silently for cron jobs\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --check                   # Exit with code 2 if any file is out of sync\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --dry-run --user deploy   # Simulate the sync of a single user\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --dry-run --explain       # Show why each key is kept or dropped\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --dry-run --policy-report keys.json\n")
+		fmt.Fprintf(os.Stderr, "                                        # Report the authorized keys of every user\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --check-sources           # Check that every source is reachable\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --validate-config         # Check the config file without touching anything\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --config-test-fetch       # Check config, sources and users before deploying\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --show-user deploy        # Show the effective sources of a user\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --prune-backups           # Delete backups beyond the retention count\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync restore --user deploy     # Restore the newest backup of a user\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --interval 5m             # Run as a daemon, sync every 5 minutes\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --quiet --log-syslog      # Log to syslog (e.g. from cron)\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --log-format json         # Log one JSON object per line\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --quiet --output json     # Print the sync result as JSON on stdout\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --metrics-file /var/lib/node_exporter/authkeysync.prom\n")
+		fmt.Fprintf(os.Stderr, "                                        # Export metrics to node_exporter\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --trace                   # Export traces to an OTLP collector\n")
+		fmt.Fprintf(os.Stderr, "  authkeysync --test-source <url> --header \"Authorization: Bearer x\"\n")
+		fmt.Fprintf(os.Stderr, "                                        # Test a single source without config\n")
+		fmt.Fprintf(os.Stderr, "\nEnvironment:\n")
+		fmt.Fprintf(os.Stderr, "  Every option can also be set with AUTHKEYSYNC_<OPTION>, e.g.\n")
+		fmt.Fprintf(os.Stderr, "  AUTHKEYSYNC_CONFIG=/path/to/config or AUTHKEYSYNC_DRY_RUN=true.\n")
+		fmt.Fprintf(os.Stderr, "  The log level is set with AUTHKEYSYNC_LOG_LEVEL=debug|info|warn|error.\n")
+		fmt.Fprintf(os.Stderr, "  Options given on the command line take precedence.\n")
 		fmt.Fprintf(os.Stderr, "\nExit Codes:\n")
 		fmt.Fprintf(os.Stderr, "  0  Success (all users processed successfully or skipped)\n")
 		fmt.Fprintf(os.Stderr, "  1  Failure (at least one user failed to synchronize)\n")
+		fmt.Fprintf(os.Stderr, "  2  Drift (--check only: at least one authorized_keys would change)\n")
+		fmt.Fprintf(os.Stderr, "  3  Locked (another run holds the lock file)\n")
 		fmt.Fprintf(os.Stderr, "\nMore info: https://github.com/eduardolat/authkeysync\n")
 	}
 
+	// Environment variables set defaults, flags on the command line win
+	if err := applyEnv(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+
 	flag.Parse()
 
 	// Show version and exit
@@ -103,10 +198,97 @@ func run() int {
 	default:
 		logLevel = slog.LevelInfo // Normal operation (0)
 	}
+	if !isFlagSet(flag.CommandLine, "debug", "quiet", "silent") {
+		envLevel, ok, err := envLogLevelValue()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return ExitFailure
+		}
+		if ok {
+			logLevel = envLevel
+		}
+	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	handlerOpts := &slog.HandlerOptions{
 		Level: logLevel,
-	}))
+	}
+	// In JSON mode stdout is reserved for the summary
+	var logOutput io.Writer = os.Stdout
+	if *output == outputJSON {
+		logOutput = os.Stderr
+	}
+	var handler slog.Handler
+	var err error
+	if *logSyslog {
+		handler, err = logging.NewSyslogHandler(*syslogFacility, *syslogTag, *logFormat, handlerOpts)
+	} else {
+		handler, err = logging.NewHandler(logOutput, *logFormat, handlerOpts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+	logger := slog.New(handler)
+
+	if *interval < 0 {
+		logger.Error("invalid interval, must not be negative", "interval", interval.String())
+		return ExitFailure
+	}
+
+	if *check && *interval > 0 {
+		logger.Error("--check cannot be used with --interval")
+		return ExitFailure
+	}
+
+	if *output != outputText && *output != outputJSON {
+		logger.Error("invalid output format, must be text or json", "output", *output)
+		return ExitFailure
+	}
+	if *output == outputJSON {
+		if *interval > 0 || *explain || *policyReportPath == "-" {
+			logger.Error("--output json cannot be used with --interval, --explain or --policy-report -")
+			return ExitFailure
+		}
+	}
+
+	if *policyReportPath != "" {
+		if *policyReportFormat != policyReportJSON && *policyReportFormat != policyReportCSV {
+			logger.Error("invalid policy report format, must be json or csv", "format", *policyReportFormat)
+			return ExitFailure
+		}
+		if *interval > 0 {
+			logger.Error("--policy-report cannot be used with --interval")
+			return ExitFailure
+		}
+	}
+
+	if *metricsFile != "" && (*dryRun || *check) {
+		logger.Error("--metrics-file cannot be used with --dry-run or --check")
+		return ExitFailure
+	}
+
+	if *sourceTimeout < 0 {
+		logger.Error("invalid source timeout, must not be negative", "source_timeout", *sourceTimeout)
+		return ExitFailure
+	}
+
+	if *backupRetention < config.BackupRetentionUnlimited {
+		logger.Error("invalid backup retention, must be -1 (unlimited) or more", "backup_retention", *backupRetention)
+		return ExitFailure
+	}
+
+	// Test a single source and exit
+	if *testSource != "" {
+		source := config.Source{
+			URL:     *testSource,
+			Method:  *testMethod,
+			Headers: testHeaders,
+			Body:    *testBody,
+
+			TimeoutCapSeconds: *sourceTimeout,
+		}
+		return runTestSource(context.Background(), os.Stdout, logger, source)
+	}
 
 	logger.Info("AuthKeySync starting",
 		"version", version.Version,
@@ -122,12 +304,70 @@ func run() int {
 		return ExitFailure
 	}
 
+	for _, warning := range cfg.Warnings {
+		logger.Warn("configuration warning", "path", *configPath, "warning", warning)
+	}
+
+	// Summarize the validated configuration and exit
+	if *validateConfig {
+		return runValidateConfig(os.Stdout, cfg, *configPath)
+	}
+
+	// List the accepted key types and exit
+	if *listAlgorithms {
+		return runListAlgorithms(os.Stdout, cfg)
+	}
+
 	logger.Info("configuration loaded",
 		"users", len(cfg.Users),
 		"backup_enabled", cfg.Policy.IsBackupEnabled(),
 		"backup_retention", cfg.Policy.GetBackupRetentionCount(),
 		"preserve_local_keys", cfg.Policy.IsPreserveLocalKeys())
 
+	opts := sync.Options{
+		DryRun:   *dryRun,
+		Check:    *check,
+		NoBackup: *noBackup,
+		NoRotate: *noRotate,
+
+		SourceTimeout: *sourceTimeout,
+		ChangedOnly:   *changedOnly,
+		StateFile:     *stateFile,
+
+		DropPrivileges: *dropPrivileges,
+	}
+	if isFlagSet(flag.CommandLine, "backup-retention") {
+		opts.BackupRetention = backupRetention
+	}
+	if opts.NoBackup {
+		logger.Warn("override: backups disabled by --no-backup")
+	}
+	if opts.NoRotate && !opts.NoBackup {
+		logger.Warn("override: backup rotation disabled by --no-rotate")
+	}
+	if opts.BackupRetention != nil {
+		logger.Warn("override: backup retention set by --backup-retention",
+			"backup_retention", *opts.BackupRetention)
+	}
+	if opts.SourceTimeout > 0 {
+		logger.Warn("override: source timeouts capped by --source-timeout",
+			"seconds", opts.SourceTimeout)
+	}
+	if (opts.DropPrivileges || cfg.Policy.IsDropPrivileges()) && os.Geteuid() != 0 {
+		logger.Error("dropping privileges requires running as root")
+		return ExitFailure
+	}
+
+	// Limit the run to the users given with --user
+	if len(onlyUsers) > 0 {
+		if code := checkUsers(logger, sync.NewWithOptions(cfg, logger, opts), onlyUsers); code != ExitSuccess {
+			return code
+		}
+		opts.Users = onlyUsers
+		logger.Info("only processing the users given with --user",
+			"users", onlyUsers.String())
+	}
+
 	// Setup context with signal handling
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -142,39 +382,219 @@ func run() int {
 		cancel()
 	}()
 
+	// Setup tracing if requested
+	if *trace {
+		shutdown, err := tracing.Setup(ctx)
+		if err != nil {
+			logger.Error("failed to setup tracing", "error", err)
+			return ExitFailure
+		}
+		defer func() {
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer shutdownCancel()
+			if err := shutdown(shutdownCtx); err != nil {
+				logger.Warn("failed to flush traces", "error", err)
+			}
+		}()
+		logger.Debug("tracing enabled")
+	}
+
+	// Check that sources are reachable and exit
+	if *checkSourcesFlag {
+		return runCheckSources(ctx, os.Stdout, logger, cfg, opts.SourceTimeout)
+	}
+
+	// Check the config against sources and system users and exit
+	if *configTestFetch {
+		return runConfigTestFetch(ctx, os.Stdout, logger, cfg, sync.NewWithOptions(cfg, logger, opts))
+	}
+
+	// Show the effective configuration of a user and exit
+	if *showUser != "" {
+		return runShowUser(os.Stdout, logger, sync.NewWithOptions(cfg, logger, opts), *showUser)
+	}
+
+	// Report unexpected keys and exit
+	if *audit {
+		return runAudit(ctx, os.Stdout, logger, sync.NewWithOptions(cfg, logger, opts))
+	}
+
+	// Keep runs that write from overlapping, e.g. a cron run and a manual one
+	if !*noLock && !opts.DryRun && !opts.Check {
+		lock, err := runlock.Acquire(*lockFile)
+		if errors.Is(err, runlock.ErrLocked) {
+			logger.Error("another run is in progress, exiting",
+				"lock_file", *lockFile,
+				"error", err)
+			return ExitLocked
+		}
+		if err != nil {
+			logger.Error("failed to take the lock file (use --lock-file or --no-lock)",
+				"lock_file", *lockFile,
+				"error", err)
+			return ExitFailure
+		}
+		defer func() {
+			if err := lock.Release(); err != nil {
+				logger.Warn("failed to release the lock file",
+					"lock_file", *lockFile,
+					"error", err)
+			}
+		}()
+	}
+
+	// Prune backups and exit
+	if *pruneBackups {
+		return runPruneBackups(logger, sync.NewWithOptions(cfg, logger, opts))
+	}
+
+	// Run as a daemon if an interval is set
+	if *interval > 0 {
+		return runDaemon(ctx, logger, *configPath, cfg, *interval, opts, *explain, *metricsFile)
+	}
+
 	// Run synchronization
-	syncer := sync.New(cfg, logger, *dryRun)
+	syncer := sync.NewWithOptions(cfg, logger, opts)
+	start := time.Now()
+	result, ok := syncAndReport(ctx, logger, syncer, *explain)
+	if *metricsFile != "" {
+		writeMetricsFile(logger, *metricsFile, result, ok, time.Since(start))
+	}
+
+	if *policyReportPath != "" {
+		report := buildPolicyReport(cfg, result, opts.DryRun || opts.Check, time.Now())
+		if err := savePolicyReport(*policyReportPath, report, *policyReportFormat); err != nil {
+			logger.Error("failed to write policy report", "error", err)
+			return ExitFailure
+		}
+		logger.Info("policy report written", "path", *policyReportPath, "format", *policyReportFormat)
+	}
+
+	if *output == outputJSON {
+		if err := writeSyncOutput(os.Stdout, result, ok); err != nil {
+			logger.Error("failed to write JSON output", "error", err)
+			return ExitFailure
+		}
+	}
+
+	if !ok {
+		return ExitFailure
+	}
+	if opts.Check {
+		return checkExitCode(logger, result)
+	}
+	return ExitSuccess
+}
+
+// checkExitCode returns ExitDrift and logs the users concerned if any
+// authorized_keys would change, ExitSuccess otherwise
+func checkExitCode(logger *slog.Logger, result *sync.SyncResult) int {
+	var drifted []string
+	for _, userResult := range result.Users {
+		if userResult.WouldChange {
+			drifted = append(drifted, userResult.Username)
+		}
+	}
+	if len(drifted) == 0 {
+		logger.Info("check: every authorized_keys is in sync")
+		return ExitSuccess
+	}
+	logger.Warn("check: authorized_keys out of sync",
+		"users", strings.Join(drifted, ","),
+		"count", len(drifted))
+	return ExitDrift
+}
+
+// syncAndReport runs one synchronization and logs its summary.
+// Returns the result and false if at least one user failed to synchronize.
+func syncAndReport(ctx context.Context, logger *slog.Logger, syncer *sync.Syncer, explain bool) (*sync.SyncResult, bool) {
 	result := syncer.Run(ctx)
 
+	if explain {
+		printExplain(os.Stdout, result)
+	}
+
 	// Log summary
 	successCount := 0
 	skippedCount := 0
 	failedCount := 0
+	updatedCount := 0
+	notModifiedCount := 0
+	rolledBackCount := 0
+	keysWritten := 0
+	changedUsers := make([]string, 0)
 
 	for _, userResult := range result.Users {
 		if userResult.Error != nil {
 			failedCount++
+			if userResult.RolledBack {
+				rolledBackCount++
+			}
 		} else if userResult.Skipped {
 			skippedCount++
 		} else {
 			successCount++
+			keysWritten += userResult.KeysWritten
+			if userResult.NotModified {
+				notModifiedCount++
+			}
+			if userResult.Changed {
+				updatedCount++
+				changedUsers = append(changedUsers, userResult.Username)
+				logger.Info("authorized_keys changed",
+					"username", userResult.Username,
+					"keys_written", userResult.KeysWritten,
+					"fingerprints", writtenFingerprints(userResult.Decisions))
+			}
 		}
 	}
 
+	notify(logger, systemd.Status(statusLine(len(result.Users), successCount, skippedCount, failedCount)))
+
 	// Use appropriate log level for summary based on outcome
 	if failedCount > 0 {
 		logger.Warn("synchronization complete with failures",
 			"success", successCount,
+			"updated", updatedCount,
+			"changed_users", strings.Join(changedUsers, ","),
+			"keys_written", keysWritten,
+			"unchanged", successCount-updatedCount,
+			"not_modified", notModifiedCount,
 			"skipped", skippedCount,
-			"failed", failedCount)
-		logger.Error("some users failed to synchronize")
-		return ExitFailure
+			"failed", failedCount,
+			"rolled_back", rolledBackCount,
+			"warnings", len(result.Warnings))
+		logger.Error("some users failed to synchronize", "error", result.Err())
+		return result, false
 	}
 
 	logger.Info("synchronization complete",
 		"success", successCount,
+		"updated", updatedCount,
+		"changed_users", strings.Join(changedUsers, ","),
+		"keys_written", keysWritten,
+		"unchanged", successCount-updatedCount,
+		"not_modified", notModifiedCount,
 		"skipped", skippedCount,
-		"failed", failedCount)
+		"failed", failedCount,
+		"warnings", len(result.Warnings))
+	if result.WarningsAreErrors && len(result.Warnings) > 0 {
+		logger.Error("synchronization had warnings and warnings_are_errors is enabled",
+			"warnings", strings.Join(result.Warnings, "; "))
+		return result, false
+	}
 	logger.Info("all users processed successfully")
-	return ExitSuccess
+	return result, true
+}
+
+// writtenFingerprints returns a compact, comma separated list of the
+// fingerprints of the keys written for a user
+func writtenFingerprints(decisions []sync.KeyDecision) string {
+	fingerprints := make([]string, 0, len(decisions))
+	for _, decision := range decisions {
+		if decision.Verdict == sync.VerdictWritten {
+			fingerprints = append(fingerprints, decision.Fingerprint)
+		}
+	}
+	return strings.Join(fingerprints, ",")
 }
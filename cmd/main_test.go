@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+func TestCheckExitCode(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name     string
+		users    []sync.UserResult
+		expected int
+	}{
+		{name: "no users", users: nil, expected: ExitSuccess},
+		{name: "in sync", users: []sync.UserResult{{Username: "alice"}, {Username: "bob"}}, expected: ExitSuccess},
+		{name: "drift", users: []sync.UserResult{{Username: "alice"}, {Username: "bob", WouldChange: true}}, expected: ExitDrift},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, checkExitCode(logger, &sync.SyncResult{Users: tt.users}))
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+// metricsFileMode lets the node_exporter textfile collector, which usually
+// runs as another user, read the metrics file
+const metricsFileMode = 0644
+
+// userLastSyncMetric is the per-user series carried over between runs for
+// users that did not sync successfully
+const userLastSyncMetric = "authkeysync_user_last_sync_timestamp_seconds"
+
+// writeMetricsFile writes the metrics of a run to path in the Prometheus text
+// format for the node_exporter textfile collector. A failure is logged but
+// does not fail the run.
+func writeMetricsFile(logger *slog.Logger, path string, result *sync.SyncResult, ok bool, duration time.Duration) {
+	previous := readLastSyncTimes(path)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, result, ok, duration, time.Now(), previous)
+
+	if err := replaceFile(path, buf.Bytes()); err != nil {
+		logger.Warn("failed to write metrics file",
+			"path", path,
+			"error", err)
+		return
+	}
+	logger.Debug("metrics file written", "path", path)
+}
+
+// writeMetrics writes the metrics of a run in the Prometheus text format.
+// Users that did not sync successfully keep their last sync time from
+// previous, so that an alert on its age keeps firing while they fail.
+func writeMetrics(w io.Writer, result *sync.SyncResult, ok bool, duration time.Duration, now time.Time, previous map[string]float64) {
+	succeeded, skipped, failed, keysWritten := 0, 0, 0, 0
+	for _, userResult := range result.Users {
+		switch {
+		case userResult.Error != nil:
+			failed++
+		case userResult.Skipped:
+			skipped++
+		default:
+			succeeded++
+			keysWritten += userResult.KeysWritten
+		}
+	}
+
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatMetricValue(value))
+	}
+	success := 0.0
+	if ok {
+		success = 1
+	}
+
+	gauge("authkeysync_last_run_timestamp_seconds", "Time the last run finished.", float64(now.Unix()))
+	gauge("authkeysync_last_run_success", "Whether the last run succeeded (1) or failed (0).", success)
+	gauge("authkeysync_last_run_duration_seconds", "Duration of the last run.", duration.Seconds())
+	gauge("authkeysync_users", "Users processed by the last run.", float64(len(result.Users)))
+	gauge("authkeysync_users_succeeded", "Users synced successfully by the last run.", float64(succeeded))
+	gauge("authkeysync_users_skipped", "Users skipped by the last run.", float64(skipped))
+	gauge("authkeysync_users_failed", "Users that failed in the last run.", float64(failed))
+	gauge("authkeysync_keys_written", "Keys written for every user by the last run.", float64(keysWritten))
+
+	fmt.Fprintf(w, "# HELP authkeysync_user_success Whether the user synced successfully (1) or not (0) in the last run.\n# TYPE authkeysync_user_success gauge\n")
+	for _, userResult := range result.Users {
+		value := 0.0
+		if userResult.Error == nil && !userResult.Skipped {
+			value = 1
+		}
+		fmt.Fprintf(w, "authkeysync_user_success{username=\"%s\"} %s\n", escapeLabelValue(userResult.Username), formatMetricValue(value))
+	}
+
+	fmt.Fprintf(w, "# HELP authkeysync_user_keys_written Keys written for the user by the last run.\n# TYPE authkeysync_user_keys_written gauge\n")
+	for _, userResult := range result.Users {
+		if userResult.Error == nil && !userResult.Skipped {
+			fmt.Fprintf(w, "authkeysync_user_keys_written{username=\"%s\"} %d\n", escapeLabelValue(userResult.Username), userResult.KeysWritten)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP %s Time the user last synced successfully.\n# TYPE %s gauge\n", userLastSyncMetric, userLastSyncMetric)
+	for _, userResult := range result.Users {
+		value, known := previous[userResult.Username]
+		if userResult.Error == nil && !userResult.Skipped {
+			value, known = float64(now.Unix()), true
+		}
+		if known {
+			fmt.Fprintf(w, "%s{username=\"%s\"} %s\n", userLastSyncMetric, escapeLabelValue(userResult.Username), formatMetricValue(value))
+		}
+	}
+}
+
+// readLastSyncTimes returns the per-user last sync times of an existing
+// metrics file, or nil if it cannot be read
+func readLastSyncTimes(path string) map[string]float64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+
+	times := make(map[string]float64)
+	prefix := userLastSyncMetric + `{username="`
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, found := strings.CutPrefix(scanner.Text(), prefix)
+		if !found {
+			continue
+		}
+		label, value, found := strings.Cut(line, `"} `)
+		if !found {
+			continue
+		}
+		username, err := strconv.Unquote(`"` + label + `"`)
+		if err != nil {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			times[username] = v
+		}
+	}
+	return times
+}
+
+// escapeLabelValue escapes a Prometheus label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatMetricValue formats a sample value without an exponent for whole
+// numbers such as timestamps
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// replaceFile atomically replaces path with content through a temp file in
+// the same directory, so readers never see a partial file
+func replaceFile(path string, content []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tempPath := tempFile.Name()
+	defer func() { _ = os.Remove(tempPath) }()
+
+	if _, err := tempFile.Write(content); err != nil {
+		_ = tempFile.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tempFile.Chmod(metricsFileMode); err != nil {
+		_ = tempFile.Close()
+		return fmt.Errorf("failed to set temp file permissions: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	return nil
+}
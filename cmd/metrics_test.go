@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+func TestEscapeLabelValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "alice", expected: "alice"},
+		{value: `a"b`, expected: `a\"b`},
+		{value: `a\b`, expected: `a\\b`},
+		{value: "a\nb", expected: `a\nb`},
+		{value: `\"` + "\n", expected: `\\\"\n`},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, escapeLabelValue(tt.value), tt.value)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	result := &sync.SyncResult{
+		Users: []sync.UserResult{
+			{Username: "alice", KeysWritten: 2},
+			{Username: `bo"b`, Error: errors.New("source failed")},
+			{Username: "carol", Skipped: true},
+			{Username: "dave", Error: errors.New("source failed")},
+		},
+	}
+	now := time.Unix(1700000000, 0)
+	previous := map[string]float64{`bo"b`: 1600000000, "alice": 1500000000}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, result, false, 1500*time.Millisecond, now, previous)
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE authkeysync_last_run_timestamp_seconds gauge",
+		"authkeysync_last_run_timestamp_seconds 1700000000",
+		"authkeysync_last_run_success 0",
+		"authkeysync_last_run_duration_seconds 1.5",
+		"authkeysync_users 4",
+		"authkeysync_users_succeeded 1",
+		"authkeysync_users_skipped 1",
+		"authkeysync_users_failed 2",
+		"authkeysync_keys_written 2",
+		`authkeysync_user_success{username="alice"} 1`,
+		`authkeysync_user_success{username="bo\"b"} 0`,
+		`authkeysync_user_success{username="carol"} 0`,
+		`authkeysync_user_keys_written{username="alice"} 2`,
+		// A successful sync replaces the previous time
+		`authkeysync_user_last_sync_timestamp_seconds{username="alice"} 1700000000`,
+		// A failed user keeps it
+		`authkeysync_user_last_sync_timestamp_seconds{username="bo\"b"} 1600000000`,
+	} {
+		assert.Contains(t, strings.Split(out, "\n"), line)
+	}
+
+	// Users without a previous successful sync have no last sync time
+	assert.NotContains(t, out, `authkeysync_user_last_sync_timestamp_seconds{username="carol"}`)
+	assert.NotContains(t, out, `authkeysync_user_last_sync_timestamp_seconds{username="dave"}`)
+	assert.NotContains(t, out, `authkeysync_user_keys_written{username="carol"}`)
+}
+
+func TestReadLastSyncTimes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authkeysync.prom")
+	assert.Nil(t, readLastSyncTimes(path))
+
+	result := &sync.SyncResult{
+		Users: []sync.UserResult{
+			{Username: "alice"},
+			{Username: "we\"ird\\name\n"},
+			{Username: "bob", Error: errors.New("source failed")},
+		},
+	}
+	var buf bytes.Buffer
+	writeMetrics(&buf, result, true, time.Second, time.Unix(1700000000, 0), nil)
+	buf.WriteString("authkeysync_user_last_sync_timestamp_seconds{username=\"broken} 1\n")
+	buf.WriteString("authkeysync_user_last_sync_timestamp_seconds{username=\"nan\"} abc\n")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+
+	// What writeMetrics wrote is read back, malformed lines are ignored
+	assert.Equal(t, map[string]float64{
+		"alice":           1700000000,
+		"we\"ird\\name\n": 1700000000,
+	}, readLastSyncTimes(path))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/systemd"
+)
+
+// notify sends a state to systemd when running under it with Type=notify.
+// Failures are only logged, since notifications are informational.
+func notify(logger *slog.Logger, state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		logger.Debug("failed to notify systemd",
+			"state", state,
+			"error", err)
+	}
+}
+
+// statusLine summarizes a sync run for systemd, e.g.
+// "Synced 39/40 users (1 failed)"
+func statusLine(total, success, skipped, failed int) string {
+	status := fmt.Sprintf("Synced %d/%d users", success, total)
+
+	var details []string
+	if failed > 0 {
+		details = append(details, fmt.Sprintf("%d failed", failed))
+	}
+	if skipped > 0 {
+		details = append(details, fmt.Sprintf("%d skipped", skipped))
+	}
+	if len(details) > 0 {
+		status += " (" + strings.Join(details, ", ") + ")"
+	}
+
+	return status + " at " + time.Now().Format(time.TimeOnly)
+}
+
+// runWatchdog pings the systemd watchdog until ctx is cancelled, if the
+// watchdog is enabled for this process
+func runWatchdog(ctx context.Context, logger *slog.Logger) {
+	interval, ok := systemd.WatchdogInterval()
+	if !ok {
+		return
+	}
+
+	logger.Debug("systemd watchdog enabled",
+		"interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notify(logger, systemd.StateWatchdog)
+		}
+	}
+}
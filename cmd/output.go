@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+// Output formats for --output
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// syncOutput is the JSON summary of a sync run printed by --output json
+type syncOutput struct {
+	// OK is false if the run exits with a failure
+	OK        bool             `json:"ok"`
+	HasErrors bool             `json:"has_errors"`
+	Users     []syncOutputUser `json:"users"`
+	Warnings  []string         `json:"warnings"`
+}
+
+// syncOutputUser is the outcome of a single user in the JSON summary
+type syncOutputUser struct {
+	Username    string   `json:"username"`
+	Skipped     bool     `json:"skipped"`
+	SkipReason  string   `json:"skip_reason,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	KeysWritten int      `json:"keys_written"`
+	LocalKeys   int      `json:"local_keys"`
+	Changed     bool     `json:"changed"`
+	WouldChange bool     `json:"would_change"`
+	RolledBack  bool     `json:"rolled_back"`
+	BackupPath  string   `json:"backup_path,omitempty"`
+	Warnings    []string `json:"warnings"`
+}
+
+// writeSyncOutput writes the result of a sync run to w as a single JSON
+// object. ok is the outcome of the run as reported by syncAndReport.
+func writeSyncOutput(w io.Writer, result *sync.SyncResult, ok bool) error {
+	output := syncOutput{
+		OK:        ok,
+		HasErrors: result.HasErrors,
+		Users:     make([]syncOutputUser, 0, len(result.Users)),
+		Warnings:  append([]string{}, result.Warnings...),
+	}
+	for _, userResult := range result.Users {
+		user := syncOutputUser{
+			Username:    userResult.Username,
+			Skipped:     userResult.Skipped,
+			SkipReason:  userResult.SkipReason,
+			KeysWritten: userResult.KeysWritten,
+			LocalKeys:   userResult.LocalKeys,
+			Changed:     userResult.Changed,
+			RolledBack:  userResult.RolledBack,
+			BackupPath:  userResult.BackupPath,
+			Warnings:    append([]string{}, userResult.Warnings...),
+		}
+		if userResult.Error != nil {
+			user.Error = userResult.Error.Error()
+		}
+		output.Users = append(output.Users, user)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/keyparser"
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+// Policy report formats
+const (
+	policyReportJSON = "json"
+	policyReportCSV  = "csv"
+)
+
+// policyReport lists the keys authorized for every user by a sync run
+type policyReport struct {
+	GeneratedAt time.Time          `json:"generated_at"`
+	Hostname    string             `json:"hostname"`
+	DryRun      bool               `json:"dry_run"`
+	Users       []policyReportUser `json:"users"`
+	// Warnings are the warnings of the run, prefixed with their user
+	Warnings []string `json:"warnings"`
+}
+
+// policyReportUser is the final key set of a single user
+type policyReportUser struct {
+	Username string            `json:"username"`
+	Status   string            `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Keys     []policyReportKey `json:"keys"`
+}
+
+// policyReportKey is an authorized key and the policy rules it passed
+type policyReportKey struct {
+	Source      string   `json:"source"`
+	Fingerprint string   `json:"fingerprint"`
+	Type        string   `json:"type"`
+	RulesPassed []string `json:"rules_passed"`
+}
+
+// buildPolicyReport builds a policy report from the key decisions of a sync
+// run. Only written keys are listed; they passed every rule of the policy.
+func buildPolicyReport(cfg *config.Config, result *sync.SyncResult, dryRun bool, now time.Time) policyReport {
+	policy := cfg.Policy.KeyPolicy()
+	hostname, _ := os.Hostname()
+
+	report := policyReport{
+		GeneratedAt: now.UTC(),
+		Hostname:    hostname,
+		DryRun:      dryRun,
+		Users:       make([]policyReportUser, 0, len(result.Users)),
+		Warnings:    append([]string{}, result.Warnings...),
+	}
+
+	for _, userResult := range result.Users {
+		user := policyReportUser{
+			Username: userResult.Username,
+			Status:   "synced",
+			Keys:     make([]policyReportKey, 0),
+		}
+		switch {
+		case userResult.Error != nil:
+			user.Status = "failed"
+			user.Detail = userResult.Error.Error()
+		case userResult.Skipped:
+			user.Status = "skipped"
+			user.Detail = userResult.SkipReason
+		}
+
+		for _, d := range userResult.Decisions {
+			if d.Verdict != sync.VerdictWritten {
+				continue
+			}
+			keyType := ""
+			if parts, err := keyparser.SplitKey(d.Key); err == nil {
+				keyType = parts.Type
+			}
+			rules := policy.Applied(d.Key)
+			if rules == nil {
+				rules = []string{}
+			}
+			user.Keys = append(user.Keys, policyReportKey{
+				Source:      d.Source,
+				Fingerprint: d.Fingerprint,
+				Type:        keyType,
+				RulesPassed: rules,
+			})
+		}
+
+		report.Users = append(report.Users, user)
+	}
+
+	return report
+}
+
+// writePolicyReport writes a policy report as JSON or CSV
+func writePolicyReport(w io.Writer, report policyReport, format string) error {
+	switch format {
+	case policyReportJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+
+	case policyReportCSV:
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"username", "status", "detail", "source", "fingerprint", "type", "rules_passed"})
+		for _, user := range report.Users {
+			// Users without keys still get a row, so the report covers every user
+			if len(user.Keys) == 0 {
+				_ = cw.Write([]string{user.Username, user.Status, user.Detail, "", "", "", ""})
+				continue
+			}
+			for _, key := range user.Keys {
+				_ = cw.Write([]string{user.Username, user.Status, user.Detail, key.Source, key.Fingerprint, key.Type, strings.Join(key.RulesPassed, ";")})
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+
+	default:
+		return fmt.Errorf("invalid policy report format %q (supported: %s, %s)", format, policyReportJSON, policyReportCSV)
+	}
+}
+
+// savePolicyReport writes a policy report to path, or to stdout if path is "-"
+func savePolicyReport(path string, report policyReport, format string) error {
+	if path == "-" {
+		return writePolicyReport(os.Stdout, report, format)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create policy report: %w", err)
+	}
+	if err := writePolicyReport(f, report, format); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+// runPruneBackups applies the backup retention policy to every configured
+// user without synchronizing keys
+func runPruneBackups(logger *slog.Logger, syncer *sync.Syncer) int {
+	result := syncer.PruneBackups()
+
+	deletedCount := 0
+	skippedCount := 0
+	failedCount := 0
+	for _, userResult := range result.Users {
+		deletedCount += len(userResult.Deleted)
+		if userResult.Error != nil {
+			failedCount++
+		} else if userResult.Skipped {
+			skippedCount++
+		}
+	}
+
+	if result.HasErrors {
+		logger.Error("backup pruning complete with failures",
+			"users", len(result.Users),
+			"deleted", deletedCount,
+			"skipped", skippedCount,
+			"failed", failedCount)
+		return ExitFailure
+	}
+
+	logger.Info("backup pruning complete",
+		"users", len(result.Users),
+		"deleted", deletedCount,
+		"skipped", skippedCount,
+		"failed", failedCount)
+	return ExitSuccess
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/backup"
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/logging"
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+// restoreCommand is the name of the restore subcommand
+const restoreCommand = "restore"
+
+// runRestore runs the restore subcommand: it lists the backups of a user and
+// restores one of them over authorized_keys, the newest by default
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet(restoreCommand, flag.ContinueOnError)
+	configPath := fs.String("config", config.DefaultConfigPath, "Path to the configuration file")
+	username := fs.String("user", "", "User whose authorized_keys is restored (required)")
+	backupName := fs.String("backup", "", "Filename of the backup to restore (default: the newest)")
+	dryRun := fs.Bool("dry-run", false, "List the backups and show which one would be restored, without writing")
+	noBackup := fs.Bool("no-backup", false, "Do not back up the authorized_keys being replaced")
+	logFormat := fs.String("log-format", logging.FormatText, "Log format: text (key=value) or json (one JSON object per line)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: authkeysync restore --user <name> [--backup <filename>] [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Lists the backups of a user and restores one over its authorized_keys.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+
+	if err := applyEnv(fs); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return ExitSuccess
+		}
+		return ExitFailure
+	}
+	if *username == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return ExitFailure
+	}
+
+	handler, err := logging.NewHandler(os.Stdout, *logFormat, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitFailure
+	}
+	logger := slog.New(handler)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logger.Error("failed to load configuration",
+			"path", *configPath,
+			"error", err)
+		return ExitFailure
+	}
+
+	syncer := sync.NewWithOptions(cfg, logger, sync.Options{
+		DryRun:   *dryRun,
+		NoBackup: *noBackup,
+	})
+	backupDir, backups, err := syncer.ListBackups(*username)
+	if err != nil {
+		logger.Error("failed to list backups",
+			"username", *username,
+			"error", err)
+		return ExitFailure
+	}
+	printBackups(os.Stdout, *username, backupDir, backups)
+
+	if _, err := syncer.Restore(*username, *backupName); err != nil {
+		logger.Error("failed to restore authorized_keys",
+			"username", *username,
+			"error", err)
+		return ExitFailure
+	}
+	return ExitSuccess
+}
+
+// printBackups prints the backups of a user, oldest first
+func printBackups(w io.Writer, username, backupDir string, backups []backup.Backup) {
+	fmt.Fprintf(w, "Backups of %s in %s:\n", username, backupDir)
+	if len(backups) == 0 {
+		fmt.Fprintf(w, "  (none)\n")
+		return
+	}
+	for _, b := range backups {
+		fmt.Fprintf(w, "  %s  %s  %d bytes\n", b.Name, b.Time.UTC().Format(time.RFC3339), b.Size)
+	}
+}
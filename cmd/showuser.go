@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+
+	"github.com/eduardolat/authkeysync/internal/sshfile"
+	"github.com/eduardolat/authkeysync/internal/sync"
+	"github.com/eduardolat/authkeysync/internal/userinfo"
+)
+
+// runShowUser prints the effective sources of a user and whether it
+// resolves on the system. Nothing is fetched and nothing is written.
+func runShowUser(w io.Writer, logger *slog.Logger, syncer *sync.Syncer, username string) int {
+	resolved, err := syncer.ResolveUser(username)
+	if err != nil {
+		logger.Error("failed to resolve user", "username", username, "error", err)
+		return ExitFailure
+	}
+
+	fmt.Fprintf(w, "User:    %s\n", resolved.Username)
+	fmt.Fprintf(w, "Entry:   %s\n", resolved.Entry)
+
+	if info := resolved.Info; info != nil {
+		fmt.Fprintf(w, "System:  uid=%d gid=%d home=%s\n", info.UID, info.GID, info.HomeDir)
+		sshStatus := "ok"
+		if resolved.LookupError != nil {
+			sshStatus = resolved.LookupError.Error()
+		}
+		fmt.Fprintf(w, ".ssh:    %s (%s)\n", info.SSHDir, sshStatus)
+		if info.AuthKeysPath != filepath.Join(info.SSHDir, sshfile.AuthKeysFileName) {
+			fmt.Fprintf(w, "Keys:    %s (AuthorizedKeysFile of sshd_config)\n", info.AuthKeysPath)
+		}
+	} else {
+		status := resolved.LookupError.Error()
+		if errors.Is(resolved.LookupError, userinfo.ErrUserNotFound) {
+			status = "not found, the user would be skipped"
+		}
+		fmt.Fprintf(w, "System:  %s\n", status)
+	}
+
+	fmt.Fprintf(w, "Sources: %d\n", len(resolved.Sources))
+	for _, source := range resolved.Sources {
+		fmt.Fprintf(w, "  %s %s\n", source.GetMethod(), source.URL)
+		fmt.Fprintf(w, "    timeout: %ds\n", source.GetTimeoutSeconds())
+		if source.Priority != 0 {
+			fmt.Fprintf(w, "    priority: %d\n", source.Priority)
+		}
+		if source.Paginate {
+			fmt.Fprintf(w, "    paginate: true\n")
+		}
+		for _, name := range slices.Sorted(maps.Keys(source.Headers)) {
+			fmt.Fprintf(w, "    header %s: %s\n", name, redactHeader(name, source.Headers[name]))
+		}
+		if source.Body != "" {
+			fmt.Fprintf(w, "    body: (redacted, %d chars)\n", len(source.Body))
+		}
+		switch {
+		case source.BasicAuthPasswordEnv != "":
+			fmt.Fprintf(w, "    basic auth: %s (password from $%s)\n", source.BasicAuthUser, source.BasicAuthPasswordEnv)
+		case source.BasicAuthPasswordFile != "":
+			fmt.Fprintf(w, "    basic auth: %s (password from %s)\n", source.BasicAuthUser, source.BasicAuthPasswordFile)
+		case source.BearerTokenFile != "":
+			fmt.Fprintf(w, "    bearer token: from %s\n", source.BearerTokenFile)
+		}
+		if source.CAFile != "" {
+			fmt.Fprintf(w, "    ca_file: %s\n", source.CAFile)
+		}
+		if source.ClientCertFile != "" {
+			fmt.Fprintf(w, "    client certificate: %s (key %s)\n", source.ClientCertFile, source.ClientKeyFile)
+		}
+		if source.InsecureSkipVerify {
+			fmt.Fprintf(w, "    insecure_skip_verify: true (TLS certificate not verified)\n")
+		}
+	}
+
+	return ExitSuccess
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/keyfetcher"
+	"github.com/eduardolat/authkeysync/internal/keyparser"
+)
+
+// sensitiveHeaders are request headers whose values are never printed
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// sensitiveHeaderWords mark custom headers that likely carry secrets,
+// e.g. X-Api-Key or Private-Token
+var sensitiveHeaderWords = []string{"token", "key", "secret", "auth", "session", "cookie", "password"}
+
+// redactHeader returns the printable value of a request header, hiding the
+// value of headers that may carry secrets
+func redactHeader(name, value string) string {
+	sensitive := slices.ContainsFunc(sensitiveHeaders, func(h string) bool {
+		return strings.EqualFold(h, name)
+	})
+	lower := strings.ToLower(name)
+	for _, word := range sensitiveHeaderWords {
+		if strings.Contains(lower, word) {
+			sensitive = true
+		}
+	}
+	if sensitive {
+		return fmt.Sprintf("(redacted, %d chars)", len(value))
+	}
+	return value
+}
+
+// headerFlags collects repeated --header "Name: value" flags
+type headerFlags map[string]string
+
+// String implements flag.Value
+func (h headerFlags) String() string {
+	pairs := make([]string, 0, len(h))
+	for name, value := range h {
+		pairs = append(pairs, name+": "+value)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// Set implements flag.Value
+func (h headerFlags) Set(value string) error {
+	name, val, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("invalid header %q (expected \"Name: value\")", value)
+	}
+	h[name] = strings.TrimSpace(val)
+	return nil
+}
+
+// Reset implements repeatableValue
+func (h headerFlags) Reset() {
+	clear(h)
+}
+
+// runTestSource performs a single fetch of source and prints what was
+// requested and received. Nothing is read from config and nothing is written.
+func runTestSource(ctx context.Context, w io.Writer, logger *slog.Logger, source config.Source) int {
+	fetcher := keyfetcher.NewWithLogger(logger)
+	result := fetcher.Fetch(ctx, source)
+
+	fmt.Fprintf(w, "Source:  %s %s\n", source.GetMethod(), source.URL)
+	fmt.Fprintf(w, "Request headers:\n")
+	headers := keyfetcher.RequestHeaders(source)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s: %s\n", name, redactHeader(name, headers.Get(name)))
+	}
+
+	if result.StatusCode != 0 {
+		fmt.Fprintf(w, "Status:  %d\n", result.StatusCode)
+	}
+	if result.Error != nil {
+		fmt.Fprintf(w, "Error:   %v\n", result.Error)
+		return ExitFailure
+	}
+
+	fmt.Fprintf(w, "Keys:    %d\n", len(result.Keys))
+	for _, key := range result.Keys {
+		fingerprint, err := keyparser.Fingerprint(key.Line)
+		if err != nil {
+			fingerprint = "(invalid key blob)"
+		}
+		keyType := "?"
+		comment := ""
+		if parts, err := keyparser.SplitKey(key.Line); err == nil {
+			keyType = parts.Type
+			comment = parts.Comment
+		}
+		fmt.Fprintf(w, "  %s  %s %s\n", fingerprint, keyType, comment)
+	}
+	fmt.Fprintf(w, "Discarded lines: %d\n", result.DiscardedLines)
+
+	return ExitSuccess
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/eduardolat/authkeysync/internal/sync"
+)
+
+// userFlags collects repeated --user flags. A value may also list several
+// comma-separated usernames, as AUTHKEYSYNC_USER does.
+type userFlags []string
+
+// String implements flag.Value
+func (u *userFlags) String() string {
+	return strings.Join(*u, ",")
+}
+
+// Set implements flag.Value
+func (u *userFlags) Set(value string) error {
+	for username := range strings.SplitSeq(value, ",") {
+		username = strings.TrimSpace(username)
+		if username == "" {
+			return errors.New("empty username")
+		}
+		if !slices.Contains(*u, username) {
+			*u = append(*u, username)
+		}
+	}
+	return nil
+}
+
+// Reset implements repeatableValue
+func (u *userFlags) Reset() {
+	*u = nil
+}
+
+// checkUsers returns ExitSuccess if every username given with --user is
+// resolved from the config, wildcard and group entries included. Otherwise it
+// logs the missing usernames along with the valid ones.
+func checkUsers(logger *slog.Logger, syncer *sync.Syncer, usernames []string) int {
+	configured, failed := syncer.ConfiguredUsernames()
+
+	var missing []string
+	for _, username := range usernames {
+		if !slices.Contains(configured, username) {
+			missing = append(missing, username)
+		}
+	}
+	if len(missing) == 0 {
+		return ExitSuccess
+	}
+
+	attrs := []any{
+		"users", strings.Join(missing, ","),
+		"valid_users", strings.Join(configured, ","),
+	}
+	// The user may belong to an entry that could not be expanded
+	for _, entry := range failed {
+		attrs = append(attrs, "unresolved_entry", entry.Username, "error", entry.Error)
+	}
+	logger.Error("--user names a user that is not in the config", attrs...)
+	return ExitFailure
+}
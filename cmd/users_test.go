@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		expected []string
+		errMsg   string
+	}{
+		{name: "single", values: []string{"alice"}, expected: []string{"alice"}},
+		{name: "repeated", values: []string{"alice", "bob"}, expected: []string{"alice", "bob"}},
+		{name: "comma-separated", values: []string{"alice, bob"}, expected: []string{"alice", "bob"}},
+		{name: "duplicates", values: []string{"alice,bob", "alice"}, expected: []string{"alice", "bob"}},
+		{name: "empty", values: []string{""}, errMsg: "empty username"},
+		{name: "empty in a list", values: []string{"alice,,bob"}, errMsg: "empty username"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var users userFlags
+			var err error
+			for _, value := range tt.values {
+				if err = users.Set(value); err != nil {
+					break
+				}
+			}
+			if tt.errMsg != "" {
+				assert.EqualError(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, []string(users))
+			assert.Equal(t, strings.Join(tt.expected, ","), users.String())
+		})
+	}
+}
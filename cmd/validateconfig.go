@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// validateConfigWarnings returns the suspicious but valid settings of a
+// configuration, such as sources fetched over plain http
+func validateConfigWarnings(cfg *config.Config) []string {
+	warnings := append([]string(nil), cfg.Warnings...)
+	if isPlainHTTP(cfg.Policy.SourceTemplate) {
+		warnings = append(warnings, "source_template uses http://, keys can be tampered with in transit (use https://)")
+	}
+	for _, user := range cfg.Users {
+		for j, source := range user.Sources {
+			if isPlainHTTP(source.URL) {
+				warnings = append(warnings, fmt.Sprintf("user %q source at index %d uses http://, keys can be tampered with in transit (use https://)", user.Label(), j))
+			}
+		}
+	}
+	return warnings
+}
+
+// isPlainHTTP returns true if url uses the unencrypted http scheme
+func isPlainHTTP(url string) bool {
+	return len(url) >= len("http://") && strings.EqualFold(url[:len("http://")], "http://")
+}
+
+// runValidateConfig prints a summary of a configuration that has already been
+// loaded and validated. Nothing is looked up, fetched or written, and
+// warnings do not change the exit code.
+func runValidateConfig(w io.Writer, cfg *config.Config, path string) int {
+	fmt.Fprintf(w, "Configuration: ok (%s)\n", path)
+
+	fmt.Fprintf(w, "\nUsers:\n")
+	sources := 0
+	for _, user := range cfg.Users {
+		kind := ""
+		switch {
+		case user.IsGroup():
+			kind = " (group)"
+		case user.IsPattern():
+			kind = " (pattern)"
+		}
+		fmt.Fprintf(w, "  %s%s\n", user.Label(), kind)
+
+		if len(user.Sources) == 0 {
+			fmt.Fprintf(w, "    source_template: %s\n", cfg.Policy.SourceTemplate)
+			sources++
+			continue
+		}
+		for _, source := range user.Sources {
+			if source.IsFile() || source.IsS3() {
+				fmt.Fprintf(w, "    %s\n", source.URL)
+			} else {
+				fmt.Fprintf(w, "    %s %s\n", source.GetMethod(), source.URL)
+			}
+		}
+		sources += len(user.Sources)
+	}
+
+	warnings := validateConfigWarnings(cfg)
+	if len(warnings) > 0 {
+		fmt.Fprintf(w, "\nWarnings:\n")
+		for _, warning := range warnings {
+			fmt.Fprintf(w, "  %s\n", warning)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d users, %d sources, %d warnings\n", len(cfg.Users), sources, len(warnings))
+	return ExitSuccess
+}
@@ -0,0 +1,83 @@
+package e2e
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestExitCodeDrift verifies that --check exits with code 2 when an
+// authorized_keys would change, and with code 0 once it is in sync.
+func TestExitCodeDrift(t *testing.T) {
+	_ = newTestCase(t, testUser1)
+
+	createExistingKeys(t, testUser1, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDRIFT11111111111111111111111111111111111111111 drift@user1")
+
+	configPath := createConfig(t, "exit_code_drift", `
+policy:
+  backup_enabled: false
+  preserve_local_keys: false
+
+users:
+  - username: `+testUser1+`
+    sources:
+      - url: ${MOCK_SERVER_URL}/users/alice.keys
+`)
+
+	output, exitCode := runAuthKeySync(t, "--config", configPath, "--check")
+	t.Logf("Output: %s", output)
+	assert.Equal(t, 2, exitCode, "--check should exit with code 2 when a file would change")
+	assert.Contains(t, readAuthKeys(t, testUser1), "drift@user1", "--check should not write anything")
+
+	output, exitCode = runAuthKeySync(t, "--config", configPath)
+	t.Logf("Output: %s", output)
+	require.Equal(t, 0, exitCode, "sync should succeed")
+
+	output, exitCode = runAuthKeySync(t, "--config", configPath, "--check")
+	t.Logf("Output: %s", output)
+	assert.Equal(t, 0, exitCode, "--check should exit with code 0 when every file is in sync")
+}
+
+// TestExitCodeLocked verifies that a run exits with code 3 without touching
+// any file while another process holds the lock file.
+func TestExitCodeLocked(t *testing.T) {
+	_ = newTestCase(t, testUser1)
+
+	originalKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILOCK111111111111111111111111111111111111111111 lock@user1"
+	createExistingKeys(t, testUser1, originalKey)
+
+	configPath := createConfig(t, "exit_code_locked", `
+policy:
+  backup_enabled: false
+  preserve_local_keys: false
+
+users:
+  - username: `+testUser1+`
+    sources:
+      - url: ${MOCK_SERVER_URL}/users/alice.keys
+`)
+
+	// Hold the lock as another run would
+	lockPath := filepath.Join(t.TempDir(), "authkeysync.lock")
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(t, err)
+	defer lockFile.Close()
+	require.NoError(t, syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB))
+
+	output, exitCode := runAuthKeySync(t, "--config", configPath, "--lock-file", lockPath)
+	t.Logf("Output: %s", output)
+	assert.Equal(t, 3, exitCode, "authkeysync should exit with code 3 while the lock is held")
+	assert.Contains(t, output, "another run is in progress")
+	assert.Contains(t, readAuthKeys(t, testUser1), "lock@user1", "authorized_keys should be untouched")
+
+	// Once released, the run goes ahead
+	require.NoError(t, syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN))
+	output, exitCode = runAuthKeySync(t, "--config", configPath, "--lock-file", lockPath)
+	t.Logf("Output: %s", output)
+	assert.Equal(t, 0, exitCode, "authkeysync should succeed once the lock is released")
+	assert.Contains(t, readAuthKeys(t, testUser1), "alice@laptop")
+}
@@ -2,12 +2,14 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/eduardolat/authkeysync/internal/nanoid"
@@ -22,14 +24,24 @@ const (
 	BackupFileMode = 0600
 	// BackupPrefix is the prefix for backup filenames
 	BackupPrefix = "authorized_keys_"
+	// RetentionUnlimited is the retention count that keeps every backup
+	RetentionUnlimited = -1
 )
 
+// ErrUnsafeBackupDir indicates a backup directory reached through a symlink
+// that root does not own, or that was replaced while being opened
+var ErrUnsafeBackupDir = errors.New("unsafe backup directory")
+
 // Manager handles backup creation and rotation
 type Manager struct {
 	// idGenerator allows for dependency injection in tests
 	idGenerator func() (string, error)
 	// timeNow allows for dependency injection in tests
 	timeNow func() time.Time
+	// removeFile allows for dependency injection in tests
+	removeFile func(root *os.Root, name string) error
+	// prefix is the filename prefix of backups
+	prefix string
 }
 
 // New creates a new backup Manager
@@ -37,6 +49,8 @@ func New() *Manager {
 	return &Manager{
 		idGenerator: nanoid.Generate,
 		timeNow:     time.Now,
+		removeFile:  (*os.Root).Remove,
+		prefix:      BackupPrefix,
 	}
 }
 
@@ -45,6 +59,23 @@ func NewWithDeps(idGen func() (string, error), timeNow func() time.Time) *Manage
 	return &Manager{
 		idGenerator: idGen,
 		timeNow:     timeNow,
+		removeFile:  (*os.Root).Remove,
+		prefix:      BackupPrefix,
+	}
+}
+
+// SetBackupPrefix sets the filename prefix of backups. Rotation only
+// considers files with this prefix.
+func (m *Manager) SetBackupPrefix(prefix string) {
+	m.prefix = prefix
+}
+
+// SetIDLength sets the length of the random ID in backup filenames
+// (default: 6 letters). Longer IDs make collisions less likely when many
+// backups are created in the same second.
+func (m *Manager) SetIDLength(length int) {
+	m.idGenerator = func() (string, error) {
+		return nanoid.GenerateN(length)
 	}
 }
 
@@ -52,8 +83,14 @@ func NewWithDeps(idGen func() (string, error), timeNow func() time.Time) *Manage
 // Returns the backup file path, or empty string if no backup was created.
 // If the source file doesn't exist or is empty, no backup is created.
 func (m *Manager) CreateBackup(sshDir string, uid, gid int) (string, error) {
-	authKeysPath := filepath.Join(sshDir, "authorized_keys")
+	return m.CreateBackupIn(filepath.Join(sshDir, "authorized_keys"), filepath.Join(sshDir, BackupDirName), uid, gid)
+}
 
+// CreateBackupIn creates a backup of the given authorized_keys file inside
+// backupDir, creating missing parent directories. The backup directory and
+// file are owned by uid:gid.
+// Returns the backup file path, or empty string if no backup was created.
+func (m *Manager) CreateBackupIn(authKeysPath, backupDir string, uid, gid int) (string, error) {
 	// Check if source file exists
 	stat, err := os.Stat(authKeysPath)
 	if err != nil {
@@ -69,11 +106,12 @@ func (m *Manager) CreateBackup(sshDir string, uid, gid int) (string, error) {
 		return "", nil
 	}
 
-	// Ensure backup directory exists
-	backupDir := filepath.Join(sshDir, BackupDirName)
-	if err := m.ensureBackupDir(backupDir, uid, gid); err != nil {
+	// Open the backup directory, creating it if needed
+	root, err := m.openBackupDir(backupDir, true, uid, gid)
+	if err != nil {
 		return "", err
 	}
+	defer func() { _ = root.Close() }()
 
 	// Generate backup filename
 	timestamp := m.timeNow().UTC().Format("20060102_150405")
@@ -81,53 +119,94 @@ func (m *Manager) CreateBackup(sshDir string, uid, gid int) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to generate backup ID: %w", err)
 	}
-	backupFilename := fmt.Sprintf("%s%s_%s", BackupPrefix, timestamp, id)
-	backupPath := filepath.Join(backupDir, backupFilename)
+	backupFilename := fmt.Sprintf("%s%s_%s", m.prefix, timestamp, id)
 
 	// Copy file
-	if err := m.copyFile(authKeysPath, backupPath, uid, gid); err != nil {
+	if err := m.copyFile(authKeysPath, root, backupFilename, uid, gid); err != nil {
 		return "", err
 	}
 
-	return backupPath, nil
+	return filepath.Join(backupDir, backupFilename), nil
 }
 
-// ensureBackupDir creates the backup directory if it doesn't exist
-func (m *Manager) ensureBackupDir(backupDir string, uid, gid int) error {
-	stat, err := os.Stat(backupDir)
-	if err == nil {
+// openBackupDir opens the backup directory, creating it and its missing
+// parents if create is set. Parents are left to the user running AuthKeySync,
+// the backup directory is owned by uid:gid.
+// The backup directory is often writable by the user, who could point it
+// anywhere with a symlink and have root write and delete files there. Its path
+// is therefore checked a component at a time and a symlink not owned by root
+// is refused with ErrUnsafeBackupDir. The opened directory must be the one
+// checked, so it cannot be swapped in the meantime.
+func (m *Manager) openBackupDir(backupDir string, create bool, uid, gid int) (*os.Root, error) {
+	backupDir = filepath.Clean(backupDir)
+	dirs := []string{backupDir}
+	for dir := backupDir; filepath.Dir(dir) != dir; dir = filepath.Dir(dir) {
+		dirs = append(dirs, filepath.Dir(dir))
+	}
+
+	// Walk down from the top, backupDir being the last one
+	var stat os.FileInfo
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		var err error
+		stat, err = os.Lstat(dir)
+		if os.IsNotExist(err) && create {
+			if err := os.Mkdir(dir, BackupDirMode); err != nil && !os.IsExist(err) {
+				return nil, fmt.Errorf("failed to create backup directory: %w", err)
+			} else if err == nil && i == 0 {
+				if err := os.Lchown(dir, uid, gid); err != nil {
+					return nil, fmt.Errorf("failed to set backup directory ownership: %w", err)
+				}
+			}
+			stat, err = os.Lstat(dir)
+		}
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to stat backup directory: %w", err)
+		}
+
+		if stat.Mode()&os.ModeSymlink != 0 {
+			// Only root can create a symlink owned by root, such as /var on macOS
+			if sys, ok := stat.Sys().(*syscall.Stat_t); !ok || sys.Uid != 0 {
+				return nil, fmt.Errorf("%w: %s is a symlink", ErrUnsafeBackupDir, dir)
+			}
+			if stat, err = os.Stat(dir); err != nil {
+				return nil, fmt.Errorf("failed to stat backup directory: %w", err)
+			}
+		}
 		if !stat.IsDir() {
-			return fmt.Errorf("backup path exists but is not a directory: %s", backupDir)
+			return nil, fmt.Errorf("backup path exists but is not a directory: %s", dir)
 		}
-		return nil
 	}
 
-	if !os.IsNotExist(err) {
-		return fmt.Errorf("failed to stat backup directory: %w", err)
+	root, err := os.OpenRoot(backupDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup directory: %w", err)
 	}
-
-	// Create directory
-	if err := os.Mkdir(backupDir, BackupDirMode); err != nil {
-		return fmt.Errorf("failed to create backup directory: %w", err)
+	opened, err := root.Stat(".")
+	if err != nil {
+		_ = root.Close()
+		return nil, fmt.Errorf("failed to stat backup directory: %w", err)
 	}
-
-	// Set ownership
-	if err := os.Chown(backupDir, uid, gid); err != nil {
-		return fmt.Errorf("failed to set backup directory ownership: %w", err)
+	if !os.SameFile(stat, opened) {
+		_ = root.Close()
+		return nil, fmt.Errorf("%w: %s changed while being opened", ErrUnsafeBackupDir, backupDir)
 	}
-
-	return nil
+	return root, nil
 }
 
-// copyFile copies a file and sets proper permissions and ownership
-func (m *Manager) copyFile(src, dst string, uid, gid int) error {
+// copyFile copies a file to a new file in the backup directory and sets its
+// ownership. An existing file, or a symlink, at name is never written.
+func (m *Manager) copyFile(src string, root *os.Root, name string, uid, gid int) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("failed to open source file: %w", err)
 	}
 	defer func() { _ = srcFile.Close() }()
 
-	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, BackupFileMode)
+	dstFile, err := root.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, BackupFileMode)
 	if err != nil {
 		return fmt.Errorf("failed to create backup file: %w", err)
 	}
@@ -143,7 +222,7 @@ func (m *Manager) copyFile(src, dst string, uid, gid int) error {
 	}
 
 	// Set ownership
-	if err := os.Chown(dst, uid, gid); err != nil {
+	if err := dstFile.Chown(uid, gid); err != nil {
 		return fmt.Errorf("failed to set backup file ownership: %w", err)
 	}
 
@@ -152,20 +231,35 @@ func (m *Manager) copyFile(src, dst string, uid, gid int) error {
 
 // RotateBackups removes old backups, keeping only the specified count.
 // Oldest files are deleted first (based on filename which includes timestamp).
+// A retention count of RetentionUnlimited keeps every backup, while 0 deletes all of them.
+// A failure to delete one backup does not stop the others from being deleted:
+// every deleted backup is returned along with all failures joined in one error.
 func (m *Manager) RotateBackups(sshDir string, retentionCount int) ([]string, error) {
+	return m.RotateBackupsIn(filepath.Join(sshDir, BackupDirName), retentionCount)
+}
+
+// RotateBackupsIn removes old backups from backupDir, keeping only the
+// specified count. See RotateBackups.
+func (m *Manager) RotateBackupsIn(backupDir string, retentionCount int) ([]string, error) {
+	if retentionCount == RetentionUnlimited {
+		return nil, nil
+	}
 	if retentionCount < 0 {
-		return nil, fmt.Errorf("retention count cannot be negative")
+		return nil, fmt.Errorf("retention count cannot be negative (use %d for unlimited)", RetentionUnlimited)
 	}
 
-	backupDir := filepath.Join(sshDir, BackupDirName)
-
 	// Check if backup directory exists
-	if _, err := os.Stat(backupDir); os.IsNotExist(err) {
+	root, err := m.openBackupDir(backupDir, false, 0, 0)
+	if os.IsNotExist(err) {
 		return nil, nil
 	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = root.Close() }()
 
 	// List backup files
-	entries, err := os.ReadDir(backupDir)
+	entries, err := readDir(root)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read backup directory: %w", err)
 	}
@@ -173,10 +267,10 @@ func (m *Manager) RotateBackups(sshDir string, retentionCount int) ([]string, er
 	// Filter and collect backup files
 	var backups []string
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if !entry.Type().IsRegular() {
 			continue
 		}
-		if strings.HasPrefix(entry.Name(), BackupPrefix) {
+		if _, ok := m.parseBackupName(entry.Name()); ok {
 			backups = append(backups, entry.Name())
 		}
 	}
@@ -192,19 +286,139 @@ func (m *Manager) RotateBackups(sshDir string, retentionCount int) ([]string, er
 
 	// Delete oldest files
 	deleted := make([]string, 0, deleteCount)
+	var errs []error
 	for i := range deleteCount {
-		path := filepath.Join(backupDir, backups[i])
-		if err := os.Remove(path); err != nil {
-			return deleted, fmt.Errorf("failed to remove backup %s: %w", backups[i], err)
+		if err := m.removeFile(root, backups[i]); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove backup %s: %w", backups[i], err))
+			continue
 		}
 		deleted = append(deleted, backups[i])
 	}
 
-	return deleted, nil
+	return deleted, errors.Join(errs...)
+}
+
+// readDir returns the entries of an opened directory
+func readDir(root *os.Root) ([]os.DirEntry, error) {
+	dir, err := root.Open(".")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = dir.Close() }()
+	return dir.ReadDir(-1)
+}
+
+// Backup is a backup file in a backup directory
+type Backup struct {
+	// Name is the filename of the backup
+	Name string
+	Path string
+	// Time is when the backup was taken, read from its filename
+	Time time.Time
+	Size int64
+}
+
+// ListBackups returns the backups in backupDir sorted by filename, which is
+// oldest first, as for rotation. Only regular files named like the backups
+// CreateBackupIn makes are listed, and a missing directory has no backups.
+func (m *Manager) ListBackups(backupDir string) ([]Backup, error) {
+	root, err := m.openBackupDir(backupDir, false, 0, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = root.Close() }()
+
+	entries, err := readDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var backups []Backup
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		taken, ok := m.parseBackupName(entry.Name())
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat backup %s: %w", entry.Name(), err)
+		}
+		backups = append(backups, Backup{
+			Name: entry.Name(),
+			Path: filepath.Join(backupDir, entry.Name()),
+			Time: taken,
+			Size: info.Size(),
+		})
+	}
+	return backups, nil
+}
+
+// ReadBackup returns the content of the backup named name in backupDir. The
+// backup directory is usually writable by the user, so the backup must be a
+// regular file: a symlink to a file only root can read is never followed.
+func (m *Manager) ReadBackup(backupDir, name string) ([]byte, error) {
+	if _, ok := m.parseBackupName(name); !ok {
+		return nil, fmt.Errorf("invalid backup name %q", name)
+	}
+	root, err := m.openBackupDir(backupDir, false, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup directory: %w", err)
+	}
+	defer func() { _ = root.Close() }()
+
+	// O_NONBLOCK keeps a FIFO planted at the name from blocking the open
+	file, err := root.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat backup: %w", err)
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, fmt.Errorf("backup %s is not a regular file", name)
+	}
+	return io.ReadAll(file)
+}
+
+// parseBackupName reports whether name has the form of the backups
+// CreateBackupIn makes: the backup prefix, a UTC timestamp and a random ID of
+// lowercase letters. Returns the timestamp.
+func (m *Manager) parseBackupName(name string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(name, m.prefix)
+	if !ok || len(rest) < len("20060102_150405_") || rest[len("20060102_150405")] != '_' {
+		return time.Time{}, false
+	}
+	taken, err := time.Parse("20060102_150405", rest[:len("20060102_150405")])
+	if err != nil {
+		return time.Time{}, false
+	}
+	id := rest[len("20060102_150405_"):]
+	if len(id) < nanoid.DefaultLength {
+		return time.Time{}, false
+	}
+	for _, char := range id {
+		if char < 'a' || char > 'z' {
+			return time.Time{}, false
+		}
+	}
+	return taken, true
 }
 
 // ManagerProvider is an interface for backup management
 type ManagerProvider interface {
 	CreateBackup(sshDir string, uid, gid int) (string, error)
 	RotateBackups(sshDir string, retentionCount int) ([]string, error)
+	CreateBackupIn(authKeysPath, backupDir string, uid, gid int) (string, error)
+	RotateBackupsIn(backupDir string, retentionCount int) ([]string, error)
+	ListBackups(backupDir string) ([]Backup, error)
+	ReadBackup(backupDir, name string) ([]byte, error)
 }
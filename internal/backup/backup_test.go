@@ -49,6 +49,36 @@ func TestCreateBackup_Success(t *testing.T) {
 	assert.Equal(t, os.FileMode(BackupDirMode), stat.Mode().Perm())
 }
 
+func TestCreateBackupIn_CustomDir(t *testing.T) {
+	tempDir := t.TempDir()
+	authKeysPath := filepath.Join(tempDir, "authorized_keys")
+	require.NoError(t, os.WriteFile(authKeysPath, []byte("ssh-ed25519 AAAA key"), 0600))
+
+	manager := NewWithDeps(
+		func() (string, error) { return "abcdef", nil },
+		func() time.Time { return time.Date(2024, 6, 15, 10, 30, 45, 0, time.UTC) },
+	)
+
+	// Parent directories do not exist yet
+	backupDir := filepath.Join(tempDir, "var", "backups", "alice")
+	backupPath, err := manager.CreateBackupIn(authKeysPath, backupDir, os.Getuid(), os.Getgid())
+
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(backupDir, "authorized_keys_20240615_103045_abcdef"), backupPath)
+
+	content, err := os.ReadFile(backupPath)
+	require.NoError(t, err)
+	assert.Equal(t, "ssh-ed25519 AAAA key", string(content))
+
+	stat, err := os.Stat(backupDir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(BackupDirMode), stat.Mode().Perm())
+
+	deleted, err := manager.RotateBackupsIn(backupDir, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"authorized_keys_20240615_103045_abcdef"}, deleted)
+}
+
 func TestCreateBackup_NoSourceFile(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
@@ -167,6 +197,66 @@ func TestCreateBackup_BackupDirNotADirectory(t *testing.T) {
 	assert.Contains(t, err.Error(), "not a directory")
 }
 
+// userSymlink creates a symlink owned by a user other than root, as a user
+// could plant in its own directories
+func userSymlink(t *testing.T, target, link string) {
+	t.Helper()
+	require.NoError(t, os.Symlink(target, link))
+	if os.Geteuid() == 0 {
+		require.NoError(t, os.Lchown(link, 12345, 12345))
+	}
+}
+
+func TestCreateBackupIn_RefusesSymlink(t *testing.T) {
+	tempDir := t.TempDir()
+	authKeysPath := filepath.Join(tempDir, "authorized_keys")
+	require.NoError(t, os.WriteFile(authKeysPath, []byte("ssh-ed25519 AAAA key"), 0600))
+	target := filepath.Join(tempDir, "target")
+	require.NoError(t, os.Mkdir(target, 0700))
+
+	manager := NewWithDeps(
+		func() (string, error) { return "abcdef", nil },
+		func() time.Time { return time.Date(2024, 6, 15, 10, 30, 45, 0, time.UTC) },
+	)
+
+	t.Run("backup directory", func(t *testing.T) {
+		backupDir := filepath.Join(tempDir, "backups")
+		userSymlink(t, target, backupDir)
+
+		_, err := manager.CreateBackupIn(authKeysPath, backupDir, os.Getuid(), os.Getgid())
+		require.ErrorIs(t, err, ErrUnsafeBackupDir)
+		_, err = manager.RotateBackupsIn(backupDir, 0)
+		require.ErrorIs(t, err, ErrUnsafeBackupDir)
+	})
+
+	t.Run("parent directory", func(t *testing.T) {
+		parent := filepath.Join(tempDir, "parent")
+		userSymlink(t, target, parent)
+
+		_, err := manager.CreateBackupIn(authKeysPath, filepath.Join(parent, "backups"), os.Getuid(), os.Getgid())
+		require.ErrorIs(t, err, ErrUnsafeBackupDir)
+		assert.NoDirExists(t, filepath.Join(target, "backups"))
+	})
+
+	t.Run("backup file", func(t *testing.T) {
+		backupDir := filepath.Join(tempDir, "real")
+		require.NoError(t, os.Mkdir(backupDir, BackupDirMode))
+		victim := filepath.Join(tempDir, "victim")
+		require.NoError(t, os.WriteFile(victim, []byte("keep"), 0600))
+		userSymlink(t, victim, filepath.Join(backupDir, "authorized_keys_20240615_103045_abcdef"))
+
+		_, err := manager.CreateBackupIn(authKeysPath, backupDir, os.Getuid(), os.Getgid())
+		require.Error(t, err)
+		content, err := os.ReadFile(victim)
+		require.NoError(t, err)
+		assert.Equal(t, "keep", string(content))
+	})
+
+	entries, err := os.ReadDir(target)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
 func TestCreateBackup_IDGeneratorError(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
@@ -227,6 +317,52 @@ func TestRotateBackups_KeepsCorrectCount(t *testing.T) {
 	assert.Len(t, entries, 3)
 }
 
+func TestRotateBackups_ContinuesAfterFailure(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	backupDir := filepath.Join(sshDir, BackupDirName)
+	require.NoError(t, os.Mkdir(backupDir, BackupDirMode))
+
+	backupFiles := []string{
+		"authorized_keys_20240101_100000_aaaaaa",
+		"authorized_keys_20240102_100000_bbbbbb",
+		"authorized_keys_20240103_100000_cccccc",
+		"authorized_keys_20240104_100000_dddddd",
+		"authorized_keys_20240105_100000_eeeeee",
+	}
+	for _, name := range backupFiles {
+		require.NoError(t, os.WriteFile(filepath.Join(backupDir, name), []byte("content"), 0600))
+	}
+
+	// The second oldest backup cannot be deleted
+	undeletable := "authorized_keys_20240102_100000_bbbbbb"
+	manager := New()
+	manager.removeFile = func(root *os.Root, name string) error {
+		if name == undeletable {
+			return os.ErrPermission
+		}
+		return root.Remove(name)
+	}
+
+	deleted, err := manager.RotateBackups(sshDir, 1)
+
+	require.Error(t, err)
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.Contains(t, err.Error(), undeletable)
+	assert.Equal(t, []string{
+		"authorized_keys_20240101_100000_aaaaaa",
+		"authorized_keys_20240103_100000_cccccc",
+		"authorized_keys_20240104_100000_dddddd",
+	}, deleted)
+
+	entries, err := os.ReadDir(backupDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, undeletable, entries[0].Name())
+	assert.Equal(t, "authorized_keys_20240105_100000_eeeeee", entries[1].Name())
+}
+
 func TestRotateBackups_NoBackupDir(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
@@ -313,18 +449,89 @@ func TestRotateBackups_IgnoresNonBackupFiles(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestBackupPrefix_Custom(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(sshDir, "authorized_keys"), []byte("ssh-ed25519 AAAA test"), 0600))
+	backupDir := filepath.Join(sshDir, BackupDirName)
+	require.NoError(t, os.Mkdir(backupDir, BackupDirMode))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(backupDir, "authorized_keys_20240101_100000_aaaaaa"),
+		[]byte("content"), 0600))
+
+	manager := NewWithDeps(
+		func() (string, error) { return "bbbbbb", nil },
+		func() time.Time { return time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC) },
+	)
+	manager.SetBackupPrefix("ak-")
+
+	backupPath, err := manager.CreateBackup(sshDir, os.Getuid(), os.Getgid())
+	require.NoError(t, err)
+	assert.Equal(t, "ak-20240102_100000_bbbbbb", filepath.Base(backupPath))
+
+	// Rotation only considers files with the configured prefix
+	deleted, err := manager.RotateBackups(sshDir, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ak-20240102_100000_bbbbbb"}, deleted)
+	assert.FileExists(t, filepath.Join(backupDir, "authorized_keys_20240101_100000_aaaaaa"))
+}
+
+func TestSetIDLength(t *testing.T) {
+	sshDir := filepath.Join(t.TempDir(), ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(sshDir, "authorized_keys"), []byte("ssh-ed25519 AAAA test"), 0600))
+
+	manager := New()
+	manager.SetIDLength(10)
+
+	backupPath, err := manager.CreateBackup(sshDir, os.Getuid(), os.Getgid())
+	require.NoError(t, err)
+	assert.Regexp(t, `^authorized_keys_\d{8}_\d{6}_[a-z]{10}$`, filepath.Base(backupPath))
+
+	backups, err := manager.ListBackups(filepath.Join(sshDir, BackupDirName))
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, filepath.Base(backupPath), backups[0].Name)
+}
+
 func TestRotateBackups_NegativeRetention(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
 	require.NoError(t, os.Mkdir(sshDir, 0700))
 
 	manager := New()
-	_, err := manager.RotateBackups(sshDir, -1)
+	_, err := manager.RotateBackups(sshDir, -2)
 
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "retention count cannot be negative")
 }
 
+func TestRotateBackups_UnlimitedRetention(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	backupDir := filepath.Join(sshDir, BackupDirName)
+	require.NoError(t, os.Mkdir(backupDir, BackupDirMode))
+
+	require.NoError(t, os.WriteFile(
+		filepath.Join(backupDir, "authorized_keys_20240101_100000_aaaaaa"),
+		[]byte("content"), 0600))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(backupDir, "authorized_keys_20240102_100000_bbbbbb"),
+		[]byte("content"), 0600))
+
+	manager := New()
+	deleted, err := manager.RotateBackups(sshDir, RetentionUnlimited)
+
+	require.NoError(t, err)
+	assert.Empty(t, deleted)
+
+	entries, err := os.ReadDir(backupDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2) // Nothing deleted
+}
+
 func TestRotateBackups_IgnoresSubdirectories(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
@@ -353,6 +560,76 @@ func TestRotateBackups_IgnoresSubdirectories(t *testing.T) {
 	assert.True(t, stat.IsDir())
 }
 
+func TestListBackups(t *testing.T) {
+	backupDir := t.TempDir()
+	require.NoError(t, os.WriteFile(
+		filepath.Join(backupDir, "authorized_keys_20240102_100000_bbbbbb"),
+		[]byte("newer"), 0600))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(backupDir, "authorized_keys_20240101_100000_aaaaaa"),
+		[]byte("old"), 0600))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(backupDir, "authorized_keys_manual"),
+		[]byte("copy"), 0600))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(backupDir, "some_other_file.txt"),
+		[]byte("content"), 0600))
+	require.NoError(t, os.Mkdir(filepath.Join(backupDir, "authorized_keys_20240103_100000_dirdir"), 0700))
+
+	// A symlink named like the newest backup must not be listed or read
+	secret := filepath.Join(t.TempDir(), "shadow")
+	require.NoError(t, os.WriteFile(secret, []byte("root:secret"), 0600))
+	require.NoError(t, os.Symlink(secret, filepath.Join(backupDir, "authorized_keys_99991231_235959_zzzzzz")))
+
+	manager := New()
+	backups, err := manager.ListBackups(backupDir)
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+
+	assert.Equal(t, "authorized_keys_20240101_100000_aaaaaa", backups[0].Name)
+	assert.Equal(t, filepath.Join(backupDir, "authorized_keys_20240101_100000_aaaaaa"), backups[0].Path)
+	assert.Equal(t, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), backups[0].Time)
+	assert.Equal(t, int64(3), backups[0].Size)
+	assert.Equal(t, "authorized_keys_20240102_100000_bbbbbb", backups[1].Name)
+
+	content, err := manager.ReadBackup(backupDir, backups[1].Name)
+	require.NoError(t, err)
+	assert.Equal(t, "newer", string(content))
+	_, err = manager.ReadBackup(backupDir, "authorized_keys_99991231_235959_zzzzzz")
+	require.Error(t, err)
+	_, err = manager.ReadBackup(backupDir, "../shadow")
+	require.Error(t, err)
+
+	// A missing directory has no backups
+	backups, err = manager.ListBackups(filepath.Join(backupDir, "missing"))
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+}
+
+func TestParseBackupName(t *testing.T) {
+	manager := New()
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "authorized_keys_20240115_103045_kqzvbx", want: true},
+		{name: "authorized_keys_20240115_103045_kqzvbxmwtekqzvbxmwte", want: true},
+		{name: "authorized_keys_20240115_103045_kqz", want: false},
+		{name: "authorized_keys_20240115_103045_KQZVBX", want: false},
+		{name: "authorized_keys_20241399_103045_kqzvbx", want: false},
+		{name: "authorized_keys_20240115-103045_kqzvbx", want: false},
+		{name: "authorized_keys_manual", want: false},
+		{name: "ak-20240115_103045_kqzvbx", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := manager.parseBackupName(tt.name)
+			assert.Equal(t, tt.want, ok)
+		})
+	}
+}
+
 func TestNew(t *testing.T) {
 	manager := New()
 	assert.NotNil(t, manager)
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadRootCAs builds the certificate pool used to verify https sources: the
+// system pool plus the certificates of ca_file and of every file in
+// ca_bundle_dir. Returns nil if neither is set, so the system pool is used.
+func loadRootCAs(caFile, caBundleDir string) (*x509.CertPool, error) {
+	if caFile == "" && caBundleDir == "" {
+		return nil, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: failed to read ca_file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("config: ca_file %s contains no PEM certificates", caFile)
+		}
+	}
+
+	if caBundleDir != "" {
+		entries, err := os.ReadDir(caBundleDir)
+		if err != nil {
+			return nil, fmt.Errorf("config: failed to read ca_bundle_dir: %w", err)
+		}
+
+		// Bundle directories often contain other files (e.g. CRLs or
+		// READMEs), so only a directory without any certificate is an error
+		loaded := 0
+		for _, entry := range entries {
+			path := filepath.Join(caBundleDir, entry.Name())
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("config: failed to read CA file in ca_bundle_dir: %w", err)
+			}
+			if pool.AppendCertsFromPEM(pem) {
+				loaded++
+			}
+		}
+		if loaded == 0 {
+			return nil, fmt.Errorf("config: ca_bundle_dir %s contains no PEM certificates", caBundleDir)
+		}
+	}
+
+	return pool, nil
+}
+
+// HasTLSConfig returns true if the source sets any TLS option of its own
+func (s Source) HasTLSConfig() bool {
+	return s.CAFile != "" || s.ClientCertFile != "" || s.ClientKeyFile != "" || s.InsecureSkipVerify
+}
+
+// TLSConfig builds the TLS configuration of a source with TLS options of its
+// own. Its ca_file is trusted on top of rootCAs, or of the system pool if
+// rootCAs is nil, and its client certificate is presented to servers asking
+// for one. Returns nil if the source sets no TLS option.
+func (s Source) TLSConfig(rootCAs *x509.CertPool) (*tls.Config, error) {
+	if !s.HasTLSConfig() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if s.CAFile != "" {
+		pool := rootCAs
+		if pool == nil {
+			var err error
+			if pool, err = x509.SystemCertPool(); err != nil {
+				pool = x509.NewCertPool()
+			}
+		} else {
+			pool = pool.Clone()
+		}
+
+		pem, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s contains no PEM certificates", s.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if s.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.ClientCertFile, s.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// validateSourceTLS checks the TLS options of a source without reading any
+// file. The returned error completes a sentence about the source.
+func validateSourceTLS(source Source) error {
+	if !source.HasTLSConfig() {
+		return nil
+	}
+	if (source.ClientCertFile == "") != (source.ClientKeyFile == "") {
+		return errors.New("must set client_cert_file and client_key_file together")
+	}
+	if !strings.HasPrefix(strings.ToLower(source.URL), "https://") {
+		return errors.New("sets TLS options but its URL is not an https URL")
+	}
+	return nil
+}
+
+// loadSourceTLS reads the CA and client certificate files of every source,
+// so that a missing or invalid file fails the config load instead of the
+// fetch, and warns about sources that skip certificate verification
+func (c *Config) loadSourceTLS() error {
+	for _, user := range c.Users {
+		for j, source := range user.Sources {
+			if _, err := source.TLSConfig(c.RootCAs); err != nil {
+				return fmt.Errorf("config: user %q source at index %d: %w", user.Label(), j, err)
+			}
+			if source.InsecureSkipVerify {
+				c.Warnings = append(c.Warnings, fmt.Sprintf("user %q source at index %d sets insecure_skip_verify, its TLS certificate is not verified", user.Label(), j))
+			}
+		}
+	}
+	return nil
+}
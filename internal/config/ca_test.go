@@ -0,0 +1,206 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCAPEM returns a self-signed CA certificate in PEM format
+func testCAPEM(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Internal Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestLoadRootCAs(t *testing.T) {
+	t.Run("not configured", func(t *testing.T) {
+		pool, err := loadRootCAs("", "")
+		require.NoError(t, err)
+		assert.Nil(t, pool)
+	})
+
+	t.Run("ca_file and ca_bundle_dir", func(t *testing.T) {
+		dir := t.TempDir()
+		caFile := filepath.Join(dir, "ca.pem")
+		require.NoError(t, os.WriteFile(caFile, testCAPEM(t), 0644))
+
+		bundleDir := filepath.Join(dir, "bundle")
+		require.NoError(t, os.Mkdir(bundleDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(bundleDir, "a.pem"), testCAPEM(t), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(bundleDir, "README"), []byte("not a cert"), 0644))
+
+		pool, err := loadRootCAs(caFile, bundleDir)
+		require.NoError(t, err)
+		assert.NotNil(t, pool)
+	})
+
+	t.Run("missing ca_file", func(t *testing.T) {
+		_, err := loadRootCAs(filepath.Join(t.TempDir(), "missing.pem"), "")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to read ca_file")
+	})
+
+	t.Run("ca_file without certificates", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		require.NoError(t, os.WriteFile(caFile, []byte("garbage"), 0644))
+
+		_, err := loadRootCAs(caFile, "")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "contains no PEM certificates")
+	})
+
+	t.Run("ca_bundle_dir without certificates", func(t *testing.T) {
+		_, err := loadRootCAs("", t.TempDir())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "ca_bundle_dir")
+	})
+}
+
+func TestLoad_CAFileError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+policy:
+  ca_file: "/nonexistent/ca.pem"
+users:
+  - username: "alice"
+    sources:
+      - url: "https://example.com/keys"
+`), 0600))
+
+	_, err := Load(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to read ca_file")
+}
+
+// writeTestClientCert writes a self-signed client certificate and its key in
+// PEM format to dir, returning their paths
+func writeTestClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "authkeysync"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestLoad_SourceTLS(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, testCAPEM(t), 0644))
+	certFile, keyFile := writeTestClientCert(t, dir)
+
+	load := func(source string) (*Config, error) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(`
+users:
+  - username: "alice"
+    sources:
+      - url: "https://keys.internal/alice"`+source+"\n"), 0600))
+		return Load(path)
+	}
+
+	t.Run("ca and client certificate", func(t *testing.T) {
+		cfg, err := load(`
+        ca_file: "` + caFile + `"
+        client_cert_file: "` + certFile + `"
+        client_key_file: "` + keyFile + `"`)
+		require.NoError(t, err)
+		assert.Empty(t, cfg.Warnings)
+
+		tlsConfig, err := cfg.Users[0].Sources[0].TLSConfig(nil)
+		require.NoError(t, err)
+		assert.NotNil(t, tlsConfig.RootCAs)
+		assert.Len(t, tlsConfig.Certificates, 1)
+	})
+
+	t.Run("insecure skip verify warns", func(t *testing.T) {
+		cfg, err := load(`
+        insecure_skip_verify: true`)
+		require.NoError(t, err)
+		require.Len(t, cfg.Warnings, 1)
+		assert.Contains(t, cfg.Warnings[0], "sets insecure_skip_verify")
+	})
+
+	t.Run("missing ca_file", func(t *testing.T) {
+		_, err := load(`
+        ca_file: "` + filepath.Join(dir, "missing.pem") + `"`)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `user "alice" source at index 0: failed to read ca_file`)
+	})
+
+	t.Run("key of another certificate", func(t *testing.T) {
+		_, otherKey := writeTestClientCert(t, t.TempDir())
+		_, err := load(`
+        client_cert_file: "` + certFile + `"
+        client_key_file: "` + otherKey + `"`)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to load client certificate")
+	})
+}
+
+func TestValidate_SourceTLS(t *testing.T) {
+	tests := []struct {
+		name   string
+		source Source
+		errMsg string
+	}{
+		{name: "no TLS options on http", source: Source{URL: "http://example.com/keys"}},
+		{name: "ca file", source: Source{URL: "https://example.com/keys", CAFile: "/etc/ca.pem"}},
+		{name: "cert without key", source: Source{URL: "https://example.com/keys", ClientCertFile: "/etc/client.pem"}, errMsg: "must set client_cert_file and client_key_file together"},
+		{name: "key without cert", source: Source{URL: "https://example.com/keys", ClientKeyFile: "/etc/client-key.pem"}, errMsg: "must set client_cert_file and client_key_file together"},
+		{name: "plain http", source: Source{URL: "http://example.com/keys", InsecureSkipVerify: true}, errMsg: "is not an https URL"},
+		{name: "file source", source: Source{URL: "/etc/keys", CAFile: "/etc/ca.pem"}, errMsg: "is not an https URL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Users: []User{{Username: "alice", Sources: []Source{tt.source}}}}
+			err := cfg.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// IsFile returns true if the keys of the source are read from a local file:
+// its URL is a file:// URL or a path instead of an http(s) URL
+func (s Source) IsFile() bool {
+	return strings.HasPrefix(s.URL, "file:") || !strings.Contains(s.URL, "://")
+}
+
+// FilePath returns the path of a file source
+func (s Source) FilePath() string {
+	if !strings.HasPrefix(s.URL, "file:") {
+		return s.URL
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// validateFileSource checks a file source. The path must be absolute, so it
+// never depends on the working directory, and HTTP settings are rejected.
+// The returned error completes a sentence about the source.
+func validateFileSource(source Source) error {
+	if strings.HasPrefix(source.URL, "file:") {
+		u, err := url.Parse(source.URL)
+		if err != nil {
+			return fmt.Errorf("has an invalid file URL: %w", err)
+		}
+		if u.Host != "" && u.Host != "localhost" {
+			return fmt.Errorf("has file URL %q with host %q (use file:///absolute/path)", source.URL, u.Host)
+		}
+	}
+	if path := source.FilePath(); !filepath.IsAbs(path) {
+		return fmt.Errorf("has relative path %q (use an absolute path, a file:// URL or an http(s) URL)", source.URL)
+	}
+
+	var unsupported []string
+	if source.Method != "" {
+		unsupported = append(unsupported, "method")
+	}
+	if len(source.Headers) > 0 {
+		unsupported = append(unsupported, "headers")
+	}
+	if source.Body != "" {
+		unsupported = append(unsupported, "body")
+	}
+	if source.BasicAuthUser != "" {
+		unsupported = append(unsupported, "basic_auth_user")
+	}
+	if source.BearerTokenFile != "" {
+		unsupported = append(unsupported, "bearer_token_file")
+	}
+	if source.Paginate {
+		unsupported = append(unsupported, "paginate")
+	}
+	if source.ExpectContentType != "" {
+		unsupported = append(unsupported, "expect_content_type")
+	}
+	if source.MaxRedirects != nil {
+		unsupported = append(unsupported, "max_redirects")
+	}
+	if len(unsupported) > 0 {
+		return errors.New("is a file and cannot set " + strings.Join(unsupported, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// SourceTypeGitHubTeam is the type of a source reading the keys of every
+// member of a GitHub team
+const SourceTypeGitHubTeam = "github_team"
+
+// DefaultGitHubAPIURL is the GitHub API that github_team sources without a
+// url read team members from
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// githubNamePattern matches GitHub organization names and team slugs
+var githubNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// IsGitHubTeam returns true if the source reads the keys of the members of a
+// GitHub team
+func (s Source) IsGitHubTeam() bool {
+	return s.Type == SourceTypeGitHubTeam
+}
+
+// GitHubTeamMembersURL returns the team members API URL of a github_team
+// source on the public GitHub API
+func (s Source) GitHubTeamMembersURL() string {
+	return fmt.Sprintf("%s/orgs/%s/teams/%s/members", DefaultGitHubAPIURL, url.PathEscape(s.Org), url.PathEscape(s.Team))
+}
+
+// defaultGitHubTeamURLs sets the URL of github_team sources that do not set
+// one to the team members API URL on the public GitHub API
+func (c *Config) defaultGitHubTeamURLs() {
+	for i := range c.Users {
+		for j, source := range c.Users[i].Sources {
+			if source.IsGitHubTeam() && source.URL == "" {
+				c.Users[i].Sources[j].URL = source.GitHubTeamMembersURL()
+			}
+		}
+	}
+}
+
+// validateSourceType checks the type of a source and the settings only its
+// type uses. The returned error completes a sentence about the source.
+func validateSourceType(source Source) error {
+	switch source.Type {
+	case "":
+		if source.Org != "" || source.Team != "" {
+			return fmt.Errorf("sets org or team without type %q", SourceTypeGitHubTeam)
+		}
+		if source.Bucket != "" || source.Key != "" || source.Region != "" || source.Endpoint != "" {
+			return fmt.Errorf("sets bucket, key, region or endpoint without type %q", SourceTypeS3)
+		}
+		return nil
+	case SourceTypeGitHubTeam:
+		return validateGitHubTeamSource(source)
+	case SourceTypeS3:
+		return validateS3Source(source)
+	default:
+		return fmt.Errorf("has invalid type %q (supported: %s, %s)", source.Type, SourceTypeGitHubTeam, SourceTypeS3)
+	}
+}
+
+// validateGitHubTeamSource checks a github_team source. Its url, if set, is
+// the members API of the team (e.g. on GitHub Enterprise Server), which the
+// source paginates itself with GET requests.
+func validateGitHubTeamSource(source Source) error {
+	if source.Org == "" || source.Team == "" {
+		return fmt.Errorf("of type %q requires org and team", SourceTypeGitHubTeam)
+	}
+	if !githubNamePattern.MatchString(source.Org) {
+		return fmt.Errorf("has invalid GitHub organization %q", source.Org)
+	}
+	if !githubNamePattern.MatchString(source.Team) {
+		return fmt.Errorf("has invalid GitHub team slug %q", source.Team)
+	}
+	if source.IsFile() {
+		return fmt.Errorf("of type %q has URL %q that is not an http(s) URL", SourceTypeGitHubTeam, source.URL)
+	}
+
+	var unsupported []string
+	if source.Method != "" && source.GetMethod() != DefaultMethod {
+		unsupported = append(unsupported, "method")
+	}
+	if source.Body != "" {
+		unsupported = append(unsupported, "body")
+	}
+	if source.Paginate {
+		unsupported = append(unsupported, "paginate")
+	}
+	if source.ExpectContentType != "" {
+		unsupported = append(unsupported, "expect_content_type")
+	}
+	if len(unsupported) > 0 {
+		return errors.New("of type " + SourceTypeGitHubTeam + " cannot set " + strings.Join(unsupported, ", "))
+	}
+	return nil
+}
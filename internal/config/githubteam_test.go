@@ -0,0 +1,100 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_GitHubTeam(t *testing.T) {
+	yamlData := `
+users:
+  - username: "admin"
+    sources:
+      - type: "github_team"
+        org: "acme"
+        team: "platform-ops"
+        headers:
+          Authorization: "Bearer token"
+      - type: "github_team"
+        org: "acme"
+        team: "sre"
+        url: "https://github.acme.internal/api/v3/orgs/acme/teams/sre/members"
+`
+
+	cfg, err := Parse([]byte(yamlData))
+	require.NoError(t, err)
+
+	sources := cfg.Users[0].Sources
+	require.Len(t, sources, 2)
+	assert.True(t, sources[0].IsGitHubTeam())
+	assert.Equal(t, "https://api.github.com/orgs/acme/teams/platform-ops/members", sources[0].URL)
+	assert.Equal(t, "https://github.acme.internal/api/v3/orgs/acme/teams/sre/members", sources[1].URL)
+}
+
+func TestValidate_SourceType(t *testing.T) {
+	tests := []struct {
+		name   string
+		source Source
+		errMsg string
+	}{
+		{
+			name:   "github team",
+			source: Source{Type: "github_team", Org: "acme", Team: "ops", URL: "https://api.github.com/orgs/acme/teams/ops/members"},
+		},
+		{
+			name:   "unknown type",
+			source: Source{Type: "gitlab_group", URL: "https://example.com"},
+			errMsg: `has invalid type "gitlab_group"`,
+		},
+		{
+			name:   "team without type",
+			source: Source{Team: "ops", URL: "https://example.com"},
+			errMsg: "sets org or team without type",
+		},
+		{
+			name:   "missing team",
+			source: Source{Type: "github_team", Org: "acme", URL: "https://api.github.com/orgs/acme/teams//members"},
+			errMsg: "requires org and team",
+		},
+		{
+			name:   "invalid org",
+			source: Source{Type: "github_team", Org: "acme/other", Team: "ops", URL: "https://example.com"},
+			errMsg: `invalid GitHub organization "acme/other"`,
+		},
+		{
+			name:   "file URL",
+			source: Source{Type: "github_team", Org: "acme", Team: "ops", URL: "/etc/keys"},
+			errMsg: "is not an http(s) URL",
+		},
+		{
+			name:   "POST with body",
+			source: Source{Type: "github_team", Org: "acme", Team: "ops", URL: "https://example.com", Method: "POST", Body: "{}"},
+			errMsg: "cannot set method, body",
+		},
+		{
+			name:   "paginate",
+			source: Source{Type: "github_team", Org: "acme", Team: "ops", URL: "https://example.com", Paginate: true},
+			errMsg: "cannot set paginate",
+		},
+		{
+			name:   "expect_content_type",
+			source: Source{Type: "github_team", Org: "acme", Team: "ops", URL: "https://example.com", ExpectContentType: "text/plain"},
+			errMsg: "cannot set expect_content_type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Users: []User{{Username: "admin", Sources: []Source{tt.source}}}}
+			err := cfg.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
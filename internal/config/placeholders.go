@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// UsernamePlaceholder is replaced by the username of the user being synced
+// in the URL, header values and body of its sources
+const UsernamePlaceholder = "{username}"
+
+// placeholderPattern matches anything that looks like a placeholder. Other
+// braces, e.g. those of a JSON body, are left alone.
+var placeholderPattern = regexp.MustCompile(`\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+// validatePlaceholders returns an error naming the first placeholder in s
+// that is not UsernamePlaceholder
+func validatePlaceholders(s string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(s, -1) {
+		if placeholder != UsernamePlaceholder {
+			return fmt.Errorf("unknown placeholder %s (supported: %s)", placeholder, UsernamePlaceholder)
+		}
+	}
+	return nil
+}
+
+// HasPlaceholders returns true if the URL, a header value, the body or the S3
+// key of the source contains UsernamePlaceholder
+func (s Source) HasPlaceholders() bool {
+	if strings.Contains(s.URL, UsernamePlaceholder) || strings.Contains(s.Body, UsernamePlaceholder) || strings.Contains(s.Key, UsernamePlaceholder) {
+		return true
+	}
+	for _, value := range s.Headers {
+		if strings.Contains(value, UsernamePlaceholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandUsername returns a copy of the source with UsernamePlaceholder
+// replaced by username. In the URL the username is escaped for the path, or
+// for the query after a "?"; header values, the body and the S3 key get it
+// verbatim.
+func (s Source) ExpandUsername(username string) Source {
+	if !s.HasPlaceholders() {
+		return s
+	}
+
+	path, query, hasQuery := strings.Cut(s.URL, "?")
+	s.URL = strings.ReplaceAll(path, UsernamePlaceholder, url.PathEscape(username))
+	if hasQuery {
+		s.URL += "?" + strings.ReplaceAll(query, UsernamePlaceholder, url.QueryEscape(username))
+	}
+
+	if s.Headers != nil {
+		headers := maps.Clone(s.Headers)
+		for name, value := range headers {
+			headers[name] = strings.ReplaceAll(value, UsernamePlaceholder, username)
+		}
+		s.Headers = headers
+	}
+	s.Body = strings.ReplaceAll(s.Body, UsernamePlaceholder, username)
+	s.Key = strings.ReplaceAll(s.Key, UsernamePlaceholder, username)
+	return s
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSource_ExpandUsername(t *testing.T) {
+	source := Source{
+		URL:     "https://keys.example.com/{username}/keys?user={username}&v=1",
+		Headers: map[string]string{"X-User": "{username}", "Accept": "text/plain"},
+		Body:    `{"user": "{username}"}`,
+	}
+
+	expanded := source.ExpandUsername("john doe/x")
+	assert.Equal(t, "https://keys.example.com/john%20doe%2Fx/keys?user=john+doe%2Fx&v=1", expanded.URL)
+	assert.Equal(t, map[string]string{"X-User": "john doe/x", "Accept": "text/plain"}, expanded.Headers)
+	assert.Equal(t, `{"user": "john doe/x"}`, expanded.Body)
+
+	// The original source is not modified
+	assert.Equal(t, "{username}", source.Headers["X-User"])
+
+	plain := Source{URL: "https://example.com/keys", Body: `{"a": 1}`}
+	assert.False(t, plain.HasPlaceholders())
+	assert.Equal(t, plain, plain.ExpandUsername("alice"))
+}
+
+func TestPolicy_ResolveSources_Placeholders(t *testing.T) {
+	sources := []Source{
+		{URL: "https://github.com/{username}.keys"},
+		{URL: "https://example.com/shared"},
+	}
+
+	resolved, err := Policy{}.ResolveSources("alice", sources)
+	require.NoError(t, err)
+	require.Len(t, resolved, 2)
+	assert.Equal(t, "https://github.com/alice.keys", resolved[0].URL)
+	assert.Equal(t, "https://example.com/shared", resolved[1].URL)
+	assert.Equal(t, "https://github.com/{username}.keys", sources[0].URL)
+}
+
+func TestParse_Placeholders(t *testing.T) {
+	yamlData := `
+users:
+  - username: "dev-*"
+    sources:
+      - url: "https://keys.example.com/{username}"
+        method: POST
+        headers:
+          X-User: "{username}"
+        body: '{"user": "{username}"}'
+`
+
+	_, err := Parse([]byte(yamlData))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		wantErr string
+	}{
+		{name: "url", from: "keys.example.com/{username}", to: "keys.example.com/{uid}", wantErr: "has an invalid url: unknown placeholder {uid}"},
+		{name: "header", from: `X-User: "{username}"`, to: `X-User: "{home}"`, wantErr: "has an invalid header X-User: unknown placeholder {home}"},
+		{name: "body", from: `"user": "{username}"`, to: `"user": "{user}"`, wantErr: "has an invalid body: unknown placeholder {user}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(strings.Replace(yamlData, tt.from, tt.to, 1)))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// SourceTypeS3 is the type of a source reading an object of an S3 bucket
+const SourceTypeS3 = "s3"
+
+// s3BucketPattern matches S3 bucket names
+var s3BucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// IsS3 returns true if the source reads an object of an S3 bucket
+func (s Source) IsS3() bool {
+	return s.Type == SourceTypeS3
+}
+
+// S3URL returns the s3://bucket/key URL of an s3 source, which names it in
+// logs and reports
+func (s Source) S3URL() string {
+	return "s3://" + s.Bucket + "/" + s.Key
+}
+
+// defaultS3URLs sets the URL of s3 sources to their S3URL
+func (c *Config) defaultS3URLs() {
+	for i := range c.Users {
+		for j, source := range c.Users[i].Sources {
+			if source.IsS3() && source.URL == "" {
+				c.Users[i].Sources[j].URL = source.S3URL()
+			}
+		}
+	}
+}
+
+// validateS3Source checks an s3 source. Its URL is derived from bucket and
+// key, and only the settings of the request itself apply to it. The returned
+// error completes a sentence about the source.
+func validateS3Source(source Source) error {
+	if source.Bucket == "" || source.Key == "" {
+		return fmt.Errorf("of type %q requires bucket and key", SourceTypeS3)
+	}
+	if !s3BucketPattern.MatchString(source.Bucket) {
+		return fmt.Errorf("has invalid S3 bucket %q", source.Bucket)
+	}
+	if source.URL != source.S3URL() {
+		return fmt.Errorf("of type %q sets url (use bucket and key)", SourceTypeS3)
+	}
+	if source.Endpoint != "" {
+		u, err := url.Parse(source.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("has invalid endpoint %q (expected an http(s) URL)", source.Endpoint)
+		}
+	}
+
+	var unsupported []string
+	if source.Method != "" {
+		unsupported = append(unsupported, "method")
+	}
+	if len(source.Headers) > 0 {
+		unsupported = append(unsupported, "headers")
+	}
+	if source.Body != "" {
+		unsupported = append(unsupported, "body")
+	}
+	if source.Paginate {
+		unsupported = append(unsupported, "paginate")
+	}
+	if source.BasicAuthUser != "" {
+		unsupported = append(unsupported, "basic_auth_user")
+	}
+	if source.BearerTokenFile != "" {
+		unsupported = append(unsupported, "bearer_token_file")
+	}
+	if source.HasTLSConfig() {
+		unsupported = append(unsupported, "TLS options")
+	}
+	if source.ExpectContentType != "" {
+		unsupported = append(unsupported, "expect_content_type")
+	}
+	if source.MaxRedirects != nil {
+		unsupported = append(unsupported, "max_redirects")
+	}
+	if len(unsupported) > 0 {
+		return errors.New("of type " + SourceTypeS3 + " cannot set " + strings.Join(unsupported, ", "))
+	}
+	return nil
+}
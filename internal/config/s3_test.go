@@ -0,0 +1,77 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_S3(t *testing.T) {
+	yamlData := `
+users:
+  - username: "deploy"
+    sources:
+      - type: "s3"
+        bucket: "acme-keys"
+        key: "users/{username}.keys"
+        region: "eu-west-1"
+      - type: "s3"
+        bucket: "keys"
+        key: "team.keys"
+        endpoint: "https://minio.acme.internal:9000"
+`
+
+	cfg, err := Parse([]byte(yamlData))
+	require.NoError(t, err)
+
+	sources := cfg.Users[0].Sources
+	require.Len(t, sources, 2)
+	assert.True(t, sources[0].IsS3())
+	assert.False(t, sources[0].IsFile())
+	assert.Equal(t, "s3://acme-keys/users/{username}.keys", sources[0].URL)
+	assert.Equal(t, "s3://keys/team.keys", sources[1].URL)
+
+	expanded := sources[0].ExpandUsername("deploy")
+	assert.Equal(t, "users/deploy.keys", expanded.Key)
+	assert.Equal(t, "s3://acme-keys/users/deploy.keys", expanded.URL)
+}
+
+func TestValidate_S3Source(t *testing.T) {
+	s3Source := func(modify func(*Source)) Source {
+		source := Source{Type: "s3", Bucket: "acme-keys", Key: "deploy.keys"}
+		modify(&source)
+		if source.URL == "" {
+			source.URL = source.S3URL()
+		}
+		return source
+	}
+
+	tests := []struct {
+		name   string
+		source Source
+		errMsg string
+	}{
+		{name: "valid", source: s3Source(func(s *Source) { s.Region = "eu-west-1" })},
+		{name: "valid with endpoint", source: s3Source(func(s *Source) { s.Endpoint = "http://localhost:9000" })},
+		{name: "missing key", source: s3Source(func(s *Source) { s.Key = "" }), errMsg: `of type "s3" requires bucket and key`},
+		{name: "invalid bucket", source: s3Source(func(s *Source) { s.Bucket = "Acme_Keys" }), errMsg: `invalid S3 bucket "Acme_Keys"`},
+		{name: "url", source: s3Source(func(s *Source) { s.URL = "https://acme-keys.s3.amazonaws.com/deploy.keys" }), errMsg: "sets url (use bucket and key)"},
+		{name: "invalid endpoint", source: s3Source(func(s *Source) { s.Endpoint = "minio:9000" }), errMsg: `invalid endpoint "minio:9000"`},
+		{name: "HTTP settings", source: s3Source(func(s *Source) { s.Method = "POST"; s.Paginate = true }), errMsg: "of type s3 cannot set method, paginate"},
+		{name: "bucket without type", source: Source{URL: "https://example.com/keys", Bucket: "acme-keys"}, errMsg: `sets bucket, key, region or endpoint without type "s3"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Users: []User{{Username: "admin", Sources: []Source{tt.source}}}}
+			err := cfg.Validate()
+			if tt.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
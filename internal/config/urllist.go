@@ -0,0 +1,97 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// expandURLLists replaces every source with a url_list by one source per URL
+// listed in the matching files, in file name order. Each of them inherits
+// every other field of the source it was expanded from.
+func (c *Config) expandURLLists() error {
+	for i, user := range c.Users {
+		if !slices.ContainsFunc(user.Sources, func(source Source) bool { return source.URLList != "" }) {
+			continue
+		}
+
+		sources := make([]Source, 0, len(user.Sources))
+		for j, source := range user.Sources {
+			if source.URLList == "" {
+				sources = append(sources, source)
+				continue
+			}
+			if source.URL != "" {
+				return fmt.Errorf("config: user %q source at index %d sets both url and url_list", user.Label(), j)
+			}
+
+			urls, err := readURLList(source.URLList)
+			if err != nil {
+				return fmt.Errorf("config: user %q source at index %d: %w", user.Label(), j, err)
+			}
+			for _, u := range urls {
+				expanded := source
+				expanded.URL = u
+				expanded.URLList = ""
+				sources = append(sources, expanded)
+			}
+		}
+		c.Users[i].Sources = sources
+	}
+	return nil
+}
+
+// readURLList returns the URLs listed in the files matching pattern, an
+// absolute glob or directory. Files list one URL per line; empty lines and
+// lines starting with # are ignored.
+func readURLList(pattern string) ([]string, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("url_list %q must be an absolute path", pattern)
+	}
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = filepath.Join(pattern, "*")
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url_list %q: %w", pattern, err)
+	}
+
+	var urls []string
+	for _, file := range files {
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read url_list file: %w", err)
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if parsed, err := url.Parse(line); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("%s:%d is not an http or https URL", file, lineNumber)
+			}
+			urls = append(urls, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read url_list file: %w", err)
+		}
+	}
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("url_list %q lists no URLs", pattern)
+	}
+	return urls, nil
+}
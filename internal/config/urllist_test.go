@@ -0,0 +1,96 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_URLList(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("https://keys.example.com/b\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("# platform team\nhttps://keys.example.com/a1\n\n  https://keys.example.com/a2  \n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.md"), []byte("not a list"), 0600))
+
+	yamlData := `
+users:
+  - username: "admin"
+    sources:
+      - url: "https://example.com/admin"
+      - url_list: "` + filepath.Join(dir, "*.txt") + `"
+        headers:
+          X-Api-Key: "secret"
+        timeout_seconds: 5
+`
+
+	cfg, err := Parse([]byte(yamlData))
+	require.NoError(t, err)
+
+	sources := cfg.Users[0].Sources
+	require.Len(t, sources, 4)
+	assert.Equal(t, "https://example.com/admin", sources[0].URL)
+	assert.Empty(t, sources[0].Headers)
+	for i, url := range []string{"https://keys.example.com/a1", "https://keys.example.com/a2", "https://keys.example.com/b"} {
+		source := sources[i+1]
+		assert.Equal(t, url, source.URL)
+		assert.Empty(t, source.URLList)
+		assert.Equal(t, "secret", source.Headers["X-Api-Key"])
+		assert.Equal(t, 5, source.GetTimeoutSeconds())
+	}
+}
+
+func TestParse_URLListDirectory(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "team"), []byte("https://keys.example.com/team\n"), 0600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "archive"), 0700))
+
+	yamlData := `
+users:
+  - username: "admin"
+    sources:
+      - url_list: "` + dir + `"
+`
+
+	cfg, err := Parse([]byte(yamlData))
+	require.NoError(t, err)
+	require.Len(t, cfg.Users[0].Sources, 1)
+	assert.Equal(t, "https://keys.example.com/team", cfg.Users[0].Sources[0].URL)
+}
+
+func TestParse_URLListErrors(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bad.txt"), []byte("https://keys.example.com/ok\nkeys.example.com/bad\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty.txt"), []byte("# nothing yet\n"), 0600))
+
+	tests := []struct {
+		name    string
+		source  string
+		wantErr string
+	}{
+		{name: "relative", source: `url_list: "lists/*.txt"`, wantErr: "must be an absolute path"},
+		{name: "no files", source: `url_list: "` + filepath.Join(dir, "*.csv") + `"`, wantErr: "lists no URLs"},
+		{name: "no urls", source: `url_list: "` + filepath.Join(dir, "empty.txt") + `"`, wantErr: "lists no URLs"},
+		{name: "invalid url", source: `url_list: "` + filepath.Join(dir, "bad.txt") + `"`, wantErr: "bad.txt:2 is not an http or https URL"},
+		{name: "url and url_list", source: `url: "https://example.com/keys"
+        url_list: "` + filepath.Join(dir, "bad.txt") + `"`, wantErr: "sets both url and url_list"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlData := `
+users:
+  - username: "admin"
+    sources:
+      - ` + tt.source + "\n"
+
+			_, err := Parse([]byte(yamlData))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+			assert.True(t, strings.HasPrefix(err.Error(), "config: "))
+		})
+	}
+}
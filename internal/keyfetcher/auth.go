@@ -0,0 +1,80 @@
+package keyfetcher
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// setAuth sets the credentials of the source on req: a bearer token or HTTP
+// Basic credentials. Secrets are read for every request, so rotated ones are
+// picked up without a restart.
+func setAuth(req *http.Request, source config.Source) error {
+	if source.BearerTokenFile != "" {
+		return setBearerToken(req, source)
+	}
+	return setBasicAuth(req, source)
+}
+
+// setBearerToken sets an "Authorization: Bearer" header with the token read
+// from the bearer token file of the source
+func setBearerToken(req *http.Request, source config.Source) error {
+	data, err := os.ReadFile(source.BearerTokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read bearer token file: %w", err)
+	}
+	// Files usually end with a newline that is not part of the token
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("bearer token file %s is empty", source.BearerTokenFile)
+	}
+	if strings.ContainsAny(token, "\r\n") {
+		return fmt.Errorf("bearer token file %s has more than one line", source.BearerTokenFile)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// setBasicAuth sets HTTP Basic credentials on req if the source defines a
+// basic auth user. The password is read from the configured environment
+// variable or file, so it never has to be written in the config file.
+func setBasicAuth(req *http.Request, source config.Source) error {
+	if source.BasicAuthUser == "" {
+		return nil
+	}
+
+	password, err := basicAuthPassword(source)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(source.BasicAuthUser, password)
+	return nil
+}
+
+// basicAuthPassword reads the basic auth password of a source
+func basicAuthPassword(source config.Source) (string, error) {
+	switch {
+	case source.BasicAuthPasswordEnv != "":
+		password, ok := os.LookupEnv(source.BasicAuthPasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("basic auth password environment variable %q is not set", source.BasicAuthPasswordEnv)
+		}
+		return password, nil
+
+	case source.BasicAuthPasswordFile != "":
+		data, err := os.ReadFile(source.BasicAuthPasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read basic auth password file: %w", err)
+		}
+		// Files usually end with a newline that is not part of the password
+		return strings.TrimRight(string(data), "\r\n"), nil
+
+	default:
+		return "", fmt.Errorf("basic auth user %q has no password source", source.BasicAuthUser)
+	}
+}
@@ -0,0 +1,144 @@
+package keyfetcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// cacheFileVersion is the format version of cache files
+const cacheFileVersion = 1
+
+// CacheStore persists cached responses and their validators between
+// processes
+type CacheStore interface {
+	// Load returns the stored responses, keyed like Validators
+	Load() (map[string]Validator, error)
+	// Save replaces the stored responses
+	Save(validators map[string]Validator) error
+}
+
+// cacheFile is the content of the file of a FileCacheStore
+type cacheFile struct {
+	Version int                  `json:"version"`
+	Sources map[string]Validator `json:"sources"`
+}
+
+// FileCacheStore is a CacheStore backed by a JSON file readable only by its
+// owner
+type FileCacheStore struct {
+	path string
+}
+
+// NewFileCacheStore creates a FileCacheStore writing to path
+func NewFileCacheStore(path string) *FileCacheStore {
+	return &FileCacheStore{path: path}
+}
+
+// Load reads the cache file. A missing file, or one written in another
+// format version, is an empty cache.
+func (c *FileCacheStore) Load() (map[string]Validator, error) {
+	var file cacheFile
+	if err := readCacheFile(c.path, &file); err != nil || file.Version != cacheFileVersion {
+		return nil, err
+	}
+	return file.Sources, nil
+}
+
+// Save atomically replaces the cache file, creating its directory if needed
+func (c *FileCacheStore) Save(validators map[string]Validator) error {
+	return writeCacheFile(c.path, cacheFile{Version: cacheFileVersion, Sources: validators})
+}
+
+// NegativeCacheStore persists the failure streaks of the negative cache
+// between processes
+type NegativeCacheStore interface {
+	// Load returns the stored failure streaks, keyed like Validators
+	Load() (map[string]NegativeEntry, error)
+	// Save replaces the stored failure streaks
+	Save(entries map[string]NegativeEntry) error
+}
+
+// negativeCacheFile is the content of the file of a FileNegativeCacheStore
+type negativeCacheFile struct {
+	Version int                      `json:"version"`
+	Sources map[string]NegativeEntry `json:"sources"`
+}
+
+// FileNegativeCacheStore is a NegativeCacheStore backed by a JSON file
+// readable only by its owner
+type FileNegativeCacheStore struct {
+	path string
+}
+
+// NewFileNegativeCacheStore creates a FileNegativeCacheStore writing to path
+func NewFileNegativeCacheStore(path string) *FileNegativeCacheStore {
+	return &FileNegativeCacheStore{path: path}
+}
+
+// Load reads the negative cache file. A missing file, or one written in
+// another format version, has no failure streaks.
+func (c *FileNegativeCacheStore) Load() (map[string]NegativeEntry, error) {
+	var file negativeCacheFile
+	if err := readCacheFile(c.path, &file); err != nil || file.Version != cacheFileVersion {
+		return nil, err
+	}
+	return file.Sources, nil
+}
+
+// Save atomically replaces the negative cache file, creating its directory
+// if needed
+func (c *FileNegativeCacheStore) Save(entries map[string]NegativeEntry) error {
+	return writeCacheFile(c.path, negativeCacheFile{Version: cacheFileVersion, Sources: entries})
+}
+
+// readCacheFile decodes the JSON file at path into v. A missing file leaves
+// v untouched.
+func readCacheFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cache file: %w", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse cache file: %w", err)
+	}
+	return nil
+}
+
+// writeCacheFile atomically replaces the file at path with v encoded as
+// JSON, creating its directory with mode 0700 if needed
+func writeCacheFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp(dir, ".cache-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to create temp cache file: %w", err)
+	}
+	tempPath := tempFile.Name()
+	defer func() { _ = os.Remove(tempPath) }()
+
+	if _, err := tempFile.Write(data); err != nil {
+		_ = tempFile.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to replace cache file: %w", err)
+	}
+	return nil
+}
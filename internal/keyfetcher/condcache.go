@@ -0,0 +1,127 @@
+package keyfetcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// validatorEntry is the last successful response of a source along with
+// the validators needed to revalidate it
+type validatorEntry struct {
+	etag         string
+	lastModified string
+	body         []byte
+	// used is true if the source was requested by this process
+	used bool
+}
+
+// Validator is the exported form of a cached response, used to persist
+// validators between runs
+type Validator struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Body         []byte `json:"body"`
+}
+
+// validatorKey returns the cache key of a source. It is hashed, since the
+// request body may carry credentials and the cache can be written to disk.
+func validatorKey(source config.Source) string {
+	sum := sha256.Sum256([]byte(sourceCacheKey(source)))
+	return hex.EncodeToString(sum[:])
+}
+
+// validatorCache remembers ETag and Last-Modified validators so that
+// unchanged sources can be answered with 304 Not Modified
+type validatorCache struct {
+	mu      sync.Mutex
+	entries map[string]*validatorEntry
+}
+
+// newValidatorCache creates an empty validator cache
+func newValidatorCache() *validatorCache {
+	return &validatorCache{
+		entries: make(map[string]*validatorEntry),
+	}
+}
+
+// lookup returns the cached response of a source, if any
+func (c *validatorCache) lookup(source config.Source) (*validatorEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[validatorKey(source)]
+	if ok {
+		entry.used = true
+	}
+	return entry, ok
+}
+
+// store remembers a successful response if it carries a validator,
+// and forgets the source otherwise
+func (c *validatorCache) store(source config.Source, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := validatorKey(source)
+	etag := header.Get("ETag")
+	lastModified := header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		delete(c.entries, key)
+		return
+	}
+
+	c.entries[key] = &validatorEntry{
+		etag:         etag,
+		lastModified: lastModified,
+		body:         body,
+		used:         true,
+	}
+}
+
+// export returns the entries of the sources requested by this process
+func (c *validatorCache) export() map[string]Validator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	validators := make(map[string]Validator)
+	for key, entry := range c.entries {
+		if !entry.used {
+			continue
+		}
+		validators[key] = Validator{
+			ETag:         entry.etag,
+			LastModified: entry.lastModified,
+			Body:         entry.body,
+		}
+	}
+	return validators
+}
+
+// load adds previously exported entries to the cache
+func (c *validatorCache) load(validators map[string]Validator) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, v := range validators {
+		c.entries[key] = &validatorEntry{
+			etag:         v.ETag,
+			lastModified: v.LastModified,
+			body:         v.Body,
+		}
+	}
+}
+
+// setConditionalHeaders adds If-None-Match and If-Modified-Since headers
+// from a cached response
+func setConditionalHeaders(req *http.Request, entry *validatorEntry) {
+	if entry.etag != "" {
+		req.Header.Set("If-None-Match", entry.etag)
+	}
+	if entry.lastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.lastModified)
+	}
+}
@@ -0,0 +1,64 @@
+package keyfetcher
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decodeBody returns a reader of the body of resp with its Content-Encoding
+// undone. The Go transport only decompresses a response when it added
+// Accept-Encoding to the request itself, so a source that sets that header
+// receives the bytes as they were sent. Callers limit the decoded stream, so
+// the size limit applies to the decompressed body.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	var body io.Reader = resp.Body
+
+	// Encodings are listed in the order they were applied
+	encodings := strings.Split(resp.Header.Get("Content-Encoding"), ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		switch encoding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			reader, err := gzip.NewReader(body)
+			if errors.Is(err, io.EOF) {
+				return strings.NewReader(""), nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode gzip response: %w", err)
+			}
+			body = reader
+		case "deflate":
+			reader, err := newDeflateReader(body)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode deflate response: %w", err)
+			}
+			body = reader
+		default:
+			return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+		}
+	}
+	return body, nil
+}
+
+// newDeflateReader decodes a deflate body. The HTTP deflate encoding is zlib
+// data, but some servers send raw deflate data instead, so the zlib header is
+// only read when present.
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	if errors.Is(err, io.EOF) && len(header) == 0 {
+		return strings.NewReader(""), nil
+	}
+	return flate.NewReader(buffered), nil
+}
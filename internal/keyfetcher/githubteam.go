@@ -0,0 +1,294 @@
+package keyfetcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+const (
+	// githubMembersPerPage is the page size requested from the team members
+	// API, the largest GitHub allows
+	githubMembersPerPage = 100
+
+	// githubKeysURL is where the public keys of github.com users are read from
+	githubKeysURL = "https://github.com"
+)
+
+// ErrGitHubTeamAccess indicates that the members of a GitHub team cannot be
+// listed with the credentials of the source
+var ErrGitHubTeamAccess = errors.New("cannot list GitHub team members")
+
+// githubMember is a member in a team members API response
+type githubMember struct {
+	Login string `json:"login"`
+}
+
+// fetchGitHubTeam fetches the keys of a github_team source: it lists the
+// members of the team with the headers of the source, following pagination,
+// then fetches the public keys of every member and merges them into one
+// result. The timeout covers all requests.
+func (f *Fetcher) fetchGitHubTeam(ctx context.Context, source config.Source) *FetchResult {
+	result := &FetchResult{
+		Source: source,
+	}
+
+	timeout := time.Duration(source.GetTimeoutSeconds()) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logins, err := f.listGitHubTeamMembers(ctx, source, result)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	keysURL, err := githubKeysBaseURL(source.URL)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	bodies, err := f.fetchGitHubMemberKeys(ctx, source, keysURL, logins)
+	result.Pages += len(logins)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	var body []byte
+	for _, memberBody := range bodies {
+		if int64(len(body)+len(memberBody)) > MaxResponseSize {
+			f.logger.Warn("GitHub team size limit reached, ignoring remaining members",
+				"url", source.URL,
+				"max_bytes", MaxResponseSize)
+			break
+		}
+		body = append(body, memberBody...)
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			body = append(body, '\n')
+		}
+	}
+
+	f.logger.Debug("fetched GitHub team keys",
+		"org", source.Org,
+		"team", source.Team,
+		"members", len(logins))
+
+	f.parseKeys(result, body)
+	return result
+}
+
+// listGitHubTeamMembers returns the logins of the members of the team of a
+// github_team source, requesting the pages of the members API in turn and
+// counting them in result.Pages. The status code of the last response is set
+// in result.StatusCode.
+func (f *Fetcher) listGitHubTeamMembers(ctx context.Context, source config.Source, result *FetchResult) ([]string, error) {
+	firstPage, err := url.Parse(source.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub team members URL: %w", err)
+	}
+	query := firstPage.Query()
+	if !query.Has("per_page") {
+		query.Set("per_page", fmt.Sprint(githubMembersPerPage))
+		firstPage.RawQuery = query.Encode()
+	}
+
+	var logins []string
+	pageURL := firstPage.String()
+	for {
+		members, next, err := f.fetchGitHubMembersPage(ctx, source, pageURL, result)
+		result.Pages++
+		if err != nil {
+			if result.Pages > 1 {
+				err = fmt.Errorf("page %d: %w", result.Pages, err)
+			}
+			return nil, err
+		}
+		for _, member := range members {
+			logins = append(logins, member.Login)
+		}
+
+		if next == "" {
+			return logins, nil
+		}
+		if result.Pages >= MaxPages {
+			f.logger.Warn("pagination page limit reached, ignoring remaining team members",
+				"url", source.URL,
+				"pages", result.Pages)
+			return logins, nil
+		}
+
+		pageURL, err = resolveNextURL(source.URL, pageURL, next)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fetchGitHubMembersPage requests a single page of the team members API. It
+// returns the members of the page and the raw rel="next" link, if any.
+func (f *Fetcher) fetchGitHubMembersPage(ctx context.Context, source config.Source, pageURL string, result *FetchResult) ([]githubMember, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header = RequestHeaders(source)
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/vnd.github+json")
+	}
+	if err := setAuth(req, source); err != nil {
+		return nil, "", err
+	}
+
+	f.logger.Debug("listing GitHub team members",
+		"url", pageURL,
+		"org", source.Org,
+		"team", source.Team)
+
+	client, err := f.clientFor(source)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", requestError(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	result.StatusCode = resp.StatusCode
+	result.FetchedAt = time.Now()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, "", fmt.Errorf("%w: status 401, the token is missing or invalid", ErrGitHubTeamAccess)
+	case http.StatusForbidden, http.StatusNotFound:
+		return nil, "", githubTeamAccessError(source, resp)
+	default:
+		return nil, "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var members []githubMember
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxResponseSize)).Decode(&members); err != nil {
+		return nil, "", fmt.Errorf("failed to parse GitHub team members: %w", err)
+	}
+	for _, member := range members {
+		if !isGitHubLogin(member.Login) {
+			return nil, "", fmt.Errorf("GitHub team members response has invalid login %q", member.Login)
+		}
+	}
+
+	return members, parseNextLink(resp.Header.Values("Link")), nil
+}
+
+// githubTeamAccessError explains a 403 or 404 of the team members API. GitHub
+// answers 404 instead of 403 for a team the token cannot see, so both usually
+// mean that the token lacks the read:org scope or is not allowed in the
+// organization.
+func githubTeamAccessError(source config.Source, resp *http.Response) error {
+	team := source.Org + "/" + source.Team
+
+	// Classic tokens list their scopes, fine-grained tokens do not
+	if scopes, ok := resp.Header["X-Oauth-Scopes"]; ok {
+		granted := strings.Split(strings.Join(scopes, ","), ",")
+		hasReadOrg := false
+		for _, scope := range granted {
+			switch strings.TrimSpace(scope) {
+			case "read:org", "write:org", "admin:org":
+				hasReadOrg = true
+			}
+		}
+		if !hasReadOrg {
+			return fmt.Errorf("%w: status %d for team %s, the token lacks the read:org scope", ErrGitHubTeamAccess, resp.StatusCode, team)
+		}
+	}
+
+	return fmt.Errorf("%w: status %d for team %s, check that it exists and that the token has the read:org scope (or read access to organization members) and is authorized for the organization", ErrGitHubTeamAccess, resp.StatusCode, team)
+}
+
+// githubKeysBaseURL returns where the public keys of team members are read
+// from: github.com for the public GitHub API, or the host of the members URL
+// for GitHub Enterprise Server
+func githubKeysBaseURL(membersURL string) (string, error) {
+	u, err := url.Parse(membersURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid GitHub team members URL: %w", err)
+	}
+	if u.Host == "api.github.com" {
+		return githubKeysURL, nil
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// fetchGitHubMemberKeys fetches the public keys of every login from
+// <keysURL>/<login>.keys, up to maxConcurrency at the same time, returning
+// the bodies in login order. The headers of the source are not sent, they
+// are meant for the members API only. Any failure fails the whole source.
+func (f *Fetcher) fetchGitHubMemberKeys(ctx context.Context, source config.Source, keysURL string, logins []string) ([][]byte, error) {
+	concurrency := f.maxConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultMaxConcurrency
+	}
+
+	bodies := make([][]byte, len(logins))
+	errs := make([]error, len(logins))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, login := range logins {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+
+			// Each member is its own source, so that http_cache can
+			// revalidate the keys of every member. Keys are read from the
+			// host of the members API, so its TLS settings still apply.
+			memberSource := config.Source{
+				URL:                keysURL + "/" + login + ".keys",
+				TimeoutSeconds:     source.TimeoutSeconds,
+				CAFile:             source.CAFile,
+				ClientCertFile:     source.ClientCertFile,
+				ClientKeyFile:      source.ClientKeyFile,
+				InsecureSkipVerify: source.InsecureSkipVerify,
+			}
+			page, err := f.fetchPage(ctx, memberSource, memberSource.URL, MaxResponseSize)
+			if err != nil {
+				errs[i] = fmt.Errorf("member %s: %w", login, err)
+				return
+			}
+			bodies[i] = page.body
+		})
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bodies, nil
+}
+
+// isGitHubLogin reports whether login is a valid GitHub login, so that it
+// can be used in a key URL as is
+func isGitHubLogin(login string) bool {
+	if login == "" || len(login) > 39 {
+		return false
+	}
+	for _, r := range login {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
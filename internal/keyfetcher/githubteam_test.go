@@ -0,0 +1,120 @@
+package keyfetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+func TestFetch_GitHubTeam(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/orgs/acme/teams/ops/members":
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			assert.Equal(t, "100", r.URL.Query().Get("per_page"))
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Query().Get("page") == "2" {
+				_, _ = w.Write([]byte(`[{"login":"bob","id":2}]`))
+				return
+			}
+			w.Header().Set("Link", `</api/v3/orgs/acme/teams/ops/members?per_page=100&page=2>; rel="next"`)
+			_, _ = w.Write([]byte(`[{"login":"alice","id":1}]`))
+		case "/alice.keys":
+			assert.Empty(t, r.Header.Get("Authorization"), "token must not be sent with key requests")
+			_, _ = w.Write([]byte("ssh-ed25519 AAAA\nssh-rsa BBBB"))
+		case "/bob.keys":
+			_, _ = w.Write([]byte("ssh-ed25519 CCCC\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	source := config.Source{
+		Type:    config.SourceTypeGitHubTeam,
+		Org:     "acme",
+		Team:    "ops",
+		URL:     server.URL + "/api/v3/orgs/acme/teams/ops/members",
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}
+
+	result := New().Fetch(context.Background(), source)
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, 4, result.Pages)
+	require.Len(t, result.Keys, 3)
+	assert.Equal(t, "ssh-ed25519 AAAA", result.Keys[0].Line)
+	assert.Equal(t, "ssh-rsa BBBB", result.Keys[1].Line)
+	assert.Equal(t, "ssh-ed25519 CCCC", result.Keys[2].Line)
+}
+
+func TestFetch_GitHubTeamErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		scopes string
+		errMsg string
+	}{
+		{name: "missing scope", status: http.StatusNotFound, scopes: "repo, gist", errMsg: "status 404 for team acme/ops, the token lacks the read:org scope"},
+		{name: "fine-grained token", status: http.StatusForbidden, errMsg: "status 403 for team acme/ops, check that it exists"},
+		{name: "invalid token", status: http.StatusUnauthorized, errMsg: "the token is missing or invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.scopes != "" {
+					w.Header().Set("X-OAuth-Scopes", tt.scopes)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			source := config.Source{Type: config.SourceTypeGitHubTeam, Org: "acme", Team: "ops", URL: server.URL + "/orgs/acme/teams/ops/members"}
+			result := New().Fetch(context.Background(), source)
+
+			require.ErrorIs(t, result.Error, ErrGitHubTeamAccess)
+			assert.Contains(t, result.Error.Error(), tt.errMsg)
+			assert.Equal(t, tt.status, result.StatusCode)
+		})
+	}
+}
+
+func TestFetch_GitHubTeamMemberFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/orgs/acme/teams/ops/members" {
+			_, _ = w.Write([]byte(`[{"login":"alice"},{"login":"ghost"}]`))
+			return
+		}
+		if r.URL.Path == "/alice.keys" {
+			_, _ = w.Write([]byte("ssh-ed25519 AAAA\n"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	source := config.Source{Type: config.SourceTypeGitHubTeam, Org: "acme", Team: "ops", URL: server.URL + "/orgs/acme/teams/ops/members"}
+	result := New().Fetch(context.Background(), source)
+
+	require.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), "member ghost: unexpected status code: 404")
+	assert.Empty(t, result.Keys)
+}
+
+func TestGitHubKeysBaseURL(t *testing.T) {
+	keysURL, err := githubKeysBaseURL("https://api.github.com/orgs/acme/teams/ops/members")
+	require.NoError(t, err)
+	assert.Equal(t, "https://github.com", keysURL)
+
+	keysURL, err = githubKeysBaseURL("https://github.acme.internal/api/v3/orgs/acme/teams/ops/members")
+	require.NoError(t, err)
+	assert.Equal(t, "https://github.acme.internal", keysURL)
+}
@@ -0,0 +1,62 @@
+package keyfetcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"strings"
+)
+
+// isJSONContentType returns true for application/json and +json media types
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// matchesContentType returns true if contentType starts with expected,
+// compared case-insensitively, or if nothing is expected
+func matchesContentType(contentType, expected string) bool {
+	if expected == "" {
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), strings.ToLower(expected))
+}
+
+// extractJSONKeys converts a JSON response body into one key per line.
+// Supported shapes are an array of strings (`["ssh-ed25519 AAAA..."]`) and an
+// array of objects with a string "key" field (e.g. GitHub's `[{"id":1,"key":"..."}]`).
+// Returns false if the body has any other shape, so that it can be parsed as
+// plain text instead.
+func extractJSONKeys(body []byte) ([]byte, bool) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, false
+	}
+
+	var out bytes.Buffer
+	for _, item := range items {
+		var key string
+		if err := json.Unmarshal(item, &key); err != nil {
+			var object struct {
+				Key *string `json:"key"`
+			}
+			if err := json.Unmarshal(item, &object); err != nil || object.Key == nil {
+				return nil, false
+			}
+			key = *object.Key
+		}
+
+		// A key spanning several lines could smuggle extra lines into the file
+		if strings.ContainsAny(key, "\r\n") {
+			return nil, false
+		}
+
+		out.WriteString(key)
+		out.WriteByte('\n')
+	}
+
+	return out.Bytes(), true
+}
@@ -3,23 +3,58 @@ package keyfetcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
 	"github.com/eduardolat/authkeysync/internal/config"
 	"github.com/eduardolat/authkeysync/internal/keyparser"
 	"github.com/eduardolat/authkeysync/internal/version"
 )
 
 const (
-	// MaxResponseSize is the maximum response body size (10MB)
+	// MaxResponseSize is the maximum response body size (10MB).
+	// For paginated sources it is the limit across all pages.
 	MaxResponseSize = 10 * 1024 * 1024
+
+	// MaxPages is the maximum number of pages followed for a paginated source
+	MaxPages = 100
+
+	// DefaultMaxConcurrency is the default number of sources FetchAll
+	// fetches at the same time
+	DefaultMaxConcurrency = 4
 )
 
+// ErrFileNotFound indicates that the file of a file source does not exist,
+// the equivalent of a 404 for an HTTP source
+var ErrFileNotFound = errors.New("source file not found")
+
+// ErrRequestFailed indicates that no response was received from a source,
+// e.g. because of a connection error or a timeout
+var ErrRequestFailed = errors.New("request failed")
+
+// ErrS3NotSupported indicates that an s3 source is used by a binary built
+// without the s3 build tag
+var ErrS3NotSupported = errors.New("s3 sources need a build with the s3 tag (go build -tags s3)")
+
+// ErrUnexpectedContentType indicates that a response does not have the
+// expect_content_type of its source
+var ErrUnexpectedContentType = errors.New("unexpected content type")
+
+// tracer creates spans for source fetches (no-op unless tracing is enabled)
+var tracer = otel.Tracer("github.com/eduardolat/authkeysync/internal/keyfetcher")
+
 // FetchResult contains the result of fetching keys from a source
 type FetchResult struct {
 	// Source is the source configuration
@@ -32,12 +67,47 @@ type FetchResult struct {
 	StatusCode int
 	// DiscardedLines is the number of discarded lines during parsing
 	DiscardedLines int
+	// FetchedAt is when the response was received (zero if request failed)
+	FetchedAt time.Time
+	// Pages is the number of pages requested (1 unless the source paginates)
+	Pages int
+	// Attempts is the number of times the source was requested, more than 1
+	// if it was retried (0 if served from the negative cache)
+	Attempts int
+	// NotModified is true if the source answered 304 Not Modified and the
+	// keys of its previous response were reused
+	NotModified bool
+	// BodyPreview is the start of the response body with obvious secrets
+	// redacted, set when every line was discarded (e.g. a login page)
+	BodyPreview string
 }
 
 // Fetcher fetches SSH keys from remote sources
 type Fetcher struct {
-	client *http.Client
-	logger *slog.Logger
+	client     *http.Client
+	logger     *slog.Logger
+	negCache   *negativeCache
+	validators *validatorCache
+	parser     *keyparser.Parser
+	// cacheStore persists validators between processes, read once by
+	// loadCache
+	cacheStore CacheStore
+	cacheLoad  sync.Once
+	// negStore persists the negative cache between processes, read once by
+	// loadNegativeCache
+	negStore NegativeCacheStore
+	negLoad  sync.Once
+	// maxConcurrency limits the parallel fetches of FetchAll, 0 uses
+	// DefaultMaxConcurrency
+	maxConcurrency int
+	// sourceClients are the clients of sources with TLS options of their
+	// own, built by tlsClientFor
+	sourceClients   map[string]*http.Client
+	sourceClientsMu sync.Mutex
+	// s3Clients are the clients of s3 sources by region and endpoint, built
+	// by s3Client
+	s3Clients   map[string]any
+	s3ClientsMu sync.Mutex
 }
 
 // New creates a new Fetcher with the default HTTP client and a no-op logger
@@ -72,8 +142,231 @@ func NewWithClientAndLogger(client *http.Client, logger *slog.Logger) *Fetcher {
 	}
 }
 
+// SetNegativeCache enables caching of failures: after NegativeCacheThreshold
+// consecutive identical failures, a source is not requested again until ttl
+// has elapsed and its last failure is returned instead. A ttl <= 0 disables it.
+func (f *Fetcher) SetNegativeCache(ttl time.Duration) {
+	if ttl <= 0 {
+		f.negCache = nil
+		return
+	}
+	f.negCache = newNegativeCache(ttl)
+}
+
+// SetNegativeCacheStore keeps the failure streaks of the negative cache in
+// store, so a source failing once per run is skipped by later runs too. The
+// store is read on the first request, and written by SaveNegativeCache. It
+// has no effect without a negative cache.
+func (f *Fetcher) SetNegativeCacheStore(store NegativeCacheStore) {
+	f.negStore = store
+}
+
+// SaveNegativeCache writes the failure streaks of the sources requested by
+// this Fetcher to its negative cache store, dropping the others. It does
+// nothing without a negative cache store.
+func (f *Fetcher) SaveNegativeCache() error {
+	if f.negStore == nil || f.negCache == nil {
+		return nil
+	}
+	return f.negStore.Save(f.negCache.export())
+}
+
+// loadNegativeCache adds the failure streaks of the negative cache store to
+// the negative cache, once. A store that cannot be read only costs requests.
+func (f *Fetcher) loadNegativeCache() {
+	f.negLoad.Do(func() {
+		if f.negStore == nil {
+			return
+		}
+		entries, err := f.negStore.Load()
+		if err != nil {
+			f.logger.Warn("failed to load negative cache, requesting every source",
+				"error", err)
+			return
+		}
+		f.negCache.load(entries)
+	})
+}
+
+// SetConditionalRequests enables revalidation of sources with their ETag and
+// Last-Modified validators. A source answering 304 Not Modified is served
+// from its previous response. Paginated sources are always fully fetched.
+func (f *Fetcher) SetConditionalRequests(enabled bool) {
+	if !enabled {
+		f.validators = nil
+		return
+	}
+	if f.validators == nil {
+		f.validators = newValidatorCache()
+	}
+}
+
+// SetCacheStore keeps the responses of conditional requests in store, so
+// they outlive the process, and enables conditional requests. The store is
+// read on the first request, and written by SaveCache.
+func (f *Fetcher) SetCacheStore(store CacheStore) {
+	f.cacheStore = store
+	f.SetConditionalRequests(true)
+}
+
+// SaveCache writes the cached responses of the sources requested by this
+// Fetcher to its cache store, dropping the others. It does nothing without a
+// cache store.
+func (f *Fetcher) SaveCache() error {
+	if f.cacheStore == nil || f.validators == nil {
+		return nil
+	}
+	return f.cacheStore.Save(f.validators.export())
+}
+
+// loadCache adds the responses of the cache store to the validator cache,
+// once. A store that cannot be read only costs full fetches.
+func (f *Fetcher) loadCache() {
+	f.cacheLoad.Do(func() {
+		if f.cacheStore == nil {
+			return
+		}
+		validators, err := f.cacheStore.Load()
+		if err != nil {
+			f.logger.Warn("failed to load HTTP cache, fetching sources in full",
+				"error", err)
+			return
+		}
+		f.validators.load(validators)
+	})
+}
+
+// SetDiscardLinePrefixes makes the Fetcher also discard response lines
+// starting with any of prefixes, in addition to keyparser.DefaultDiscardPrefixes
+func (f *Fetcher) SetDiscardLinePrefixes(prefixes []string) {
+	f.parser = keyparser.NewParser(prefixes)
+}
+
+// SetMaxConcurrency sets how many sources FetchAll fetches at the same time.
+// A value <= 0 restores DefaultMaxConcurrency.
+func (f *Fetcher) SetMaxConcurrency(n int) {
+	f.maxConcurrency = n
+}
+
+// Validators returns the cached validators of the sources requested by this
+// Fetcher, keyed by a hash of the request, so they can be persisted and
+// passed to LoadValidators by a later process. Returns nil if conditional
+// requests are disabled.
+func (f *Fetcher) Validators() map[string]Validator {
+	if f.validators == nil {
+		return nil
+	}
+	return f.validators.export()
+}
+
+// LoadValidators adds validators returned by Validators to the cache.
+// It has no effect if conditional requests are disabled.
+func (f *Fetcher) LoadValidators(validators map[string]Validator) {
+	if f.validators == nil {
+		return
+	}
+	f.validators.load(validators)
+}
+
 // Fetch fetches keys from a single source
 func (f *Fetcher) Fetch(ctx context.Context, source config.Source) *FetchResult {
+	ctx, span := tracer.Start(ctx, "keyfetcher.Fetch")
+	defer span.End()
+
+	result, cached := f.fetchCached(ctx, source)
+	span.SetAttributes(attribute.Bool("negative_cache.hit", cached))
+
+	span.SetAttributes(
+		attribute.String("source.url", source.URL),
+		attribute.String("http.request.method", source.GetMethod()),
+		attribute.Int("http.response.status_code", result.StatusCode),
+		attribute.Int("keys.count", len(result.Keys)),
+		attribute.Int("keys.discarded_lines", result.DiscardedLines),
+		attribute.Int("pages.count", result.Pages),
+		attribute.Bool("not_modified", result.NotModified),
+	)
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		span.SetStatus(codes.Error, result.Error.Error())
+	}
+
+	return result
+}
+
+// fetchCached serves recent failures from the negative cache when enabled,
+// otherwise it performs the request and records its outcome
+func (f *Fetcher) fetchCached(ctx context.Context, source config.Source) (*FetchResult, bool) {
+	if f.negCache == nil {
+		return f.fetchWithRetries(ctx, source), false
+	}
+
+	f.loadNegativeCache()
+	if result, ok := f.negCache.lookup(source); ok {
+		f.logger.Warn("skipping source due to recent failures",
+			"url", source.URL,
+			"error", result.Error)
+		return result, true
+	}
+
+	result := f.fetchWithRetries(ctx, source)
+
+	// A cancelled run says nothing about the health of the source
+	if ctx.Err() == nil {
+		f.negCache.record(result)
+	}
+
+	return result, false
+}
+
+// fetchWithRetries fetches a source, retrying network errors and 5xx
+// responses up to the retries of the source. The delay starts at its retry
+// backoff and doubles after each attempt. Cancelling ctx stops the retries
+// immediately.
+func (f *Fetcher) fetchWithRetries(ctx context.Context, source config.Source) *FetchResult {
+	delay := source.GetRetryBackoff()
+	for attempt := 1; ; attempt++ {
+		result := f.fetch(ctx, source)
+		result.Attempts = attempt
+		if result.Error == nil || attempt > source.GetRetries() || !isTransient(result) {
+			return result
+		}
+
+		f.logger.Debug("retrying source after transient failure",
+			"url", source.URL,
+			"attempt", attempt+1,
+			"delay", delay.String(),
+			"error", result.Error)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// isTransient reports whether a failed fetch may succeed when retried: no
+// response was received, or the server answered with a 5xx status
+func isTransient(result *FetchResult) bool {
+	return errors.Is(result.Error, ErrRequestFailed) || result.StatusCode >= 500
+}
+
+// fetch performs the request for a single source, following pagination
+// links when the source enables it. The timeout covers all pages.
+func (f *Fetcher) fetch(ctx context.Context, source config.Source) *FetchResult {
+	if source.IsGitHubTeam() {
+		return f.fetchGitHubTeam(ctx, source)
+	}
+	if source.IsS3() {
+		return f.fetchS3(ctx, source)
+	}
+	if source.IsFile() {
+		return f.fetchFile(source)
+	}
+
 	result := &FetchResult{
 		Source: source,
 	}
@@ -83,93 +376,347 @@ func (f *Fetcher) Fetch(ctx context.Context, source config.Source) *FetchResult
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	// Build request
-	var bodyReader io.Reader
-	if source.Body != "" {
-		bodyReader = strings.NewReader(source.Body)
+	var body []byte
+	pageURL := source.URL
+	for {
+		page, err := f.fetchPage(ctx, source, pageURL, MaxResponseSize-int64(len(body)))
+		result.Pages++
+		result.StatusCode = 0
+		if page != nil {
+			result.StatusCode = page.statusCode
+			result.FetchedAt = page.fetchedAt
+			result.NotModified = page.notModified
+		}
+		if err != nil {
+			if result.Pages > 1 {
+				err = fmt.Errorf("page %d: %w", result.Pages, err)
+			}
+			result.Error = err
+			return result
+		}
+
+		body = append(body, page.body...)
+		if !source.Paginate || page.next == "" || source.GetMethod() == http.MethodHead {
+			break
+		}
+
+		if result.Pages >= MaxPages {
+			f.logger.Warn("pagination page limit reached, ignoring remaining pages",
+				"url", source.URL,
+				"pages", result.Pages)
+			break
+		}
+		if int64(len(body)) >= MaxResponseSize {
+			f.logger.Warn("pagination size limit reached, ignoring remaining pages",
+				"url", source.URL,
+				"pages", result.Pages,
+				"max_bytes", MaxResponseSize)
+			break
+		}
+
+		next, err := resolveNextURL(source.URL, pageURL, page.next)
+		if err != nil {
+			result.Error = err
+			return result
+		}
+		pageURL = next
+
+		// Make sure pages never run together on one line
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			body = append(body, '\n')
+		}
+	}
+
+	f.parseKeys(result, body)
+	return result
+}
+
+// fetchFile reads the keys of a file source from disk, reading at most
+// MaxResponseSize bytes like an HTTP response
+func (f *Fetcher) fetchFile(source config.Source) *FetchResult {
+	result := &FetchResult{
+		Source: source,
+		Pages:  1,
 	}
 
-	req, err := http.NewRequestWithContext(ctx, source.GetMethod(), source.URL, bodyReader)
+	path := source.FilePath()
+	f.logger.Debug("reading source file",
+		"path", path)
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		result.Error = fmt.Errorf("%w: %s", ErrFileNotFound, path)
+		return result
+	}
 	if err != nil {
-		result.Error = fmt.Errorf("failed to create request: %w", err)
+		result.Error = fmt.Errorf("failed to open source file: %w", err)
 		return result
 	}
+	defer func() { _ = file.Close() }()
 
-	// Set default User-Agent if not provided
-	hasUserAgent := false
-	for key := range source.Headers {
-		if strings.EqualFold(key, "User-Agent") {
-			hasUserAgent = true
-			break
+	body, err := io.ReadAll(io.LimitReader(file, MaxResponseSize))
+	if err != nil {
+		result.Error = fmt.Errorf("failed to read source file: %w", err)
+		return result
+	}
+	result.FetchedAt = time.Now()
+
+	f.parseKeys(result, body)
+	return result
+}
+
+// parseKeys parses the keys of a fetched body into result, setting
+// result.Error if the keys cannot be used
+func (f *Fetcher) parseKeys(result *FetchResult, body []byte) {
+	source := result.Source
+	parser := f.parser
+	if parser == nil {
+		parser = keyparser.NewParser(nil)
+	}
+	parseResult, err := parser.ParseString(string(body))
+	if err != nil {
+		result.Error = fmt.Errorf("failed to parse keys: %w", err)
+		return
+	}
+
+	result.Keys = parseResult.Keys
+	result.DiscardedLines = parseResult.DiscardedLines
+	if source.AsCertAuthority {
+		if err := toCertAuthorities(result.Keys, source); err != nil {
+			result.Keys = nil
+			result.Error = err
+			return
 		}
 	}
-	if !hasUserAgent {
-		req.Header.Set("User-Agent", version.UserAgent())
+	if len(result.Keys) == 0 && result.DiscardedLines > 0 {
+		result.BodyPreview = bodyPreview(body)
+	}
+}
+
+// toCertAuthorities rewrites the keys of an as_cert_authority source in place
+// as cert-authority entries with the principals and expiry time of the source
+func toCertAuthorities(keys []keyparser.ParsedKey, source config.Source) error {
+	for i, key := range keys {
+		line, err := keyparser.CertAuthorityLine(key.Line, source.Principals, source.ExpiryTime)
+		if err != nil {
+			return fmt.Errorf("line %d is not a certificate authority key: %w", key.LineNumber, err)
+		}
+		keys[i].Line = line
+		keys[i].Raw = line
+	}
+	return nil
+}
+
+// RequestHeaders returns the headers sent for a source: its custom headers
+// plus a default User-Agent if the source does not set one
+func RequestHeaders(source config.Source) http.Header {
+	headers := make(http.Header)
+
+	// Set default User-Agent if not provided
+	if !source.HasHeader("User-Agent") {
+		headers.Set("User-Agent", version.UserAgent())
 	}
 
 	// Set custom headers
 	for key, value := range source.Headers {
-		req.Header.Set(key, value)
+		headers.Set(key, value)
+	}
+
+	return headers
+}
+
+// pageResponse is the response of a single page request
+type pageResponse struct {
+	statusCode int
+	fetchedAt  time.Time
+	body       []byte
+	// next is the raw rel="next" link target, empty if none
+	next string
+	// notModified is true if body was reused from a 304 Not Modified response
+	notModified bool
+}
+
+// fetchPage requests a single page of a source, reading at most limit bytes.
+// The returned page is non-nil whenever a response was received.
+func (f *Fetcher) fetchPage(ctx context.Context, source config.Source, pageURL string, limit int64) (*pageResponse, error) {
+	// HEAD requests only check reachability, there is no body to send or parse
+	isHead := source.GetMethod() == http.MethodHead
+
+	// Build request
+	var bodyReader io.Reader
+	if source.Body != "" && !isHead {
+		bodyReader = strings.NewReader(source.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, source.GetMethod(), pageURL, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header = RequestHeaders(source)
+	if err := setAuth(req, source); err != nil {
+		return nil, err
+	}
+
+	// Revalidate the previous response of non-paginated sources
+	conditional := f.validators != nil && !source.Paginate && !isHead
+	var cached *validatorEntry
+	if conditional {
+		f.loadCache()
+		if entry, ok := f.validators.lookup(source); ok {
+			cached = entry
+			setConditionalHeaders(req, entry)
+		}
 	}
 
 	// Log request details for debugging
 	f.logger.Debug("executing HTTP request",
-		"url", source.URL,
+		"url", pageURL,
 		"method", source.GetMethod(),
 		"user_agent", req.Header.Get("User-Agent"),
 		"timeout_seconds", source.GetTimeoutSeconds())
 
+	client, err := f.clientFor(source)
+	if err != nil {
+		return nil, err
+	}
+
 	// Execute request
-	resp, err := f.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		result.Error = fmt.Errorf("request failed: %w", err)
-		return result
+		return nil, requestError(err)
 	}
 	defer func() { _ = resp.Body.Close() }()
 
-	result.StatusCode = resp.StatusCode
+	page := &pageResponse{
+		statusCode: resp.StatusCode,
+		fetchedAt:  time.Now(),
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		f.logger.Debug("source not modified, reusing previous response",
+			"url", pageURL)
+		page.body = cached.body
+		page.notModified = true
+		return page, nil
+	}
 
 	// Check status code
 	if resp.StatusCode != http.StatusOK {
-		result.Error = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-		return result
+		return page, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	// Read response body with size limit
-	limitedReader := io.LimitReader(resp.Body, MaxResponseSize)
-	body, err := io.ReadAll(limitedReader)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to read response body: %w", err)
-		return result
+	// Fail fast on e.g. a login page instead of discarding every line of it
+	if contentType := resp.Header.Get("Content-Type"); !matchesContentType(contentType, source.ExpectContentType) {
+		return page, fmt.Errorf("%w %q (expected %s)", ErrUnexpectedContentType, contentType, source.ExpectContentType)
 	}
 
-	// Parse keys
-	parseResult, err := keyparser.ParseString(string(body))
+	var body io.Reader = resp.Body
+	if !isHead {
+		body, err = decodeBody(resp)
+		if err != nil {
+			return page, err
+		}
+	}
+
+	// Read response body with size limit, after decompression so that a
+	// small compressed body cannot expand without bound
+	limitedReader := io.LimitReader(body, limit)
+	page.body, err = io.ReadAll(limitedReader)
 	if err != nil {
-		result.Error = fmt.Errorf("failed to parse keys: %w", err)
-		return result
+		return page, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	result.Keys = parseResult.Keys
-	result.DiscardedLines = parseResult.DiscardedLines
+	// JSON APIs usually return a list of keys, fall back to line parsing otherwise
+	if !isHead && isJSONContentType(resp.Header.Get("Content-Type")) {
+		if lines, ok := extractJSONKeys(page.body); ok {
+			page.body = lines
+		} else {
+			f.logger.Debug("JSON response has no known key list shape, parsing as text",
+				"url", pageURL)
+		}
+	}
 
-	return result
+	if conditional {
+		f.validators.store(source, resp.Header, page.body)
+	}
+
+	page.next = parseNextLink(resp.Header.Values("Link"))
+
+	return page, nil
 }
 
-// FetchAll fetches keys from multiple sources for a user.
-// If any source fails, the function returns an error and stops processing.
+// FetchAll fetches keys from multiple sources for a user, up to
+// maxConcurrency at the same time. Results are returned in source order.
+// If a required source fails, no further fetches are started and, once every
+// fetch in flight has finished, the results up to the first failed required
+// source are returned with its error. A failed optional source is returned
+// with its Error set and does not stop the others, unless every source
+// fails. Cancelling ctx also stops starting fetches.
 func (f *Fetcher) FetchAll(ctx context.Context, sources []config.Source) ([]*FetchResult, error) {
+	concurrency := f.maxConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultMaxConcurrency
+	}
+
+	fetched := make([]*FetchResult, len(sources))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+
+	launched := 0
+launch:
+	for i, source := range sources {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			break launch
+		}
+		// A failure or cancellation while waiting for a slot stops the rest
+		if failed.Load() || ctx.Err() != nil {
+			<-slots
+			break
+		}
+
+		launched++
+		wg.Go(func() {
+			defer func() { <-slots }()
+			result := f.Fetch(ctx, source)
+			fetched[i] = result
+			if result.Error != nil && source.IsRequired() {
+				failed.Store(true)
+			}
+		})
+	}
+	wg.Wait()
+
 	results := make([]*FetchResult, 0, len(sources))
+	for _, result := range fetched {
+		if result != nil {
+			results = append(results, result)
+		}
+	}
 
-	for _, source := range sources {
-		result := f.Fetch(ctx, source)
-		results = append(results, result)
+	// If a required source fails, abort for this user
+	for i, result := range results {
+		if result.Error != nil && result.Source.IsRequired() {
+			return results[:i+1], fmt.Errorf("source %s failed: %w", result.Source.URL, result.Error)
+		}
+	}
+	if launched < len(sources) {
+		return results, fmt.Errorf("source %s not fetched: %w", sources[launched].URL, context.Cause(ctx))
+	}
 
-		// If any source fails, abort for this user
+	// Optional sources may fail, but not all of them
+	var errs []error
+	for _, result := range results {
 		if result.Error != nil {
-			return results, fmt.Errorf("source %s failed: %w", source.URL, result.Error)
+			errs = append(errs, fmt.Errorf("source %s failed: %w", result.Source.URL, result.Error))
 		}
 	}
+	if len(errs) > 0 && len(errs) == len(results) {
+		return results, fmt.Errorf("every source failed: %w", errors.Join(errs...))
+	}
 
 	return results, nil
 }
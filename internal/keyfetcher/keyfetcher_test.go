@@ -1,10 +1,29 @@
 package keyfetcher
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,6 +31,10 @@ import (
 	"github.com/eduardolat/authkeysync/internal/version"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestFetch_Success(t *testing.T) {
@@ -186,6 +209,112 @@ func TestFetch_Timeout(t *testing.T) {
 	assert.Contains(t, result.Error.Error(), "context deadline exceeded")
 }
 
+func TestFetch_Retries(t *testing.T) {
+	failures := 2
+	status := http.StatusServiceUnavailable
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host"))
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	retries, backoff := 2, 1
+	source := config.Source{URL: server.URL, Retries: &retries, RetryBackoffMs: &backoff}
+
+	result := fetcher.Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	assert.Equal(t, 3, result.Attempts)
+	assert.Len(t, result.Keys, 1)
+
+	// Out of retries
+	requests, failures = 0, 3
+	result = fetcher.Fetch(context.Background(), source)
+	require.Error(t, result.Error)
+	assert.Equal(t, 3, result.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, result.StatusCode)
+
+	// Client errors are never retried
+	requests, status = 0, http.StatusNotFound
+	result = fetcher.Fetch(context.Background(), source)
+	require.Error(t, result.Error)
+	assert.Equal(t, 1, result.Attempts)
+	assert.Equal(t, 1, requests)
+
+	// No retries by default
+	requests, status = 0, http.StatusBadGateway
+	result = fetcher.Fetch(context.Background(), config.Source{URL: server.URL})
+	require.Error(t, result.Error)
+	assert.Equal(t, 1, result.Attempts)
+}
+
+func TestFetch_FileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.keys")
+	content := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host\nnot a key\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	fetcher := New()
+	for _, url := range []string{"file://" + path, path} {
+		result := fetcher.Fetch(context.Background(), config.Source{URL: url})
+		require.NoError(t, result.Error, url)
+		require.Len(t, result.Keys, 1)
+		assert.Equal(t, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host", result.Keys[0].Line)
+		assert.Equal(t, 1, result.DiscardedLines)
+		assert.Equal(t, 0, result.StatusCode)
+		assert.False(t, result.FetchedAt.IsZero())
+	}
+
+	// A missing file is reported like a 404 and never retried
+	retries, backoff := 2, 1
+	result := fetcher.Fetch(context.Background(), config.Source{URL: path + ".missing", Retries: &retries, RetryBackoffMs: &backoff})
+	require.ErrorIs(t, result.Error, ErrFileNotFound)
+	assert.Equal(t, 1, result.Attempts)
+
+	// Files are read up to MaxResponseSize like response bodies
+	large := filepath.Join(t.TempDir(), "large.keys")
+	line := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host\n"
+	require.NoError(t, os.WriteFile(large, []byte(strings.Repeat(line, MaxResponseSize/len(line)+10)), 0o644))
+	result = fetcher.Fetch(context.Background(), config.Source{URL: large})
+	require.NoError(t, result.Error)
+	assert.LessOrEqual(t, len(result.Keys), MaxResponseSize/len(line))
+}
+
+func TestFetch_RetriesNetworkError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	fetcher := New()
+	retries, backoff := 1, 1
+	result := fetcher.Fetch(context.Background(), config.Source{URL: server.URL, Retries: &retries, RetryBackoffMs: &backoff})
+
+	require.ErrorIs(t, result.Error, ErrRequestFailed)
+	assert.Equal(t, 2, result.Attempts)
+}
+
+func TestFetch_RetriesCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	fetcher := New()
+	retries, backoff := 5, int(time.Hour/time.Millisecond)
+	start := time.Now()
+	result := fetcher.Fetch(ctx, config.Source{URL: server.URL, Retries: &retries, RetryBackoffMs: &backoff})
+
+	require.Error(t, result.Error)
+	assert.Equal(t, 1, result.Attempts)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
 func TestFetch_InvalidURL(t *testing.T) {
 	fetcher := New()
 	source := config.Source{
@@ -214,6 +343,58 @@ func TestFetch_HTMLErrorPage(t *testing.T) {
 	assert.Greater(t, result.DiscardedLines, 0)
 }
 
+func TestFetch_DiscardLinePrefixes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host\nrestrict ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit tmp@host\n"))
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	source := config.Source{URL: server.URL}
+
+	result := fetcher.Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	assert.Len(t, result.Keys, 2)
+
+	fetcher.SetDiscardLinePrefixes([]string{"restrict"})
+	result = fetcher.Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	require.Len(t, result.Keys, 1)
+	assert.Equal(t, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host", result.Keys[0].Line)
+	assert.Equal(t, 1, result.DiscardedLines)
+}
+
+func TestFetch_AsCertAuthority(t *testing.T) {
+	caKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW ca@example"
+	body := caKey
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	source := config.Source{
+		URL:             server.URL,
+		AsCertAuthority: true,
+		Principals:      []string{"alice"},
+	}
+
+	result := fetcher.Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	require.Len(t, result.Keys, 1)
+	assert.Equal(t, `cert-authority,principals="alice" `+caKey, result.Keys[0].Line)
+	assert.Equal(t, result.Keys[0].Line, result.Keys[0].Raw)
+
+	// Keys with options cannot become certificate authorities
+	body = "restrict " + caKey
+	result = fetcher.Fetch(context.Background(), source)
+	require.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), "line 1 is not a certificate authority key")
+	assert.Empty(t, result.Keys)
+}
+
 func TestFetchAll_AllSuccess(t *testing.T) {
 	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -262,11 +443,105 @@ func TestFetchAll_FirstSourceFails(t *testing.T) {
 	results, err := fetcher.FetchAll(context.Background(), sources)
 
 	require.Error(t, err)
-	// Should have only tried the first source before failing
+	// Results end at the first failed source
 	require.Len(t, results, 1)
 	assert.Error(t, results[0].Error)
 }
 
+func TestFetchAll_OptionalSources(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key"))
+	}))
+	defer working.Close()
+
+	fetcher := New()
+	optional := false
+
+	// A failed optional source is returned with its error
+	results, err := fetcher.FetchAll(context.Background(), []config.Source{
+		{URL: failing.URL, Required: &optional},
+		{URL: working.URL},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Error(t, results[0].Error)
+	assert.NoError(t, results[1].Error)
+	assert.Len(t, results[1].Keys, 1)
+
+	// A failed required source still aborts
+	_, err = fetcher.FetchAll(context.Background(), []config.Source{
+		{URL: working.URL, Required: &optional},
+		{URL: failing.URL},
+	})
+	require.Error(t, err)
+
+	// So does the failure of every source
+	_, err = fetcher.FetchAll(context.Background(), []config.Source{
+		{URL: failing.URL, Required: &optional},
+		{URL: failing.URL + "/other", Required: &optional},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "every source failed")
+}
+
+func TestFetchAll_Concurrency(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			peak := maxInFlight.Load()
+			if n <= peak || maxInFlight.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA " + strings.TrimPrefix(r.URL.Path, "/")))
+	}))
+	defer server.Close()
+
+	var sources []config.Source
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		sources = append(sources, config.Source{URL: server.URL + "/" + name})
+	}
+
+	fetcher := New()
+	fetcher.SetMaxConcurrency(2)
+	results, err := fetcher.FetchAll(context.Background(), sources)
+	require.NoError(t, err)
+
+	// Results keep the source order
+	require.Len(t, results, len(sources))
+	for i, result := range results {
+		assert.Equal(t, sources[i].URL, result.Source.URL)
+		require.Len(t, result.Keys, 1)
+		assert.True(t, strings.HasSuffix(result.Keys[0].Line, strings.TrimPrefix(sources[i].URL, server.URL+"/")))
+	}
+	assert.Equal(t, int32(2), maxInFlight.Load())
+}
+
+func TestFetchAll_Cancelled(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fetcher := New()
+	results, err := fetcher.FetchAll(ctx, []config.Source{{URL: server.URL}, {URL: server.URL}})
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, results)
+	assert.Zero(t, requests)
+}
+
 func TestFetchAll_SecondSourceFails(t *testing.T) {
 	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -361,3 +636,898 @@ func TestFetch_JSONErrorResponse(t *testing.T) {
 	assert.Len(t, result.Keys, 0)
 	assert.Equal(t, 1, result.DiscardedLines)
 }
+
+func TestFetch_RecordsSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key1\nssh-ed25519 BBBB key2"))
+	}))
+	defer server.Close()
+
+	result := New().Fetch(context.Background(), config.Source{URL: server.URL})
+	require.NoError(t, result.Error)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "keyfetcher.Fetch", spans[0].Name())
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range spans[0].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, server.URL, attrs["source.url"].AsString())
+	assert.Equal(t, int64(http.StatusOK), attrs["http.response.status_code"].AsInt64())
+	assert.Equal(t, int64(2), attrs["keys.count"].AsInt64())
+}
+
+func TestFetch_NegativeCache(t *testing.T) {
+	var requests int
+	status := http.StatusNotFound
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host"))
+		}
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	fetcher := New()
+	fetcher.SetNegativeCache(time.Minute)
+	fetcher.negCache.timeNow = func() time.Time { return now }
+	source := config.Source{URL: server.URL}
+
+	// Failures below the threshold are always requested
+	for range NegativeCacheThreshold {
+		result := fetcher.Fetch(context.Background(), source)
+		require.Error(t, result.Error)
+		assert.NotErrorIs(t, result.Error, ErrRecentlyFailed)
+	}
+	assert.Equal(t, NegativeCacheThreshold, requests)
+
+	// Within the cooldown the failure is served from cache
+	result := fetcher.Fetch(context.Background(), source)
+	require.ErrorIs(t, result.Error, ErrRecentlyFailed)
+	assert.Contains(t, result.Error.Error(), "unexpected status code: 404")
+	assert.Equal(t, http.StatusNotFound, result.StatusCode)
+	assert.Equal(t, NegativeCacheThreshold, requests)
+
+	// After the cooldown the source is re-checked and recovery clears the cache
+	now = now.Add(time.Minute)
+	status = http.StatusOK
+	result = fetcher.Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	assert.Equal(t, NegativeCacheThreshold+1, requests)
+
+	status = http.StatusNotFound
+	result = fetcher.Fetch(context.Background(), source)
+	require.Error(t, result.Error)
+	assert.NotErrorIs(t, result.Error, ErrRecentlyFailed)
+}
+
+func TestFetch_NegativeCacheDifferentFailuresRestartStreak(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests%2 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	fetcher.SetNegativeCache(time.Hour)
+	source := config.Source{URL: server.URL}
+
+	for range NegativeCacheThreshold * 2 {
+		result := fetcher.Fetch(context.Background(), source)
+		require.Error(t, result.Error)
+		assert.NotErrorIs(t, result.Error, ErrRecentlyFailed)
+	}
+	assert.Equal(t, NegativeCacheThreshold*2, requests)
+}
+
+func TestFetch_Pagination(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", `</keys?page=2>; rel="next"`)
+			_, _ = w.Write([]byte("ssh-ed25519 AAAA one@host"))
+		case "2":
+			w.Header().Set("Link", `<`+server.URL+`/keys?page=1>; rel="prev", <`+server.URL+`/keys?page=3>; rel="next"`)
+			_, _ = w.Write([]byte("ssh-ed25519 BBBB two@host\ninvalid\n"))
+		case "3":
+			_, _ = w.Write([]byte("ssh-ed25519 CCCC three@host\n"))
+		}
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	source := config.Source{
+		URL:      server.URL + "/keys",
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+		Paginate: true,
+	}
+
+	result := fetcher.Fetch(context.Background(), source)
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, 3, result.Pages)
+	assert.Equal(t, 1, result.DiscardedLines)
+	require.Len(t, result.Keys, 3)
+	assert.Equal(t, "ssh-ed25519 AAAA one@host", result.Keys[0].Line)
+	assert.Equal(t, "ssh-ed25519 BBBB two@host", result.Keys[1].Line)
+	assert.Equal(t, "ssh-ed25519 CCCC three@host", result.Keys[2].Line)
+}
+
+func TestFetch_PaginationDisabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</keys?page=2>; rel="next"`)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA " + r.URL.Query().Get("page") + "@host"))
+	}))
+	defer server.Close()
+
+	result := New().Fetch(context.Background(), config.Source{URL: server.URL})
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, 1, result.Pages)
+	require.Len(t, result.Keys, 1)
+}
+
+func TestFetch_PaginationPageLimit(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Link", `</keys?page=next>; rel="next"`)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA loop@host\n"))
+	}))
+	defer server.Close()
+
+	result := New().Fetch(context.Background(), config.Source{URL: server.URL, Paginate: true})
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, MaxPages, requests)
+	assert.Equal(t, MaxPages, result.Pages)
+}
+
+func TestFetch_PaginationFailingPage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Link", `</keys?page=2>; rel="next"`)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA one@host\n"))
+	}))
+	defer server.Close()
+
+	result := New().Fetch(context.Background(), config.Source{URL: server.URL, Paginate: true})
+
+	require.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), "page 2: unexpected status code: 500")
+	assert.Equal(t, http.StatusInternalServerError, result.StatusCode)
+	assert.Empty(t, result.Keys)
+}
+
+func TestRequestHeaders(t *testing.T) {
+	headers := RequestHeaders(config.Source{
+		Headers: map[string]string{"authorization": "Bearer token"},
+	})
+	assert.Equal(t, "Bearer token", headers.Get("Authorization"))
+	assert.Equal(t, version.UserAgent(), headers.Get("User-Agent"))
+
+	headers = RequestHeaders(config.Source{
+		Headers: map[string]string{"user-agent": "custom/1.0"},
+	})
+	assert.Equal(t, "custom/1.0", headers.Get("User-Agent"))
+	assert.Len(t, headers, 1)
+}
+
+func TestFetch_BasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "deploy" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host"))
+	}))
+	defer server.Close()
+
+	t.Run("password from env", func(t *testing.T) {
+		t.Setenv("AUTHKEYSYNC_TEST_PASSWORD", "s3cret")
+		result := New().Fetch(context.Background(), config.Source{
+			URL:                  server.URL,
+			BasicAuthUser:        "deploy",
+			BasicAuthPasswordEnv: "AUTHKEYSYNC_TEST_PASSWORD",
+		})
+		require.NoError(t, result.Error)
+		assert.Len(t, result.Keys, 1)
+	})
+
+	t.Run("password from file", func(t *testing.T) {
+		passwordFile := filepath.Join(t.TempDir(), "password")
+		require.NoError(t, os.WriteFile(passwordFile, []byte("s3cret\n"), 0600))
+		result := New().Fetch(context.Background(), config.Source{
+			URL:                   server.URL,
+			BasicAuthUser:         "deploy",
+			BasicAuthPasswordFile: passwordFile,
+		})
+		require.NoError(t, result.Error)
+		assert.Len(t, result.Keys, 1)
+	})
+
+	t.Run("missing env variable", func(t *testing.T) {
+		result := New().Fetch(context.Background(), config.Source{
+			URL:                  server.URL,
+			BasicAuthUser:        "deploy",
+			BasicAuthPasswordEnv: "AUTHKEYSYNC_TEST_MISSING_PASSWORD",
+		})
+		require.Error(t, result.Error)
+		assert.Contains(t, result.Error.Error(), "is not set")
+		assert.Equal(t, 0, result.StatusCode)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		result := New().Fetch(context.Background(), config.Source{
+			URL:                   server.URL,
+			BasicAuthUser:         "deploy",
+			BasicAuthPasswordFile: filepath.Join(t.TempDir(), "missing"),
+		})
+		require.Error(t, result.Error)
+		assert.Contains(t, result.Error.Error(), "failed to read basic auth password file")
+	})
+}
+
+func TestFetch_BearerTokenFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA " + strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ") + "@host"))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	source := config.Source{URL: server.URL, BearerTokenFile: tokenFile}
+
+	t.Run("token is read for every request", func(t *testing.T) {
+		fetcher := New()
+		for _, token := range []string{"first", "rotated"} {
+			require.NoError(t, os.WriteFile(tokenFile, []byte(token+"\n"), 0600))
+			result := fetcher.Fetch(context.Background(), source)
+			require.NoError(t, result.Error)
+			require.Len(t, result.Keys, 1)
+			assert.Equal(t, "ssh-ed25519 AAAA "+token+"@host", result.Keys[0].Line)
+		}
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(tokenFile, []byte("\n"), 0600))
+		result := New().Fetch(context.Background(), source)
+		require.Error(t, result.Error)
+		assert.Contains(t, result.Error.Error(), "is empty")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		result := New().Fetch(context.Background(), config.Source{
+			URL:             server.URL,
+			BearerTokenFile: filepath.Join(t.TempDir(), "missing"),
+		})
+		require.Error(t, result.Error)
+		assert.Contains(t, result.Error.Error(), "failed to read bearer token file")
+		assert.Equal(t, 0, result.StatusCode)
+	})
+}
+
+func TestFetch_JSONContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		keys        []string
+		discarded   int
+	}{
+		{
+			name:        "array of strings",
+			contentType: "application/json",
+			body:        `["ssh-ed25519 AAAA a@host", "ssh-rsa BBBB b@host"]`,
+			keys:        []string{"ssh-ed25519 AAAA a@host", "ssh-rsa BBBB b@host"},
+		},
+		{
+			name:        "github shape",
+			contentType: "application/json; charset=utf-8",
+			body:        `[{"id": 1, "key": "ssh-ed25519 AAAA"}, {"id": 2, "key": "ssh-rsa BBBB"}]`,
+			keys:        []string{"ssh-ed25519 AAAA", "ssh-rsa BBBB"},
+		},
+		{
+			name:        "vendor json type",
+			contentType: "application/vnd.api+json",
+			body:        `[{"key": "ssh-ed25519 AAAA a@host", "title": "laptop"}]`,
+			keys:        []string{"ssh-ed25519 AAAA a@host"},
+		},
+		{
+			name:        "empty array",
+			contentType: "application/json",
+			body:        `[]`,
+		},
+		{
+			name:        "unknown shape falls back to text",
+			contentType: "application/json",
+			body:        `{"keys": ["ssh-ed25519 AAAA a@host"]}`,
+			discarded:   1,
+		},
+		{
+			name:        "multi-line key falls back to text",
+			contentType: "application/json",
+			body:        `["ssh-ed25519 AAAA a@host\nssh-rsa BBBB injected@host"]`,
+			discarded:   1,
+		},
+		{
+			name:        "plain text is never parsed as JSON",
+			contentType: "text/plain",
+			body:        "[\"ssh-ed25519 AAAA a@host\"]\nssh-rsa BBBB b@host",
+			keys:        []string{"ssh-rsa BBBB b@host"},
+			discarded:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			result := New().Fetch(context.Background(), config.Source{URL: server.URL})
+
+			require.NoError(t, result.Error)
+			keys := make([]string, 0, len(result.Keys))
+			for _, key := range result.Keys {
+				keys = append(keys, key.Line)
+			}
+			assert.ElementsMatch(t, tt.keys, keys)
+			assert.Equal(t, tt.discarded, result.DiscardedLines)
+		})
+	}
+}
+
+func TestFetch_ExpectContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		expected    string
+		wantErr     bool
+	}{
+		{name: "not set", contentType: "text/html", expected: ""},
+		{name: "exact match", contentType: "text/plain", expected: "text/plain"},
+		{name: "with parameters", contentType: "text/plain; charset=utf-8", expected: "text/plain"},
+		{name: "case-insensitive", contentType: "Text/Plain", expected: "text/plain"},
+		{name: "prefix", contentType: "application/vnd.keys+json", expected: "application/"},
+		{name: "login page", contentType: "text/html; charset=utf-8", expected: "text/plain", wantErr: true},
+		{name: "missing", contentType: "", expected: "text/plain", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = []string{tt.contentType}
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host\n"))
+			}))
+			defer server.Close()
+
+			result := New().Fetch(context.Background(), config.Source{URL: server.URL, ExpectContentType: tt.expected})
+
+			if tt.wantErr {
+				require.ErrorIs(t, result.Error, ErrUnexpectedContentType)
+				assert.ErrorContains(t, result.Error, "expected text/plain")
+				assert.Equal(t, http.StatusOK, result.StatusCode)
+				assert.Empty(t, result.Keys)
+				return
+			}
+			require.NoError(t, result.Error)
+			assert.Len(t, result.Keys, 1)
+		})
+	}
+}
+
+func TestFetch_ContentEncoding(t *testing.T) {
+	const keys = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host\nssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQ another@host\n"
+
+	compress := func(t *testing.T, newWriter func(io.Writer) io.WriteCloser, content string) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		_, err := io.WriteString(w, content)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+	gzipWriter := func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	zlibWriter := func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }
+	flateWriter := func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		keys     int
+		wantErr  string
+	}{
+		{name: "gzip", encoding: "gzip", body: compress(t, gzipWriter, keys), keys: 2},
+		{name: "x-gzip", encoding: "x-gzip", body: compress(t, gzipWriter, keys), keys: 2},
+		{name: "zlib deflate", encoding: "deflate", body: compress(t, zlibWriter, keys), keys: 2},
+		{name: "raw deflate", encoding: "deflate", body: compress(t, flateWriter, keys), keys: 2},
+		{name: "gzip then deflate", encoding: "gzip, deflate", body: compress(t, zlibWriter, string(compress(t, gzipWriter, keys))), keys: 2},
+		{name: "identity", encoding: "identity", body: []byte(keys), keys: 2},
+		{name: "empty gzip body", encoding: "gzip"},
+		{name: "invalid gzip body", encoding: "gzip", body: []byte(keys), wantErr: "failed to decode gzip response"},
+		{name: "unsupported encoding", encoding: "br", body: []byte(keys), wantErr: `unsupported Content-Encoding "br"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(tt.body)
+			}))
+			defer server.Close()
+
+			// Setting Accept-Encoding stops the transport from decompressing
+			source := config.Source{URL: server.URL, Headers: map[string]string{"Accept-Encoding": "gzip, deflate"}}
+			result := New().Fetch(context.Background(), source)
+
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, result.Error, tt.wantErr)
+				return
+			}
+			require.NoError(t, result.Error)
+			assert.Len(t, result.Keys, tt.keys)
+			assert.Equal(t, 0, result.DiscardedLines)
+		})
+	}
+
+	t.Run("size limit applies to the decompressed body", func(t *testing.T) {
+		// A few KB of gzip expanding past MaxResponseSize, with a key after
+		// the limit
+		body := compress(t, gzipWriter, strings.Repeat("\n", MaxResponseSize+1)+keys)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(body)
+		}))
+		defer server.Close()
+
+		source := config.Source{URL: server.URL, Headers: map[string]string{"Accept-Encoding": "gzip"}}
+		result := New().Fetch(context.Background(), source)
+
+		require.NoError(t, result.Error)
+		assert.Less(t, len(body), 100*1024)
+		assert.Empty(t, result.Keys)
+	})
+}
+
+func TestFetch_ConditionalRequests(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA user@host"))
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	fetcher.SetConditionalRequests(true)
+	source := config.Source{URL: server.URL}
+
+	first := fetcher.Fetch(context.Background(), source)
+	require.NoError(t, first.Error)
+	assert.False(t, first.NotModified)
+
+	second := fetcher.Fetch(context.Background(), source)
+	require.NoError(t, second.Error)
+	assert.True(t, second.NotModified)
+	assert.Equal(t, http.StatusNotModified, second.StatusCode)
+	assert.Equal(t, first.Keys, second.Keys)
+	assert.Equal(t, 2, requests)
+
+	// Without conditional requests no validators are sent
+	third := New().Fetch(context.Background(), source)
+	require.NoError(t, third.Error)
+	assert.False(t, third.NotModified)
+}
+
+func TestFetcher_PersistValidators(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") == "Mon, 15 Jan 2024 10:00:00 GMT" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", "Mon, 15 Jan 2024 10:00:00 GMT")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA user@host"))
+	}))
+	defer server.Close()
+
+	source := config.Source{URL: server.URL, Body: "token=secret"}
+
+	first := New()
+	first.SetConditionalRequests(true)
+	require.NoError(t, first.Fetch(context.Background(), source).Error)
+
+	validators := first.Validators()
+	require.Len(t, validators, 1)
+	for key, v := range validators {
+		assert.NotContains(t, key, "secret")
+		assert.Equal(t, "Mon, 15 Jan 2024 10:00:00 GMT", v.LastModified)
+	}
+
+	// A new process revalidates with the persisted validators
+	second := New()
+	second.SetConditionalRequests(true)
+	second.LoadValidators(validators)
+	result := second.Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	assert.True(t, result.NotModified)
+	require.Len(t, result.Keys, 1)
+	assert.Equal(t, "ssh-ed25519 AAAA user@host", result.Keys[0].Line)
+
+	// Loaded but unused validators are not exported again
+	third := New()
+	third.SetConditionalRequests(true)
+	third.LoadValidators(validators)
+	assert.Empty(t, third.Validators())
+}
+
+func TestFetcher_CacheStore(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA user@host"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cache", "http_cache.json")
+	source := config.Source{URL: server.URL}
+
+	// A missing cache file is an empty cache
+	first := New()
+	first.SetCacheStore(NewFileCacheStore(path))
+	result := first.Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	assert.False(t, result.NotModified)
+	require.NoError(t, first.SaveCache())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// A new process revalidates from the cache file
+	second := New()
+	second.SetCacheStore(NewFileCacheStore(path))
+	result = second.Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	assert.True(t, result.NotModified)
+	require.Len(t, result.Keys, 1)
+	assert.Equal(t, "ssh-ed25519 AAAA user@host", result.Keys[0].Line)
+	assert.Equal(t, 2, requests)
+
+	// A corrupt cache file falls back to a full fetch
+	require.NoError(t, os.WriteFile(path, []byte("{not json"), 0600))
+	third := New()
+	third.SetCacheStore(NewFileCacheStore(path))
+	result = third.Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	assert.False(t, result.NotModified)
+	require.Len(t, result.Keys, 1)
+
+	// The next save replaces the corrupt file
+	require.NoError(t, third.SaveCache())
+	validators, err := NewFileCacheStore(path).Load()
+	require.NoError(t, err)
+	assert.Len(t, validators, 1)
+
+	// Without a cache store there is nothing to save
+	assert.NoError(t, New().SaveCache())
+}
+
+func TestFetcher_NegativeCacheStore(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cache", "negative_cache.json")
+	source := config.Source{URL: server.URL}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	run := func() *FetchResult {
+		fetcher := New()
+		fetcher.SetNegativeCache(time.Hour)
+		fetcher.negCache.timeNow = func() time.Time { return now }
+		fetcher.SetNegativeCacheStore(NewFileNegativeCacheStore(path))
+		result := fetcher.Fetch(context.Background(), source)
+		require.NoError(t, fetcher.SaveNegativeCache())
+		return result
+	}
+
+	// One request per process still builds up the failure streak
+	for range NegativeCacheThreshold {
+		result := run()
+		require.Error(t, result.Error)
+		assert.NotErrorIs(t, result.Error, ErrRecentlyFailed)
+	}
+	assert.Equal(t, NegativeCacheThreshold, requests)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), server.URL)
+
+	result := run()
+	require.ErrorIs(t, result.Error, ErrRecentlyFailed)
+	assert.Equal(t, http.StatusNotFound, result.StatusCode)
+	assert.Equal(t, NegativeCacheThreshold, requests)
+
+	// After the cooldown the source is requested again
+	now = now.Add(time.Hour)
+	result = run()
+	require.Error(t, result.Error)
+	assert.NotErrorIs(t, result.Error, ErrRecentlyFailed)
+	assert.Equal(t, NegativeCacheThreshold+1, requests)
+
+	// A corrupt file only costs requests, and sources not requested are dropped
+	require.NoError(t, os.WriteFile(path, []byte("{not json"), 0600))
+	require.Error(t, run().Error)
+	fetcher := New()
+	fetcher.SetNegativeCache(time.Hour)
+	fetcher.SetNegativeCacheStore(NewFileNegativeCacheStore(path))
+	require.NoError(t, fetcher.SaveNegativeCache())
+	entries, err := NewFileNegativeCacheStore(path).Load()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestFetch_NotModifiedWithoutCachedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	fetcher.SetConditionalRequests(true)
+
+	result := fetcher.Fetch(context.Background(), config.Source{URL: server.URL})
+
+	require.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), "unexpected status code: 304")
+}
+
+func TestFetch_HEAD(t *testing.T) {
+	var method string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Link", `</keys?page=2>; rel="next"`)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	result := New().Fetch(context.Background(), config.Source{
+		URL:      server.URL,
+		Method:   "HEAD",
+		Body:     "ignored",
+		Paginate: true,
+	})
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, http.MethodHead, method)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, 1, result.Pages)
+	assert.Empty(t, result.Keys)
+	assert.Zero(t, result.DiscardedLines)
+}
+
+func TestNewTransport(t *testing.T) {
+	transport := NewTransport(2*time.Second, 3*time.Second)
+	assert.Equal(t, 3*time.Second, transport.TLSHandshakeTimeout)
+	assert.NotNil(t, transport.DialContext)
+
+	// Unset timeouts keep the defaults
+	transport = NewTransport(0, 0)
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+}
+
+func TestFetch_TLSHandshakeTimeout(t *testing.T) {
+	// The listener never accepts, so the TCP connection is established through
+	// the backlog but the TLS handshake never completes
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	client := &http.Client{Transport: NewTransport(time.Second, 200*time.Millisecond)}
+	fetcher := NewWithClient(client)
+
+	start := time.Now()
+	result := fetcher.Fetch(context.Background(), config.Source{
+		URL: "https://" + listener.Addr().String(),
+	})
+
+	require.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), "TLS handshake timeout")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// writeTestClientCert writes a self-signed client certificate and its key in
+// PEM format to dir, returning their paths
+func writeTestClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "authkeysync"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestFetch_SourceTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA " + r.TLS.PeerCertificates[0].Subject.CommonName + "@host"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644))
+	certFile, keyFile := writeTestClientCert(t, dir)
+
+	t.Run("ca file and client certificate", func(t *testing.T) {
+		result := New().Fetch(context.Background(), config.Source{
+			URL:            server.URL,
+			CAFile:         caFile,
+			ClientCertFile: certFile,
+			ClientKeyFile:  keyFile,
+		})
+		require.NoError(t, result.Error)
+		require.Len(t, result.Keys, 1)
+		assert.Equal(t, "ssh-ed25519 AAAA authkeysync@host", result.Keys[0].Line)
+	})
+
+	t.Run("insecure skip verify", func(t *testing.T) {
+		result := New().Fetch(context.Background(), config.Source{
+			URL:                server.URL,
+			InsecureSkipVerify: true,
+			ClientCertFile:     certFile,
+			ClientKeyFile:      keyFile,
+		})
+		require.NoError(t, result.Error)
+	})
+
+	t.Run("untrusted server", func(t *testing.T) {
+		result := New().Fetch(context.Background(), config.Source{
+			URL:            server.URL,
+			ClientCertFile: certFile,
+			ClientKeyFile:  keyFile,
+		})
+		require.Error(t, result.Error)
+		assert.Contains(t, result.Error.Error(), "certificate")
+	})
+
+	t.Run("settings of other sources are not shared", func(t *testing.T) {
+		fetcher := New()
+		result := fetcher.Fetch(context.Background(), config.Source{URL: server.URL, CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile})
+		require.NoError(t, result.Error)
+
+		result = fetcher.Fetch(context.Background(), config.Source{URL: server.URL})
+		require.Error(t, result.Error)
+	})
+
+	t.Run("missing ca file", func(t *testing.T) {
+		result := New().Fetch(context.Background(), config.Source{
+			URL:    server.URL,
+			CAFile: filepath.Join(dir, "missing.pem"),
+		})
+		require.Error(t, result.Error)
+		assert.Contains(t, result.Error.Error(), "failed to load TLS settings")
+		assert.Equal(t, 0, result.StatusCode)
+	})
+}
+
+func TestFetch_Redirects(t *testing.T) {
+	var target *httptest.Server
+	target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /hop/N redirects N more times before serving the keys
+		var hops int
+		if _, err := fmt.Sscanf(r.URL.Path, "/hop/%d", &hops); err == nil && hops > 0 {
+			http.Redirect(w, r, fmt.Sprintf("%s/hop/%d", target.URL, hops-1), http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host\n"))
+	}))
+	defer target.Close()
+
+	t.Run("follows redirects and logs every hop", func(t *testing.T) {
+		var logs bytes.Buffer
+		fetcher := NewWithLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+		result := fetcher.Fetch(context.Background(), config.Source{URL: target.URL + "/hop/2"})
+		require.NoError(t, result.Error)
+		assert.Len(t, result.Keys, 1)
+		assert.Equal(t, 2, strings.Count(logs.String(), `msg="following redirect"`))
+		assert.Contains(t, logs.String(), "to="+target.URL+"/hop/0")
+	})
+
+	t.Run("max_redirects", func(t *testing.T) {
+		maxRedirects, retries := 1, 2
+		result := New().Fetch(context.Background(), config.Source{URL: target.URL + "/hop/2", MaxRedirects: &maxRedirects, Retries: &retries})
+		require.ErrorIs(t, result.Error, ErrTooManyRedirects)
+		assert.ErrorContains(t, result.Error, "max_redirects is 1")
+		assert.Equal(t, 1, result.Attempts)
+
+		maxRedirects = 0
+		result = New().Fetch(context.Background(), config.Source{URL: target.URL + "/hop/1", MaxRedirects: &maxRedirects})
+		require.ErrorIs(t, result.Error, ErrTooManyRedirects)
+
+		maxRedirects = 2
+		result = New().Fetch(context.Background(), config.Source{URL: target.URL + "/hop/2", MaxRedirects: &maxRedirects})
+		require.NoError(t, result.Error)
+	})
+
+	t.Run("refuses https to http", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, target.URL+"/hop/0", http.StatusFound)
+		}))
+		defer server.Close()
+
+		retries := 2
+		result := NewWithClient(server.Client()).Fetch(context.Background(), config.Source{URL: server.URL, Retries: &retries})
+		require.ErrorIs(t, result.Error, ErrInsecureRedirect)
+		assert.NotErrorIs(t, result.Error, ErrRequestFailed)
+		assert.Equal(t, 1, result.Attempts)
+		assert.Empty(t, result.Keys)
+	})
+}
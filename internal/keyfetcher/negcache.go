@@ -0,0 +1,151 @@
+package keyfetcher
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+const (
+	// NegativeCacheThreshold is the number of consecutive identical failures
+	// after which a source is served from the negative cache
+	NegativeCacheThreshold = 3
+)
+
+// ErrRecentlyFailed is returned for sources skipped because of recent failures
+var ErrRecentlyFailed = errors.New("skipped due to recent failures")
+
+// negativeEntry tracks consecutive failures of a single source
+type negativeEntry struct {
+	failures   int
+	lastError  string
+	statusCode int
+	until      time.Time
+	// used is true if the source was requested by this process
+	used bool
+}
+
+// NegativeEntry is the exported form of a failure streak, used to persist
+// the negative cache between runs
+type NegativeEntry struct {
+	Failures   int       `json:"failures"`
+	LastError  string    `json:"last_error"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Until      time.Time `json:"until,omitzero"`
+}
+
+// negativeCache remembers sources that keep failing the same way so they
+// are not re-requested until a cooldown period has elapsed. Sources are
+// keyed like the validator cache, hashed, since the cache can be written to
+// disk.
+type negativeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*negativeEntry
+	timeNow func() time.Time
+}
+
+// newNegativeCache creates a negative cache with the given cooldown period
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		entries: make(map[string]*negativeEntry),
+		timeNow: time.Now,
+	}
+}
+
+// sourceCacheKey identifies a source by its request parameters
+func sourceCacheKey(source config.Source) string {
+	return source.GetMethod() + " " + source.URL + "\x00" + source.Body
+}
+
+// lookup returns a cached failure for the source if it is cooling down
+func (c *negativeCache) lookup(source config.Source) (*FetchResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[validatorKey(source)]
+	if !ok {
+		return nil, false
+	}
+	entry.used = true
+	if entry.until.IsZero() || !c.timeNow().Before(entry.until) {
+		return nil, false
+	}
+
+	return &FetchResult{
+		Source:     source,
+		StatusCode: entry.statusCode,
+		Error:      fmt.Errorf("%w (until %s): %s", ErrRecentlyFailed, entry.until.Format(time.RFC3339), entry.lastError),
+	}, true
+}
+
+// record updates the failure streak of a source with a fetch result.
+// A success clears the streak, a different failure restarts it.
+func (c *negativeCache) record(result *FetchResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := validatorKey(result.Source)
+	if result.Error == nil {
+		delete(c.entries, key)
+		return
+	}
+
+	entry, ok := c.entries[key]
+	if !ok || entry.lastError != result.Error.Error() || entry.statusCode != result.StatusCode {
+		entry = &negativeEntry{
+			lastError:  result.Error.Error(),
+			statusCode: result.StatusCode,
+		}
+		c.entries[key] = entry
+	}
+
+	entry.used = true
+	entry.failures++
+	if entry.failures >= NegativeCacheThreshold {
+		entry.until = c.timeNow().Add(c.ttl)
+	}
+}
+
+// export returns the failure streaks of the sources requested by this
+// process, so that sources no longer configured are dropped
+func (c *negativeCache) export() map[string]NegativeEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	exported := make(map[string]NegativeEntry)
+	for key, entry := range c.entries {
+		if !entry.used {
+			continue
+		}
+		exported[key] = NegativeEntry{
+			Failures:   entry.failures,
+			LastError:  entry.lastError,
+			StatusCode: entry.statusCode,
+			Until:      entry.until,
+		}
+	}
+	return exported
+}
+
+// load adds failure streaks returned by export, keeping those already known
+func (c *negativeCache) load(entries map[string]NegativeEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range entries {
+		if _, ok := c.entries[key]; ok {
+			continue
+		}
+		c.entries[key] = &negativeEntry{
+			failures:   entry.Failures,
+			lastError:  entry.LastError,
+			statusCode: entry.StatusCode,
+			until:      entry.Until,
+		}
+	}
+}
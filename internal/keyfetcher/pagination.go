@@ -0,0 +1,95 @@
+package keyfetcher
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// parseNextLink returns the target of the rel="next" link from Link header
+// values (RFC 8288), e.g. `<https://api.example.com/keys?page=2>; rel="next"`.
+// Returns an empty string if there is no next link.
+func parseNextLink(values []string) string {
+	for _, value := range values {
+		for _, link := range splitLinkValue(value, ',') {
+			parts := splitLinkValue(link, ';')
+			target := strings.TrimSpace(parts[0])
+			if len(parts) < 2 || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+
+			for _, param := range parts[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(strings.TrimSpace(name), "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+					if strings.EqualFold(rel, "next") {
+						return target[1 : len(target)-1]
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// splitLinkValue splits a Link header value on sep, ignoring separators
+// inside a <target> or a quoted parameter, so that a URL or title holding a
+// comma or semicolon is kept whole
+func splitLinkValue(value string, sep byte) []string {
+	var parts []string
+	inTarget, inQuotes, escaped := false, false, false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inQuotes:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inQuotes = false
+			}
+		case inTarget:
+			if c == '>' {
+				inTarget = false
+			}
+		case c == '<':
+			inTarget = true
+		case c == '"':
+			inQuotes = true
+		case c == sep:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// resolveNextURL resolves a next link against the current page URL and makes
+// sure it stays on the same scheme and host as the source, so that source
+// headers (e.g. credentials) are never sent to another server
+func resolveNextURL(sourceURL, pageURL, next string) (string, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid page URL: %w", err)
+	}
+	ref, err := url.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("invalid next page link %q: %w", next, err)
+	}
+	resolved := base.ResolveReference(ref)
+
+	origin, err := url.Parse(sourceURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid source URL: %w", err)
+	}
+	if resolved.Scheme != origin.Scheme || resolved.Host != origin.Host {
+		return "", fmt.Errorf("next page link %q points to a different origin than the source", resolved.Redacted())
+	}
+
+	return resolved.String(), nil
+}
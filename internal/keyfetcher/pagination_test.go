@@ -0,0 +1,52 @@
+package keyfetcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNextLink(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		expected string
+	}{
+		{name: "no header", values: nil, expected: ""},
+		{name: "next only", values: []string{`<https://api.example.com/keys?page=2>; rel="next"`}, expected: "https://api.example.com/keys?page=2"},
+		{name: "multiple links", values: []string{`<https://a/keys?page=1>; rel="prev", <https://a/keys?page=3>; rel="next", <https://a/keys?page=9>; rel="last"`}, expected: "https://a/keys?page=3"},
+		{name: "multiple header values", values: []string{`</keys?page=1>; rel="first"`, `</keys?page=2>; rel=next`}, expected: "/keys?page=2"},
+		{name: "multiple rel values", values: []string{`</keys?page=2>; title="more"; rel="next nofollow"`}, expected: "/keys?page=2"},
+		{name: "last page", values: []string{`</keys?page=1>; rel="prev"`}, expected: ""},
+		{name: "malformed target", values: []string{`/keys?page=2; rel="next"`}, expected: ""},
+		{name: "comma in next url", values: []string{`<https://a/keys?ids=1,2&page=2>; rel="next", <https://a/keys?ids=1,2&page=9>; rel="last"`}, expected: "https://a/keys?ids=1,2&page=2"},
+		{name: "comma in prev url", values: []string{`<https://a/keys?ids=1,2&page=1>; rel="prev", <https://a/keys?page=3>; rel="next"`}, expected: "https://a/keys?page=3"},
+		{name: "semicolon in url", values: []string{`</keys;v=2?page=2>; rel="next"`}, expected: "/keys;v=2?page=2"},
+		{name: "separators in quoted param", values: []string{`</keys?page=1>; title="a, b; rel=next"; rel="prev", </keys?page=2>; title="say \"hi\", then"; rel="next"`}, expected: "/keys?page=2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseNextLink(tt.values))
+		})
+	}
+}
+
+func TestResolveNextURL(t *testing.T) {
+	next, err := resolveNextURL("https://api.example.com/keys", "https://api.example.com/keys?page=1", "/keys?page=2")
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.example.com/keys?page=2", next)
+
+	next, err = resolveNextURL("https://api.example.com/keys", "https://api.example.com/keys", "?page=2")
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.example.com/keys?page=2", next)
+
+	_, err = resolveNextURL("https://api.example.com/keys", "https://api.example.com/keys", "https://evil.example.com/keys?page=2")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "different origin")
+
+	_, err = resolveNextURL("https://api.example.com/keys", "https://api.example.com/keys", "http://api.example.com/keys?page=2")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "different origin")
+}
@@ -0,0 +1,54 @@
+package keyfetcher
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// BodyPreviewSize is the maximum size in bytes of FetchResult.BodyPreview
+const BodyPreviewSize = 200
+
+// previewScanSize is how much of the body is redacted before it is cut to
+// BodyPreviewSize, so a secret crossing the cut is still recognized
+const previewScanSize = 1024
+
+// redacted replaces secrets in body previews
+const redacted = "[REDACTED]"
+
+// previewRedactions match obvious secrets in response bodies, e.g. tokens
+// echoed back by a login page or an error message
+var previewRedactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// Authorization schemes: "Bearer abc", "Basic abc", "token abc"
+	{regexp.MustCompile(`(?i)\b(bearer|basic|token)(\s+)[A-Za-z0-9._~+/=-]+`), "$1$2" + redacted},
+	// Assignments: token=abc, "password": "abc", api_key: abc
+	{regexp.MustCompile(`(?i)((?:token|secret|passw(?:or)?d|pwd|api[_-]?key|access[_-]?key|session|signature|sig)["']?\s*[:=]\s*["']?)[^\s"'&,;<>]+`), "$1" + redacted},
+	// JSON web tokens
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redacted},
+	// Long opaque strings such as API tokens (but not the shorter words of HTML)
+	{regexp.MustCompile(`[A-Za-z0-9+/_-]{40,}={0,2}`), redacted},
+}
+
+// bodyPreview returns the start of a response body with obvious secrets
+// redacted, for logging a source that returned no keys
+func bodyPreview(body []byte) string {
+	if len(body) > previewScanSize {
+		body = body[:previewScanSize]
+	}
+	preview := strings.ToValidUTF8(string(body), "")
+	for _, r := range previewRedactions {
+		preview = r.pattern.ReplaceAllString(preview, r.replacement)
+	}
+
+	if len(preview) > BodyPreviewSize {
+		cut := BodyPreviewSize
+		for cut > 0 && !utf8.RuneStart(preview[cut]) {
+			cut--
+		}
+		preview = preview[:cut] + "..."
+	}
+	return strings.TrimSpace(preview)
+}
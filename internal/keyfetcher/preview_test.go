@@ -0,0 +1,62 @@
+package keyfetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyPreview(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "login page", body: "<html><title>Sign in</title></html>\n", expected: "<html><title>Sign in</title></html>"},
+		{name: "bearer token", body: "invalid header: Authorization: Bearer abc.def-123", expected: "invalid header: Authorization: Bearer [REDACTED]"},
+		{name: "assignment", body: `{"error":"expired","access_token":"s3cr3t"}`, expected: `{"error":"expired","access_token":"[REDACTED]"}`},
+		{name: "query string", body: "redirect to /login?next=/keys&password=hunter2&x=1", expected: "redirect to /login?next=/keys&password=[REDACTED]&x=1"},
+		{name: "jwt", body: "session eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln expired", expected: "session [REDACTED] expired"},
+		{name: "opaque token", body: "use ghp_" + strings.Repeat("a1B2", 10), expected: "use [REDACTED]"},
+		{name: "invalid utf-8", body: "bad \xff byte", expected: "bad  byte"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, bodyPreview([]byte(tt.body)))
+		})
+	}
+}
+
+func TestBodyPreview_Truncated(t *testing.T) {
+	preview := bodyPreview([]byte(strings.Repeat("é", BodyPreviewSize)))
+	assert.True(t, strings.HasSuffix(preview, "..."))
+	assert.LessOrEqual(t, len(preview), BodyPreviewSize+len("..."))
+	assert.True(t, strings.HasPrefix(preview, "éé"))
+}
+
+func TestFetcher_BodyPreview(t *testing.T) {
+	body := "<html><body>Please log in</body></html>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	result := fetcher.Fetch(context.Background(), config.Source{URL: server.URL})
+	require.NoError(t, result.Error)
+	assert.Empty(t, result.Keys)
+	assert.Equal(t, body, result.BodyPreview)
+
+	// Responses with keys carry no preview
+	body = "ssh-ed25519 AAAA user@host\ngarbage"
+	result = fetcher.Fetch(context.Background(), config.Source{URL: server.URL})
+	require.NoError(t, result.Error)
+	assert.Empty(t, result.BodyPreview)
+}
@@ -0,0 +1,52 @@
+package keyfetcher
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// ErrTooManyRedirects indicates that a source redirected more often than its
+// max_redirects allows
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// ErrInsecureRedirect indicates that an https source redirected to a plain
+// http URL, which would send the request and its credentials unencrypted
+var ErrInsecureRedirect = errors.New("refusing redirect from https to http")
+
+// withRedirectPolicy returns a copy of client that follows at most the
+// max_redirects of source and never downgrades from https to http, logging
+// every redirect it follows
+func (f *Fetcher) withRedirectPolicy(client *http.Client, source config.Source) *http.Client {
+	maxRedirects := source.GetMaxRedirects()
+
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		previous := via[len(via)-1]
+		if previous.URL.Scheme == "https" && req.URL.Scheme != "https" {
+			return fmt.Errorf("%w: %s", ErrInsecureRedirect, req.URL.Redacted())
+		}
+		if len(via) > maxRedirects {
+			return fmt.Errorf("%w (max_redirects is %d)", ErrTooManyRedirects, maxRedirects)
+		}
+
+		f.logger.Debug("following redirect",
+			"url", source.URL,
+			"from", previous.URL.Redacted(),
+			"to", req.URL.Redacted(),
+			"redirects", len(via))
+		return nil
+	}
+	return &c
+}
+
+// requestError wraps the error of a request that received no response. A
+// refused redirect fails the same way every time, so it is not retried.
+func requestError(err error) error {
+	if errors.Is(err, ErrInsecureRedirect) || errors.Is(err, ErrTooManyRedirects) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrRequestFailed, err)
+}
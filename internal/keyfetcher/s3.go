@@ -0,0 +1,147 @@
+//go:build s3
+
+package keyfetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// s3EndpointRegion is the region used with an endpoint when neither the
+// source nor the AWS configuration sets one, as most S3-compatible services
+// accept any region
+const s3EndpointRegion = "us-east-1"
+
+// fetchS3 reads the object of an s3 source with the credentials of the
+// standard AWS chain (environment, shared config, instance profile), reading
+// at most MaxResponseSize bytes like an HTTP response
+func (f *Fetcher) fetchS3(ctx context.Context, source config.Source) *FetchResult {
+	result := &FetchResult{
+		Source: source,
+		Pages:  1,
+	}
+
+	timeout := time.Duration(source.GetTimeoutSeconds()) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := f.s3Client(ctx, source)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	f.logger.Debug("reading S3 object",
+		"bucket", source.Bucket,
+		"key", source.Key,
+		"timeout_seconds", source.GetTimeoutSeconds())
+
+	// --check-sources only checks that the object can be read
+	if source.GetMethod() == http.MethodHead {
+		_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(source.Bucket),
+			Key:    aws.String(source.Key),
+		})
+		if err != nil {
+			result.Error = s3Error(result, err)
+			return result
+		}
+		result.StatusCode = http.StatusOK
+		result.FetchedAt = time.Now()
+		return result
+	}
+
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(source.Bucket),
+		Key:    aws.String(source.Key),
+	})
+	if err != nil {
+		result.Error = s3Error(result, err)
+		return result
+	}
+	defer func() { _ = output.Body.Close() }()
+	result.StatusCode = http.StatusOK
+	result.FetchedAt = time.Now()
+
+	body, err := io.ReadAll(io.LimitReader(output.Body, MaxResponseSize))
+	if err != nil {
+		result.Error = fmt.Errorf("failed to read S3 object: %w", err)
+		return result
+	}
+
+	f.parseKeys(result, body)
+	return result
+}
+
+// s3Error converts a GetObject error like the response of an HTTP source: a
+// missing object is a 404, other errors with a response keep their status,
+// and errors without one are request failures, which may be retried
+func s3Error(result *FetchResult, err error) error {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		result.StatusCode = http.StatusNotFound
+		return fmt.Errorf("unexpected status code: %d", http.StatusNotFound)
+	}
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) {
+		result.StatusCode = responseErr.HTTPStatusCode()
+		return fmt.Errorf("unexpected status code: %d: %w", result.StatusCode, err)
+	}
+	return fmt.Errorf("%w: %w", ErrRequestFailed, err)
+}
+
+// s3Client returns the S3 client of a source. Clients are built once per
+// Fetcher, region and endpoint, and send their requests through the HTTP
+// client of the Fetcher, so the policy timeouts and CAs apply to them rather
+// than AWS_CA_BUNDLE.
+func (f *Fetcher) s3Client(ctx context.Context, source config.Source) (*s3.Client, error) {
+	key := source.Region + "\x00" + source.Endpoint
+
+	f.s3ClientsMu.Lock()
+	defer f.s3ClientsMu.Unlock()
+	if client, ok := f.s3Clients[key]; ok {
+		return client.(*s3.Client), nil
+	}
+
+	var options []func(*awsconfig.LoadOptions) error
+	if source.Region != "" {
+		options = append(options, awsconfig.WithRegion(source.Region))
+	}
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	if awsConfig.Region == "" && source.Endpoint != "" {
+		awsConfig.Region = s3EndpointRegion
+	}
+
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.HTTPClient = f.client
+		if source.Endpoint != "" {
+			o.BaseEndpoint = aws.String(source.Endpoint)
+			// S3-compatible services rarely serve buckets as subdomains
+			o.UsePathStyle = true
+		}
+		// S3-compatible services often send no checksum, which the SDK would
+		// otherwise log to stderr on every fetch
+		o.DisableLogOutputChecksumValidationSkipped = true
+	})
+
+	if f.s3Clients == nil {
+		f.s3Clients = make(map[string]any)
+	}
+	f.s3Clients[key] = client
+	return client, nil
+}
@@ -0,0 +1,19 @@
+//go:build !s3
+
+package keyfetcher
+
+import (
+	"context"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// fetchS3 fails every s3 source, so that builds without the s3 tag do not
+// depend on the AWS SDK
+func (f *Fetcher) fetchS3(_ context.Context, source config.Source) *FetchResult {
+	return &FetchResult{
+		Source: source,
+		Error:  ErrS3NotSupported,
+		Pages:  1,
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !s3
+
+package keyfetcher
+
+import (
+	"context"
+	"testing"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetch_S3NotSupported(t *testing.T) {
+	source := config.Source{Type: config.SourceTypeS3, Bucket: "acme-keys", Key: "deploy.keys"}
+	source.URL = source.S3URL()
+
+	result := New().Fetch(context.Background(), source)
+	assert.ErrorIs(t, result.Error, ErrS3NotSupported)
+	assert.Equal(t, 1, result.Attempts)
+}
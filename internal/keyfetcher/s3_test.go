@@ -0,0 +1,100 @@
+//go:build s3
+
+package keyfetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetch_S3(t *testing.T) {
+	// Static credentials, and nothing read from the machine running the tests
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	objects := map[string]string{
+		"/acme-keys/deploy.keys": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit deploy@host\n",
+		"/acme-keys/large.keys":  strings.Repeat("\n", MaxResponseSize) + "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit late@host\n",
+	}
+	var authorization, method string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization, method = r.Header.Get("Authorization"), r.Method
+		switch content, ok := objects[r.URL.Path]; {
+		case ok:
+			_, _ = w.Write([]byte(content))
+		case r.URL.Path == "/acme-keys/denied.keys":
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+		default:
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		}
+	}))
+	defer server.Close()
+
+	s3Source := func(key string) config.Source {
+		source := config.Source{Type: config.SourceTypeS3, Bucket: "acme-keys", Key: key, Endpoint: server.URL}
+		source.URL = source.S3URL()
+		return source
+	}
+	fetcher := New()
+
+	t.Run("object", func(t *testing.T) {
+		result := fetcher.Fetch(context.Background(), s3Source("deploy.keys"))
+		require.NoError(t, result.Error)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+		require.Len(t, result.Keys, 1)
+		assert.Equal(t, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit deploy@host", result.Keys[0].Line)
+		assert.False(t, result.FetchedAt.IsZero())
+		assert.Contains(t, authorization, "Credential=AKIDEXAMPLE/")
+		assert.Contains(t, authorization, "/us-east-1/s3/")
+	})
+
+	t.Run("missing object is a 404", func(t *testing.T) {
+		result := fetcher.Fetch(context.Background(), s3Source("missing.keys"))
+		assert.EqualError(t, result.Error, "unexpected status code: 404")
+		assert.Equal(t, http.StatusNotFound, result.StatusCode)
+	})
+
+	t.Run("other errors keep their status", func(t *testing.T) {
+		result := fetcher.Fetch(context.Background(), s3Source("denied.keys"))
+		assert.ErrorContains(t, result.Error, "unexpected status code: 403")
+		assert.Equal(t, http.StatusForbidden, result.StatusCode)
+	})
+
+	t.Run("HEAD", func(t *testing.T) {
+		source := s3Source("deploy.keys")
+		source.Method = http.MethodHead
+		result := fetcher.Fetch(context.Background(), source)
+		require.NoError(t, result.Error)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, http.MethodHead, method)
+		assert.Empty(t, result.Keys)
+
+		source = s3Source("missing.keys")
+		source.Method = http.MethodHead
+		result = fetcher.Fetch(context.Background(), source)
+		assert.ErrorContains(t, result.Error, "unexpected status code: 404")
+	})
+
+	t.Run("read up to MaxResponseSize", func(t *testing.T) {
+		result := fetcher.Fetch(context.Background(), s3Source("large.keys"))
+		require.NoError(t, result.Error)
+		assert.Empty(t, result.Keys)
+	})
+}
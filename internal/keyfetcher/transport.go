@@ -0,0 +1,98 @@
+package keyfetcher
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// DefaultConnectTimeout is the connect timeout of the default HTTP transport
+const DefaultConnectTimeout = 30 * time.Second
+
+// NewTransport returns an HTTP transport with separate limits for
+// establishing the TCP connection and for the TLS handshake, so that
+// unreachable sources fail fast while slow responses still get the full
+// source timeout. A timeout <= 0 keeps the default of http.DefaultTransport.
+func NewTransport(connectTimeout, tlsHandshakeTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport.DialContext = dialer.DialContext
+
+	if tlsHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+	}
+
+	return transport
+}
+
+// clientFor returns the HTTP client for a source, following redirects as
+// the source allows
+func (f *Fetcher) clientFor(source config.Source) (*http.Client, error) {
+	client, err := f.tlsClientFor(source)
+	if err != nil {
+		return nil, err
+	}
+	return f.withRedirectPolicy(client, source), nil
+}
+
+// tlsClientFor returns the client of the Fetcher, or for a source with TLS
+// options of its own a copy of it with its own transport. Those clients are
+// built once per Fetcher and shared by the sources with the same TLS options.
+func (f *Fetcher) tlsClientFor(source config.Source) (*http.Client, error) {
+	if !source.HasTLSConfig() {
+		return f.client, nil
+	}
+
+	key := strings.Join([]string{source.CAFile, source.ClientCertFile, source.ClientKeyFile, strconv.FormatBool(source.InsecureSkipVerify)}, "\x00")
+
+	f.sourceClientsMu.Lock()
+	defer f.sourceClientsMu.Unlock()
+	if client, ok := f.sourceClients[key]; ok {
+		return client, nil
+	}
+
+	// Start from the transport of the Fetcher, to keep its timeouts and the
+	// CAs of the policy
+	var transport *http.Transport
+	if base, ok := f.client.Transport.(*http.Transport); ok {
+		transport = base.Clone()
+	} else {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	var rootCAs *x509.CertPool
+	if transport.TLSClientConfig != nil {
+		rootCAs = transport.TLSClientConfig.RootCAs
+	}
+
+	tlsConfig, err := source.TLSConfig(rootCAs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS settings: %w", err)
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if source.InsecureSkipVerify {
+		f.logger.Warn("TLS certificate verification is disabled for source",
+			"url", source.URL)
+	}
+
+	client := *f.client
+	client.Transport = transport
+	if f.sourceClients == nil {
+		f.sourceClients = make(map[string]*http.Client)
+	}
+	f.sourceClients[key] = &client
+	return &client, nil
+}
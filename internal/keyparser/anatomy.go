@@ -0,0 +1,268 @@
+package keyparser
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// ErrMalformedKey is returned when a key line cannot be split into its fields
+var ErrMalformedKey = errors.New("malformed key")
+
+// certSuffix is the suffix of OpenSSH certificate key types
+const certSuffix = "-cert-v01@openssh.com"
+
+// SupportedKeyTypes are the key types whose blobs can be inspected
+var SupportedKeyTypes = []string{
+	"ssh-ed25519",
+	"sk-ssh-ed25519@openssh.com",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"sk-ecdsa-sha2-nistp256@openssh.com",
+	"ssh-rsa",
+	"ssh-dss",
+}
+
+// KeyParts are the fields of an authorized_keys line:
+// [options] <key-type> <base64-blob> [comment]
+type KeyParts struct {
+	// Options are the comma-separated restrictions, empty if none
+	Options string
+	// Type is the key type, e.g. "ssh-ed25519"
+	Type string
+	// Blob is the base64-encoded public key
+	Blob string
+	// Comment is the trailing free-form text, empty if none
+	Comment string
+}
+
+// PublicKeyInfo describes the public key encoded in a key blob
+type PublicKeyInfo struct {
+	// Type is the key type embedded in the blob
+	Type string
+	// Bits is the key size in bits, 0 if unknown for the key type
+	Bits int
+}
+
+// SplitKey splits a key line into its options, type, blob and comment.
+// Options may contain quoted values with spaces, e.g. command="echo hi".
+// A line is assumed to start with options unless its first field is a
+// supported key type (or certificate type) or matches the type embedded in
+// the blob that follows it.
+func SplitKey(line string) (*KeyParts, error) {
+	line = strings.TrimSpace(line)
+
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && (IsSupportedKeyType(fields[0]) || blobMatchesType(fields[0], fields[1])) {
+		return splitTypeBlobComment("", line)
+	}
+
+	options, rest := splitOptions(line)
+	if options == "" || rest == "" {
+		return nil, fmt.Errorf("%w: missing key type or blob", ErrMalformedKey)
+	}
+
+	return splitTypeBlobComment(options, rest)
+}
+
+// InspectBlob decodes a base64 key blob and returns its type and size.
+// Certificates are reported with their certificate type and the size of
+// the key they certify.
+func InspectBlob(blob string) (*PublicKeyInfo, error) {
+	data, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid base64 blob", ErrMalformedKey)
+	}
+
+	r := &wireReader{data: data}
+	keyType, ok := r.str()
+	if !ok {
+		return nil, fmt.Errorf("%w: truncated blob", ErrMalformedKey)
+	}
+
+	info := &PublicKeyInfo{Type: string(keyType)}
+	baseType := strings.TrimSuffix(info.Type, certSuffix)
+	if baseType != info.Type {
+		// Certificates carry a nonce before the certified key fields
+		if _, ok := r.str(); !ok {
+			return nil, fmt.Errorf("%w: truncated certificate", ErrMalformedKey)
+		}
+	}
+
+	switch baseType {
+	case "ssh-ed25519", "sk-ssh-ed25519@openssh.com":
+		info.Bits = 256
+	case "ecdsa-sha2-nistp256", "sk-ecdsa-sha2-nistp256@openssh.com":
+		info.Bits = 256
+	case "ecdsa-sha2-nistp384":
+		info.Bits = 384
+	case "ecdsa-sha2-nistp521":
+		info.Bits = 521
+	case "ssh-rsa":
+		// e, n
+		if _, ok := r.str(); !ok {
+			return nil, fmt.Errorf("%w: truncated RSA key", ErrMalformedKey)
+		}
+		n, ok := r.str()
+		if !ok {
+			return nil, fmt.Errorf("%w: truncated RSA key", ErrMalformedKey)
+		}
+		info.Bits = new(big.Int).SetBytes(n).BitLen()
+	case "ssh-dss":
+		// p, q, g, y
+		p, ok := r.str()
+		if !ok {
+			return nil, fmt.Errorf("%w: truncated DSA key", ErrMalformedKey)
+		}
+		info.Bits = new(big.Int).SetBytes(p).BitLen()
+	}
+
+	return info, nil
+}
+
+// SupportedAlgorithms returns every key type accepted by name: the
+// SupportedKeyTypes followed by their certificate types. Other key types are
+// only accepted if they match the type embedded in their blob.
+func SupportedAlgorithms() []string {
+	algorithms := slices.Clone(SupportedKeyTypes)
+	for _, keyType := range SupportedKeyTypes {
+		algorithms = append(algorithms, certType(keyType))
+	}
+	return algorithms
+}
+
+// IsSupportedKeyType reports whether keyType is one of SupportedKeyTypes
+// or a certificate of one of them
+func IsSupportedKeyType(keyType string) bool {
+	for _, supported := range SupportedKeyTypes {
+		if keyType == supported || keyType == certType(supported) {
+			return true
+		}
+	}
+	return false
+}
+
+// certType returns the certificate type of a key type, e.g.
+// "sk-ssh-ed25519-cert-v01@openssh.com" for "sk-ssh-ed25519@openssh.com"
+func certType(keyType string) string {
+	return strings.TrimSuffix(keyType, "@openssh.com") + certSuffix
+}
+
+// Fingerprint returns the OpenSSH SHA256 fingerprint of a key line, as shown
+// by "ssh-keygen -l", e.g. "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"
+func Fingerprint(line string) (string, error) {
+	blob, err := decodeBlob(line)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+// FingerprintMD5 returns the legacy MD5 fingerprint of a key line, as shown
+// by "ssh-keygen -l -E md5" and older OpenSSH versions, e.g.
+// "MD5:02:57:a1:4a:c8:5d:18:d4:25:14:25:e6:2c:6d:8a:2a"
+func FingerprintMD5(line string) (string, error) {
+	blob, err := decodeBlob(line)
+	if err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(blob)
+	hexPairs := make([]string, len(sum))
+	for i, b := range sum {
+		hexPairs[i] = fmt.Sprintf("%02x", b)
+	}
+	return "MD5:" + strings.Join(hexPairs, ":"), nil
+}
+
+// decodeBlob returns the decoded key blob of a key line, which fingerprints
+// are computed over
+func decodeBlob(line string) ([]byte, error) {
+	parts, err := SplitKey(line)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(parts.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid base64 blob", ErrMalformedKey)
+	}
+	return blob, nil
+}
+
+// blobMatchesType reports whether blob decodes to a key of the given type
+func blobMatchesType(keyType, blob string) bool {
+	info, err := InspectBlob(blob)
+	return err == nil && info.Type == keyType
+}
+
+// splitOptions splits the leading options field, honoring double quotes,
+// from the rest of the line
+func splitOptions(line string) (string, string) {
+	inQuotes := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && inQuotes && i+1 < len(line):
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+		case (c == ' ' || c == '\t') && !inQuotes:
+			return line[:i], strings.TrimSpace(line[i:])
+		}
+	}
+	return line, ""
+}
+
+// splitTypeBlobComment splits "<type> <blob> [comment]"
+func splitTypeBlobComment(options, rest string) (*KeyParts, error) {
+	keyType, rest := cutField(rest)
+	blob, comment := cutField(rest)
+	if keyType == "" || blob == "" {
+		return nil, fmt.Errorf("%w: missing key type or blob", ErrMalformedKey)
+	}
+
+	return &KeyParts{
+		Options: options,
+		Type:    keyType,
+		Blob:    blob,
+		Comment: comment,
+	}, nil
+}
+
+// cutField splits the first whitespace-separated field from the rest of s
+func cutField(s string) (string, string) {
+	s = strings.TrimLeft(s, " \t")
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// wireReader reads length-prefixed strings of the SSH wire format
+type wireReader struct {
+	data []byte
+}
+
+// str reads the next length-prefixed string
+func (r *wireReader) str() ([]byte, bool) {
+	if len(r.data) < 4 {
+		return nil, false
+	}
+	n := binary.BigEndian.Uint32(r.data)
+	if uint64(len(r.data)-4) < uint64(n) {
+		return nil, false
+	}
+	s := r.data[4 : 4+n]
+	r.data = r.data[4+n:]
+	return s, true
+}
@@ -0,0 +1,208 @@
+package keyparser
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlob builds a base64 key blob from its SSH wire format fields
+func testBlob(keyType string, fields ...[]byte) string {
+	var data []byte
+	for _, field := range append([][]byte{[]byte(keyType)}, fields...) {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(field)))
+		data = append(data, field...)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// testModulus returns a big-endian integer with exactly the given bit length
+func testModulus(bits int) []byte {
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-1)).Bytes()
+}
+
+func TestSplitKey(t *testing.T) {
+	ed25519Blob := testBlob("ssh-ed25519", make([]byte, 32))
+	unknownBlob := testBlob("ssh-future", []byte("x"))
+
+	tests := []struct {
+		name     string
+		line     string
+		expected KeyParts
+	}{
+		{
+			name:     "type and blob",
+			line:     "ssh-ed25519 " + ed25519Blob,
+			expected: KeyParts{Type: "ssh-ed25519", Blob: ed25519Blob},
+		},
+		{
+			name:     "comment with spaces",
+			line:     "ssh-ed25519 " + ed25519Blob + " John Doe  laptop",
+			expected: KeyParts{Type: "ssh-ed25519", Blob: ed25519Blob, Comment: "John Doe  laptop"},
+		},
+		{
+			name:     "options",
+			line:     "restrict,port-forwarding ssh-ed25519 " + ed25519Blob + " user@host",
+			expected: KeyParts{Options: "restrict,port-forwarding", Type: "ssh-ed25519", Blob: ed25519Blob, Comment: "user@host"},
+		},
+		{
+			name:     "quoted options with spaces",
+			line:     `command="echo \"hi there\"",no-pty	ssh-ed25519 ` + ed25519Blob,
+			expected: KeyParts{Options: `command="echo \"hi there\"",no-pty`, Type: "ssh-ed25519", Blob: ed25519Blob},
+		},
+		{
+			name:     "unknown type recognized by its blob",
+			line:     "ssh-future " + unknownBlob + " user@host",
+			expected: KeyParts{Type: "ssh-future", Blob: unknownBlob, Comment: "user@host"},
+		},
+		{
+			name:     "fake blob with known type",
+			line:     "ssh-ed25519 AAAA user@host",
+			expected: KeyParts{Type: "ssh-ed25519", Blob: "AAAA", Comment: "user@host"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, err := SplitKey(tt.line)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, *parts)
+		})
+	}
+}
+
+func TestSplitKey_Malformed(t *testing.T) {
+	_, err := SplitKey("no-pty")
+	require.ErrorIs(t, err, ErrMalformedKey)
+
+	_, err = SplitKey(`command="unterminated ssh-ed25519 AAAA`)
+	require.ErrorIs(t, err, ErrMalformedKey)
+}
+
+func TestInspectBlob(t *testing.T) {
+	tests := []struct {
+		name         string
+		blob         string
+		expectedType string
+		expectedBits int
+	}{
+		{
+			name:         "ed25519",
+			blob:         testBlob("ssh-ed25519", make([]byte, 32)),
+			expectedType: "ssh-ed25519",
+			expectedBits: 256,
+		},
+		{
+			name:         "ecdsa p384",
+			blob:         testBlob("ecdsa-sha2-nistp384", []byte("nistp384"), make([]byte, 97)),
+			expectedType: "ecdsa-sha2-nistp384",
+			expectedBits: 384,
+		},
+		{
+			name:         "rsa 3072",
+			blob:         testBlob("ssh-rsa", []byte{0x01, 0x00, 0x01}, append([]byte{0x00}, testModulus(3072)...)),
+			expectedType: "ssh-rsa",
+			expectedBits: 3072,
+		},
+		{
+			name:         "dsa 1024",
+			blob:         testBlob("ssh-dss", testModulus(1024), testModulus(160), testModulus(1024), testModulus(1024)),
+			expectedType: "ssh-dss",
+			expectedBits: 1024,
+		},
+		{
+			name:         "rsa certificate",
+			blob:         testBlob("ssh-rsa-cert-v01@openssh.com", []byte("nonce"), []byte{0x03}, testModulus(2048)),
+			expectedType: "ssh-rsa-cert-v01@openssh.com",
+			expectedBits: 2048,
+		},
+		{
+			name:         "unknown type",
+			blob:         testBlob("ssh-future", []byte("x")),
+			expectedType: "ssh-future",
+			expectedBits: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := InspectBlob(tt.blob)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedType, info.Type)
+			assert.Equal(t, tt.expectedBits, info.Bits)
+		})
+	}
+}
+
+func TestInspectBlob_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		blob string
+	}{
+		{name: "not base64", blob: "!!!"},
+		{name: "empty", blob: ""},
+		{name: "truncated type", blob: base64.StdEncoding.EncodeToString([]byte{0, 0, 0, 9, 's'})},
+		{name: "truncated rsa", blob: testBlob("ssh-rsa", []byte{0x03})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := InspectBlob(tt.blob)
+			require.ErrorIs(t, err, ErrMalformedKey)
+		})
+	}
+}
+
+func TestSupportedAlgorithms(t *testing.T) {
+	algorithms := SupportedAlgorithms()
+	assert.Len(t, algorithms, 2*len(SupportedKeyTypes))
+	assert.Contains(t, algorithms, "ssh-ed25519")
+	assert.Contains(t, algorithms, "ssh-ed25519-cert-v01@openssh.com")
+	assert.Contains(t, algorithms, "sk-ssh-ed25519-cert-v01@openssh.com")
+
+	for _, algorithm := range algorithms {
+		assert.True(t, IsSupportedKeyType(algorithm), algorithm)
+	}
+	assert.False(t, IsSupportedKeyType("ssh-ed448"))
+	assert.False(t, IsSupportedKeyType("sk-ssh-ed25519@openssh.com-cert-v01@openssh.com"))
+
+	// Callers cannot change the supported key types through the result
+	algorithms[0] = "changed"
+	assert.Equal(t, "ssh-ed25519", SupportedKeyTypes[0])
+}
+
+func TestFingerprint(t *testing.T) {
+	// Expected value from "ssh-keygen -l"
+	line := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW u@h"
+
+	fingerprint, err := Fingerprint(line)
+	require.NoError(t, err)
+	assert.Equal(t, "SHA256:BlO5d3w0VSdK7aim1tmFmVqIId6ECOjwc2LkLZfENxI", fingerprint)
+
+	withOptions, err := Fingerprint("restrict " + line)
+	require.NoError(t, err)
+	assert.Equal(t, fingerprint, withOptions)
+
+	_, err = Fingerprint("ssh-ed25519 !!! u@h")
+	require.ErrorIs(t, err, ErrMalformedKey)
+}
+
+func TestFingerprintMD5(t *testing.T) {
+	// Expected value from "ssh-keygen -l -E md5"
+	line := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW u@h"
+
+	fingerprint, err := FingerprintMD5(line)
+	require.NoError(t, err)
+	assert.Equal(t, "MD5:02:57:a1:4a:c8:5d:18:d4:25:14:25:e6:2c:6d:8a:2a", fingerprint)
+
+	withOptions, err := FingerprintMD5(`from="10.0.0.0/8" ` + line)
+	require.NoError(t, err)
+	assert.Equal(t, fingerprint, withOptions)
+
+	_, err = FingerprintMD5("not-a-key")
+	require.ErrorIs(t, err, ErrMalformedKey)
+}
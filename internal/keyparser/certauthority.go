@@ -0,0 +1,52 @@
+package keyparser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CertAuthorityLine turns the public key of an SSH certificate authority into
+// an authorized_keys entry trusting every user certificate it signs:
+//
+//	cert-authority[,principals="a,b"][,expiry-time="20300101"] <type> <blob> [comment]
+//
+// The line must be a plain public key without options whose blob matches its
+// type; certificates cannot act as authorities. Principals and the expiry
+// time are passed to sshd as is and must not contain quotes.
+func CertAuthorityLine(line string, principals []string, expiryTime string) (string, error) {
+	parts, err := SplitKey(line)
+	if err != nil {
+		return "", err
+	}
+	if parts.Options != "" {
+		return "", fmt.Errorf("%w: certificate authority key has options", ErrMalformedKey)
+	}
+	if strings.HasSuffix(parts.Type, certSuffix) {
+		return "", fmt.Errorf("%w: %s is a certificate, not a certificate authority key", ErrMalformedKey, parts.Type)
+	}
+	if !blobMatchesType(parts.Type, parts.Blob) {
+		return "", fmt.Errorf("%w: blob does not match key type %s", ErrMalformedKey, parts.Type)
+	}
+
+	options := []string{"cert-authority"}
+	if len(principals) > 0 {
+		for _, principal := range principals {
+			if principal == "" || strings.ContainsAny(principal, "\",\\ \t") {
+				return "", fmt.Errorf("invalid principal %q", principal)
+			}
+		}
+		options = append(options, fmt.Sprintf("principals=%q", strings.Join(principals, ",")))
+	}
+	if expiryTime != "" {
+		if strings.ContainsAny(expiryTime, "\"\\ \t") {
+			return "", fmt.Errorf("invalid expiry time %q", expiryTime)
+		}
+		options = append(options, fmt.Sprintf("expiry-time=%q", expiryTime))
+	}
+
+	entry := strings.Join(options, ",") + " " + parts.Type + " " + parts.Blob
+	if parts.Comment != "" {
+		entry += " " + parts.Comment
+	}
+	return entry, nil
+}
@@ -0,0 +1,53 @@
+package keyparser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertAuthorityLine(t *testing.T) {
+	caKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW ca@example"
+
+	line, err := CertAuthorityLine(caKey, nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, "cert-authority "+caKey, line)
+	assert.True(t, IsValidKey(line))
+
+	line, err = CertAuthorityLine(caKey, []string{"alice", "deploy"}, "20301231")
+	require.NoError(t, err)
+	assert.Equal(t, `cert-authority,principals="alice,deploy",expiry-time="20301231" `+caKey, line)
+	assert.True(t, IsValidKey(line))
+
+	parts, err := SplitKey(line)
+	require.NoError(t, err)
+	assert.Equal(t, "ssh-ed25519", parts.Type)
+	assert.Equal(t, "ca@example", parts.Comment)
+}
+
+func TestCertAuthorityLine_Invalid(t *testing.T) {
+	caKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW ca@example"
+	certBlob := testBlob("ssh-ed25519-cert-v01@openssh.com", []byte("nonce"), make([]byte, 32))
+
+	tests := []struct {
+		name       string
+		line       string
+		principals []string
+		expiry     string
+	}{
+		{name: "options", line: "restrict " + caKey},
+		{name: "certificate", line: "ssh-ed25519-cert-v01@openssh.com " + certBlob},
+		{name: "mismatched blob", line: "ssh-rsa AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW"},
+		{name: "malformed", line: "ssh-ed25519"},
+		{name: "quoted principal", line: caKey, principals: []string{`a"b`}},
+		{name: "principal with comma", line: caKey, principals: []string{"a,b"}},
+		{name: "quoted expiry", line: caKey, expiry: `2030"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CertAuthorityLine(tt.line, tt.principals, tt.expiry)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"bufio"
 	"io"
 	"strings"
+
+	"golang.org/x/crypto/ssh"
 )
 
 // ParsedKey represents a parsed SSH public key line
 type ParsedKey struct {
 	// Line is the trimmed key content
 	Line string
+	// Raw is the original line verbatim, without the trailing carriage return
+	Raw string
 	// LineNumber is the original line number (1-indexed)
 	LineNumber int
 }
@@ -21,6 +25,50 @@ type ParseResult struct {
 	Keys []ParsedKey
 	// DiscardedLines is the count of lines that were discarded
 	DiscardedLines int
+	// Discarded explains why each discarded line was discarded
+	Discarded []DiscardedLine
+}
+
+// DiscardedLine is a non-empty line that was not taken for a key
+type DiscardedLine struct {
+	// LineNumber is the original line number (1-indexed)
+	LineNumber int
+	// Reason tells why the line was discarded, e.g. "comment" or
+	// "unrecognized key type"
+	Reason string
+}
+
+// DefaultDiscardPrefixes are the prefixes of lines that are always
+// discarded: comments and HTML/JSON error bodies
+var DefaultDiscardPrefixes = []string{"#", "<", "{", "["}
+
+// Parser parses SSH public keys, discarding lines that start with any of
+// DefaultDiscardPrefixes or the extra prefixes it was created with
+type Parser struct {
+	discardPrefixes []string
+	// strict also requires the key blob to decode to a valid public key
+	strict bool
+}
+
+// NewParser creates a Parser that also discards lines starting with any of
+// extraDiscardPrefixes, e.g. "---" or "error:" for YAML error documents.
+// Empty prefixes are ignored.
+func NewParser(extraDiscardPrefixes []string) *Parser {
+	prefixes := make([]string, 0, len(DefaultDiscardPrefixes)+len(extraDiscardPrefixes))
+	prefixes = append(prefixes, DefaultDiscardPrefixes...)
+	for _, prefix := range extraDiscardPrefixes {
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return &Parser{discardPrefixes: prefixes}
+}
+
+// SetStrict enables strict mode, where a key must also decode to a valid
+// public key of its type, as sshd would check it. Lines whose blob is not
+// valid base64 or not a well-formed key are discarded. Disabled by default.
+func (p *Parser) SetStrict(strict bool) {
+	p.strict = strict
 }
 
 // Parse parses SSH public keys from a reader.
@@ -28,8 +76,11 @@ type ParseResult struct {
 // - Empty lines are discarded
 // - Comment lines (starting with #) are discarded
 // - HTML/JSON error lines (starting with <, {, or [) are discarded
+// - Lines starting with any extra discard prefix are discarded
 // - Valid lines must have at least 2 whitespace-separated fields
-func Parse(r io.Reader) (*ParseResult, error) {
+// - The key type, after any options, must be recognized
+// - In strict mode, the key must parse as a valid public key
+func (p *Parser) Parse(r io.Reader) (*ParseResult, error) {
 	result := &ParseResult{
 		Keys: make([]ParsedKey, 0),
 	}
@@ -39,16 +90,23 @@ func Parse(r io.Reader) (*ParseResult, error) {
 
 	for scanner.Scan() {
 		lineNumber++
-		line := strings.TrimSpace(scanner.Text())
+		raw := strings.TrimSuffix(scanner.Text(), "\r")
+		line := strings.TrimSpace(raw)
 
-		if isValidKey(line) {
+		reason := p.checkKey(line)
+		if reason == "" {
 			result.Keys = append(result.Keys, ParsedKey{
 				Line:       line,
+				Raw:        raw,
 				LineNumber: lineNumber,
 			})
 		} else if line != "" {
 			// Only count non-empty lines as discarded
 			result.DiscardedLines++
+			result.Discarded = append(result.Discarded, DiscardedLine{
+				LineNumber: lineNumber,
+				Reason:     reason,
+			})
 		}
 	}
 
@@ -59,34 +117,91 @@ func Parse(r io.Reader) (*ParseResult, error) {
 	return result, nil
 }
 
+// ParseString is a convenience function to parse keys from a string
+func (p *Parser) ParseString(content string) (*ParseResult, error) {
+	return p.Parse(strings.NewReader(content))
+}
+
+// IsValidKey reports whether a line is a valid SSH public key for this Parser
+func (p *Parser) IsValidKey(line string) bool {
+	return p.isValidKey(strings.TrimSpace(line))
+}
+
+// defaultParser discards only DefaultDiscardPrefixes
+var defaultParser = NewParser(nil)
+
+// Parse parses SSH public keys from a reader with the default discard
+// prefixes. See Parser.Parse for the parsing rules.
+func Parse(r io.Reader) (*ParseResult, error) {
+	return defaultParser.Parse(r)
+}
+
 // ParseString is a convenience function to parse keys from a string
 func ParseString(content string) (*ParseResult, error) {
-	return Parse(strings.NewReader(content))
+	return defaultParser.ParseString(content)
+}
+
+// strictParser discards only DefaultDiscardPrefixes, in strict mode
+var strictParser = func() *Parser {
+	p := NewParser(nil)
+	p.SetStrict(true)
+	return p
+}()
+
+// ParseStrict parses SSH public keys from a reader with the default discard
+// prefixes, in strict mode. See Parser.SetStrict.
+func ParseStrict(r io.Reader) (*ParseResult, error) {
+	return strictParser.Parse(r)
 }
 
 // isValidKey checks if a trimmed line is a valid SSH public key
-func isValidKey(line string) bool {
+func (p *Parser) isValidKey(line string) bool {
+	return p.checkKey(line) == ""
+}
+
+// checkKey returns why a trimmed line is not a valid SSH public key, or an
+// empty string if it is one
+func (p *Parser) checkKey(line string) string {
 	// Empty lines are not valid
 	if line == "" {
-		return false
+		return "empty line"
 	}
 
-	// Comment lines are not valid
+	// Comments, HTML/JSON error lines and extra prefixes are not valid
 	if strings.HasPrefix(line, "#") {
-		return false
+		return "comment"
 	}
-
-	// HTML/JSON error lines are not valid
-	if strings.HasPrefix(line, "<") || strings.HasPrefix(line, "{") || strings.HasPrefix(line, "[") {
-		return false
+	for _, prefix := range p.discardPrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return "starts with " + prefix
+		}
 	}
 
 	// Must have at least 2 whitespace-separated fields
 	fields := strings.Fields(line)
-	return len(fields) >= 2
+	if len(fields) < 2 {
+		return "not enough fields"
+	}
+
+	// The key type, after any options, must be recognized so that
+	// plain-text error pages are not taken for keys
+	parts, err := SplitKey(line)
+	if err != nil {
+		return err.Error()
+	}
+	if !IsSupportedKeyType(parts.Type) && !blobMatchesType(parts.Type, parts.Blob) {
+		return "unrecognized key type"
+	}
+
+	if p.strict {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+			return "invalid key: " + err.Error()
+		}
+	}
+	return ""
 }
 
 // IsValidKey is exported for testing purposes
 func IsValidKey(line string) bool {
-	return isValidKey(strings.TrimSpace(line))
+	return defaultParser.IsValidKey(line)
 }
@@ -132,6 +132,19 @@ func TestParse_WhitespaceTrimming(t *testing.T) {
 	assert.Equal(t, "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQ another@host", result.Keys[1].Line)
 }
 
+func TestParse_RawPreservesOriginalLine(t *testing.T) {
+	content := "  restrict  ssh-ed25519 AAAA user@host \r\n\tssh-rsa BBBB another@host\n"
+
+	result, err := ParseString(content)
+	require.NoError(t, err)
+	require.Len(t, result.Keys, 2)
+
+	assert.Equal(t, "restrict  ssh-ed25519 AAAA user@host", result.Keys[0].Line)
+	assert.Equal(t, "  restrict  ssh-ed25519 AAAA user@host ", result.Keys[0].Raw)
+	assert.Equal(t, "ssh-rsa BBBB another@host", result.Keys[1].Line)
+	assert.Equal(t, "\tssh-rsa BBBB another@host", result.Keys[1].Raw)
+}
+
 func TestIsValidKey(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -151,6 +164,9 @@ func TestIsValidKey(t *testing.T) {
 		{name: "whitespace only", line: "   ", expected: false},
 		{name: "with leading whitespace", line: "  ssh-ed25519 AAAA", expected: true},
 		{name: "with trailing whitespace", line: "ssh-ed25519 AAAA  ", expected: true},
+		{name: "plain text error", line: "404 page not found", expected: false},
+		{name: "yaml error", line: "error: unauthorized", expected: false},
+		{name: "options without key type", line: "restrict unknown-type AAAA", expected: false},
 	}
 
 	for _, tt := range tests {
@@ -161,6 +177,35 @@ func TestIsValidKey(t *testing.T) {
 	}
 }
 
+func TestParse_UnrecognizedKeyType(t *testing.T) {
+	content := `---
+error: rate limited
+Service Unavailable
+ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host`
+
+	result, err := ParseString(content)
+	require.NoError(t, err)
+	require.Len(t, result.Keys, 1)
+	assert.Equal(t, 4, result.Keys[0].LineNumber)
+	assert.Equal(t, 3, result.DiscardedLines)
+}
+
+func TestParser_DiscardPrefixes(t *testing.T) {
+	content := `ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host
+ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQ legacy@host
+# comment`
+
+	parser := NewParser([]string{"ssh-rsa", ""})
+	result, err := parser.ParseString(content)
+	require.NoError(t, err)
+	require.Len(t, result.Keys, 1)
+	assert.Equal(t, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host", result.Keys[0].Line)
+	assert.Equal(t, 2, result.DiscardedLines)
+
+	assert.False(t, parser.IsValidKey("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQ"))
+	assert.True(t, IsValidKey("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQ"))
+}
+
 func TestParse_LineNumbers(t *testing.T) {
 	content := `# Comment on line 1
 
@@ -203,3 +248,52 @@ func TestParse_LargeContent(t *testing.T) {
 	require.NoError(t, err)
 	assert.Len(t, result.Keys, 1000)
 }
+
+func TestParse_DiscardedReasons(t *testing.T) {
+	content := "# comment\n\n<html>\nnot-a-key\nssh-ed25519 AAAA user@host\nfoo-key AAAA x\n"
+
+	result, err := ParseString(content)
+	require.NoError(t, err)
+
+	assert.Len(t, result.Keys, 1)
+	assert.Equal(t, 4, result.DiscardedLines)
+	assert.Equal(t, []DiscardedLine{
+		{LineNumber: 1, Reason: "comment"},
+		{LineNumber: 3, Reason: "starts with <"},
+		{LineNumber: 4, Reason: "not enough fields"},
+		{LineNumber: 6, Reason: "unrecognized key type"},
+	}, result.Discarded)
+}
+
+func TestParseStrict(t *testing.T) {
+	valid := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW user@host"
+	content := strings.Join([]string{
+		valid,
+		`no-pty,command="/bin/true" ` + valid,
+		"ssh-ed25519 not-real-base64 junk",
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host",
+		"ssh-rsa AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW wrong-type@host",
+	}, "\n")
+
+	// The lenient parser only checks the shape of the lines
+	result, err := ParseString(content)
+	require.NoError(t, err)
+	assert.Len(t, result.Keys, 5)
+
+	result, err = ParseStrict(strings.NewReader(content))
+	require.NoError(t, err)
+	require.Len(t, result.Keys, 2)
+	assert.Equal(t, valid, result.Keys[0].Line)
+	assert.Equal(t, 3, result.DiscardedLines)
+	require.Len(t, result.Discarded, 3)
+	for i, discarded := range result.Discarded {
+		assert.Equal(t, i+3, discarded.LineNumber)
+		assert.Contains(t, discarded.Reason, "invalid key")
+	}
+
+	// Strict mode is also available on a Parser with extra prefixes
+	parser := NewParser([]string{"---"})
+	parser.SetStrict(true)
+	assert.True(t, parser.IsValidKey(valid))
+	assert.False(t, parser.IsValidKey("ssh-ed25519 not-real-base64 junk"))
+}
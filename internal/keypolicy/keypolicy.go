@@ -0,0 +1,197 @@
+// Package keypolicy restricts which SSH key types and sizes may be written.
+package keypolicy
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/eduardolat/authkeysync/internal/keyparser"
+)
+
+// Profile is a named preset of allowed key types and minimum key sizes
+type Profile string
+
+const (
+	// ProfileModern allows only Ed25519 keys (including security keys)
+	ProfileModern Profile = "modern"
+	// ProfileFIPS allows only RSA-3072+ and ECDSA P-384/P-521 keys
+	ProfileFIPS Profile = "fips"
+	// ProfileLegacy allows every supported key type, with RSA-1024+
+	ProfileLegacy Profile = "legacy"
+)
+
+var (
+	// ErrTypeNotAllowed is returned for keys whose type is not allowed
+	ErrTypeNotAllowed = errors.New("key type not allowed")
+	// ErrKeyTooWeak is returned for keys smaller than the minimum size
+	ErrKeyTooWeak = errors.New("key too weak")
+	// ErrUninspectable is returned for keys whose blob cannot be decoded
+	ErrUninspectable = errors.New("key cannot be inspected")
+)
+
+// Rules are the allowed key types and per-type minimum key sizes
+type Rules struct {
+	// AllowedTypes are the allowed key types, nil allows every type
+	AllowedTypes []string
+	// MinBits are the minimum key sizes in bits, by key type
+	MinBits map[string]int
+}
+
+// profiles are the rulesets of each profile
+var profiles = map[Profile]Rules{
+	ProfileModern: {
+		AllowedTypes: []string{
+			"ssh-ed25519",
+			"sk-ssh-ed25519@openssh.com",
+		},
+	},
+	ProfileFIPS: {
+		AllowedTypes: []string{
+			"ssh-rsa",
+			"ecdsa-sha2-nistp384",
+			"ecdsa-sha2-nistp521",
+		},
+		MinBits: map[string]int{"ssh-rsa": 3072},
+	},
+	ProfileLegacy: {
+		AllowedTypes: keyparser.SupportedKeyTypes,
+		MinBits:      map[string]int{"ssh-rsa": 1024},
+	},
+}
+
+// Profiles returns the names of all profiles
+func Profiles() []Profile {
+	return []Profile{ProfileModern, ProfileFIPS, ProfileLegacy}
+}
+
+// IsValidProfile returns true if name is a known profile
+func IsValidProfile(name string) bool {
+	_, ok := profiles[Profile(name)]
+	return ok
+}
+
+// ProfileRules returns the ruleset of a profile
+func ProfileRules(profile Profile) (Rules, bool) {
+	rules, ok := profiles[profile]
+	return rules, ok
+}
+
+// Names of the rules reported by Policy.Applied
+const (
+	// RuleAllowedTypes is the key type allowlist
+	RuleAllowedTypes = "allowed_types"
+	// RuleMinBits is the minimum key size, reported as "min_bits=N"
+	RuleMinBits = "min_bits"
+)
+
+// Policy checks keys against a set of rules.
+// A nil Policy allows every key.
+type Policy struct {
+	rules Rules
+}
+
+// New creates a Policy from a profile name and an explicit list of allowed
+// key types. Explicit types replace the profile's allowed types, while the
+// profile's minimum sizes still apply. Returns nil (allow everything) if
+// neither is set; an unknown profile is ignored.
+func New(profile string, allowedTypes []string) *Policy {
+	rules, ok := profiles[Profile(profile)]
+	if !ok && len(allowedTypes) == 0 {
+		return nil
+	}
+
+	if len(allowedTypes) > 0 {
+		rules.AllowedTypes = allowedTypes
+	}
+
+	return &Policy{rules: rules}
+}
+
+// WithMinBits returns a copy of the policy that also requires keys of
+// keyType to have at least bits bits. A minimum the policy already has is
+// only ever raised. A nil Policy becomes one that allows every key type.
+// bits <= 0 returns the policy unchanged.
+func (p *Policy) WithMinBits(keyType string, bits int) *Policy {
+	if bits <= 0 {
+		return p
+	}
+
+	var rules Rules
+	if p != nil {
+		rules = p.rules
+	}
+	minBits := make(map[string]int, len(rules.MinBits)+1)
+	maps.Copy(minBits, rules.MinBits)
+	minBits[keyType] = max(minBits[keyType], bits)
+	rules.MinBits = minBits
+
+	return &Policy{rules: rules}
+}
+
+// Check returns nil if the key line is allowed by the policy, or an error
+// wrapping ErrTypeNotAllowed, ErrKeyTooWeak or ErrUninspectable
+func (p *Policy) Check(line string) error {
+	if p == nil {
+		return nil
+	}
+
+	parts, err := keyparser.SplitKey(line)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUninspectable, err)
+	}
+
+	if p.rules.AllowedTypes != nil && !slices.Contains(p.rules.AllowedTypes, parts.Type) {
+		return fmt.Errorf("%w: %s", ErrTypeNotAllowed, parts.Type)
+	}
+
+	minBits, hasMin := p.rules.MinBits[parts.Type]
+	if !hasMin {
+		return nil
+	}
+
+	info, err := keyparser.InspectBlob(parts.Blob)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUninspectable, err)
+	}
+	if info.Type != parts.Type {
+		return fmt.Errorf("%w: blob type %s does not match %s", ErrUninspectable, info.Type, parts.Type)
+	}
+	if info.Bits < minBits {
+		return fmt.Errorf("%w: %s has %d bits, at least %d required", ErrKeyTooWeak, parts.Type, info.Bits, minBits)
+	}
+
+	return nil
+}
+
+// AllowedTypes returns the key types allowed by the policy.
+// Returns nil if every key type is allowed, as by a nil Policy.
+func (p *Policy) AllowedTypes() []string {
+	if p == nil {
+		return nil
+	}
+	return slices.Clone(p.rules.AllowedTypes)
+}
+
+// Applied returns the rules a key line is checked against, in the order Check
+// applies them, so for an allowed key these are the rules it passed.
+// A nil Policy applies no rules.
+func (p *Policy) Applied(line string) []string {
+	if p == nil {
+		return nil
+	}
+
+	var rules []string
+	if p.rules.AllowedTypes != nil {
+		rules = append(rules, RuleAllowedTypes)
+	}
+	parts, err := keyparser.SplitKey(line)
+	if err != nil {
+		return rules
+	}
+	if minBits, ok := p.rules.MinBits[parts.Type]; ok {
+		rules = append(rules, fmt.Sprintf("%s=%d", RuleMinBits, minBits))
+	}
+	return rules
+}
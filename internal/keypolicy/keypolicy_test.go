@@ -0,0 +1,128 @@
+package keypolicy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKey builds an authorized_keys line from its SSH wire format fields
+func testKey(keyType string, fields ...[]byte) string {
+	var data []byte
+	for _, field := range append([][]byte{[]byte(keyType)}, fields...) {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(field)))
+		data = append(data, field...)
+	}
+	return keyType + " " + base64.StdEncoding.EncodeToString(data) + " user@host"
+}
+
+// testRSAKey builds an RSA key line with the given modulus size
+func testRSAKey(bits int) string {
+	n := new(big.Int).Lsh(big.NewInt(1), uint(bits-1)).Bytes()
+	return testKey("ssh-rsa", []byte{0x01, 0x00, 0x01}, n)
+}
+
+func TestPolicy_Check(t *testing.T) {
+	ed25519 := testKey("ssh-ed25519", make([]byte, 32))
+	ecdsa256 := testKey("ecdsa-sha2-nistp256", []byte("nistp256"), make([]byte, 65))
+	ecdsa384 := testKey("ecdsa-sha2-nistp384", []byte("nistp384"), make([]byte, 97))
+	dsa := testKey("ssh-dss", make([]byte, 128), make([]byte, 20), make([]byte, 128), make([]byte, 128))
+
+	tests := []struct {
+		name         string
+		profile      string
+		allowedTypes []string
+		line         string
+		wantErr      error
+	}{
+		{name: "modern allows ed25519", profile: "modern", line: ed25519},
+		{name: "modern rejects rsa", profile: "modern", line: testRSAKey(4096), wantErr: ErrTypeNotAllowed},
+		{name: "modern rejects ecdsa", profile: "modern", line: ecdsa384, wantErr: ErrTypeNotAllowed},
+		{name: "fips allows rsa 3072", profile: "fips", line: testRSAKey(3072)},
+		{name: "fips rejects rsa 2048", profile: "fips", line: testRSAKey(2048), wantErr: ErrKeyTooWeak},
+		{name: "fips allows ecdsa p384", profile: "fips", line: ecdsa384},
+		{name: "fips rejects ecdsa p256", profile: "fips", line: ecdsa256, wantErr: ErrTypeNotAllowed},
+		{name: "fips rejects ed25519", profile: "fips", line: ed25519, wantErr: ErrTypeNotAllowed},
+		{name: "fips rejects fake rsa blob", profile: "fips", line: "ssh-rsa AAAA user@host", wantErr: ErrUninspectable},
+		{name: "legacy allows dsa", profile: "legacy", line: dsa},
+		{name: "legacy rejects rsa 768", profile: "legacy", line: testRSAKey(768), wantErr: ErrKeyTooWeak},
+		{name: "explicit types override profile", profile: "fips", allowedTypes: []string{"ssh-ed25519"}, line: ed25519},
+		{name: "explicit types keep profile minimums", profile: "fips", allowedTypes: []string{"ssh-rsa"}, line: testRSAKey(2048), wantErr: ErrKeyTooWeak},
+		{name: "explicit types without profile", allowedTypes: []string{"ssh-rsa"}, line: testRSAKey(1024)},
+		{name: "explicit types reject others", allowedTypes: []string{"ssh-rsa"}, line: ed25519, wantErr: ErrTypeNotAllowed},
+		{name: "options are skipped", profile: "modern", line: "restrict,command=\"a b\" " + ed25519},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := New(tt.profile, tt.allowedTypes)
+			require.NotNil(t, policy)
+
+			err := policy.Check(tt.line)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestPolicy_Applied(t *testing.T) {
+	ed25519 := testKey("ssh-ed25519", make([]byte, 32))
+	rsa := testRSAKey(4096)
+
+	assert.Nil(t, New("", nil).Applied(ed25519))
+	assert.Equal(t, []string{"allowed_types"}, New("modern", nil).Applied(ed25519))
+	assert.Equal(t, []string{"allowed_types", "min_bits=3072"}, New("fips", nil).Applied(rsa))
+	assert.Equal(t, []string{"allowed_types"}, New("", []string{"ssh-rsa"}).Applied(rsa))
+}
+
+func TestPolicy_AllowedTypes(t *testing.T) {
+	assert.Nil(t, New("", nil).AllowedTypes())
+	assert.Equal(t, []string{"ssh-ed25519", "sk-ssh-ed25519@openssh.com"}, New("modern", nil).AllowedTypes())
+	assert.Equal(t, []string{"ssh-rsa"}, New("fips", []string{"ssh-rsa"}).AllowedTypes())
+}
+
+func TestPolicy_WithMinBits(t *testing.T) {
+	ed25519 := testKey("ssh-ed25519", make([]byte, 32))
+
+	// Without a profile every type stays allowed
+	policy := New("", nil).WithMinBits("ssh-rsa", 3072)
+	require.NotNil(t, policy)
+	assert.NoError(t, policy.Check(ed25519))
+	assert.NoError(t, policy.Check(testRSAKey(3072)))
+	assert.ErrorIs(t, policy.Check(testRSAKey(2048)), ErrKeyTooWeak)
+	assert.Nil(t, policy.AllowedTypes())
+	assert.Equal(t, []string{"min_bits=3072"}, policy.Applied(testRSAKey(4096)))
+
+	// A profile minimum is raised, never lowered
+	assert.ErrorIs(t, New("legacy", nil).WithMinBits("ssh-rsa", 3072).Check(testRSAKey(2048)), ErrKeyTooWeak)
+	assert.ErrorIs(t, New("fips", nil).WithMinBits("ssh-rsa", 2048).Check(testRSAKey(2048)), ErrKeyTooWeak)
+	assert.ErrorIs(t, New("", []string{"ssh-ed25519"}).WithMinBits("ssh-rsa", 2048).Check(testRSAKey(4096)), ErrTypeNotAllowed)
+
+	// The profile itself is left untouched
+	assert.NoError(t, New("legacy", nil).Check(testRSAKey(2048)))
+
+	assert.Nil(t, New("", nil).WithMinBits("ssh-rsa", 0))
+}
+
+func TestNew_NoRestrictions(t *testing.T) {
+	policy := New("", nil)
+	assert.Nil(t, policy)
+	assert.NoError(t, policy.Check("anything goes"))
+}
+
+func TestIsValidProfile(t *testing.T) {
+	for _, profile := range Profiles() {
+		assert.True(t, IsValidProfile(string(profile)))
+		_, ok := ProfileRules(profile)
+		assert.True(t, ok)
+	}
+	assert.False(t, IsValidProfile("paranoid"))
+	assert.False(t, IsValidProfile(""))
+}
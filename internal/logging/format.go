@@ -0,0 +1,27 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Log formats
+const (
+	// FormatText writes each record as key=value pairs (the default)
+	FormatText = "text"
+	// FormatJSON writes each record as a JSON object on its own line
+	FormatJSON = "json"
+)
+
+// NewHandler returns a handler writing records to w in the given format
+func NewHandler(w io.Writer, format string, opts *slog.HandlerOptions) (slog.Handler, error) {
+	switch format {
+	case FormatText:
+		return slog.NewTextHandler(w, opts), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q (supported: %s, %s)", format, FormatText, FormatJSON)
+	}
+}
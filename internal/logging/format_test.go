@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHandler(t *testing.T) {
+	opts := &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+
+	t.Run("text", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		handler, err := NewHandler(buf, FormatText, opts)
+		require.NoError(t, err)
+
+		logger := slog.New(handler)
+		logger.Debug("hidden")
+		logger.Info("AuthKeySync starting", "version", "1.0.0", "dry_run", true)
+
+		assert.Equal(t, "level=INFO msg=\"AuthKeySync starting\" version=1.0.0 dry_run=true\n", buf.String())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		handler, err := NewHandler(buf, FormatJSON, opts)
+		require.NoError(t, err)
+
+		logger := slog.New(handler)
+		logger.Debug("hidden")
+		logger.With("username", "alice").Error("failed to write authorized_keys", "error", errors.New("permission denied"), "keys", 2)
+
+		var record map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+		assert.Equal(t, map[string]any{
+			"level":    "ERROR",
+			"msg":      "failed to write authorized_keys",
+			"username": "alice",
+			"error":    "permission denied",
+			"keys":     float64(2),
+		}, record)
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		_, err := NewHandler(&bytes.Buffer{}, "logfmt", opts)
+		assert.ErrorContains(t, err, `invalid log format "logfmt"`)
+	})
+}
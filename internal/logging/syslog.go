@@ -0,0 +1,154 @@
+// Package logging provides log handlers for destinations other than stdout.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultSyslogTag is the default tag of syslog messages
+const DefaultSyslogTag = "authkeysync"
+
+// DefaultSyslogFacility is the default syslog facility
+const DefaultSyslogFacility = "daemon"
+
+// facilities are the supported syslog facilities by name
+var facilities = map[string]syslog.Priority{
+	"user":     syslog.LOG_USER,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"cron":     syslog.LOG_CRON,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// Facilities returns the names of the supported syslog facilities
+func Facilities() []string {
+	names := make([]string, 0, len(facilities))
+	for name := range facilities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// syslogWriter is the subset of *syslog.Writer used by the handler
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// NewSyslogHandler connects to the local syslog daemon and returns a handler
+// that sends each record in the given format (key=value text or JSON) with a
+// matching severity. Time and level are left to syslog, which records both.
+func NewSyslogHandler(facility, tag, format string, opts *slog.HandlerOptions) (slog.Handler, error) {
+	priority, ok := facilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("invalid syslog facility %q (supported: %s)", facility, strings.Join(Facilities(), ", "))
+	}
+
+	// Check the format before connecting
+	if _, err := NewHandler(io.Discard, format, opts); err != nil {
+		return nil, err
+	}
+
+	w, err := syslog.New(priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+
+	return newSyslogHandler(w, format, opts)
+}
+
+// syslogHandler formats records with a text or JSON handler and writes them
+// to syslog
+type syslogHandler struct {
+	w         syslogWriter
+	formatter slog.Handler
+	buf       *bytes.Buffer
+	mu        *sync.Mutex
+}
+
+// newSyslogHandler creates a handler writing to w in the given format
+func newSyslogHandler(w syslogWriter, format string, opts *slog.HandlerOptions) (*syslogHandler, error) {
+	formatOpts := &slog.HandlerOptions{}
+	if opts != nil {
+		*formatOpts = *opts
+	}
+	replace := formatOpts.ReplaceAttr
+	formatOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+			return slog.Attr{}
+		}
+		if replace != nil {
+			return replace(groups, a)
+		}
+		return a
+	}
+
+	buf := &bytes.Buffer{}
+	formatter, err := NewHandler(buf, format, formatOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogHandler{
+		w:         w,
+		formatter: formatter,
+		buf:       buf,
+		mu:        &sync.Mutex{},
+	}, nil
+}
+
+// Enabled reports whether the handler handles records at the given level
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.formatter.Enabled(ctx, level)
+}
+
+// Handle formats the record and writes it with the severity of its level
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buf.Reset()
+	if err := h.formatter.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(h.buf.String(), "\n")
+
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(msg)
+	default:
+		return h.w.Debug(msg)
+	}
+}
+
+// WithAttrs returns a handler that adds attrs to every record
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{w: h.w, formatter: h.formatter.WithAttrs(attrs), buf: h.buf, mu: h.mu}
+}
+
+// WithGroup returns a handler that qualifies later attributes with name
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{w: h.w, formatter: h.formatter.WithGroup(name), buf: h.buf, mu: h.mu}
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSyslog records messages by severity
+type fakeSyslog struct {
+	messages []string
+}
+
+func (f *fakeSyslog) Debug(m string) error {
+	f.messages = append(f.messages, "debug: "+m)
+	return nil
+}
+
+func (f *fakeSyslog) Info(m string) error {
+	f.messages = append(f.messages, "info: "+m)
+	return nil
+}
+
+func (f *fakeSyslog) Warning(m string) error {
+	f.messages = append(f.messages, "warning: "+m)
+	return nil
+}
+
+func (f *fakeSyslog) Err(m string) error {
+	f.messages = append(f.messages, "err: "+m)
+	return nil
+}
+
+func TestSyslogHandler(t *testing.T) {
+	w := &fakeSyslog{}
+	handler, err := newSyslogHandler(w, FormatText, &slog.HandlerOptions{Level: slog.LevelInfo})
+	require.NoError(t, err)
+	logger := slog.New(handler)
+
+	logger.Debug("hidden")
+	logger.Info("processing user", "username", "alice")
+	logger.With("username", "bob").Warn("user not found in system, skipping")
+	logger.Error("failed to write authorized_keys", "error", "permission denied")
+
+	assert.Equal(t, []string{
+		`info: msg="processing user" username=alice`,
+		`warning: msg="user not found in system, skipping" username=bob`,
+		`err: msg="failed to write authorized_keys" error="permission denied"`,
+	}, w.messages)
+}
+
+func TestSyslogHandler_JSON(t *testing.T) {
+	w := &fakeSyslog{}
+	handler, err := newSyslogHandler(w, FormatJSON, &slog.HandlerOptions{Level: slog.LevelInfo})
+	require.NoError(t, err)
+	logger := slog.New(handler)
+
+	logger.Info("processing user", "username", "alice")
+	logger.With("username", "bob").Warn("user not found in system, skipping")
+
+	assert.Equal(t, []string{
+		`info: {"msg":"processing user","username":"alice"}`,
+		`warning: {"msg":"user not found in system, skipping","username":"bob"}`,
+	}, w.messages)
+}
+
+func TestNewSyslogHandler_InvalidFacility(t *testing.T) {
+	_, err := NewSyslogHandler("kernel", DefaultSyslogTag, FormatText, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid syslog facility "kernel"`)
+}
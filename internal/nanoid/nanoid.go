@@ -2,24 +2,56 @@
 package nanoid
 
 import (
+	"errors"
+	"fmt"
+
 	gonanoid "github.com/matoous/go-nanoid/v2"
 )
 
 const (
-	// alphabet contains only lowercase letters as per spec
-	alphabet = "abcdefghijklmnopqrstuvwxyz"
-	// idLength is the length of generated IDs (6 characters = 26^6 = 308,915,776 combinations)
-	idLength = 6
+	// DefaultAlphabet contains only lowercase letters as per spec
+	DefaultAlphabet = "abcdefghijklmnopqrstuvwxyz"
+	// DefaultLength is the length of IDs from Generate (6 characters = 26^6 = 308,915,776 combinations)
+	DefaultLength = 6
 )
 
 // Generate creates a new NanoID with 6 lowercase letters.
 // Uses crypto/rand for secure random generation.
 func Generate() (string, error) {
-	return gonanoid.Generate(alphabet, idLength)
+	return GenerateN(DefaultLength)
+}
+
+// GenerateN creates a new NanoID with length lowercase letters, for callers
+// that need fewer collisions than Generate gives, e.g. 10 letters for
+// 26^10 (about 1.4 * 10^14) combinations
+func GenerateN(length int) (string, error) {
+	return GenerateWithAlphabet(DefaultAlphabet, length)
+}
+
+// GenerateWithAlphabet creates a new NanoID with length characters of
+// alphabet. Random bytes are masked to the next power of two and values
+// beyond the alphabet are drawn again, so every character is equally likely
+// even when the alphabet size is not a power of two. The alphabet must not
+// repeat a character, which would make it more likely.
+func GenerateWithAlphabet(alphabet string, length int) (string, error) {
+	if length <= 0 {
+		return "", fmt.Errorf("invalid ID length %d, must be positive", length)
+	}
+	seen := make(map[rune]bool, len(alphabet))
+	for _, char := range alphabet {
+		if seen[char] {
+			return "", fmt.Errorf("alphabet repeats the character %q", char)
+		}
+		seen[char] = true
+	}
+	if len(seen) < 2 || len(alphabet) > 255 {
+		return "", errors.New("alphabet must have between 2 and 255 characters")
+	}
+	return gonanoid.Generate(alphabet, length)
 }
 
 // MustGenerate creates a new NanoID and panics on error.
 // Use only when you're certain random generation won't fail.
 func MustGenerate() string {
-	return gonanoid.MustGenerate(alphabet, idLength)
+	return gonanoid.MustGenerate(DefaultAlphabet, DefaultLength)
 }
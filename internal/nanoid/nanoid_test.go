@@ -83,3 +83,53 @@ func TestGenerate_Alphabet(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateN(t *testing.T) {
+	for _, length := range []int{1, 6, 10, 32} {
+		id, err := GenerateN(length)
+		require.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile(`^[a-z]+$`), id)
+		assert.Len(t, id, length)
+	}
+
+	_, err := GenerateN(0)
+	assert.ErrorContains(t, err, "invalid ID length 0")
+}
+
+func TestGenerateWithAlphabet(t *testing.T) {
+	id, err := GenerateWithAlphabet("0123456789abcdef", 12)
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{12}$`), id)
+
+	tests := []struct {
+		name     string
+		alphabet string
+		errMsg   string
+	}{
+		{name: "empty", alphabet: "", errMsg: "between 2 and 255 characters"},
+		{name: "single character", alphabet: "a", errMsg: "between 2 and 255 characters"},
+		{name: "repeated character", alphabet: "abca", errMsg: `repeats the character 'a'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := GenerateWithAlphabet(tt.alphabet, 6)
+			assert.ErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
+
+func TestGenerateWithAlphabet_Uniform(t *testing.T) {
+	// Every character of an alphabet whose size is not a power of two is
+	// about equally likely
+	const samples = 30000
+	id, err := GenerateWithAlphabet("abc", samples)
+	require.NoError(t, err)
+
+	counts := make(map[rune]int)
+	for _, char := range id {
+		counts[char]++
+	}
+	for _, char := range "abc" {
+		assert.InDelta(t, samples/3, counts[char], samples/30, "count of %c", char)
+	}
+}
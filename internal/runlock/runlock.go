@@ -0,0 +1,83 @@
+// Package runlock prevents concurrent runs of AuthKeySync with an exclusive
+// advisory lock (flock) on a lock file.
+package runlock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockFileMode is the mode of a new lock file, readable by everyone so that
+// the PID of the holder can be checked
+const lockFileMode = 0644
+
+// ErrLocked indicates that another process holds the lock
+var ErrLocked = errors.New("another authkeysync process is running")
+
+// Lock is a held run lock
+type Lock struct {
+	file *os.File
+}
+
+// DefaultPath returns the default lock file: /run/authkeysync.lock, or
+// /var/run/authkeysync.lock on macOS, which has no /run
+func DefaultPath() string {
+	if runtime.GOOS == "darwin" {
+		return "/var/run/authkeysync.lock"
+	}
+	return "/run/authkeysync.lock"
+}
+
+// Acquire takes the lock on path without waiting, creating the file if
+// needed, and writes the PID of this process into it. Returns an error
+// wrapping ErrLocked, with the PID of the holder when known, if another
+// process holds the lock. The lock is released by Release or when the
+// process exits, however it exits.
+func Acquire(path string) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, lockFileMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer func() { _ = file.Close() }()
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if pid := holderPID(file); pid > 0 {
+			return nil, fmt.Errorf("%w: %s is held by pid %d", ErrLocked, path, pid)
+		}
+		return nil, fmt.Errorf("%w: %s is held by another process", ErrLocked, path)
+	}
+
+	// The PID is only informative, the flock is what excludes other runs
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// Release releases the lock. The lock file is left in place: removing it
+// would let a process that already opened it lock a file nobody else sees.
+func (l *Lock) Release() error {
+	_ = l.file.Truncate(0)
+	// Closing the descriptor releases the flock
+	return l.file.Close()
+}
+
+// holderPID returns the PID written in a lock file by its holder, or 0
+func holderPID(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
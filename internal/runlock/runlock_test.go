@@ -0,0 +1,42 @@
+package runlock
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authkeysync.lock")
+
+	lock, err := Acquire(path)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(content))
+
+	// flock locks belong to the open file, so a second open conflicts even
+	// within the same process
+	_, err = Acquire(path)
+	require.ErrorIs(t, err, ErrLocked)
+	assert.Contains(t, err.Error(), "is held by pid "+strconv.Itoa(os.Getpid()))
+
+	require.NoError(t, lock.Release())
+	assert.FileExists(t, path)
+
+	lock, err = Acquire(path)
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+}
+
+func TestAcquire_MissingDirectory(t *testing.T) {
+	_, err := Acquire(filepath.Join(t.TempDir(), "missing", "authkeysync.lock"))
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrLocked)
+	assert.Contains(t, err.Error(), "failed to open lock file")
+}
@@ -0,0 +1,94 @@
+package sshfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Markers of the managed block of authorized_keys
+const (
+	ManagedBlockBegin = "# BEGIN AUTHKEYSYNC"
+	ManagedBlockEnd   = "# END AUTHKEYSYNC"
+)
+
+// ErrInvalidManagedBlock indicates markers that do not delimit exactly one
+// managed block
+var ErrInvalidManagedBlock = errors.New("invalid managed block")
+
+// ManagedBlock is authorized_keys content split around its managed block
+type ManagedBlock struct {
+	// Before is the content before the begin marker, verbatim
+	Before []byte
+	// Inner is the content between the markers
+	Inner []byte
+	// After is the content after the end marker, verbatim
+	After []byte
+	// Found is false if the content has no markers yet
+	Found bool
+}
+
+// SplitManagedBlock splits authorized_keys content around the lines holding
+// the begin and end markers. Surrounding whitespace of a marker line is
+// ignored. Content without markers is kept whole in Before. Returns an error
+// wrapping ErrInvalidManagedBlock for a marker without its pair, markers out
+// of order or more than one block.
+func SplitManagedBlock(content []byte) (*ManagedBlock, error) {
+	begin, end := -1, -1
+	innerStart, afterStart := 0, 0
+	for offset := 0; offset < len(content); {
+		next := len(content)
+		if i := bytes.IndexByte(content[offset:], '\n'); i >= 0 {
+			next = offset + i + 1
+		}
+
+		switch strings.TrimSpace(string(content[offset:next])) {
+		case ManagedBlockBegin:
+			if begin >= 0 {
+				return nil, fmt.Errorf("%w: more than one %q line", ErrInvalidManagedBlock, ManagedBlockBegin)
+			}
+			begin, innerStart = offset, next
+		case ManagedBlockEnd:
+			if begin < 0 {
+				return nil, fmt.Errorf("%w: %q line without %q before it", ErrInvalidManagedBlock, ManagedBlockEnd, ManagedBlockBegin)
+			}
+			if end >= 0 {
+				return nil, fmt.Errorf("%w: more than one %q line", ErrInvalidManagedBlock, ManagedBlockEnd)
+			}
+			end, afterStart = offset, next
+		}
+		offset = next
+	}
+
+	switch {
+	case begin < 0:
+		return &ManagedBlock{Before: content}, nil
+	case end < 0:
+		return nil, fmt.Errorf("%w: %q line without %q after it", ErrInvalidManagedBlock, ManagedBlockBegin, ManagedBlockEnd)
+	}
+	return &ManagedBlock{
+		Before: content[:begin],
+		Inner:  content[innerStart:end],
+		After:  content[afterStart:],
+		Found:  true,
+	}, nil
+}
+
+// Replace returns the content with inner between the markers. Without
+// markers, a block is appended after the existing content.
+func (b *ManagedBlock) Replace(inner []byte) []byte {
+	var out bytes.Buffer
+	out.Write(b.Before)
+	if len(b.Before) > 0 && !bytes.HasSuffix(b.Before, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	out.WriteString(ManagedBlockBegin + "\n")
+	out.Write(inner)
+	if len(inner) > 0 && !bytes.HasSuffix(inner, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	out.WriteString(ManagedBlockEnd + "\n")
+	out.Write(b.After)
+	return out.Bytes()
+}
@@ -3,9 +3,13 @@ package sshfile
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/eduardolat/authkeysync/internal/nanoid"
@@ -16,6 +20,32 @@ const (
 	AuthKeysMode = 0600
 	// TempFilePrefix is the prefix for temporary files
 	TempFilePrefix = ".authkeysync_"
+	// StaleTempFileAge is the age after which a leftover temp file is considered stale
+	StaleTempFileAge = time.Hour
+	// AuthKeysFileName is the default name of the authorized_keys file
+	AuthKeysFileName = "authorized_keys"
+	// LockFileName is the name of the advisory lock file of the default
+	// authorized_keys file, see LockPath
+	LockFileName = ".authorized_keys.lock"
+	// ChangelogFileName is the name of the key changelog of the default
+	// authorized_keys file, see ChangelogPath
+	ChangelogFileName = "authorized_keys_changelog"
+	// LockTimeout is the default time to wait for the advisory lock
+	LockTimeout = 30 * time.Second
+	// lockRetryInterval is the delay between lock attempts
+	lockRetryInterval = 100 * time.Millisecond
+	// DefaultRenameRetries is the default number of times a rename failing
+	// with a transient error (EBUSY, ETXTBSY) is retried
+	DefaultRenameRetries = 3
+	// renameRetryInterval is the delay between rename attempts
+	renameRetryInterval = 50 * time.Millisecond
+)
+
+var (
+	// ErrLockTimeout indicates the advisory lock could not be acquired in time
+	ErrLockTimeout = errors.New("timed out waiting for authorized_keys lock")
+	// ErrVerifyFailed indicates the written file does not match what was intended
+	ErrVerifyFailed = errors.New("authorized_keys verification failed")
 )
 
 // Writer handles atomic file writes
@@ -24,21 +54,70 @@ type Writer struct {
 	idGenerator func() (string, error)
 	// timeNow allows for dependency injection in tests
 	timeNow func() time.Time
+	// rename allows for dependency injection in tests
+	rename func(oldpath, newpath string) error
+	// renameRetries is how often a transiently failing rename is retried
+	renameRetries int
+	// verifyAfterWrite enables reading the file back after each write
+	verifyAfterWrite bool
+	// durableWrites enables fsyncing the directory after each rename
+	durableWrites bool
+	// tempFilePrefix is the filename prefix of temporary files
+	tempFilePrefix string
 }
 
 // New creates a new Writer
 func New() *Writer {
 	return &Writer{
-		idGenerator: nanoid.Generate,
-		timeNow:     time.Now,
+		idGenerator:    nanoid.Generate,
+		timeNow:        time.Now,
+		rename:         os.Rename,
+		renameRetries:  DefaultRenameRetries,
+		tempFilePrefix: TempFilePrefix,
 	}
 }
 
 // NewWithDeps creates a new Writer with custom dependencies (for testing)
 func NewWithDeps(idGen func() (string, error), timeNow func() time.Time) *Writer {
 	return &Writer{
-		idGenerator: idGen,
-		timeNow:     timeNow,
+		idGenerator:    idGen,
+		timeNow:        timeNow,
+		rename:         os.Rename,
+		renameRetries:  DefaultRenameRetries,
+		tempFilePrefix: TempFilePrefix,
+	}
+}
+
+// SetVerifyAfterWrite enables or disables verifying every written file by
+// reading it back after the rename (see Verify)
+func (w *Writer) SetVerifyAfterWrite(verify bool) {
+	w.verifyAfterWrite = verify
+}
+
+// SetDurableWrites enables or disables fsyncing the .ssh directory after the
+// rename, so the new directory entry survives a crash or power loss
+func (w *Writer) SetDurableWrites(durable bool) {
+	w.durableWrites = durable
+}
+
+// SetRenameRetries sets how many times the final rename is retried when it
+// fails with a transient error, as seen on some overlay filesystems
+func (w *Writer) SetRenameRetries(retries int) {
+	w.renameRetries = retries
+}
+
+// SetTempFilePrefix sets the filename prefix of temporary files, both for
+// creating them and for finding stale ones in CleanupStaleTempFiles
+func (w *Writer) SetTempFilePrefix(prefix string) {
+	w.tempFilePrefix = prefix
+}
+
+// SetIDLength sets the length of the random ID in temporary filenames
+// (default: 6 letters). Longer IDs make collisions less likely when many
+// files are written in the same second.
+func (w *Writer) SetIDLength(length int) {
+	w.idGenerator = func() (string, error) {
+		return nanoid.GenerateN(length)
 	}
 }
 
@@ -50,37 +129,127 @@ type WriteResult struct {
 	Path string
 }
 
-// WriteAtomic atomically writes content to the authorized_keys file.
+// LockPath returns the advisory lock file of an authorized_keys file: a
+// hidden file named after it in the same directory
+func LockPath(authKeysPath string) string {
+	return filepath.Join(filepath.Dir(authKeysPath), "."+filepath.Base(authKeysPath)+".lock")
+}
+
+// ChangelogPath returns the key changelog of an authorized_keys file, named
+// after it in the same directory
+func ChangelogPath(authKeysPath string) string {
+	return authKeysPath + "_changelog"
+}
+
+// WriteAtomic atomically writes content to the authorized_keys file at authKeysPath.
 // It uses the atomic write procedure specified in the spec:
 // 1. Create temp file in the same directory
 // 2. Set permissions (0600)
 // 3. Set ownership (uid:gid)
 // 4. Write content and fsync
-// 5. Atomic rename
+// 5. Atomic rename (retried on transient errors, see SetRenameRetries)
+// 6. Directory fsync (only if enabled with SetDurableWrites)
+// 7. Read-back verification (only if enabled with SetVerifyAfterWrite)
 //
 // Returns whether the file was changed (different content).
-func (w *Writer) WriteAtomic(sshDir string, content []byte, uid, gid int) (*WriteResult, error) {
-	authKeysPath := filepath.Join(sshDir, "authorized_keys")
-
+// A failed verification returns an error wrapping ErrVerifyFailed.
+func (w *Writer) WriteAtomic(authKeysPath string, content []byte, uid, gid int) (*WriteResult, error) {
 	// Check if content is different from existing file
 	existingContent, err := os.ReadFile(authKeysPath)
 	if err == nil && bytes.Equal(existingContent, content) {
 		return &WriteResult{Changed: false, Path: authKeysPath}, nil
 	}
 
+	if err := w.replaceFile(authKeysPath, content, uid, gid); err != nil {
+		return nil, err
+	}
+
+	if w.verifyAfterWrite {
+		if err := Verify(authKeysPath, content, uid, gid); err != nil {
+			return nil, err
+		}
+	}
+
+	return &WriteResult{Changed: true, Path: authKeysPath}, nil
+}
+
+// AppendChangelog appends entry to the key changelog of the authorized_keys
+// file at authKeysPath, then drops its oldest lines until it is at most
+// maxBytes long (0 means unlimited). The changelog is replaced atomically
+// like authorized_keys. A symlink or other non-regular file at its path is
+// replaced without being read.
+func (w *Writer) AppendChangelog(authKeysPath string, entry []byte, maxBytes, uid, gid int) error {
+	path := ChangelogPath(authKeysPath)
+
+	existing, err := readRegularFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read changelog: %w", err)
+	}
+
+	content := append(existing, entry...)
+	if maxBytes > 0 && len(content) > maxBytes {
+		cut := len(content) - maxBytes
+		// Never keep a partial line at the start
+		if content[cut-1] != '\n' {
+			next := bytes.IndexByte(content[cut:], '\n')
+			if next < 0 {
+				cut = len(content)
+			} else {
+				cut += next + 1
+			}
+		}
+		content = content[cut:]
+	}
+
+	if err := w.replaceFile(path, content, uid, gid); err != nil {
+		return fmt.Errorf("failed to write changelog: %w", err)
+	}
+	return nil
+}
+
+// readRegularFile returns the content of path, or nil if it does not exist or
+// is not a regular file. The directory is writable by the user, so a symlink
+// at path is never followed: root would read its target into a file the user
+// owns. O_NONBLOCK keeps a FIFO from blocking the open.
+func readRegularFile(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ELOOP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, nil
+	}
+	return io.ReadAll(f)
+}
+
+// replaceFile atomically replaces path with content through a temp file in
+// the same directory, with mode 0600 and uid:gid ownership (steps 1-6 of
+// WriteAtomic)
+func (w *Writer) replaceFile(path string, content []byte, uid, gid int) error {
+	dir := filepath.Dir(path)
+
 	// Generate temp filename
 	timestamp := w.timeNow().UTC().Format("20060102_150405")
 	id, err := w.idGenerator()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate temp file ID: %w", err)
+		return fmt.Errorf("failed to generate temp file ID: %w", err)
 	}
-	tempFilename := fmt.Sprintf("%s%s_%s", TempFilePrefix, timestamp, id)
-	tempPath := filepath.Join(sshDir, tempFilename)
+	tempFilename := fmt.Sprintf("%s%s_%s", w.tempFilePrefix, timestamp, id)
+	tempPath := filepath.Join(dir, tempFilename)
 
 	// Create temp file
 	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_EXCL, AuthKeysMode)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp file: %w", err)
+		return fmt.Errorf("failed to create temp file: %w", err)
 	}
 
 	// Ensure cleanup on error
@@ -94,43 +263,238 @@ func (w *Writer) WriteAtomic(sshDir string, content []byte, uid, gid int) (*Writ
 
 	// Set permissions explicitly (in case umask affected file creation)
 	if err := tempFile.Chmod(AuthKeysMode); err != nil {
-		return nil, fmt.Errorf("failed to set temp file permissions: %w", err)
+		return fmt.Errorf("failed to set temp file permissions: %w", err)
 	}
 
 	// Set ownership
 	if err := os.Chown(tempPath, uid, gid); err != nil {
-		return nil, fmt.Errorf("failed to set temp file ownership: %w", err)
+		return fmt.Errorf("failed to set temp file ownership: %w", err)
 	}
 
 	// Write content
 	if _, err := tempFile.Write(content); err != nil {
-		return nil, fmt.Errorf("failed to write content: %w", err)
+		return fmt.Errorf("failed to write content: %w", err)
 	}
 
 	// Sync to disk
 	if err := tempFile.Sync(); err != nil {
-		return nil, fmt.Errorf("failed to sync temp file: %w", err)
+		return fmt.Errorf("failed to sync temp file: %w", err)
 	}
 
 	// Close before rename
 	if err := tempFile.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close temp file: %w", err)
+		return fmt.Errorf("failed to close temp file: %w", err)
 	}
 
 	// Atomic rename
-	if err := os.Rename(tempPath, authKeysPath); err != nil {
-		return nil, fmt.Errorf("failed to rename temp file: %w", err)
+	if err := w.renameWithRetry(tempPath, path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
 	}
 
 	success = true
-	return &WriteResult{Changed: true, Path: authKeysPath}, nil
+
+	if w.durableWrites {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// ReadContent reads the current content of the authorized_keys file.
-// Returns empty byte slice if file doesn't exist.
-func ReadContent(sshDir string) ([]byte, error) {
-	authKeysPath := filepath.Join(sshDir, "authorized_keys")
+// renameWithRetry renames a file, retrying transient errors (EBUSY, ETXTBSY)
+// up to renameRetries times
+func (w *Writer) renameWithRetry(oldpath, newpath string) error {
+	for attempt := 0; ; attempt++ {
+		err := w.rename(oldpath, newpath)
+		if err == nil {
+			return nil
+		}
+		if attempt >= w.renameRetries || !isTransientRenameError(err) {
+			return err
+		}
+		time.Sleep(renameRetryInterval)
+	}
+}
+
+// isTransientRenameError returns true if a failed rename may succeed when retried
+func isTransientRenameError(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ETXTBSY)
+}
+
+// syncDir fsyncs a directory, making renames inside it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory for sync: %w", err)
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return d.Close()
+}
+
+// Verify reads a written authorized_keys file back and checks that it is a
+// regular file with the expected content, permissions (0600) and ownership.
+// Returns an error wrapping ErrVerifyFailed on any mismatch.
+func Verify(path string, content []byte, uid, gid int) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVerifyFailed, err)
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is not a regular file", ErrVerifyFailed, path)
+	}
+
+	if perm := info.Mode().Perm(); perm != AuthKeysMode {
+		return fmt.Errorf("%w: unexpected permissions %04o (expected %04o)", ErrVerifyFailed, perm, AuthKeysMode)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if int(stat.Uid) != uid || int(stat.Gid) != gid {
+			return fmt.Errorf("%w: unexpected ownership %d:%d (expected %d:%d)", ErrVerifyFailed, stat.Uid, stat.Gid, uid, gid)
+		}
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVerifyFailed, err)
+	}
+
+	if !bytes.Equal(written, content) {
+		return fmt.Errorf("%w: content mismatch (wrote %d bytes, read back %d bytes)", ErrVerifyFailed, len(content), len(written))
+	}
+
+	return nil
+}
+
+// Lock acquires an exclusive advisory lock (flock) on the lock file of the
+// authorized_keys file at authKeysPath (see LockPath).
+// The lock must be held for the whole read-compare-backup-write cycle so that
+// concurrent AuthKeySync operations, or other key managers honoring the same
+// lock file, cannot interleave. The lock file is owned by uid:gid.
+// Returns ErrLockTimeout if the lock is still held by someone else after timeout.
+// The returned function releases the lock.
+func (w *Writer) Lock(authKeysPath string, uid, gid int, timeout time.Duration) (func() error, error) {
+	lockPath := LockPath(authKeysPath)
+
+	// The directory is writable by the user, so a symlink planted at the
+	// lock path must never be followed: root would hand its target over
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, AuthKeysMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	stat, err := lockFile.Stat()
+	if err != nil {
+		_ = lockFile.Close()
+		return nil, fmt.Errorf("failed to stat lock file: %w", err)
+	}
+	if !stat.Mode().IsRegular() {
+		_ = lockFile.Close()
+		return nil, fmt.Errorf("lock file %s is not a regular file", lockPath)
+	}
+
+	if err := lockFile.Chown(uid, gid); err != nil {
+		_ = lockFile.Close()
+		return nil, fmt.Errorf("failed to set lock file ownership: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			_ = lockFile.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", lockPath, err)
+		}
+		if time.Now().After(deadline) {
+			_ = lockFile.Close()
+			return nil, fmt.Errorf("%w: %s", ErrLockTimeout, lockPath)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	unlock := func() error {
+		// Closing the descriptor releases the flock
+		return lockFile.Close()
+	}
+
+	return unlock, nil
+}
+
+// CleanupStaleTempFiles removes leftover temp files older than the given age
+// from dir, the directory of an authorized_keys file.
+// Temp files normally never outlive WriteAtomic, but they can remain in the
+// directory if the process was killed between creation and rename.
+// Only regular files named exactly like the temp files WriteAtomic creates
+// are considered, so a careless prefix cannot match the user's other files.
+// Returns the names of the removed files.
+func (w *Writer) CleanupStaleTempFiles(dir string, olderThan time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	cutoff := w.timeNow().Add(-olderThan)
+
+	var removed []string
+	var errs []error
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !w.isTempFileName(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			// File disappeared in the meantime
+			continue
+		}
+		if info.ModTime().After(cutoff) {
+			// Might belong to a write in progress
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", entry.Name(), err))
+			continue
+		}
+		removed = append(removed, entry.Name())
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// isTempFileName reports whether name has the form of the temp files
+// WriteAtomic creates: the temp file prefix, a UTC timestamp and a random ID
+// of lowercase letters, as in ".authkeysync_20240115_103045_kqzvbx"
+func (w *Writer) isTempFileName(name string) bool {
+	rest, ok := strings.CutPrefix(name, w.tempFilePrefix)
+	if !ok || len(rest) < len("20060102_150405_") || rest[len("20060102_150405")] != '_' {
+		return false
+	}
+	if _, err := time.Parse("20060102_150405", rest[:len("20060102_150405")]); err != nil {
+		return false
+	}
+	id := rest[len("20060102_150405_"):]
+	if len(id) < nanoid.DefaultLength {
+		return false
+	}
+	for _, char := range id {
+		if char < 'a' || char > 'z' {
+			return false
+		}
+	}
+	return true
+}
 
+// ReadContent reads the current content of the authorized_keys file at
+// authKeysPath. Returns empty byte slice if file doesn't exist.
+func ReadContent(authKeysPath string) ([]byte, error) {
 	content, err := os.ReadFile(authKeysPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -144,5 +508,8 @@ func ReadContent(sshDir string) ([]byte, error) {
 
 // WriterProvider is an interface for atomic file writing
 type WriterProvider interface {
-	WriteAtomic(sshDir string, content []byte, uid, gid int) (*WriteResult, error)
+	WriteAtomic(authKeysPath string, content []byte, uid, gid int) (*WriteResult, error)
+	AppendChangelog(authKeysPath string, entry []byte, maxBytes, uid, gid int) error
+	CleanupStaleTempFiles(dir string, olderThan time.Duration) ([]string, error)
+	Lock(authKeysPath string, uid, gid int, timeout time.Duration) (func() error, error)
 }
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"regexp"
+	"syscall"
 	"testing"
 	"time"
 
@@ -21,7 +23,7 @@ func TestWriteAtomic_NewFile(t *testing.T) {
 
 	uid := os.Getuid()
 	gid := os.Getgid()
-	result, err := writer.WriteAtomic(sshDir, content, uid, gid)
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, uid, gid)
 
 	require.NoError(t, err)
 	assert.True(t, result.Changed)
@@ -51,7 +53,7 @@ func TestWriteAtomic_ExistingFileWithSameContent(t *testing.T) {
 	writer := New()
 	uid := os.Getuid()
 	gid := os.Getgid()
-	result, err := writer.WriteAtomic(sshDir, content, uid, gid)
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, uid, gid)
 
 	require.NoError(t, err)
 	assert.False(t, result.Changed) // No change
@@ -71,7 +73,7 @@ func TestWriteAtomic_ExistingFileWithDifferentContent(t *testing.T) {
 	newContent := []byte("ssh-ed25519 BBBB new@host\n")
 	uid := os.Getuid()
 	gid := os.Getgid()
-	result, err := writer.WriteAtomic(sshDir, newContent, uid, gid)
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), newContent, uid, gid)
 
 	require.NoError(t, err)
 	assert.True(t, result.Changed)
@@ -92,7 +94,7 @@ func TestWriteAtomic_TempFileCleanup(t *testing.T) {
 	uid := os.Getuid()
 	gid := os.Getgid()
 
-	_, err := writer.WriteAtomic(sshDir, content, uid, gid)
+	_, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, uid, gid)
 	require.NoError(t, err)
 
 	// Verify no temp files left
@@ -119,7 +121,7 @@ func TestWriteAtomic_CustomDeps(t *testing.T) {
 	content := []byte("ssh-ed25519 AAAA key@host\n")
 	uid := os.Getuid()
 	gid := os.Getgid()
-	result, err := writer.WriteAtomic(sshDir, content, uid, gid)
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, uid, gid)
 
 	require.NoError(t, err)
 	assert.True(t, result.Changed)
@@ -135,7 +137,7 @@ func TestWriteAtomic_FilePermissions(t *testing.T) {
 	uid := os.Getuid()
 	gid := os.Getgid()
 
-	result, err := writer.WriteAtomic(sshDir, content, uid, gid)
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, uid, gid)
 
 	require.NoError(t, err)
 	require.True(t, result.Changed)
@@ -158,7 +160,7 @@ func TestWriteAtomic_PreservesPermissionsAfterUpdate(t *testing.T) {
 
 	// First write
 	content1 := []byte("ssh-ed25519 AAAA key1@host\n")
-	result1, err := writer.WriteAtomic(sshDir, content1, uid, gid)
+	result1, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content1, uid, gid)
 	require.NoError(t, err)
 
 	stat1, err := os.Stat(result1.Path)
@@ -167,7 +169,7 @@ func TestWriteAtomic_PreservesPermissionsAfterUpdate(t *testing.T) {
 
 	// Second write with different content
 	content2 := []byte("ssh-ed25519 BBBB key2@host\n")
-	result2, err := writer.WriteAtomic(sshDir, content2, uid, gid)
+	result2, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content2, uid, gid)
 	require.NoError(t, err)
 
 	stat2, err := os.Stat(result2.Path)
@@ -186,7 +188,7 @@ func TestWriteAtomic_EmptyContent(t *testing.T) {
 	uid := os.Getuid()
 	gid := os.Getgid()
 
-	result, err := writer.WriteAtomic(sshDir, content, uid, gid)
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, uid, gid)
 
 	require.NoError(t, err)
 	assert.True(t, result.Changed)
@@ -212,7 +214,7 @@ func TestWriteAtomic_LargeContent(t *testing.T) {
 	uid := os.Getuid()
 	gid := os.Getgid()
 
-	result, err := writer.WriteAtomic(sshDir, content, uid, gid)
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, uid, gid)
 
 	require.NoError(t, err)
 	assert.True(t, result.Changed)
@@ -237,7 +239,7 @@ func TestWriteAtomic_IDGeneratorError(t *testing.T) {
 	uid := os.Getuid()
 	gid := os.Getgid()
 
-	_, err := writer.WriteAtomic(sshDir, content, uid, gid)
+	_, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, uid, gid)
 
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to generate temp file ID")
@@ -252,7 +254,7 @@ func TestWriteAtomic_NonExistentSSHDir(t *testing.T) {
 	uid := os.Getuid()
 	gid := os.Getgid()
 
-	_, err := writer.WriteAtomic(sshDir, content, uid, gid)
+	_, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, uid, gid)
 
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to create temp file")
@@ -268,7 +270,7 @@ func TestReadContent_ExistingFile(t *testing.T) {
 	content := []byte("ssh-ed25519 AAAA key@host\n")
 	require.NoError(t, os.WriteFile(authKeysPath, content, 0600))
 
-	read, err := ReadContent(sshDir)
+	read, err := ReadContent(filepath.Join(sshDir, AuthKeysFileName))
 	require.NoError(t, err)
 	assert.Equal(t, content, read)
 }
@@ -278,7 +280,7 @@ func TestReadContent_NonExistentFile(t *testing.T) {
 	sshDir := filepath.Join(tempDir, ".ssh")
 	require.NoError(t, os.Mkdir(sshDir, 0700))
 
-	read, err := ReadContent(sshDir)
+	read, err := ReadContent(filepath.Join(sshDir, AuthKeysFileName))
 	require.NoError(t, err)
 	assert.Empty(t, read)
 }
@@ -292,7 +294,7 @@ func TestReadContent_EmptyFile(t *testing.T) {
 	authKeysPath := filepath.Join(sshDir, "authorized_keys")
 	require.NoError(t, os.WriteFile(authKeysPath, []byte{}, 0600))
 
-	read, err := ReadContent(sshDir)
+	read, err := ReadContent(filepath.Join(sshDir, AuthKeysFileName))
 	require.NoError(t, err)
 	assert.Empty(t, read)
 }
@@ -301,7 +303,7 @@ func TestReadContent_NonExistentSSHDir(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, "nonexistent", ".ssh")
 
-	read, err := ReadContent(sshDir)
+	read, err := ReadContent(filepath.Join(sshDir, AuthKeysFileName))
 	require.NoError(t, err)
 	assert.Empty(t, read)
 }
@@ -344,7 +346,7 @@ func TestWriteAtomic_AtomicityOnContentChange(t *testing.T) {
 	uid := os.Getuid()
 	gid := os.Getgid()
 
-	result, err := writer.WriteAtomic(sshDir, newContent, uid, gid)
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), newContent, uid, gid)
 	require.NoError(t, err)
 	require.True(t, result.Changed)
 
@@ -363,3 +365,452 @@ func TestWriteAtomic_AtomicityOnContentChange(t *testing.T) {
 	_ = stat1
 	_ = stat2
 }
+
+func TestCleanupStaleTempFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	staleTemp := filepath.Join(tempDir, TempFilePrefix+"20240615_100000_aaaaaa")
+	freshTemp := filepath.Join(tempDir, TempFilePrefix+"20240615_115959_bbbbbb")
+	staleOther := filepath.Join(tempDir, "authorized_keys")
+	staleTempDir := filepath.Join(tempDir, TempFilePrefix+"dir")
+	// Files with the prefix but not named like a temp file are kept
+	stalePrefixed := []string{
+		filepath.Join(tempDir, TempFilePrefix+"notes"),
+		filepath.Join(tempDir, TempFilePrefix+"20240615_100000_ABCDEF"),
+		filepath.Join(tempDir, TempFilePrefix+"20240615_100000_abc"),
+		filepath.Join(tempDir, TempFilePrefix+"20241399_100000_abcdef"),
+	}
+
+	for _, path := range append([]string{staleTemp, freshTemp, staleOther}, stalePrefixed...) {
+		require.NoError(t, os.WriteFile(path, []byte("content"), 0600))
+	}
+	require.NoError(t, os.Mkdir(staleTempDir, 0700))
+
+	old := now.Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(staleTemp, old, old))
+	require.NoError(t, os.Chtimes(staleOther, old, old))
+	for _, path := range stalePrefixed {
+		require.NoError(t, os.Chtimes(path, old, old))
+	}
+	require.NoError(t, os.Chtimes(staleTempDir, old, old))
+	recent := now.Add(-time.Minute)
+	require.NoError(t, os.Chtimes(freshTemp, recent, recent))
+
+	writer := NewWithDeps(
+		func() (string, error) { return "abcdef", nil },
+		func() time.Time { return now },
+	)
+
+	removed, err := writer.CleanupStaleTempFiles(tempDir, StaleTempFileAge)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Base(staleTemp)}, removed)
+
+	assert.NoFileExists(t, staleTemp)
+	assert.FileExists(t, freshTemp)
+	assert.FileExists(t, staleOther)
+	assert.DirExists(t, staleTempDir)
+	for _, path := range stalePrefixed {
+		assert.FileExists(t, path)
+	}
+}
+
+func TestTempFilePrefix_Custom(t *testing.T) {
+	tempDir := t.TempDir()
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	var tempNames []string
+	writer := NewWithDeps(
+		func() (string, error) { return "abcdef", nil },
+		func() time.Time { return now },
+	)
+	writer.SetTempFilePrefix(".tmp-aks-")
+	writer.rename = func(oldpath, newpath string) error {
+		tempNames = append(tempNames, filepath.Base(oldpath))
+		return os.Rename(oldpath, newpath)
+	}
+
+	_, err := writer.WriteAtomic(filepath.Join(tempDir, AuthKeysFileName), []byte("ssh-ed25519 AAAA test\n"), os.Getuid(), os.Getgid())
+	require.NoError(t, err)
+	assert.Equal(t, []string{".tmp-aks-20240615_120000_abcdef"}, tempNames)
+
+	// Cleanup only considers files with the configured prefix
+	staleCustom := filepath.Join(tempDir, ".tmp-aks-20240615_100000_aaaaaa")
+	staleDefault := filepath.Join(tempDir, TempFilePrefix+"20240615_100000_bbbbbb")
+	old := now.Add(-2 * time.Hour)
+	for _, path := range []string{staleCustom, staleDefault} {
+		require.NoError(t, os.WriteFile(path, []byte("content"), 0600))
+		require.NoError(t, os.Chtimes(path, old, old))
+	}
+
+	removed, err := writer.CleanupStaleTempFiles(tempDir, StaleTempFileAge)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Base(staleCustom)}, removed)
+	assert.FileExists(t, staleDefault)
+}
+
+func TestSetIDLength(t *testing.T) {
+	tempDir := t.TempDir()
+
+	var tempNames []string
+	writer := New()
+	writer.SetIDLength(10)
+	writer.rename = func(oldpath, newpath string) error {
+		tempNames = append(tempNames, filepath.Base(oldpath))
+		return os.Rename(oldpath, newpath)
+	}
+
+	_, err := writer.WriteAtomic(filepath.Join(tempDir, AuthKeysFileName), []byte("ssh-ed25519 AAAA test\n"), os.Getuid(), os.Getgid())
+	require.NoError(t, err)
+	require.Len(t, tempNames, 1)
+	assert.Regexp(t, `^`+regexp.QuoteMeta(TempFilePrefix)+`\d{8}_\d{6}_[a-z]{10}$`, tempNames[0])
+}
+
+func TestCleanupStaleTempFiles_NonExistentDir(t *testing.T) {
+	writer := New()
+
+	_, err := writer.CleanupStaleTempFiles(filepath.Join(t.TempDir(), "missing"), StaleTempFileAge)
+	require.Error(t, err)
+}
+
+func TestLock_ExclusiveUntilReleased(t *testing.T) {
+	tempDir := t.TempDir()
+	writer := New()
+	uid := os.Getuid()
+	gid := os.Getgid()
+
+	unlock, err := writer.Lock(filepath.Join(tempDir, AuthKeysFileName), uid, gid, time.Second)
+	require.NoError(t, err)
+
+	// Lock file is created with restrictive permissions
+	stat, err := os.Stat(filepath.Join(tempDir, LockFileName))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(AuthKeysMode), stat.Mode().Perm())
+
+	// A second lock attempt (separate open file description) must time out
+	_, err = writer.Lock(filepath.Join(tempDir, AuthKeysFileName), uid, gid, 200*time.Millisecond)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrLockTimeout)
+
+	// Once released, the lock can be acquired again
+	require.NoError(t, unlock())
+
+	unlock2, err := writer.Lock(filepath.Join(tempDir, AuthKeysFileName), uid, gid, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, unlock2())
+}
+
+func TestLock_RefusesSymlink(t *testing.T) {
+	tempDir := t.TempDir()
+	target := filepath.Join(tempDir, "shadow")
+	require.NoError(t, os.WriteFile(target, []byte("root:secret\n"), 0600))
+	require.NoError(t, os.Symlink(target, filepath.Join(tempDir, LockFileName)))
+	before, err := os.Stat(target)
+	require.NoError(t, err)
+
+	// As root, a followed symlink would hand the target to this uid
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = 12345, 12345
+	}
+	_, err = New().Lock(filepath.Join(tempDir, AuthKeysFileName), uid, gid, time.Second)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to open lock file")
+
+	after, err := os.Stat(target)
+	require.NoError(t, err)
+	assert.Equal(t, before.Sys().(*syscall.Stat_t).Uid, after.Sys().(*syscall.Stat_t).Uid)
+	assert.Equal(t, before.Sys().(*syscall.Stat_t).Gid, after.Sys().(*syscall.Stat_t).Gid)
+}
+
+func TestLock_RefusesNonRegularFile(t *testing.T) {
+	tempDir := t.TempDir()
+	require.NoError(t, syscall.Mkfifo(filepath.Join(tempDir, LockFileName), 0600))
+
+	_, err := New().Lock(filepath.Join(tempDir, AuthKeysFileName), os.Getuid(), os.Getgid(), time.Second)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not a regular file")
+}
+
+func TestLock_NonExistentDir(t *testing.T) {
+	writer := New()
+
+	_, err := writer.Lock(filepath.Join(t.TempDir(), "missing", AuthKeysFileName), os.Getuid(), os.Getgid(), time.Second)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to open lock file")
+}
+
+func TestWriteAtomic_VerifyAfterWrite(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	writer := New()
+	writer.SetVerifyAfterWrite(true)
+	content := []byte("ssh-ed25519 AAAA key@host\n")
+
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, os.Getuid(), os.Getgid())
+
+	require.NoError(t, err)
+	assert.True(t, result.Changed)
+}
+
+func TestWriteAtomic_DurableWrites(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	writer := New()
+	writer.SetDurableWrites(true)
+	content := []byte("ssh-ed25519 AAAA key@host\n")
+
+	result, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, os.Getuid(), os.Getgid())
+
+	require.NoError(t, err)
+	assert.True(t, result.Changed)
+
+	written, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+}
+
+func TestAppendChangelog(t *testing.T) {
+	sshDir := filepath.Join(t.TempDir(), ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	path := filepath.Join(sshDir, ChangelogFileName)
+
+	writer := New()
+	require.NoError(t, writer.AppendChangelog(filepath.Join(sshDir, AuthKeysFileName), []byte("1 added a\n"), 0, os.Getuid(), os.Getgid()))
+	require.NoError(t, writer.AppendChangelog(filepath.Join(sshDir, AuthKeysFileName), []byte("2 added b\n2 removed a\n"), 0, os.Getuid(), os.Getgid()))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "1 added a\n2 added b\n2 removed a\n", string(content))
+
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(AuthKeysMode), stat.Mode().Perm())
+
+	// The oldest lines are dropped whole to stay under the limit
+	require.NoError(t, writer.AppendChangelog(filepath.Join(sshDir, AuthKeysFileName), []byte("3 added c\n"), 25, os.Getuid(), os.Getgid()))
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "2 removed a\n3 added c\n", string(content))
+
+	require.NoError(t, writer.AppendChangelog(filepath.Join(sshDir, AuthKeysFileName), []byte("4 added d\n"), 20, os.Getuid(), os.Getgid()))
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "3 added c\n4 added d\n", string(content))
+}
+
+func TestAppendChangelog_Symlink(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	target := filepath.Join(tempDir, "shadow")
+	require.NoError(t, os.WriteFile(target, []byte("root:secret\n"), 0600))
+	path := filepath.Join(sshDir, ChangelogFileName)
+	require.NoError(t, os.Symlink(target, path))
+
+	require.NoError(t, New().AppendChangelog(filepath.Join(sshDir, AuthKeysFileName), []byte("1 added a\n"), 0, os.Getuid(), os.Getgid()))
+
+	// The symlink is replaced by a changelog that does not disclose its target
+	stat, err := os.Lstat(path)
+	require.NoError(t, err)
+	assert.True(t, stat.Mode().IsRegular())
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "1 added a\n", string(content))
+
+	targetContent, err := os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "root:secret\n", string(targetContent))
+}
+
+func TestWriteAtomic_RenameRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		retries   int
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "EBUSY once", failures: 1, err: syscall.EBUSY, retries: DefaultRenameRetries, wantCalls: 2},
+		{name: "ETXTBSY once", failures: 1, err: syscall.ETXTBSY, retries: DefaultRenameRetries, wantCalls: 2},
+		{name: "retries exhausted", failures: 3, err: syscall.EBUSY, retries: 2, wantErr: true, wantCalls: 3},
+		{name: "retries disabled", failures: 1, err: syscall.EBUSY, retries: 0, wantErr: true, wantCalls: 1},
+		{name: "permanent error", failures: 1, err: syscall.EACCES, retries: DefaultRenameRetries, wantErr: true, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sshDir := filepath.Join(t.TempDir(), ".ssh")
+			require.NoError(t, os.Mkdir(sshDir, 0700))
+
+			calls := 0
+			writer := New()
+			writer.SetRenameRetries(tt.retries)
+			writer.rename = func(oldpath, newpath string) error {
+				calls++
+				if calls <= tt.failures {
+					return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: tt.err}
+				}
+				return os.Rename(oldpath, newpath)
+			}
+			content := []byte("ssh-ed25519 AAAA key@host\n")
+
+			_, err := writer.WriteAtomic(filepath.Join(sshDir, AuthKeysFileName), content, os.Getuid(), os.Getgid())
+
+			assert.Equal(t, tt.wantCalls, calls)
+			if tt.wantErr {
+				require.ErrorIs(t, err, tt.err)
+				assert.Contains(t, err.Error(), "failed to rename temp file")
+				return
+			}
+			require.NoError(t, err)
+			written, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+			require.NoError(t, err)
+			assert.Equal(t, content, written)
+		})
+	}
+}
+
+func TestSyncDir_Missing(t *testing.T) {
+	err := syncDir(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to open directory for sync")
+}
+
+func TestVerify(t *testing.T) {
+	uid := os.Getuid()
+	gid := os.Getgid()
+	content := []byte("ssh-ed25519 AAAA key@host\n")
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, path string)
+		uid     int
+		wantErr string
+	}{
+		{
+			name: "matching file",
+			setup: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, content, AuthKeysMode))
+			},
+			uid: uid,
+		},
+		{
+			name:    "missing file",
+			setup:   func(t *testing.T, path string) {},
+			uid:     uid,
+			wantErr: "no such file",
+		},
+		{
+			name: "different content",
+			setup: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, []byte("ssh-ed25519 AAAA key@hos"), AuthKeysMode))
+			},
+			uid:     uid,
+			wantErr: "content mismatch",
+		},
+		{
+			name: "wrong permissions",
+			setup: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, content, AuthKeysMode))
+				require.NoError(t, os.Chmod(path, 0644))
+			},
+			uid:     uid,
+			wantErr: "unexpected permissions 0644",
+		},
+		{
+			name: "wrong owner",
+			setup: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, content, AuthKeysMode))
+			},
+			uid:     uid + 1,
+			wantErr: "unexpected ownership",
+		},
+		{
+			name: "symlink",
+			setup: func(t *testing.T, path string) {
+				target := path + ".target"
+				require.NoError(t, os.WriteFile(target, content, AuthKeysMode))
+				require.NoError(t, os.Symlink(target, path))
+			},
+			uid:     uid,
+			wantErr: "not a regular file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "authorized_keys")
+			tt.setup(t, path)
+
+			err := Verify(path, content, tt.uid, gid)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrVerifyFailed)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestSplitManagedBlock(t *testing.T) {
+	t.Run("no markers", func(t *testing.T) {
+		block, err := SplitManagedBlock([]byte("ssh-ed25519 AAAA own@laptop"))
+		require.NoError(t, err)
+		assert.False(t, block.Found)
+		assert.Equal(t,
+			"ssh-ed25519 AAAA own@laptop\n# BEGIN AUTHKEYSYNC\nssh-ed25519 BBBB synced\n# END AUTHKEYSYNC\n",
+			string(block.Replace([]byte("ssh-ed25519 BBBB synced\n"))))
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		block, err := SplitManagedBlock(nil)
+		require.NoError(t, err)
+		assert.Equal(t, "# BEGIN AUTHKEYSYNC\nssh-ed25519 BBBB synced\n# END AUTHKEYSYNC\n",
+			string(block.Replace([]byte("ssh-ed25519 BBBB synced"))))
+	})
+
+	t.Run("replaces only the block", func(t *testing.T) {
+		content := "# mine\nssh-ed25519 AAAA own@laptop\n\n  # BEGIN AUTHKEYSYNC  \nssh-ed25519 OLD synced\n# END AUTHKEYSYNC\r\nssh-ed25519 CCCC after@host\n"
+		block, err := SplitManagedBlock([]byte(content))
+		require.NoError(t, err)
+		assert.True(t, block.Found)
+		assert.Equal(t, "# mine\nssh-ed25519 AAAA own@laptop\n\n", string(block.Before))
+		assert.Equal(t, "ssh-ed25519 OLD synced\n", string(block.Inner))
+		assert.Equal(t, "ssh-ed25519 CCCC after@host\n", string(block.After))
+		assert.Equal(t,
+			"# mine\nssh-ed25519 AAAA own@laptop\n\n# BEGIN AUTHKEYSYNC\nssh-ed25519 NEW synced\n# END AUTHKEYSYNC\nssh-ed25519 CCCC after@host\n",
+			string(block.Replace([]byte("ssh-ed25519 NEW synced\n"))))
+	})
+
+	t.Run("invalid markers", func(t *testing.T) {
+		for name, content := range map[string]string{
+			"two blocks":    "# BEGIN AUTHKEYSYNC\n# END AUTHKEYSYNC\n# BEGIN AUTHKEYSYNC\n# END AUTHKEYSYNC\n",
+			"nested":        "# BEGIN AUTHKEYSYNC\n# BEGIN AUTHKEYSYNC\n# END AUTHKEYSYNC\n",
+			"two ends":      "# BEGIN AUTHKEYSYNC\n# END AUTHKEYSYNC\n# END AUTHKEYSYNC\n",
+			"end first":     "# END AUTHKEYSYNC\n# BEGIN AUTHKEYSYNC\n",
+			"missing end":   "# BEGIN AUTHKEYSYNC\nssh-ed25519 AAAA\n",
+			"missing begin": "ssh-ed25519 AAAA\n# END AUTHKEYSYNC\n",
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := SplitManagedBlock([]byte(content))
+				require.ErrorIs(t, err, ErrInvalidManagedBlock)
+			})
+		}
+	})
+}
+
+func TestLockAndChangelogPath(t *testing.T) {
+	assert.Equal(t, "/home/alice/.ssh/"+LockFileName, LockPath("/home/alice/.ssh/authorized_keys"))
+	assert.Equal(t, "/home/alice/.ssh/"+ChangelogFileName, ChangelogPath("/home/alice/.ssh/authorized_keys"))
+
+	// Keys of several users in one directory get their own files
+	assert.Equal(t, "/etc/ssh/keys/.alice.lock", LockPath("/etc/ssh/keys/alice"))
+	assert.Equal(t, "/etc/ssh/keys/alice_changelog", ChangelogPath("/etc/ssh/keys/alice"))
+}
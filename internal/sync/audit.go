@@ -0,0 +1,196 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/keyparser"
+	"github.com/eduardolat/authkeysync/internal/userinfo"
+)
+
+// UnexpectedKey is a key of authorized_keys that no source, include file or
+// always_keys entry returns, e.g. one added by hand or by another tool
+type UnexpectedKey struct {
+	// Key is the trimmed key line
+	Key string
+	// Fingerprint is a short fingerprint of the key line
+	Fingerprint string
+	// Type is the key type, empty if the line cannot be split
+	Type string
+	// Comment is the key comment, empty if none
+	Comment string
+	// Kept is true if a sync would keep the key as a local key, because
+	// preserve_local_keys is enabled and the key policy allows it
+	Kept bool
+}
+
+// AuditUserResult contains the result of auditing a single user
+type AuditUserResult struct {
+	Username   string
+	Skipped    bool
+	SkipReason string
+	Error      error
+	// Unexpected are the unexpected keys, in file order
+	Unexpected []UnexpectedKey
+}
+
+// AuditResult contains the result of auditing all users
+type AuditResult struct {
+	Users     []AuditUserResult
+	HasErrors bool
+}
+
+// Audit fetches the sources of every configured user and reports the keys of
+// their authorized_keys that none of them returns. Nothing is written.
+func (s *Syncer) Audit(ctx context.Context) *AuditResult {
+	result := &AuditResult{
+		Users: make([]AuditUserResult, 0, len(s.cfg.Users)),
+	}
+
+	users, _, failed := s.resolveUsers()
+	for _, userResult := range failed {
+		result.Users = append(result.Users, AuditUserResult{
+			Username: userResult.Username,
+			Error:    userResult.Error,
+		})
+		result.HasErrors = true
+	}
+
+	for _, user := range users {
+		userResult := s.auditUser(ctx, user)
+		result.Users = append(result.Users, userResult)
+
+		if userResult.Error != nil {
+			result.HasErrors = true
+		}
+	}
+
+	return result
+}
+
+// auditUser audits a single user
+func (s *Syncer) auditUser(ctx context.Context, user config.User) AuditUserResult {
+	username := user.Username
+	result := AuditUserResult{Username: username}
+
+	info, err := s.lookupUser(user)
+	if err != nil {
+		if errors.Is(err, userinfo.ErrUserNotFound) ||
+			errors.Is(err, userinfo.ErrHomeDirNotFound) ||
+			errors.Is(err, userinfo.ErrSSHDirNotFound) ||
+			errors.Is(err, userinfo.ErrSSHDirNotDir) {
+			s.logger.Warn("skipping audit",
+				"username", username,
+				"reason", err.Error())
+			result.Skipped = true
+			result.SkipReason = err.Error()
+			return result
+		}
+		result.Error = fmt.Errorf("failed to lookup user: %w", err)
+		s.logger.Error("failed to lookup user",
+			"username", username,
+			"error", err)
+		return result
+	}
+
+	sources, err := s.cfg.Policy.ResolveSources(username, user.Sources)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	for _, source := range sources {
+		if source.GetMethod() == http.MethodHead {
+			result.Error = fmt.Errorf("source %s uses method HEAD, which is only supported by --check-sources", source.URL)
+			return result
+		}
+	}
+
+	// Every source must answer, or a key could be flagged only because its
+	// source was down
+	fetchResults, err := s.fetcher.FetchAll(ctx, config.CapTimeouts(sources, s.sourceTimeout))
+	if err != nil {
+		result.Error = fmt.Errorf("failed to fetch keys: %w", err)
+		s.logger.Error("failed to fetch keys, aborting user audit",
+			"username", username,
+			"error", err)
+		return result
+	}
+
+	for _, fr := range fetchResults {
+		if fr.Error != nil {
+			result.Error = fmt.Errorf("failed to fetch keys: optional source %s failed: %w", fr.Source.URL, fr.Error)
+			s.logger.Error("optional source failed, aborting user audit",
+				"username", username,
+				"url", fr.Source.URL,
+				"error", fr.Error)
+			return result
+		}
+	}
+
+	included, err := s.readIncludeFiles(s.cfg.Policy.IncludeFiles)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	// Keys are compared like buildContent deduplicates them
+	known := make(map[string]bool)
+	for _, fr := range fetchResults {
+		for _, key := range fr.Keys {
+			known[s.dedupKey(key.Line)] = true
+		}
+	}
+	for _, file := range included {
+		for _, key := range file.keys {
+			known[s.dedupKey(key.Line)] = true
+		}
+	}
+	for _, line := range s.cfg.Policy.AlwaysKeys {
+		known[s.dedupKey(strings.TrimSpace(line))] = true
+	}
+
+	// Lines outside the managed block are not ours to audit
+	existing, err := s.managedContent(info)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	parseResult, err := s.keyParser.ParseString(string(existing))
+	if err != nil {
+		result.Error = fmt.Errorf("failed to parse authorized_keys: %w", err)
+		return result
+	}
+
+	reported := make(map[string]bool)
+	for _, key := range parseResult.Keys {
+		dedup := s.dedupKey(key.Line)
+		if known[dedup] || reported[dedup] {
+			continue
+		}
+		reported[dedup] = true
+
+		unexpected := UnexpectedKey{
+			Key:         key.Line,
+			Fingerprint: keyFingerprint(key.Line),
+			Kept:        s.cfg.Policy.IsPreserveLocalKeys() && s.keyPolicy.Check(key.Line) == nil,
+		}
+		if parts, err := keyparser.SplitKey(key.Line); err == nil {
+			unexpected.Type = parts.Type
+			unexpected.Comment = parts.Comment
+		}
+		result.Unexpected = append(result.Unexpected, unexpected)
+	}
+
+	if len(result.Unexpected) > 0 {
+		s.logger.Warn("unexpected keys found",
+			"username", username,
+			"count", len(result.Unexpected))
+	}
+
+	return result
+}
@@ -0,0 +1,66 @@
+package sync
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/keyparser"
+	"github.com/eduardolat/authkeysync/internal/userinfo"
+)
+
+// appendChangelog appends the keys added and removed by a write to the
+// changelog of the user. Failures are logged and reported to warnings: the
+// keys are already written.
+func (s *Syncer) appendChangelog(username string, info *userinfo.UserInfo, previous []byte, decisions []KeyDecision, warnings *warningRecorder) {
+	at := s.timeNow().In(s.cfg.Policy.Location())
+	entry := changelogEntry(at, s.keyParser, previous, decisions)
+	if entry == "" {
+		return
+	}
+
+	err := s.asUser(info, func() error {
+		return s.fileWriter.AppendChangelog(info.AuthKeysPath, []byte(entry), s.cfg.Policy.GetChangelogMaxBytes(), info.UID, info.GID)
+	})
+	if err != nil {
+		s.logger.Warn("failed to append to key changelog",
+			"username", username,
+			"error", err)
+		warnings.record("failed to append to key changelog: %v", err)
+	}
+}
+
+// changelogEntry returns one line per key added or removed by a write, in
+// the format "<time> added <fingerprint> source=<source>" or
+// "<time> removed <fingerprint>". Returns "" if the keys did not change.
+func changelogEntry(at time.Time, parser *keyparser.Parser, previous []byte, decisions []KeyDecision) string {
+	previousKeys := make(map[string]bool)
+	var previousOrder []string
+	if parseResult, err := parser.ParseString(string(previous)); err == nil {
+		for _, key := range parseResult.Keys {
+			if !previousKeys[key.Line] {
+				previousKeys[key.Line] = true
+				previousOrder = append(previousOrder, key.Line)
+			}
+		}
+	}
+
+	timestamp := at.Format(time.RFC3339)
+	var builder strings.Builder
+	written := make(map[string]bool)
+	for _, decision := range decisions {
+		if decision.Verdict != VerdictWritten {
+			continue
+		}
+		written[decision.Key] = true
+		if !previousKeys[decision.Key] {
+			fmt.Fprintf(&builder, "%s added %s source=%s\n", timestamp, decision.Fingerprint, decision.Source)
+		}
+	}
+	for _, key := range previousOrder {
+		if !written[key] {
+			fmt.Fprintf(&builder, "%s removed %s\n", timestamp, keyFingerprint(key))
+		}
+	}
+	return builder.String()
+}
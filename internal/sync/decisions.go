@@ -0,0 +1,76 @@
+package sync
+
+// Verdict describes what happened to a candidate key while building content
+type Verdict string
+
+const (
+	// VerdictWritten means the key was written to authorized_keys
+	VerdictWritten Verdict = "written"
+	// VerdictDeduped means the key was dropped as a duplicate of an earlier key
+	VerdictDeduped Verdict = "deduped"
+	// VerdictRejected means the key was dropped by the key policy
+	VerdictRejected Verdict = "rejected"
+	// VerdictWithheld means the key would have been written, but the file was
+	// kept because the generated one broke a limit such as min_keys
+	VerdictWithheld Verdict = "withheld"
+)
+
+// SourceLocal is the source label used for keys preserved from the existing file
+const SourceLocal = "Local"
+
+// SourceAlways is the source label used for the always_keys of the policy
+const SourceAlways = "Always"
+
+// KeyDecision records why a candidate key was written or dropped
+type KeyDecision struct {
+	// Source is the source URL (or SourceLocal) the key came from
+	Source string
+	// Key is the trimmed key line
+	Key string
+	// Fingerprint is a short fingerprint of the key line
+	Fingerprint string
+	// Verdict is the outcome for this key
+	Verdict Verdict
+	// Detail gives additional context, e.g. the source a duplicate was found in
+	// first or the reason a key was rejected
+	Detail string
+}
+
+// decisionRecorder collects key decisions while building content.
+// A nil recorder discards all decisions.
+type decisionRecorder struct {
+	decisions []KeyDecision
+}
+
+// record adds a decision for the given key
+func (r *decisionRecorder) record(source, key string, verdict Verdict, detail string) {
+	if r == nil {
+		return
+	}
+	r.decisions = append(r.decisions, KeyDecision{
+		Source:      source,
+		Key:         key,
+		Fingerprint: keyFingerprint(key),
+		Verdict:     verdict,
+		Detail:      detail,
+	})
+}
+
+// list returns the recorded decisions in the order they were made
+func (r *decisionRecorder) list() []KeyDecision {
+	if r == nil {
+		return nil
+	}
+	return r.decisions
+}
+
+// withhold marks the keys that would have been written as withheld, with the
+// limit that kept the existing file as detail
+func withhold(decisions []KeyDecision, detail string) {
+	for i := range decisions {
+		if decisions[i].Verdict == VerdictWritten {
+			decisions[i].Verdict = VerdictWithheld
+			decisions[i].Detail = detail
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// hookOutputLimit is the number of bytes of stdout and of stderr of a hook
+// kept for the logs
+const hookOutputLimit = 16 * 1024
+
+// hookWaitDelay is how long a killed or finished hook may keep its output
+// open, e.g. through a background child, before it is abandoned
+const hookWaitDelay = 2 * time.Second
+
+// syncUserWithHooks syncs a user between its hooks: pre_sync_hook runs
+// first, then post_sync_hook and, if authorized_keys changed, the
+// on_change_hook of the user. A failing hook is a warning, or fails the user
+// with hook_fails_user; a failing pre_sync_hook then skips the sync. Skipped
+// users only run pre_sync_hook, and no hook runs in dry-run mode.
+func (s *Syncer) syncUserWithHooks(ctx context.Context, user config.User, warnings *warningRecorder) UserResult {
+	policy := s.cfg.Policy
+	if s.dryRun {
+		return s.syncUser(ctx, user, warnings)
+	}
+
+	if policy.PreSyncHook != "" {
+		err := s.runHook(ctx, "pre_sync_hook", policy.PreSyncHook, user.Username, nil)
+		if err != nil {
+			warnings.record("pre_sync_hook failed: %v", err)
+			if policy.IsHookFailsUser() {
+				return UserResult{
+					Username: user.Username,
+					Error:    fmt.Errorf("pre_sync_hook failed: %w", err),
+				}
+			}
+		}
+	}
+
+	result := s.syncUser(ctx, user, warnings)
+	if result.Skipped {
+		return result
+	}
+
+	status := "ok"
+	if result.Error != nil {
+		status = "failed"
+	}
+	env := []string{
+		"AUTHKEYSYNC_CHANGED=" + strconv.FormatBool(result.Changed),
+		"AUTHKEYSYNC_STATUS=" + status,
+		"AUTHKEYSYNC_KEYS_WRITTEN=" + strconv.Itoa(result.KeysWritten),
+		"AUTHKEYSYNC_AUTHORIZED_KEYS=" + result.authKeysPath,
+	}
+
+	hooks := []struct{ name, command string }{
+		{"post_sync_hook", policy.PostSyncHook},
+	}
+	if result.Changed {
+		hooks = append(hooks, struct{ name, command string }{"on_change_hook", user.OnChangeHook})
+	}
+	for _, hook := range hooks {
+		if hook.command == "" {
+			continue
+		}
+		err := s.runHook(ctx, hook.name, hook.command, user.Username, env)
+		if err == nil {
+			continue
+		}
+		warnings.record("%s failed: %v", hook.name, err)
+		if policy.IsHookFailsUser() && result.Error == nil {
+			result.Error = fmt.Errorf("%s failed: %w", hook.name, err)
+		}
+	}
+	return result
+}
+
+// runHook runs a hook command with /bin/sh for a user, with
+// AUTHKEYSYNC_USERNAME and env added to the environment of AuthKeySync. Its
+// stdout and stderr are logged. The hook runs in its own process group, which
+// is killed when ctx is cancelled or after hook_timeout_seconds.
+func (s *Syncer) runHook(ctx context.Context, name, command, username string, env []string) error {
+	timeout := time.Duration(s.cfg.Policy.GetHookTimeoutSeconds()) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr limitedBuffer
+	stdout.limit, stderr.limit = hookOutputLimit, hookOutputLimit
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "AUTHKEYSYNC_USERNAME="+username)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = hookWaitDelay
+
+	s.logger.Debug("running hook",
+		"hook", name,
+		"username", username)
+
+	start := s.timeNow()
+	err := cmd.Run()
+	attrs := []any{
+		"hook", name,
+		"username", username,
+		"duration_ms", time.Since(start).Milliseconds(),
+	}
+	if out := strings.TrimSpace(stdout.String()); out != "" {
+		attrs = append(attrs, "stdout", out)
+	}
+	if out := strings.TrimSpace(stderr.String()); out != "" {
+		attrs = append(attrs, "stderr", out)
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w (%w)", err, context.Cause(ctx))
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			attrs = append(attrs, "exit_code", exitErr.ExitCode())
+		}
+		s.logger.Warn("hook failed", append(attrs, "error", err)...)
+		return err
+	}
+
+	s.logger.Info("hook finished", attrs...)
+	return nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a chatty hook cannot fill the memory
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+// Write implements io.Writer, always reporting the whole write as done
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,60 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	gosync "sync"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// syncUsers syncs users, up to maxParallelUsers at the same time, and returns
+// their results in the order of users regardless of completion order. Users
+// with a result in sharedResults are not synced. Once ctx is cancelled no
+// further user is started; those users fail with the cancellation cause.
+func (s *Syncer) syncUsers(ctx context.Context, users []config.User, sharedResults map[int]UserResult) []UserResult {
+	parallel := s.maxParallelUsers
+	if parallel <= 0 {
+		parallel = config.DefaultMaxParallelUsers
+	}
+
+	results := make([]UserResult, len(users))
+	slots := make(chan struct{}, parallel)
+	var wg gosync.WaitGroup
+
+	for i, user := range users {
+		if userResult, shared := sharedResults[i]; shared {
+			results[i] = userResult
+			continue
+		}
+
+		// A cancellation while waiting for a slot stops the rest
+		started := false
+		select {
+		case slots <- struct{}{}:
+			started = ctx.Err() == nil
+			if !started {
+				<-slots
+			}
+		case <-ctx.Done():
+		}
+		if !started {
+			results[i] = UserResult{
+				Username: user.Username,
+				Error:    fmt.Errorf("sync not started: %w", context.Cause(ctx)),
+			}
+			continue
+		}
+
+		wg.Go(func() {
+			defer func() { <-slots }()
+			warnings := &warningRecorder{}
+			userResult := s.syncUserWithHooks(ctx, user, warnings)
+			userResult.Warnings = warnings.list()
+			results[i] = userResult
+		})
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,65 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/eduardolat/authkeysync/internal/userinfo"
+)
+
+// asUser runs fn with the effective user and group of info when privileges
+// are dropped, restoring the previous credentials before returning, so files
+// are written with the permissions of their owner. Otherwise fn runs as is.
+func (s *Syncer) asUser(info *userinfo.UserInfo, fn func() error) error {
+	if !s.dropPrivileges {
+		return fn()
+	}
+
+	restore, err := s.switchCredentials(info.UID, info.GID)
+	if err != nil {
+		return fmt.Errorf("failed to drop privileges: %w", err)
+	}
+
+	fnErr := fn()
+	if err := restore(); err != nil {
+		return errors.Join(fnErr, fmt.Errorf("failed to restore privileges: %w", err))
+	}
+	return fnErr
+}
+
+// switchCredentials sets the effective user, effective group and
+// supplementary groups of the process to uid and gid, and returns a function
+// that restores the previous ones. Go applies these calls to every thread.
+func switchCredentials(uid, gid int) (func() error, error) {
+	euid := syscall.Geteuid()
+	egid := syscall.Getegid()
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups: %w", err)
+	}
+
+	restore := func() error {
+		// Regain the user first, setting groups requires it
+		if err := syscall.Seteuid(euid); err != nil {
+			return err
+		}
+		if err := syscall.Setegid(egid); err != nil {
+			return err
+		}
+		return syscall.Setgroups(groups)
+	}
+
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return nil, fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setegid(gid); err != nil {
+		_ = restore()
+		return nil, fmt.Errorf("failed to set effective group: %w", err)
+	}
+	if err := syscall.Seteuid(uid); err != nil {
+		_ = restore()
+		return nil, fmt.Errorf("failed to set effective user: %w", err)
+	}
+	return restore, nil
+}
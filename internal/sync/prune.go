@@ -0,0 +1,132 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/sshfile"
+	"github.com/eduardolat/authkeysync/internal/userinfo"
+)
+
+// PruneUserResult contains the result of pruning the backups of a single user
+type PruneUserResult struct {
+	Username   string
+	Skipped    bool
+	SkipReason string
+	Error      error
+	// Deleted are the names of the deleted backup files
+	Deleted []string
+}
+
+// PruneResult contains the result of pruning the backups of all users
+type PruneResult struct {
+	Users     []PruneUserResult
+	HasErrors bool
+}
+
+// PruneBackups applies the backup retention policy to the backup directory of
+// every configured user, without fetching keys or touching authorized_keys.
+// In dry-run mode nothing is deleted.
+func (s *Syncer) PruneBackups() *PruneResult {
+	result := &PruneResult{
+		Users: make([]PruneUserResult, 0, len(s.cfg.Users)),
+	}
+
+	if s.cfg.Policy.IsBackupRetentionUnlimited() {
+		s.logger.Warn("backup_retention_count is unlimited, nothing to prune")
+		return result
+	}
+
+	users, _, failed := s.resolveUsers()
+	for _, userResult := range failed {
+		result.Users = append(result.Users, PruneUserResult{
+			Username: userResult.Username,
+			Error:    userResult.Error,
+		})
+		result.HasErrors = true
+	}
+
+	for _, user := range users {
+		userResult := s.pruneUser(user)
+		result.Users = append(result.Users, userResult)
+
+		if userResult.Error != nil {
+			result.HasErrors = true
+		}
+	}
+
+	return result
+}
+
+// pruneUser prunes the backups of a single user
+func (s *Syncer) pruneUser(user config.User) PruneUserResult {
+	username := user.Username
+	result := PruneUserResult{Username: username}
+
+	info, err := s.lookupUser(user)
+	if err != nil {
+		if errors.Is(err, userinfo.ErrUserNotFound) ||
+			errors.Is(err, userinfo.ErrHomeDirNotFound) ||
+			errors.Is(err, userinfo.ErrSSHDirNotFound) ||
+			errors.Is(err, userinfo.ErrSSHDirNotDir) {
+			s.logger.Warn("skipping backup pruning",
+				"username", username,
+				"reason", err.Error())
+			result.Skipped = true
+			result.SkipReason = err.Error()
+			return result
+		}
+		result.Error = fmt.Errorf("failed to lookup user: %w", err)
+		s.logger.Error("failed to lookup user",
+			"username", username,
+			"error", err)
+		return result
+	}
+
+	if backupDir := s.cfg.Policy.ExpandBackupDir(username, info.HomeDir); backupDir != "" {
+		info.BackupDir = backupDir
+	}
+
+	if s.dryRun {
+		s.logger.Info("dry-run: would prune backups",
+			"username", username,
+			"backup_dir", info.BackupDir,
+			"keep", s.cfg.Policy.GetBackupRetentionCount())
+		return result
+	}
+
+	// Do not race a sync of the same user running in another process
+	unlock, err := s.fileWriter.Lock(info.AuthKeysPath, info.UID, info.GID, sshfile.LockTimeout)
+	if err != nil {
+		result.Error = fmt.Errorf("failed to lock authorized_keys: %w", err)
+		s.logger.Error("failed to lock authorized_keys",
+			"username", username,
+			"error", err)
+		return result
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			s.logger.Warn("failed to release authorized_keys lock",
+				"username", username,
+				"error", err)
+		}
+	}()
+
+	result.Deleted, err = s.backupManager.RotateBackupsIn(info.BackupDir, s.cfg.Policy.GetBackupRetentionCount())
+	if err != nil {
+		result.Error = fmt.Errorf("failed to prune backups: %w", err)
+		s.logger.Error("failed to prune backups",
+			"username", username,
+			"deleted_count", len(result.Deleted),
+			"error", err)
+		return result
+	}
+
+	s.logger.Info("pruned backups",
+		"username", username,
+		"backup_dir", info.BackupDir,
+		"deleted_count", len(result.Deleted))
+
+	return result
+}
@@ -0,0 +1,84 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/userinfo"
+)
+
+// ErrUserNotConfigured indicates that no config entry matches a user
+var ErrUserNotConfigured = errors.New("user is not matched by any config entry")
+
+// ResolvedUser is the effective configuration of a single user
+type ResolvedUser struct {
+	Username string
+	// Entry is the config entry the user was resolved from: its username,
+	// its pattern or "group:<name>"
+	Entry string
+	// Sources are the sources a sync would fetch, after source_template and
+	// the --source-timeout cap
+	Sources []config.Source
+	// Info is the system information of the user, nil if it could not be
+	// looked up. It is set along with LookupError if .ssh is missing.
+	Info *userinfo.UserInfo
+	// LookupError is why the user cannot be synced as is, e.g. a missing
+	// system user or .ssh directory
+	LookupError error
+}
+
+// ResolveUser resolves a user the way a sync would, without fetching or
+// writing anything. Returns an error wrapping ErrUserNotConfigured if no
+// config entry matches the user.
+func (s *Syncer) ResolveUser(username string) (*ResolvedUser, error) {
+	users, entries, failed := s.resolveUsers()
+
+	for i, user := range users {
+		if user.Username != username {
+			continue
+		}
+
+		return s.resolveUser(user, entries[i])
+	}
+
+	// The user may belong to an entry that could not be expanded
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("%w: %s (%s could not be resolved: %w)", ErrUserNotConfigured, username, failed[0].Username, failed[0].Error)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUserNotConfigured, username)
+}
+
+// ResolveUsers resolves every configured user the way a sync would, without
+// fetching or writing anything. Config entries that could not be expanded to
+// users, e.g. because the system users could not be listed, are returned as
+// failed results.
+func (s *Syncer) ResolveUsers() ([]*ResolvedUser, []UserResult, error) {
+	users, entries, failed := s.resolveUsers()
+
+	resolved := make([]*ResolvedUser, 0, len(users))
+	for i, user := range users {
+		r, err := s.resolveUser(user, entries[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved, failed, nil
+}
+
+// resolveUser resolves the sources and system information of one user
+func (s *Syncer) resolveUser(user config.User, entry string) (*ResolvedUser, error) {
+	sources, err := s.cfg.Policy.ResolveSources(user.Username, user.Sources)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := &ResolvedUser{
+		Username: user.Username,
+		Entry:    entry,
+		Sources:  config.CapTimeouts(sources, s.sourceTimeout),
+	}
+	resolved.Info, resolved.LookupError = s.lookupUser(user)
+	return resolved, nil
+}
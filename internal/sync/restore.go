@@ -0,0 +1,150 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/eduardolat/authkeysync/internal/backup"
+	"github.com/eduardolat/authkeysync/internal/sshfile"
+	"github.com/eduardolat/authkeysync/internal/userinfo"
+)
+
+// ErrNoBackup indicates that a user has no backup to restore, or none with
+// the requested name
+var ErrNoBackup = errors.New("no backup to restore")
+
+// RestoreResult contains the result of restoring the backup of a user
+type RestoreResult struct {
+	Username string
+	// Restored is the backup written to authorized_keys, or that would be in
+	// dry-run mode
+	Restored backup.Backup
+	// BackupPath is the backup of the replaced authorized_keys, if one was made
+	BackupPath string
+	Changed    bool
+}
+
+// ListBackups returns the backup directory and backups of a configured user,
+// oldest first as in backup.Manager.ListBackups
+func (s *Syncer) ListBackups(username string) (string, []backup.Backup, error) {
+	info, backups, err := s.userBackups(username)
+	if err != nil {
+		return "", nil, err
+	}
+	return info.BackupDir, backups, nil
+}
+
+// userBackups looks up a configured user, with BackupDir set from backup_dir,
+// and lists its backups
+func (s *Syncer) userBackups(username string) (*userinfo.UserInfo, []backup.Backup, error) {
+	resolved, err := s.ResolveUser(username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resolved.LookupError != nil {
+		return nil, nil, fmt.Errorf("failed to lookup user: %w", resolved.LookupError)
+	}
+
+	info := resolved.Info
+	if backupDir := s.cfg.Policy.ExpandBackupDir(username, info.HomeDir); backupDir != "" {
+		info.BackupDir = backupDir
+	}
+	backups, err := s.backupManager.ListBackups(info.BackupDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, backups, nil
+}
+
+// Restore replaces the authorized_keys of a configured user with one of its
+// backups, the newest (the last listed) if name is empty. The file is written atomically with
+// the owner and mode of a sync, and the replaced file is backed up first
+// unless backups are disabled. In dry-run mode nothing is written.
+func (s *Syncer) Restore(username, name string) (*RestoreResult, error) {
+	info, backups, err := s.userBackups(username)
+	if err != nil {
+		return nil, err
+	}
+	backupDir := info.BackupDir
+	result := &RestoreResult{Username: username}
+
+	// Pick the backup before a new one is made below
+	switch {
+	case len(backups) == 0:
+		return nil, fmt.Errorf("%w: %s has no backups in %s", ErrNoBackup, username, backupDir)
+	case name == "":
+		result.Restored = backups[len(backups)-1]
+	default:
+		found := false
+		for _, b := range backups {
+			if b.Name == name {
+				result.Restored, found = b, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s has no backup named %q in %s", ErrNoBackup, username, name, backupDir)
+		}
+	}
+
+	if s.dryRun {
+		s.logger.Info("dry-run: would restore authorized_keys",
+			"username", username,
+			"backup", result.Restored.Path)
+		return result, nil
+	}
+
+	content, err := s.backupManager.ReadBackup(backupDir, result.Restored.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	// Do not race a sync of the same user running in another process
+	unlock, err := s.fileWriter.Lock(info.AuthKeysPath, info.UID, info.GID, sshfile.LockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock authorized_keys: %w", err)
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			s.logger.Warn("failed to release authorized_keys lock",
+				"username", username,
+				"error", err)
+		}
+	}()
+
+	if s.cfg.Policy.IsBackupEnabled() && !s.noBackup {
+		existingContent, _ := sshfile.ReadContent(info.AuthKeysPath)
+		if len(existingContent) > 0 && string(existingContent) != string(content) {
+			backupUID, backupGID, err := s.backupOwner(info)
+			if err != nil {
+				return nil, err
+			}
+			result.BackupPath, err = s.backupManager.CreateBackupIn(info.AuthKeysPath, backupDir, backupUID, backupGID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create backup: %w", err)
+			}
+			if result.BackupPath != "" {
+				s.logger.Info("created backup",
+					"username", username,
+					"path", result.BackupPath)
+			}
+		}
+	}
+
+	var writeResult *sshfile.WriteResult
+	err = s.asUser(info, func() error {
+		var err error
+		writeResult, err = s.fileWriter.WriteAtomic(info.AuthKeysPath, content, info.UID, info.GID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write authorized_keys: %w", err)
+	}
+	result.Changed = writeResult.Changed
+
+	s.logger.Info("restored authorized_keys from backup",
+		"username", username,
+		"backup", result.Restored.Path,
+		"changed", result.Changed)
+	return result, nil
+}
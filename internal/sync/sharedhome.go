@@ -0,0 +1,108 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/eduardolat/authkeysync/internal/config"
+)
+
+// ErrSharedHome indicates that several users resolve to the same .ssh directory
+var ErrSharedHome = errors.New("users share the same .ssh directory")
+
+// resolveSharedHomes applies on_shared_home to users resolving to the same
+// .ssh directory, which would otherwise overwrite each other's keys. It
+// returns the users to synchronize, where a merged user carries the sources
+// of every user of its directory, and the results of the users that must not
+// be synchronized, by their index in users. Users whose lookup fails are
+// left alone, syncUser reports them.
+func (s *Syncer) resolveSharedHomes(users []config.User) ([]config.User, map[int]UserResult) {
+	results := make(map[int]UserResult)
+
+	byDir := make(map[string][]int)
+	var dirs []string
+	for i, user := range users {
+		info, err := s.lookupUser(user)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Clean(info.SSHDir)
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		if _, exists := byDir[dir]; !exists {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], i)
+	}
+
+	users = append([]config.User(nil), users...)
+	mode := s.cfg.Policy.GetOnSharedHome()
+
+	for _, dir := range dirs {
+		indexes := byDir[dir]
+		if len(indexes) < 2 {
+			continue
+		}
+
+		names := make([]string, 0, len(indexes))
+		for _, i := range indexes {
+			names = append(names, users[i].Username)
+		}
+		first := indexes[0]
+		s.logger.Warn("users share the same .ssh directory",
+			"ssh_dir", dir,
+			"users", strings.Join(names, ","),
+			"on_shared_home", mode)
+
+		switch mode {
+		case config.SharedHomeFirst:
+			for _, i := range indexes[1:] {
+				reason := fmt.Sprintf("shares .ssh directory with %s", users[first].Username)
+				results[i] = UserResult{
+					Username:   users[i].Username,
+					Skipped:    true,
+					SkipReason: reason,
+					Warnings:   []string{"skipped: " + reason},
+				}
+			}
+
+		case config.SharedHomeMerge:
+			merged := users[first]
+			merged.Sources = nil
+			for _, i := range indexes {
+				sources, err := s.cfg.Policy.ResolveSources(users[i].Username, users[i].Sources)
+				if err != nil {
+					results[i] = UserResult{Username: users[i].Username, Error: err}
+					continue
+				}
+				merged.Sources = append(merged.Sources, sources...)
+				if i != first {
+					results[i] = UserResult{
+						Username:   users[i].Username,
+						Skipped:    true,
+						SkipReason: fmt.Sprintf("keys merged into %s (shared .ssh directory)", users[first].Username),
+					}
+				}
+			}
+			if _, failed := results[first]; !failed {
+				users[first] = merged
+			}
+
+		default:
+			for _, i := range indexes {
+				results[i] = UserResult{
+					Username: users[i].Username,
+					Error:    fmt.Errorf("%w: %s is used by %s", ErrSharedHome, dir, strings.Join(names, ", ")),
+				}
+				s.logger.Error("refusing to sync user with a shared .ssh directory",
+					"username", users[i].Username,
+					"ssh_dir", dir)
+			}
+		}
+	}
+
+	return users, results
+}
@@ -0,0 +1,97 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/eduardolat/authkeysync/internal/userinfo"
+)
+
+// authorizedKeysFile returns the AuthorizedKeysFile of the sshd_config set in
+// the policy, or "" to use .ssh/authorized_keys. The file is read once per
+// Syncer; if it cannot be used, .ssh/authorized_keys is used instead.
+func (s *Syncer) authorizedKeysFile() string {
+	s.sshdConfigOnce.Do(func() {
+		path := s.cfg.Policy.SSHDConfig
+		if path == "" {
+			return
+		}
+
+		pattern, err := userinfo.ReadAuthorizedKeysFile(path)
+		if errors.Is(err, userinfo.ErrNoAuthorizedKeysFile) {
+			s.logger.Info("using .ssh/authorized_keys",
+				"sshd_config", path,
+				"reason", err)
+			return
+		}
+		if err == nil {
+			// Unsupported tokens are found once, rather than for every user
+			_, err = userinfo.ExpandAuthorizedKeysFile(pattern, &userinfo.UserInfo{HomeDir: "/"})
+		}
+		if err != nil {
+			s.logger.Warn("cannot use AuthorizedKeysFile of sshd_config, using .ssh/authorized_keys",
+				"sshd_config", path,
+				"error", err)
+			return
+		}
+
+		s.logger.Debug("using AuthorizedKeysFile of sshd_config",
+			"sshd_config", path,
+			"authorized_keys_file", pattern)
+		s.sshdAuthorizedKeysFile = pattern
+	})
+	return s.sshdAuthorizedKeysFile
+}
+
+// applyAuthorizedKeysFile points the user info returned by a lookup, along
+// with its error, at the AuthorizedKeysFile of sshd_config. A missing .ssh
+// directory is no longer an error if the file lives outside of it.
+func (s *Syncer) applyAuthorizedKeysFile(info *userinfo.UserInfo, err error) (*userinfo.UserInfo, error) {
+	pattern := s.authorizedKeysFile()
+	if pattern == "" {
+		return info, err
+	}
+
+	path, expandErr := userinfo.ExpandAuthorizedKeysFile(pattern, info)
+	if expandErr != nil {
+		return nil, expandErr
+	}
+	custom := *info
+	custom.SetAuthKeysPath(path)
+
+	if !custom.InSSHDir() && errors.Is(err, userinfo.ErrSSHDirNotFound) {
+		err = nil
+	}
+	return &custom, err
+}
+
+// createKeysDir creates the missing directories of an authorized_keys file
+// that does not live directly in .ssh, see userinfo.CreateKeysDir
+func (s *Syncer) createKeysDir(username string, info *userinfo.UserInfo) error {
+	dir := info.KeysDir()
+	if dir == info.SSHDir {
+		return nil
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return nil
+	}
+
+	if s.dryRun {
+		s.logger.Info("dry-run: would create authorized_keys directory",
+			"username", username,
+			"path", dir)
+		return nil
+	}
+
+	created, err := userinfo.CreateKeysDir(info)
+	if len(created) > 0 {
+		s.logger.Info("created authorized_keys directory",
+			"username", username,
+			"paths", created)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create authorized_keys directory: %w", err)
+	}
+	return nil
+}
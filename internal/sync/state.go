@@ -0,0 +1,110 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/eduardolat/authkeysync/internal/keyfetcher"
+)
+
+// DefaultStateFile is the default path of the state file used by --changed-only
+const DefaultStateFile = "/var/lib/authkeysync/state.json"
+
+// stateVersion is the format version of the state file
+const stateVersion = 1
+
+// State is what a changed-only run remembers for the next one
+type State struct {
+	Version int `json:"version"`
+	// Config is the fingerprint of the configuration and include files the
+	// state was built with
+	Config string `json:"config"`
+	// Sources are the validators and last response of every source
+	Sources map[string]keyfetcher.Validator `json:"sources"`
+	// Users are the SHA-256 hashes of the authorized_keys files as left by
+	// the last run, by username
+	Users map[string]string `json:"users"`
+}
+
+// newState returns an empty state
+func newState() *State {
+	return &State{
+		Version: stateVersion,
+		Sources: make(map[string]keyfetcher.Validator),
+		Users:   make(map[string]string),
+	}
+}
+
+// LoadState reads a state file. A missing file returns an empty state.
+func LoadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newState(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	state := newState()
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	if state.Version != stateVersion {
+		return newState(), nil
+	}
+	if state.Sources == nil {
+		state.Sources = make(map[string]keyfetcher.Validator)
+	}
+	if state.Users == nil {
+		state.Users = make(map[string]string)
+	}
+	return state, nil
+}
+
+// SaveState atomically writes a state file readable only by its owner,
+// creating its directory if needed
+func SaveState(path string, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp(dir, ".state-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to create temp state file: %w", err)
+	}
+	tempPath := tempFile.Name()
+	defer func() { _ = os.Remove(tempPath) }()
+
+	if _, err := tempFile.Write(data); err != nil {
+		_ = tempFile.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
+
+// fileHash returns the SHA-256 hash of a file, or "" if it cannot be read
+func fileHash(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
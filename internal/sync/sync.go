@@ -2,47 +2,281 @@
 package sync
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	gosync "sync"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/eduardolat/authkeysync/internal/backup"
 	"github.com/eduardolat/authkeysync/internal/config"
 	"github.com/eduardolat/authkeysync/internal/keyfetcher"
 	"github.com/eduardolat/authkeysync/internal/keyparser"
+	"github.com/eduardolat/authkeysync/internal/keypolicy"
 	"github.com/eduardolat/authkeysync/internal/sshfile"
 	"github.com/eduardolat/authkeysync/internal/userinfo"
 	"github.com/eduardolat/authkeysync/internal/version"
 )
 
+// tracer creates spans for sync runs (no-op unless tracing is enabled)
+var tracer = otel.Tracer("github.com/eduardolat/authkeysync/internal/sync")
+
+// ErrTooFewKeys indicates a generated authorized_keys with fewer keys than
+// min_keys, which is not written to avoid locking the user out
+var ErrTooFewKeys = errors.New("too few keys")
+
 // Syncer handles the key synchronization process
 type Syncer struct {
 	cfg           *config.Config
 	logger        *slog.Logger
-	fetcher       *keyfetcher.Fetcher
-	backupManager *backup.Manager
-	fileWriter    *sshfile.Writer
+	fetcher       keyfetcher.FetcherProvider
+	backupManager backup.ManagerProvider
+	fileWriter    sshfile.WriterProvider
 	userLookup    userinfo.LookupProvider
+	userLister    userinfo.ListProvider
+	groupLister   userinfo.GroupListProvider
+	keyPolicy     *keypolicy.Policy
+	keyParser     *keyparser.Parser
 	dryRun        bool
+	check         bool
+	noBackup      bool
+	noRotate      bool
+	incremental   bool
+	sourceTimeout int
+	changedOnly   bool
+	stateFile     string
+	state         *State
 	timeNow       func() time.Time
+	// maxParallelUsers is the number of users synced at the same time
+	maxParallelUsers int
+	// dropPrivileges writes authorized_keys as its owner, see asUser
+	dropPrivileges bool
+	// onlyUsers limits the run to these usernames when not nil
+	onlyUsers map[string]bool
+	// sshdAuthorizedKeysFile is the AuthorizedKeysFile of sshd_config, read
+	// once by authorizedKeysFile
+	sshdAuthorizedKeysFile string
+	sshdConfigOnce         gosync.Once
+	// switchCredentials changes the effective user and group, allows for
+	// dependency injection in tests
+	switchCredentials func(uid, gid int) (func() error, error)
+	// afterWrite runs after authorized_keys is written, allows for
+	// dependency injection in tests
+	afterWrite func(info *userinfo.UserInfo) error
+}
+
+// Options are run-time overrides of the configured behavior
+type Options struct {
+	// DryRun simulates the sync without modifying any files
+	DryRun bool
+	// Check reports the users whose authorized_keys would change, logging a
+	// unified diff for each, without modifying any files. Implies DryRun.
+	Check bool
+	// NoBackup disables backups regardless of backup_enabled
+	NoBackup bool
+	// NoRotate creates backups but never deletes old ones
+	NoRotate bool
+	// BackupRetention overrides backup_retention_count when not nil
+	BackupRetention *int
+	// Incremental revalidates sources with ETag/Last-Modified and leaves
+	// authorized_keys untouched when only its timestamps would change.
+	// Meant for a long-running process reusing the same Syncer.
+	Incremental bool
+	// SourceTimeout caps the timeout of every source in seconds, without
+	// extending shorter ones (0 = use the configured timeouts)
+	SourceTimeout int
+	// ChangedOnly skips users whose sources all answered 304 Not Modified,
+	// remembering validators between runs in StateFile. Implies Incremental.
+	ChangedOnly bool
+	// StateFile is the state file used by ChangedOnly (default: DefaultStateFile)
+	StateFile string
+	// DropPrivileges writes authorized_keys with the effective user and group
+	// of its owner, as drop_privileges does. Requires running as root.
+	DropPrivileges bool
+	// Users limits the run to these usernames, matched after wildcard and
+	// group entries are expanded (nil = every configured user)
+	Users []string
+
+	// The dependencies below replace the network, filesystem and system
+	// user database, so a whole sync can run in a unit test. Nil uses the
+	// real implementation. Policy settings such as negative_cache_seconds or
+	// verify_after_write only apply to the real implementations.
+
+	// Fetcher fetches the keys of every source
+	Fetcher keyfetcher.FetcherProvider
+	// BackupManager creates and rotates backups
+	BackupManager backup.ManagerProvider
+	// Writer writes and locks authorized_keys
+	Writer sshfile.WriterProvider
+	// UserLookup resolves users to their home and .ssh directories
+	UserLookup userinfo.LookupProvider
+	// UserLister lists system users for wildcard usernames
+	UserLister userinfo.ListProvider
+	// GroupLister lists system groups for group entries
+	GroupLister userinfo.GroupListProvider
+	// Now is the clock used for timestamps
+	Now func() time.Time
+}
+
+// validatorStore is implemented by fetchers whose conditional request
+// validators can be kept in the state file of changed-only runs
+type validatorStore interface {
+	Validators() map[string]keyfetcher.Validator
+	LoadValidators(validators map[string]keyfetcher.Validator)
+}
+
+// cacheSaver is implemented by fetchers that keep source responses between
+// runs with http_cache
+type cacheSaver interface {
+	SaveCache() error
+}
+
+// negativeCacheSaver is implemented by fetchers that keep the failure streaks
+// of sources between runs with negative_cache_seconds
+type negativeCacheSaver interface {
+	SaveNegativeCache() error
 }
 
 // New creates a new Syncer
 func New(cfg *config.Config, logger *slog.Logger, dryRun bool) *Syncer {
-	return &Syncer{
+	return NewWithOptions(cfg, logger, Options{DryRun: dryRun})
+}
+
+// NewFetcher creates a key fetcher honoring the connection settings of the
+// policy: connect and TLS handshake timeouts, extra trusted CAs and extra
+// discarded line prefixes
+func NewFetcher(cfg *config.Config, logger *slog.Logger) *keyfetcher.Fetcher {
+	connectTimeout := time.Duration(cfg.Policy.GetConnectTimeoutSeconds()) * time.Second
+	tlsHandshakeTimeout := time.Duration(cfg.Policy.GetTLSHandshakeTimeoutSeconds()) * time.Second
+	if connectTimeout <= 0 && tlsHandshakeTimeout <= 0 && cfg.RootCAs == nil {
+		fetcher := keyfetcher.NewWithLogger(logger)
+		fetcher.SetDiscardLinePrefixes(cfg.Policy.DiscardLinePrefixes)
+		return fetcher
+	}
+
+	transport := keyfetcher.NewTransport(connectTimeout, tlsHandshakeTimeout)
+	if cfg.RootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    cfg.RootCAs,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	fetcher := keyfetcher.NewWithClientAndLogger(&http.Client{Transport: transport}, logger)
+	fetcher.SetDiscardLinePrefixes(cfg.Policy.DiscardLinePrefixes)
+	return fetcher
+}
+
+// NewWithOptions creates a new Syncer with run-time overrides
+func NewWithOptions(cfg *config.Config, logger *slog.Logger, opts Options) *Syncer {
+	incremental := opts.Incremental || opts.ChangedOnly
+
+	stateFile := opts.StateFile
+	if stateFile == "" {
+		stateFile = DefaultStateFile
+	}
+
+	// Override the retention on a copy, so the caller's config is untouched
+	if opts.BackupRetention != nil {
+		overridden := *cfg
+		overridden.Policy.BackupRetentionCount = opts.BackupRetention
+		cfg = &overridden
+	}
+
+	s := &Syncer{
 		cfg:           cfg,
 		logger:        logger,
-		fetcher:       keyfetcher.NewWithLogger(logger),
-		backupManager: backup.New(),
-		fileWriter:    sshfile.New(),
-		userLookup:    &userinfo.SystemLookupProvider{},
-		dryRun:        dryRun,
-		timeNow:       time.Now,
+		fetcher:       opts.Fetcher,
+		backupManager: opts.BackupManager,
+		fileWriter:    opts.Writer,
+		userLookup:    opts.UserLookup,
+		userLister:    opts.UserLister,
+		groupLister:   opts.GroupLister,
+		keyPolicy:     cfg.Policy.KeyPolicy(),
+		keyParser:     keyparser.NewParser(cfg.Policy.DiscardLinePrefixes),
+		dryRun:        opts.DryRun || opts.Check,
+		check:         opts.Check,
+		noBackup:      opts.NoBackup,
+		noRotate:      opts.NoRotate,
+		incremental:   incremental,
+		sourceTimeout: opts.SourceTimeout,
+		changedOnly:   opts.ChangedOnly,
+		stateFile:     stateFile,
+		timeNow:       opts.Now,
+
+		maxParallelUsers:  cfg.Policy.GetMaxParallelUsers(),
+		dropPrivileges:    opts.DropPrivileges || cfg.Policy.IsDropPrivileges(),
+		switchCredentials: switchCredentials,
+	}
+
+	// Credentials are switched for the whole process, so users cannot be
+	// synced in parallel while privileges are dropped
+	if s.dropPrivileges {
+		s.maxParallelUsers = 1
+	}
+
+	if opts.Users != nil {
+		s.onlyUsers = make(map[string]bool, len(opts.Users))
+		for _, username := range opts.Users {
+			s.onlyUsers[username] = true
+		}
+	}
+
+	if s.fetcher == nil {
+		fetcher := NewFetcher(cfg, logger)
+		fetcher.SetNegativeCache(time.Duration(cfg.Policy.GetNegativeCacheSeconds()) * time.Second)
+		if cfg.Policy.GetNegativeCacheSeconds() > 0 {
+			fetcher.SetNegativeCacheStore(keyfetcher.NewFileNegativeCacheStore(cfg.Policy.GetNegativeCacheFile()))
+		}
+		fetcher.SetConditionalRequests(incremental)
+		if cfg.Policy.IsHTTPCache() {
+			fetcher.SetCacheStore(keyfetcher.NewFileCacheStore(cfg.Policy.GetHTTPCacheFile()))
+		}
+		s.fetcher = fetcher
+	}
+	if s.backupManager == nil {
+		backupManager := backup.New()
+		backupManager.SetBackupPrefix(cfg.Policy.GetBackupPrefix())
+		backupManager.SetIDLength(cfg.Policy.GetFileIDLength())
+		s.backupManager = backupManager
 	}
+	if s.fileWriter == nil {
+		fileWriter := sshfile.New()
+		fileWriter.SetVerifyAfterWrite(cfg.Policy.IsVerifyAfterWrite())
+		fileWriter.SetDurableWrites(cfg.Policy.IsDurableWrites())
+		fileWriter.SetRenameRetries(cfg.Policy.GetRenameRetries())
+		fileWriter.SetTempFilePrefix(cfg.Policy.GetTempFilePrefix())
+		fileWriter.SetIDLength(cfg.Policy.GetFileIDLength())
+		s.fileWriter = fileWriter
+	}
+	if s.userLookup == nil {
+		s.userLookup = &userinfo.SystemLookupProvider{}
+	}
+	if s.userLister == nil {
+		s.userLister = &userinfo.SystemLookupProvider{}
+	}
+	if s.groupLister == nil {
+		s.groupLister = &userinfo.SystemLookupProvider{}
+	}
+	if s.timeNow == nil {
+		s.timeNow = time.Now
+	}
+
+	return s
 }
 
 // UserResult contains the result of syncing a single user
@@ -53,37 +287,451 @@ type UserResult struct {
 	Error       error
 	KeysWritten int
 	LocalKeys   int
-	Changed     bool
-	BackupPath  string
+	// KeysRejected is the number of keys dropped by the key policy
+	KeysRejected int
+	Changed      bool
+	// RolledBack is true if authorized_keys was restored from the backup of
+	// this run after a failure following the write
+	RolledBack bool
+	// NotModified is true if every source answered 304 Not Modified in
+	// changed-only mode, so authorized_keys was not rebuilt
+	NotModified bool
+	// WouldChange is true if, in check mode, authorized_keys differs from
+	// the generated content other than by its timestamps
+	WouldChange bool
+	// TooFewKeys is true if the sync was aborted because the generated
+	// authorized_keys held fewer keys than min_keys
+	TooFewKeys bool
+	// FirstRun is true if the user had no authorized_keys and, in
+	// changed-only mode, no entry in the state file, as on a new host
+	FirstRun   bool
+	BackupPath string
+	// Decisions explains why each candidate key was written or dropped
+	Decisions []KeyDecision
+	// Warnings are the non-fatal problems of the user sync, e.g. discarded
+	// lines, duplicate or rejected keys and skips
+	Warnings []string
+
+	// authKeysPath is the authorized_keys file of the user, once looked up
+	authKeysPath string
 }
 
 // SyncResult contains the result of the entire sync operation
 type SyncResult struct {
 	Users     []UserResult
 	HasErrors bool
+	// Warnings are the configuration warnings followed by the warnings of
+	// every user, prefixed with its username
+	Warnings []string
+	// WarningsAreErrors is true if warnings_are_errors is enabled, so any
+	// warning fails the run
+	WarningsAreErrors bool
+}
+
+// Err returns the errors of every failed user, each prefixed with its
+// username, joined with errors.Join so errors.Is and errors.As match any of
+// their causes. Returns nil if no user failed.
+func (r *SyncResult) Err() error {
+	var errs []error
+	for _, user := range r.Users {
+		if user.Error != nil {
+			errs = append(errs, fmt.Errorf("user %s: %w", user.Username, user.Error))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // Run executes the synchronization for all configured users.
 // Returns a SyncResult containing the outcome for each user.
 func (s *Syncer) Run(ctx context.Context) *SyncResult {
+	ctx, span := tracer.Start(ctx, "sync.Run")
+	defer span.End()
+
 	result := &SyncResult{
-		Users: make([]UserResult, 0, len(s.cfg.Users)),
+		Users:             make([]UserResult, 0, len(s.cfg.Users)),
+		WarningsAreErrors: s.cfg.Policy.IsWarningsAreErrors(),
 	}
+	for _, warning := range s.cfg.Warnings {
+		result.Warnings = append(result.Warnings, "config: "+warning)
+	}
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("users.count", len(result.Users)),
+			attribute.Bool("dry_run", s.dryRun),
+		)
+		if result.HasErrors {
+			span.SetStatus(codes.Error, "some users failed to synchronize")
+		}
+	}()
 
-	for _, user := range s.cfg.Users {
-		userResult := s.syncUser(ctx, user)
+	users, _, failed := s.resolveUsers()
+	for _, userResult := range failed {
+		result.Users = append(result.Users, userResult)
+		result.HasErrors = true
+	}
+
+	if s.changedOnly {
+		s.loadState()
+	}
+
+	users, sharedResults := s.resolveSharedHomes(users)
+	for _, userResult := range s.syncUsers(ctx, users, sharedResults) {
 		result.Users = append(result.Users, userResult)
+		for _, warning := range userResult.Warnings {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("user %s: %s", userResult.Username, warning))
+		}
 
 		if userResult.Error != nil {
 			result.HasErrors = true
 		}
+		if s.changedOnly {
+			s.recordUserState(userResult)
+		}
+	}
+
+	if saver, ok := s.fetcher.(cacheSaver); ok && !s.dryRun {
+		if err := saver.SaveCache(); err != nil {
+			s.logger.Warn("failed to save HTTP cache, the next run will fetch sources in full",
+				"path", s.cfg.Policy.GetHTTPCacheFile(),
+				"error", err)
+		}
+	}
+
+	if saver, ok := s.fetcher.(negativeCacheSaver); ok && !s.dryRun {
+		if err := saver.SaveNegativeCache(); err != nil {
+			s.logger.Warn("failed to save negative cache, the next run will request every source",
+				"path", s.cfg.Policy.GetNegativeCacheFile(),
+				"error", err)
+		}
+	}
+
+	if s.changedOnly && !s.dryRun {
+		if store, ok := s.fetcher.(validatorStore); ok {
+			s.state.Sources = store.Validators()
+		}
+		if err := SaveState(s.stateFile, s.state); err != nil {
+			s.logger.Warn("failed to save state file, the next run will be a full sync",
+				"path", s.stateFile,
+				"error", err)
+		}
 	}
 
 	return result
 }
 
-// syncUser synchronizes keys for a single user
-func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
+// loadState loads the state file on the first run of the Syncer and passes
+// its validators to the fetcher. Users are only skipped based on a state
+// built with the same configuration and include files.
+func (s *Syncer) loadState() {
+	if s.state == nil {
+		state, err := LoadState(s.stateFile)
+		if err != nil {
+			s.logger.Warn("failed to load state file, running a full sync",
+				"path", s.stateFile,
+				"error", err)
+			state = newState()
+		}
+		if store, ok := s.fetcher.(validatorStore); ok {
+			store.LoadValidators(state.Sources)
+		}
+		s.state = state
+	}
+
+	fingerprint := s.cfg.Fingerprint()
+	for _, path := range s.cfg.Policy.IncludeFiles {
+		fingerprint += "," + fileHash(path)
+	}
+	if s.state.Config != fingerprint {
+		if s.state.Config != "" {
+			s.logger.Info("configuration changed since the last run, rebuilding every user",
+				"path", s.stateFile)
+		}
+		s.state.Users = make(map[string]string)
+		s.state.Config = fingerprint
+	}
+}
+
+// recordUserState remembers the authorized_keys of a synchronized user, so
+// the next changed-only run can tell whether it was modified in between
+func (s *Syncer) recordUserState(result UserResult) {
+	if result.Error != nil || result.Skipped || result.authKeysPath == "" || s.dryRun {
+		delete(s.state.Users, result.Username)
+		return
+	}
+	s.state.Users[result.Username] = fileHash(result.authKeysPath)
+}
+
+// allNotModified returns true if every source answered 304 Not Modified
+func allNotModified(fetchResults []*keyfetcher.FetchResult) bool {
+	for _, fr := range fetchResults {
+		if !fr.NotModified {
+			return false
+		}
+	}
+	return len(fetchResults) > 0
+}
+
+// lookupUser returns the system information of a user. Explicit uid and
+// gid in the user's config bypass the system user database; otherwise the
+// policy uid_offset is added to the ids found there, for containers whose
+// user namespace maps them to different ids on the mounted home directories.
+func (s *Syncer) lookupUser(user config.User) (*userinfo.UserInfo, error) {
+	if user.HasIDOverride() {
+		info, err := userinfo.Resolve(user.Username, *user.UID, *user.GID, user.HomeDir)
+		if info == nil {
+			return nil, err
+		}
+		return s.applyAuthorizedKeysFile(info, err)
+	}
+
+	// The info returned with ErrSSHDirNotFound is shifted too, since it is
+	// used to create the .ssh directory
+	info, err := s.userLookup.Lookup(user.Username)
+	if info == nil {
+		return nil, err
+	}
+	info, err = s.applyAuthorizedKeysFile(info, err)
+	if info == nil {
+		return nil, err
+	}
+
+	if offset := s.cfg.Policy.GetUIDOffset(); offset != 0 {
+		shifted := *info
+		shifted.UID += offset
+		shifted.GID += offset
+		return &shifted, err
+	}
+	return info, err
+}
+
+// checkSSHDirOwner applies require_ssh_dir_owner to the .ssh directory of a
+// user. It is only checked when authorized_keys lives inside it.
+func (s *Syncer) checkSSHDirOwner(info *userinfo.UserInfo) error {
+	mode := s.cfg.Policy.GetRequireSSHDirOwner()
+	if mode == config.SSHDirOwnerAny || !info.InSSHDir() {
+		return nil
+	}
+	return userinfo.CheckSSHDirOwner(info, mode == config.SSHDirOwnerUserOrRoot)
+}
+
+// createSSHDir creates the missing .ssh directory of a user when
+// create_ssh_dir is enabled and the home directory is recent enough. Returns
+// an error wrapping userinfo.ErrSSHDirNotFound if the directory must not be
+// created, so the user is skipped as before.
+func (s *Syncer) createSSHDir(username string, info *userinfo.UserInfo) error {
+	notFound := fmt.Errorf("%w: %s", userinfo.ErrSSHDirNotFound, info.SSHDir)
+
+	// A missing .ssh in an old home is more likely a deliberate deletion
+	// than a new user, so it is left alone
+	if maxAge := s.cfg.Policy.GetCreateSSHDirMaxHomeAgeSeconds(); maxAge > 0 {
+		stat, err := os.Stat(info.HomeDir)
+		if err != nil {
+			return fmt.Errorf("failed to stat home directory: %w", err)
+		}
+		age := s.timeNow().Sub(stat.ModTime())
+		if age > time.Duration(maxAge)*time.Second {
+			s.logger.Warn("not creating .ssh directory: home directory is older than create_ssh_dir_max_home_age_seconds",
+				"username", username,
+				"home_dir", info.HomeDir,
+				"home_age", age.Truncate(time.Second).String())
+			return notFound
+		}
+	}
+
+	if s.dryRun {
+		s.logger.Info("dry-run: would create .ssh directory",
+			"username", username,
+			"path", info.SSHDir)
+		return nil
+	}
+
+	if err := userinfo.CreateSSHDir(info); err != nil {
+		return err
+	}
+	s.logger.Info("created .ssh directory",
+		"username", username,
+		"path", info.SSHDir)
+	return nil
+}
+
+// resolveUsers expands the configured users with expandUsers and, when the
+// run is limited to some users, keeps only those. Entries that could not be
+// expanded are then dropped, as they are about other users.
+func (s *Syncer) resolveUsers() (users []config.User, entries []string, failed []UserResult) {
+	users, entries, failed = s.expandUsers()
+	if s.onlyUsers == nil {
+		return users, entries, failed
+	}
+
+	kept := 0
+	for i, user := range users {
+		if s.onlyUsers[user.Username] {
+			users[kept], entries[kept] = user, entries[i]
+			kept++
+		}
+	}
+	return users[:kept], entries[:kept], nil
+}
+
+// ConfiguredUsernames returns every username the config resolves to, ignoring
+// Options.Users, and the entries that could not be expanded
+func (s *Syncer) ConfiguredUsernames() ([]string, []UserResult) {
+	users, _, failed := s.expandUsers()
+	usernames := make([]string, 0, len(users))
+	for _, user := range users {
+		usernames = append(usernames, user.Username)
+	}
+	return usernames, failed
+}
+
+// expandUsers expands wildcard and group user entries into concrete users.
+// Explicitly configured usernames always take precedence over pattern and
+// group matches, and a system user matched by several entries is only synced
+// by the first one. Entries that cannot be resolved are returned as failed results.
+// entries holds the label of the config entry each user was resolved from.
+func (s *Syncer) expandUsers() (users []config.User, entries []string, failed []UserResult) {
+	users = make([]config.User, 0, len(s.cfg.Users))
+	entries = make([]string, 0, len(s.cfg.Users))
+
+	seen := make(map[string]bool)
+	for _, user := range s.cfg.Users {
+		if !user.IsPattern() && !user.IsGroup() {
+			seen[user.Username] = true
+		}
+	}
+
+	var systemUsers []userinfo.SystemUser
+	var listErr error
+	listed := false
+
+	var systemGroups []userinfo.SystemGroup
+	var groupsErr error
+	groupsListed := false
+
+	for _, user := range s.cfg.Users {
+		if !user.IsPattern() && !user.IsGroup() {
+			users = append(users, user)
+			entries = append(entries, user.Label())
+			continue
+		}
+
+		if !listed {
+			systemUsers, listErr = s.userLister.ListUsers()
+			listed = true
+		}
+		if listErr != nil {
+			s.logger.Error("failed to list system users",
+				"pattern", user.Label(),
+				"error", listErr)
+			failed = append(failed, UserResult{
+				Username: user.Label(),
+				Error:    fmt.Errorf("failed to list system users: %w", listErr),
+			})
+			continue
+		}
+
+		if user.IsGroup() {
+			if !groupsListed {
+				systemGroups, groupsErr = s.groupLister.ListGroups()
+				groupsListed = true
+			}
+			members, err := groupMembers(user.Group, systemGroups, groupsErr, systemUsers)
+			if err != nil {
+				s.logger.Error("failed to resolve group",
+					"group", user.Group,
+					"error", err)
+				failed = append(failed, UserResult{
+					Username: user.Label(),
+					Error:    err,
+				})
+				continue
+			}
+
+			matched := 0
+			for _, member := range members {
+				if seen[member] || user.Excludes(member) {
+					continue
+				}
+				seen[member] = true
+				matched++
+				users = append(users, config.User{
+					Username:     member,
+					Sources:      user.Sources,
+					OnChangeHook: user.OnChangeHook,
+				})
+				entries = append(entries, user.Label())
+			}
+
+			s.logger.Info("resolved user group",
+				"group", user.Group,
+				"matched_users", matched)
+			continue
+		}
+
+		matched := 0
+		for _, su := range systemUsers {
+			if seen[su.Username] || !user.Matches(su.Username) {
+				continue
+			}
+			if !s.cfg.Policy.UIDInRange(su.UID) {
+				s.logger.Debug("user outside of UID range, ignoring",
+					"pattern", user.Username,
+					"username", su.Username,
+					"uid", su.UID)
+				continue
+			}
+
+			seen[su.Username] = true
+			matched++
+			users = append(users, config.User{
+				Username:     su.Username,
+				Sources:      user.Sources,
+				OnChangeHook: user.OnChangeHook,
+			})
+			entries = append(entries, user.Label())
+		}
+
+		s.logger.Info("resolved user pattern",
+			"pattern", user.Username,
+			"matched_users", matched)
+	}
+
+	return users, entries, failed
+}
+
+// groupMembers returns the members of the named group, given the result of
+// listing the system groups
+func groupMembers(name string, groups []userinfo.SystemGroup, listErr error, users []userinfo.SystemUser) ([]string, error) {
+	if listErr != nil {
+		return nil, fmt.Errorf("failed to list system groups: %w", listErr)
+	}
+	for _, group := range groups {
+		if group.Name == name {
+			return userinfo.GroupMembers(group, users), nil
+		}
+	}
+	return nil, fmt.Errorf("group %q not found in system", name)
+}
+
+// syncUser synchronizes keys for a single user. Non-fatal problems are
+// reported to warnings (which may be nil) as well as logged.
+func (s *Syncer) syncUser(ctx context.Context, user config.User, warnings *warningRecorder) (result UserResult) {
+	ctx, span := tracer.Start(ctx, "sync.User",
+		trace.WithAttributes(attribute.String("user.name", user.Username)))
+	defer func() {
+		span.SetAttributes(
+			attribute.Bool("user.skipped", result.Skipped),
+			attribute.Bool("user.changed", result.Changed),
+			attribute.Int("keys.written", result.KeysWritten),
+			attribute.Int("keys.local", result.LocalKeys),
+		)
+		if result.Error != nil {
+			span.RecordError(result.Error)
+			span.SetStatus(codes.Error, result.Error.Error())
+		}
+		span.End()
+	}()
+
 	start := s.timeNow()
 	defer func() {
 		s.logger.Debug("user sync finished",
@@ -91,12 +739,25 @@ func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
 			"duration_ms", time.Since(start).Milliseconds())
 	}()
 
-	result := UserResult{Username: user.Username}
+	result = UserResult{Username: user.Username}
 
 	s.logger.Info("processing user", "username", user.Username)
 
 	// Look up user info
-	info, err := s.userLookup.Lookup(user.Username)
+	info, err := s.lookupUser(user)
+	if errors.Is(err, userinfo.ErrSSHDirNotFound) && info != nil && s.cfg.Policy.IsCreateSSHDir() {
+		err = s.createSSHDir(user.Username, info)
+		if err != nil && !errors.Is(err, userinfo.ErrSSHDirNotFound) {
+			result.Error = err
+			s.logger.Error("failed to create .ssh directory",
+				"username", user.Username,
+				"error", err)
+			return result
+		}
+	}
+	if err == nil {
+		err = s.checkSSHDirOwner(info)
+	}
 	if err != nil {
 		if errors.Is(err, userinfo.ErrUserNotFound) {
 			s.logger.Warn("skipping user sync: system user lookup failed",
@@ -104,6 +765,23 @@ func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
 				"reason", "user does not exist in system")
 			result.Skipped = true
 			result.SkipReason = "user not found in system"
+			warnings.record("skipped: %s", result.SkipReason)
+			return result
+		}
+		if errors.Is(err, userinfo.ErrHomeDirNotFound) {
+			if !s.cfg.Policy.IsSkipMissingHome() {
+				result.Error = fmt.Errorf("failed to lookup user: %w", err)
+				s.logger.Error("home directory not found, it may be on an unmounted filesystem",
+					"username", user.Username,
+					"error", err)
+				return result
+			}
+			s.logger.Warn("skipping user sync: home directory not available",
+				"username", user.Username,
+				"reason", "home directory does not exist (it may be on an unmounted filesystem)")
+			result.Skipped = true
+			result.SkipReason = "home directory not found"
+			warnings.record("skipped: %s", result.SkipReason)
 			return result
 		}
 		if errors.Is(err, userinfo.ErrSSHDirNotFound) {
@@ -112,6 +790,17 @@ func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
 				"reason", ".ssh directory does not exist")
 			result.Skipped = true
 			result.SkipReason = ".ssh directory not found"
+			warnings.record("skipped: %s", result.SkipReason)
+			return result
+		}
+		if errors.Is(err, userinfo.ErrSSHDirWrongOwner) {
+			s.logger.Warn("skipping user sync: SSH directory has the wrong owner",
+				"username", user.Username,
+				"reason", err.Error(),
+				"require_ssh_dir_owner", s.cfg.Policy.GetRequireSSHDirOwner())
+			result.Skipped = true
+			result.SkipReason = ".ssh directory is not owned by the user"
+			warnings.record("skipped: %s", result.SkipReason)
 			return result
 		}
 		if errors.Is(err, userinfo.ErrSSHDirNotDir) {
@@ -120,6 +809,7 @@ func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
 				"reason", ".ssh exists but is not a directory")
 			result.Skipped = true
 			result.SkipReason = ".ssh exists but is not a directory"
+			warnings.record("skipped: %s", result.SkipReason)
 			return result
 		}
 		result.Error = fmt.Errorf("failed to lookup user: %w", err)
@@ -128,39 +818,273 @@ func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
 			"error", err)
 		return result
 	}
+	result.authKeysPath = info.AuthKeysPath
 
-	// Fetch keys from all sources
-	fetchResults, err := s.fetcher.FetchAll(ctx, user.Sources)
+	if err := s.createKeysDir(user.Username, info); err != nil {
+		result.Error = err
+		s.logger.Error("failed to create authorized_keys directory",
+			"username", user.Username,
+			"error", err)
+		return result
+	}
+
+	// Keep backups outside .ssh if a backup directory template is set
+	if backupDir := s.cfg.Policy.ExpandBackupDir(user.Username, info.HomeDir); backupDir != "" {
+		info.BackupDir = backupDir
+	}
+
+	// Remove temp files left behind by interrupted runs
+	if !s.dryRun {
+		removed, err := s.fileWriter.CleanupStaleTempFiles(info.KeysDir(), sshfile.StaleTempFileAge)
+		if err != nil {
+			s.logger.Warn("failed to clean up stale temp files",
+				"username", user.Username,
+				"error", err)
+			warnings.record("failed to clean up stale temp files: %v", err)
+		}
+		if len(removed) > 0 {
+			s.logger.Info("removed stale temp files",
+				"username", user.Username,
+				"files", removed)
+		}
+	}
+
+	// Users without explicit sources use the source template
+	sources, err := s.cfg.Policy.ResolveSources(user.Username, user.Sources)
 	if err != nil {
+		result.Error = err
+		s.logger.Error("failed to resolve sources, aborting user sync",
+			"username", user.Username,
+			"error", err)
+		return result
+	}
+	sources = config.CapTimeouts(sources, s.sourceTimeout)
+
+	// HEAD responses have no keys, syncing them could wipe authorized_keys
+	for _, source := range sources {
+		if source.GetMethod() == http.MethodHead {
+			result.Error = fmt.Errorf("source %s uses method HEAD, which is only supported by --check-sources", source.URL)
+			s.logger.Error("source uses method HEAD, aborting user sync",
+				"username", user.Username,
+				"url", source.URL)
+			return result
+		}
+	}
+
+	// Fetch keys from all sources
+	fetchResults, err := s.fetcher.FetchAll(ctx, sources)
+	fetchFailed := err != nil
+	if fetchFailed && len(s.cfg.Policy.AlwaysKeys) == 0 {
 		result.Error = fmt.Errorf("failed to fetch keys: %w", err)
 		s.logger.Error("failed to fetch keys, aborting user sync",
 			"username", user.Username,
 			"error", err)
 		return result
 	}
+	if fetchFailed {
+		// The always_keys must get in even when the sources are down. Every
+		// existing key is kept, since none can be checked against the
+		// sources, and the user still fails.
+		fetchErr := fmt.Errorf("failed to fetch keys: %w", err)
+		s.logger.Error("failed to fetch keys, only adding always_keys to the existing keys",
+			"username", user.Username,
+			"error", err)
+		fetchResults = nil
+		defer func() {
+			if result.Error == nil {
+				result.Error = fetchErr
+			}
+		}()
+	}
 
 	// Log fetch results
 	for _, fr := range fetchResults {
+		if fr.Error != nil {
+			s.logger.Warn("optional source failed, continuing without it",
+				"username", user.Username,
+				"url", fr.Source.URL,
+				"error", fr.Error)
+			warnings.record("optional source %s failed: %v", fr.Source.URL, fr.Error)
+			continue
+		}
 		s.logger.Info("fetched keys from source",
 			"username", user.Username,
 			"url", fr.Source.URL,
 			"keys", len(fr.Keys),
 			"discarded_lines", fr.DiscardedLines)
+		if fr.DiscardedLines > 0 {
+			warnings.record("source %s: %d lines discarded", fr.Source.URL, fr.DiscardedLines)
+		}
+		if len(fr.Keys) == 0 && fr.DiscardedLines > 0 {
+			s.logger.Debug("source returned no valid keys",
+				"username", user.Username,
+				"url", fr.Source.URL,
+				"body_preview", fr.BodyPreview)
+		}
+	}
+
+	// A missing include file would silently drop its keys, abort instead
+	included, err := s.readIncludeFiles(s.cfg.Policy.IncludeFiles)
+	if err != nil {
+		result.Error = err
+		s.logger.Error("failed to read include file, aborting user sync",
+			"username", user.Username,
+			"error", err)
+		return result
+	}
+
+	// In changed-only mode, a user whose sources are all unchanged keeps its
+	// file, unless the file was modified since the last run
+	if s.changedOnly && allNotModified(fetchResults) {
+		if previous := s.state.Users[user.Username]; previous != "" && previous == fileHash(info.AuthKeysPath) {
+			s.logger.Info("sources not modified, skipping user",
+				"username", user.Username)
+			result.NotModified = true
+			return result
+		}
+	}
+
+	result.FirstRun = s.isFirstRun(user.Username, info)
+
+	// Hold the per-user lock while reading, backing up and writing the file
+	if !s.dryRun {
+		unlock, err := s.fileWriter.Lock(info.AuthKeysPath, info.UID, info.GID, sshfile.LockTimeout)
+		if err != nil {
+			result.Error = fmt.Errorf("failed to lock authorized_keys: %w", err)
+			s.logger.Error("failed to lock authorized_keys",
+				"username", user.Username,
+				"error", err)
+			return result
+		}
+		defer func() {
+			if err := unlock(); err != nil {
+				s.logger.Warn("failed to release authorized_keys lock",
+					"username", user.Username,
+					"error", err)
+				warnings.record("failed to release authorized_keys lock: %v", err)
+			}
+		}()
 	}
 
 	// Build content with deduplication
-	content, stats := s.buildContent(info, fetchResults)
+	recorder := &decisionRecorder{}
+	content, stats := s.buildContent(info, fetchResults, included, fetchFailed, recorder)
+	result.Decisions = recorder.list()
+	managed := content
+
+	// Only replace the managed block, keeping the lines around it verbatim
+	if s.cfg.Policy.IsManagedBlock() {
+		existingContent, err := sshfile.ReadContent(info.AuthKeysPath)
+		var block *sshfile.ManagedBlock
+		if err == nil {
+			block, err = sshfile.SplitManagedBlock(existingContent)
+		}
+		if err != nil {
+			result.Error = fmt.Errorf("failed to read managed block: %w", err)
+			s.logger.Error("failed to read managed block of authorized_keys, keeping existing file",
+				"username", user.Username,
+				"error", err)
+			return result
+		}
+		content = block.Replace(content)
+	}
 
 	result.KeysWritten = stats.TotalKeys
 	result.LocalKeys = stats.LocalKeys
+	result.KeysRejected = len(stats.Rejected)
+
+	// Log keys rejected by the key policy
+	for _, rej := range stats.Rejected {
+		s.logger.Warn("key rejected by key policy",
+			"username", user.Username,
+			"key_fingerprint", keyFingerprint(rej.Key),
+			"key_fingerprint_md5", keyFingerprintMD5(rej.Key),
+			"source", rej.Source,
+			"reason", rej.Reason)
+		warnings.record("key %s from %s rejected: %s", keyFingerprint(rej.Key), rej.Source, rej.Reason)
+	}
 
 	// Log deduplication info
 	for _, dup := range stats.Duplicates {
 		s.logger.Info("duplicate key found",
 			"username", user.Username,
 			"key_fingerprint", keyFingerprint(dup.Key),
+			"key_fingerprint_md5", keyFingerprintMD5(dup.Key),
 			"first_source", dup.FirstSource,
-			"duplicate_source", dup.DuplicateSource)
+			"duplicate_source", dup.DuplicateSource,
+			"cross_source", dup.CrossSource,
+			"key_material", dup.KeyMaterial)
+		warnings.record("duplicate key %s in %s, first found in %s", keyFingerprint(dup.Key), dup.DuplicateSource, dup.FirstSource)
+	}
+
+	// Refuse to write a file with too few keys, e.g. because a source answered
+	// with an empty body, keeping the old one
+	firstRunPolicy := s.cfg.Policy.GetFirstRunPolicy()
+	if minKeys := s.cfg.Policy.GetMinKeys(); minKeys > 0 && !fetchFailed && (!result.FirstRun || firstRunPolicy != config.FirstRunRelax) {
+		keys := stats.TotalKeys
+		// An authorized_keys the state file does not know about was not
+		// written by a previous sync, so its local keys are not trusted
+		untracked := s.state == nil || s.state.Users[user.Username] == ""
+		if !s.cfg.Policy.IsMinKeysIncludeLocal() || (firstRunPolicy == config.FirstRunDistrust && untracked) {
+			keys -= stats.LocalKeys
+		}
+		if keys < minKeys {
+			result.TooFewKeys = true
+			result.Error = fmt.Errorf("%w: generated authorized_keys has %d keys, min_keys is %d", ErrTooFewKeys, keys, minKeys)
+			s.logger.Error("generated authorized_keys has too few keys, keeping existing file",
+				"username", user.Username,
+				"keys", keys,
+				"min_keys", minKeys)
+			withhold(result.Decisions, fmt.Sprintf("%d keys, min_keys is %d", keys, minKeys))
+			return result
+		}
+	}
+
+	// Refuse to write a file larger than the configured limit, keeping the old one
+	if maxBytes := s.cfg.Policy.GetMaxAuthKeysBytes(); maxBytes > 0 && len(content) > maxBytes {
+		result.Error = fmt.Errorf("generated authorized_keys is %d bytes, exceeding max_authorized_keys_bytes (%d)", len(content), maxBytes)
+		s.logger.Error("generated authorized_keys too large, keeping existing file",
+			"username", user.Username,
+			"size_bytes", len(content),
+			"max_bytes", maxBytes,
+			"keys", stats.TotalKeys)
+		withhold(result.Decisions, fmt.Sprintf("%d bytes, max_authorized_keys_bytes is %d", len(content), maxBytes))
+		return result
+	}
+
+	// Leave the file alone if only its timestamps would change
+	if s.incremental {
+		existingContent, err := sshfile.ReadContent(info.AuthKeysPath)
+		if err == nil && bytes.Equal(stableContent(existingContent), stableContent(content)) {
+			s.logger.Info("authorized_keys unchanged",
+				"username", user.Username)
+			return result
+		}
+	}
+
+	// Report drift instead of writing in check mode
+	if s.check {
+		existingContent, err := sshfile.ReadContent(info.AuthKeysPath)
+		if err != nil {
+			result.Error = err
+			s.logger.Error("failed to read authorized_keys",
+				"username", user.Username,
+				"error", err)
+			return result
+		}
+		diff := unifiedDiff(info.AuthKeysPath, info.AuthKeysPath+" (synced)",
+			contentLines(stableContent(existingContent)), contentLines(stableContent(content)))
+		if diff == "" {
+			s.logger.Info("check: authorized_keys in sync",
+				"username", user.Username)
+			return result
+		}
+		result.WouldChange = true
+		s.logger.Info("check: authorized_keys would change",
+			"username", user.Username,
+			"path", info.AuthKeysPath,
+			"diff", diff)
+		return result
 	}
 
 	if s.dryRun {
@@ -174,11 +1098,25 @@ func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
 		return result
 	}
 
-	// Create backup if enabled and content changed
-	if s.cfg.Policy.IsBackupEnabled() {
-		existingContent, _ := sshfile.ReadContent(info.SSHDir)
-		if len(existingContent) > 0 && string(existingContent) != string(content) {
-			backupPath, err := s.backupManager.CreateBackup(info.SSHDir, info.UID, info.GID)
+	// Keep the keys being replaced for the changelog
+	var previousContent []byte
+	if s.cfg.Policy.IsChangelog() {
+		previousContent, _ = s.managedContent(info)
+	}
+
+	// Create backup if enabled and the managed content changed
+	if s.cfg.Policy.IsBackupEnabled() && !s.noBackup {
+		existingContent, _ := s.managedContent(info)
+		if len(existingContent) > 0 && string(existingContent) != string(managed) {
+			backupUID, backupGID, err := s.backupOwner(info)
+			if err != nil {
+				result.Error = err
+				s.logger.Error("failed to create backup",
+					"username", user.Username,
+					"error", err)
+				return result
+			}
+			backupPath, err := s.backupManager.CreateBackupIn(info.AuthKeysPath, info.BackupDir, backupUID, backupGID)
 			if err != nil {
 				result.Error = fmt.Errorf("failed to create backup: %w", err)
 				s.logger.Error("failed to create backup",
@@ -193,22 +1131,39 @@ func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
 					"path", backupPath)
 			}
 
-			// Rotate old backups
-			deleted, err := s.backupManager.RotateBackups(info.SSHDir, s.cfg.Policy.GetBackupRetentionCount())
-			if err != nil {
-				s.logger.Warn("failed to rotate backups",
-					"username", user.Username,
-					"error", err)
-			} else if len(deleted) > 0 {
-				s.logger.Info("rotated old backups",
-					"username", user.Username,
-					"deleted_count", len(deleted))
+			// Rotate old backups (unless retention is unlimited or rotation is disabled)
+			if !s.cfg.Policy.IsBackupRetentionUnlimited() && !s.noRotate {
+				deleted, err := s.backupManager.RotateBackupsIn(info.BackupDir, s.cfg.Policy.GetBackupRetentionCount())
+				if err != nil {
+					s.logger.Warn("failed to rotate backups",
+						"username", user.Username,
+						"error", err)
+					warnings.record("failed to rotate backups: %v", err)
+				}
+				if len(deleted) > 0 {
+					s.logger.Info("rotated old backups",
+						"username", user.Username,
+						"deleted_count", len(deleted))
+				}
 			}
 		}
 	}
 
-	// Write file atomically
-	writeResult, err := s.fileWriter.WriteAtomic(info.SSHDir, content, info.UID, info.GID)
+	// Write file atomically, as the user if privileges are dropped
+	var writeResult *sshfile.WriteResult
+	err = s.asUser(info, func() error {
+		var err error
+		writeResult, err = s.fileWriter.WriteAtomic(info.AuthKeysPath, content, info.UID, info.GID)
+		return err
+	})
+	if errors.Is(err, sshfile.ErrVerifyFailed) {
+		result.Error = fmt.Errorf("failed to write authorized_keys: %w", err)
+		s.logger.Error("authorized_keys verification failed after write",
+			"username", user.Username,
+			"error", err)
+		result.RolledBack = s.restoreBackup(user.Username, info, result.BackupPath)
+		return result
+	}
 	if err != nil {
 		result.Error = fmt.Errorf("failed to write authorized_keys: %w", err)
 		s.logger.Error("failed to write authorized_keys",
@@ -217,13 +1172,36 @@ func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
 		return result
 	}
 
+	// From here on the new file is in place: with rollback_on_error, any
+	// failure restores the previous one, so the user is never left half-synced
+	defer func() {
+		if result.Error != nil && s.cfg.Policy.IsRollbackOnError() {
+			result.RolledBack = s.restoreBackup(user.Username, info, result.BackupPath)
+		}
+	}()
+
+	if s.afterWrite != nil {
+		if err := s.afterWrite(info); err != nil {
+			result.Error = fmt.Errorf("failed after writing authorized_keys: %w", err)
+			s.logger.Error("failed after writing authorized_keys",
+				"username", user.Username,
+				"error", err)
+			return result
+		}
+	}
+
 	result.Changed = writeResult.Changed
 
+	if writeResult.Changed && s.cfg.Policy.IsChangelog() {
+		s.appendChangelog(user.Username, info, previousContent, result.Decisions, warnings)
+	}
+
 	if writeResult.Changed {
 		s.logger.Info("updated authorized_keys",
 			"username", user.Username,
 			"path", writeResult.Path,
-			"keys", stats.TotalKeys)
+			"keys", stats.TotalKeys,
+			"first_run", result.FirstRun)
 	} else {
 		s.logger.Info("authorized_keys unchanged",
 			"username", user.Username)
@@ -232,11 +1210,81 @@ func (s *Syncer) syncUser(ctx context.Context, user config.User) UserResult {
 	return result
 }
 
+// isFirstRun reports whether a user looks never synced: it has no
+// authorized_keys and, in changed-only mode, no entry in the state file
+func (s *Syncer) isFirstRun(username string, info *userinfo.UserInfo) bool {
+	if _, err := os.Lstat(info.AuthKeysPath); !errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	return s.state == nil || s.state.Users[username] == ""
+}
+
+// backupOwner returns the owner of the backups of a user. Backups owned by
+// root are refused in the home directory of the user, who could replace the
+// backup directory and have root write files elsewhere.
+func (s *Syncer) backupOwner(info *userinfo.UserInfo) (int, int, error) {
+	if !s.cfg.Policy.IsBackupOwnedByRoot() {
+		return info.UID, info.GID, nil
+	}
+	if info.BackupDirInHome() {
+		return 0, 0, fmt.Errorf("backup_owner %q cannot be used with backup directory %s inside the home directory of %s",
+			config.BackupOwnerRoot, info.BackupDir, info.Username)
+	}
+	return os.Geteuid(), os.Getegid(), nil
+}
+
+// restoreBackup restores authorized_keys from the backup taken in this run
+// after a failed write verification or, with rollback_on_error, a failed
+// step after the write. Failures are logged, since the user sync has already
+// failed. Returns true if the backup was restored.
+func (s *Syncer) restoreBackup(username string, info *userinfo.UserInfo, backupPath string) bool {
+	if backupPath == "" {
+		s.logger.Error("no backup available to restore authorized_keys, manual inspection required",
+			"username", username,
+			"path", info.AuthKeysPath)
+		return false
+	}
+
+	backupContent, err := s.backupManager.ReadBackup(filepath.Dir(backupPath), filepath.Base(backupPath))
+	if err != nil {
+		s.logger.Error("failed to read backup for restore, manual inspection required",
+			"username", username,
+			"backup", backupPath,
+			"error", err)
+		return false
+	}
+
+	err = s.asUser(info, func() error {
+		_, err := s.fileWriter.WriteAtomic(info.AuthKeysPath, backupContent, info.UID, info.GID)
+		return err
+	})
+	if err != nil {
+		s.logger.Error("failed to restore authorized_keys from backup, manual inspection required",
+			"username", username,
+			"backup", backupPath,
+			"error", err)
+		return false
+	}
+
+	s.logger.Warn("restored authorized_keys from backup",
+		"username", username,
+		"backup", backupPath)
+	return true
+}
+
 // ContentStats contains statistics about built content
 type ContentStats struct {
 	TotalKeys  int
 	LocalKeys  int
 	Duplicates []DuplicateInfo
+	Rejected   []RejectedInfo
+}
+
+// RejectedInfo contains information about a key rejected by the key policy
+type RejectedInfo struct {
+	Key    string
+	Source string
+	Reason error
 }
 
 // DuplicateInfo contains information about a duplicate key
@@ -244,63 +1292,192 @@ type DuplicateInfo struct {
 	Key             string
 	FirstSource     string
 	DuplicateSource string
+	// CrossSource is true if the key was first seen in another source.
+	// It is always false for remote sources when deduplicate_across_sources
+	// is disabled, since only duplicates within a source are dropped then.
+	CrossSource bool
+	// KeyMaterial is true if the key only matched the first one on its type
+	// and blob, with different options or comment (dedupe_by_key_material)
+	KeyMaterial bool
+}
+
+// dedupKey returns what a key line is deduplicated by: the trimmed line, or
+// its type and blob with dedupe_by_key_material
+func (s *Syncer) dedupKey(line string) string {
+	if !s.cfg.Policy.IsDedupeByKeyMaterial() {
+		return line
+	}
+	parts, err := keyparser.SplitKey(line)
+	if err != nil {
+		return line
+	}
+	return parts.Type + " " + parts.Blob
 }
 
 // buildContent builds the authorized_keys file content with proper formatting and deduplication
-func (s *Syncer) buildContent(info *userinfo.UserInfo, fetchResults []*keyfetcher.FetchResult) ([]byte, *ContentStats) {
+// Every candidate key is reported to the recorder (which may be nil) with its verdict.
+// With keepLocal, existing keys are preserved even without preserve_local_keys.
+func (s *Syncer) buildContent(info *userinfo.UserInfo, fetchResults []*keyfetcher.FetchResult, included []includedFile, keepLocal bool, recorder *decisionRecorder) ([]byte, *ContentStats) {
 	stats := &ContentStats{
 		Duplicates: make([]DuplicateInfo, 0),
+		Rejected:   make([]RejectedInfo, 0),
+	}
+
+	// rejected reports whether the key policy rejects the key
+	rejected := func(source string, key keyparser.ParsedKey) bool {
+		err := s.keyPolicy.Check(key.Line)
+		if err == nil {
+			return false
+		}
+		stats.Rejected = append(stats.Rejected, RejectedInfo{
+			Key:    key.Line,
+			Source: source,
+			Reason: err,
+		})
+		recorder.record(source, key.Line, VerdictRejected, err.Error())
+		return true
 	}
 
 	// Track seen keys for deduplication
-	// Key: trimmed line, Value: source URL where first seen
+	// Key: dedupKey of the line, Value: source URL where first seen
 	seenKeys := make(map[string]string)
+	// firstLines are the lines first seen for each dedupKey
+	firstLines := make(map[string]string)
+
+	// Without cross-source deduplication, remote keys are only compared with
+	// keys of the same source. Local keys are always compared with every
+	// source, otherwise keys written by previous runs would pile up.
+	dedupAcrossSources := s.cfg.Policy.IsDeduplicateAcrossSources()
+
+	// Keys are deduplicated by their trimmed line, but written verbatim
+	// when preserve_formatting is enabled
+	preserveFormatting := s.cfg.Policy.IsPreserveFormatting()
+	outputLine := func(key keyparser.ParsedKey) string {
+		if preserveFormatting && key.Raw != "" {
+			return key.Raw
+		}
+		return key.Line
+	}
 
 	// Track keys per source
 	type sourceKeys struct {
-		url  string
-		keys []string
+		url      string
+		result   *keyfetcher.FetchResult
+		included bool
+		keys     []string
 	}
-	sources := make([]sourceKeys, 0, len(fetchResults)+1)
+	sources := make([]sourceKeys, 0, len(fetchResults)+len(included)+1)
 
-	// Process remote sources in order
-	for _, fr := range fetchResults {
-		sk := sourceKeys{url: fr.Source.URL}
-		for _, key := range fr.Keys {
-			if firstSource, exists := seenKeys[key.Line]; exists {
+	// collect keeps the keys of a remote source or include file that pass
+	// the key policy and deduplication
+	collect := func(source string, keys []keyparser.ParsedKey) []string {
+		var kept []string
+		// sourceSeen maps the dedupKey of each key kept for this source to
+		// its line
+		sourceSeen := make(map[string]string)
+		for _, key := range keys {
+			if rejected(source, key) {
+				continue
+			}
+			dedup := s.dedupKey(key.Line)
+			firstSource, exists := seenKeys[dedup]
+			firstLine := firstLines[dedup]
+			if !dedupAcrossSources {
+				exists = sourceSeen[dedup] != ""
+				firstSource = source
+				firstLine = sourceSeen[dedup]
+			}
+			if exists {
 				stats.Duplicates = append(stats.Duplicates, DuplicateInfo{
 					Key:             key.Line,
 					FirstSource:     firstSource,
-					DuplicateSource: fr.Source.URL,
+					DuplicateSource: source,
+					CrossSource:     firstSource != source,
+					KeyMaterial:     firstLine != key.Line,
 				})
+				recorder.record(source, key.Line, VerdictDeduped, "duplicate of "+firstSource)
 				continue
 			}
-			seenKeys[key.Line] = fr.Source.URL
-			sk.keys = append(sk.keys, key.Line)
+			sourceSeen[dedup] = key.Line
+			if _, exists := seenKeys[dedup]; !exists {
+				seenKeys[dedup] = source
+				firstLines[dedup] = key.Line
+			}
+			kept = append(kept, outputLine(key))
+			recorder.record(source, key.Line, VerdictWritten, "")
+		}
+		return kept
+	}
+
+	// Process remote sources by descending priority, in config order within
+	// equal priority, so higher priority sources win duplicates
+	fetchResults = slices.Clone(fetchResults)
+	slices.SortStableFunc(fetchResults, func(a, b *keyfetcher.FetchResult) int {
+		return cmp.Compare(b.Source.Priority, a.Source.Priority)
+	})
+	for _, fr := range fetchResults {
+		if keys := collect(fr.Source.URL, fr.Keys); len(keys) > 0 {
+			sources = append(sources, sourceKeys{url: fr.Source.URL, result: fr, keys: keys})
+		}
+	}
+
+	// Process include files after remote sources, in config order
+	for _, file := range included {
+		if keys := collect(file.path, file.keys); len(keys) > 0 {
+			sources = append(sources, sourceKeys{url: file.path, included: true, keys: keys})
 		}
-		if len(sk.keys) > 0 {
-			sources = append(sources, sk)
+	}
+
+	// Process always_keys before local keys, so that their copies in the
+	// existing file are not preserved as local keys. They are written last.
+	var alwaysKeys []string
+	for _, line := range s.cfg.Policy.AlwaysKeys {
+		line = strings.TrimSpace(line)
+		dedup := s.dedupKey(line)
+		if firstSource, exists := seenKeys[dedup]; exists {
+			stats.Duplicates = append(stats.Duplicates, DuplicateInfo{
+				Key:             line,
+				FirstSource:     firstSource,
+				DuplicateSource: SourceAlways,
+				CrossSource:     firstSource != SourceAlways,
+				KeyMaterial:     firstLines[dedup] != line,
+			})
+			recorder.record(SourceAlways, line, VerdictDeduped, "duplicate of "+firstSource)
+			continue
 		}
+		seenKeys[dedup] = SourceAlways
+		firstLines[dedup] = line
+		alwaysKeys = append(alwaysKeys, line)
+		recorder.record(SourceAlways, line, VerdictWritten, "")
 	}
 
 	// Process local keys if preserve_local_keys is enabled
 	var localKeys []string
-	if s.cfg.Policy.IsPreserveLocalKeys() {
-		existingContent, err := sshfile.ReadContent(info.SSHDir)
+	if s.cfg.Policy.IsPreserveLocalKeys() || keepLocal {
+		existingContent, err := s.managedContent(info)
 		if err == nil && len(existingContent) > 0 {
-			parseResult, err := keyparser.ParseString(string(existingContent))
+			parseResult, err := s.keyParser.ParseString(string(existingContent))
 			if err == nil {
 				for _, key := range parseResult.Keys {
-					if firstSource, exists := seenKeys[key.Line]; exists {
+					if rejected(SourceLocal, key) {
+						continue
+					}
+					dedup := s.dedupKey(key.Line)
+					if firstSource, exists := seenKeys[dedup]; exists {
 						stats.Duplicates = append(stats.Duplicates, DuplicateInfo{
 							Key:             key.Line,
 							FirstSource:     firstSource,
-							DuplicateSource: "Local",
+							DuplicateSource: SourceLocal,
+							CrossSource:     firstSource != SourceLocal,
+							KeyMaterial:     firstLines[dedup] != key.Line,
 						})
+						recorder.record(SourceLocal, key.Line, VerdictDeduped, "duplicate of "+firstSource)
 						continue
 					}
-					seenKeys[key.Line] = "Local"
-					localKeys = append(localKeys, key.Line)
+					seenKeys[dedup] = SourceLocal
+					firstLines[dedup] = key.Line
+					localKeys = append(localKeys, outputLine(key))
+					recorder.record(SourceLocal, key.Line, VerdictWritten, "")
 				}
 			}
 		}
@@ -310,7 +1487,8 @@ func (s *Syncer) buildContent(info *userinfo.UserInfo, fetchResults []*keyfetche
 	var builder strings.Builder
 
 	// Header
-	timestamp := s.timeNow().UTC().Format("2006-01-02T15:04:05Z")
+	location := s.cfg.Policy.Location()
+	timestamp := s.timeNow().In(location).Format(time.RFC3339)
 	builder.WriteString("# ──────────────────────────────────────────────────────────────────\n")
 	builder.WriteString("# Generated by AuthKeySync\n")
 	builder.WriteString(fmt.Sprintf("# Version:   %s\n", version.Version))
@@ -320,10 +1498,16 @@ func (s *Syncer) buildContent(info *userinfo.UserInfo, fetchResults []*keyfetche
 	builder.WriteString("# More info: https://github.com/eduardolat/authkeysync\n")
 	builder.WriteString("# ──────────────────────────────────────────────────────────────────\n")
 
-	// Remote sources
+	// Remote sources and include files
 	for _, src := range sources {
 		builder.WriteString("\n")
-		builder.WriteString(fmt.Sprintf("# Source: %s\n", src.url))
+		if src.included {
+			builder.WriteString(fmt.Sprintf("# Included: %s\n", src.url))
+		} else if s.cfg.Policy.IsVerboseSourceComments() {
+			builder.WriteString(fmt.Sprintf("# Source: %s (%s)\n", src.url, sourceMetadata(src.result, len(src.keys), location)))
+		} else {
+			builder.WriteString(fmt.Sprintf("# Source: %s\n", src.url))
+		}
 		for _, key := range src.keys {
 			builder.WriteString(key)
 			builder.WriteString("\n")
@@ -343,15 +1527,120 @@ func (s *Syncer) buildContent(info *userinfo.UserInfo, fetchResults []*keyfetche
 		}
 	}
 
+	// Always keys
+	if len(alwaysKeys) > 0 {
+		builder.WriteString("\n")
+		builder.WriteString("# Always (policy)\n")
+		for _, key := range alwaysKeys {
+			builder.WriteString(key)
+			builder.WriteString("\n")
+			stats.TotalKeys++
+		}
+	}
+
 	return []byte(builder.String()), stats
 }
 
-// keyFingerprint computes a SHA256 fingerprint of an SSH key line for visual identification.
-// Returns a short fingerprint like "SHA256:a1b2c3d4e5f6a7b8" based on the entire line.
+// managedContent returns the part of authorized_keys written by AuthKeySync:
+// the whole file, or what is inside its managed block with managed_block
+func (s *Syncer) managedContent(info *userinfo.UserInfo) ([]byte, error) {
+	content, err := sshfile.ReadContent(info.AuthKeysPath)
+	if err != nil || !s.cfg.Policy.IsManagedBlock() {
+		return content, err
+	}
+	block, err := sshfile.SplitManagedBlock(content)
+	if err != nil {
+		return nil, err
+	}
+	return block.Inner, nil
+}
+
+// includedFile holds the keys of an include_files entry
+type includedFile struct {
+	path string
+	keys []keyparser.ParsedKey
+}
+
+// readIncludeFiles reads and parses the include_files of the policy
+func (s *Syncer) readIncludeFiles(paths []string) ([]includedFile, error) {
+	included := make([]includedFile, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read include file: %w", err)
+		}
+		parseResult, err := s.keyParser.ParseString(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse include file %s: %w", path, err)
+		}
+		included = append(included, includedFile{path: path, keys: parseResult.Keys})
+	}
+	return included, nil
+}
+
+// sourceMetadata describes a fetch for verbose source comments,
+// e.g. "3 keys, HTTP 200, fetched 2024-06-01T12:00:00Z", or "3 keys, file,
+// fetched ..." for file sources
+func sourceMetadata(fr *keyfetcher.FetchResult, keys int, location *time.Location) string {
+	noun := "keys"
+	if keys == 1 {
+		noun = "key"
+	}
+	meta := fmt.Sprintf("%d %s, HTTP %d", keys, noun, fr.StatusCode)
+	if fr.Source.IsFile() {
+		meta = fmt.Sprintf("%d %s, file", keys, noun)
+	}
+	if !fr.FetchedAt.IsZero() {
+		meta += ", fetched " + fr.FetchedAt.In(location).Format(time.RFC3339)
+	}
+	return meta
+}
+
+// stableContent returns authorized_keys content without the parts that change
+// on every run: the "# Last sync:" line and the metadata of verbose
+// "# Source:" lines
+func stableContent(content []byte) []byte {
+	lines := strings.Split(string(content), "\n")
+	stable := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "# Last sync:") {
+			continue
+		}
+		if strings.HasPrefix(line, "# Source: ") {
+			line, _, _ = strings.Cut(line, " (")
+		}
+		stable = append(stable, line)
+	}
+	return []byte(strings.Join(stable, "\n"))
+}
+
+// contentLines splits authorized_keys content into lines, without the empty
+// line after the final newline
+func contentLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// keyFingerprint returns the SHA256 fingerprint of an SSH key line as shown
+// by "ssh-keygen -l", computed over the key blob, so options and comments do
+// not change it. A line whose blob cannot be decoded gets a short hash of the
+// whole line instead, like "line-sha256:a1b2c3d4e5f6a7b8".
 func keyFingerprint(line string) string {
 	if line == "" {
 		return "(empty)"
 	}
+	if fingerprint, err := keyparser.Fingerprint(line); err == nil {
+		return fingerprint
+	}
 	hash := sha256.Sum256([]byte(line))
-	return fmt.Sprintf("SHA256:%x", hash[:8])
+	return fmt.Sprintf("line-sha256:%x", hash[:8])
+}
+
+// keyFingerprintMD5 returns the legacy MD5 fingerprint of an SSH key line as
+// shown by "ssh-keygen -l -E md5", or "" if its blob cannot be decoded
+func keyFingerprintMD5(line string) string {
+	fingerprint, _ := keyparser.FingerprintMD5(line)
+	return fingerprint
 }
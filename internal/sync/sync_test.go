@@ -1,7 +1,11 @@
 package sync
 
 import (
+	"bytes"
 	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -9,9 +13,15 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/eduardolat/authkeysync/internal/backup"
 	"github.com/eduardolat/authkeysync/internal/config"
+	"github.com/eduardolat/authkeysync/internal/keyfetcher"
+	"github.com/eduardolat/authkeysync/internal/keyparser"
+	"github.com/eduardolat/authkeysync/internal/sshfile"
 	"github.com/eduardolat/authkeysync/internal/userinfo"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -33,6 +43,112 @@ func (m *mockUserLookup) Lookup(username string) (*userinfo.UserInfo, error) {
 	return nil, userinfo.ErrUserNotFound
 }
 
+// mockUserLister is a mock implementation of userinfo.ListProvider
+type mockUserLister struct {
+	users []userinfo.SystemUser
+	err   error
+}
+
+func (m *mockUserLister) ListUsers() ([]userinfo.SystemUser, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.users, nil
+}
+
+// mockGroupLister is a mock implementation of userinfo.GroupListProvider
+type mockGroupLister struct {
+	groups []userinfo.SystemGroup
+	err    error
+}
+
+func (m *mockGroupLister) ListGroups() ([]userinfo.SystemGroup, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.groups, nil
+}
+
+// mockFetcher is a mock implementation of keyfetcher.FetcherProvider
+type mockFetcher struct {
+	keys map[string]string
+	err  error
+}
+
+func (m *mockFetcher) Fetch(ctx context.Context, source config.Source) *keyfetcher.FetchResult {
+	parseResult, err := keyparser.ParseString(m.keys[source.URL])
+	if err != nil {
+		return &keyfetcher.FetchResult{Source: source, Error: err}
+	}
+	return &keyfetcher.FetchResult{Source: source, Keys: parseResult.Keys, DiscardedLines: parseResult.DiscardedLines, StatusCode: http.StatusOK}
+}
+
+func (m *mockFetcher) FetchAll(ctx context.Context, sources []config.Source) ([]*keyfetcher.FetchResult, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	results := make([]*keyfetcher.FetchResult, 0, len(sources))
+	for _, source := range sources {
+		results = append(results, m.Fetch(ctx, source))
+	}
+	return results, nil
+}
+
+// mockBackupManager is a mock implementation of backup.ManagerProvider
+type mockBackupManager struct {
+	backups []string
+}
+
+func (m *mockBackupManager) CreateBackup(sshDir string, uid, gid int) (string, error) {
+	return m.CreateBackupIn(filepath.Join(sshDir, "authorized_keys"), filepath.Join(sshDir, "authorized_keys_backups"), uid, gid)
+}
+
+func (m *mockBackupManager) RotateBackups(sshDir string, retentionCount int) ([]string, error) {
+	return nil, nil
+}
+
+func (m *mockBackupManager) CreateBackupIn(authKeysPath, backupDir string, uid, gid int) (string, error) {
+	m.backups = append(m.backups, authKeysPath)
+	return filepath.Join(backupDir, "backup"), nil
+}
+
+func (m *mockBackupManager) RotateBackupsIn(backupDir string, retentionCount int) ([]string, error) {
+	return nil, nil
+}
+
+func (m *mockBackupManager) ListBackups(backupDir string) ([]backup.Backup, error) {
+	return nil, nil
+}
+
+func (m *mockBackupManager) ReadBackup(backupDir, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(backupDir, name))
+}
+
+// mockWriter is a mock implementation of sshfile.WriterProvider
+type mockWriter struct {
+	files map[string][]byte
+}
+
+func (m *mockWriter) WriteAtomic(path string, content []byte, uid, gid int) (*sshfile.WriteResult, error) {
+	changed := !bytes.Equal(m.files[path], content)
+	m.files[path] = content
+	return &sshfile.WriteResult{Changed: changed, Path: path}, nil
+}
+
+func (m *mockWriter) AppendChangelog(authKeysPath string, entry []byte, maxBytes, uid, gid int) error {
+	path := sshfile.ChangelogPath(authKeysPath)
+	m.files[path] = append(m.files[path], entry...)
+	return nil
+}
+
+func (m *mockWriter) CleanupStaleTempFiles(dir string, olderThan time.Duration) ([]string, error) {
+	return nil, nil
+}
+
+func (m *mockWriter) Lock(authKeysPath string, uid, gid int, timeout time.Duration) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
 func TestSyncUser_Success(t *testing.T) {
 	// Create temp SSH directory
 	tempDir := t.TempDir()
@@ -84,6 +200,7 @@ func TestSyncUser_Success(t *testing.T) {
 	assert.False(t, result.Users[0].Skipped)
 	assert.Equal(t, 2, result.Users[0].KeysWritten)
 	assert.True(t, result.Users[0].Changed)
+	assert.True(t, result.Users[0].FirstRun)
 
 	// Verify file was written
 	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
@@ -91,6 +208,185 @@ func TestSyncUser_Success(t *testing.T) {
 	assert.Contains(t, string(content), "ssh-ed25519 AAAA key1@host")
 	assert.Contains(t, string(content), "ssh-rsa BBBB key2@host")
 	assert.Contains(t, string(content), "Generated by AuthKeySync")
+
+	// The file now exists, so the next run is not a first run
+	result = syncer.Run(context.Background())
+	require.False(t, result.HasErrors)
+	assert.False(t, result.Users[0].FirstRun)
+}
+
+func TestSyncUser_Changelog(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	enabled, preserveLocal := true, false
+	cfg := &config.Config{
+		Policy: config.Policy{Changelog: &enabled, PreserveLocalKeys: &preserveLocal},
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fetcher := &mockFetcher{keys: map[string]string{"https://example.com/alice": "ssh-ed25519 AAAA one@host"}}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	syncer := NewWithOptions(cfg, logger, Options{
+		Fetcher: fetcher,
+		UserLookup: &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"alice": {
+					Username:     "alice",
+					UID:          os.Getuid(),
+					GID:          os.Getgid(),
+					HomeDir:      tempDir,
+					SSHDir:       sshDir,
+					AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+					BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+				},
+			},
+		},
+		Now: func() time.Time { return now },
+	})
+
+	require.False(t, syncer.Run(context.Background()).HasErrors)
+
+	// Only the header changes, nothing is logged
+	now = now.Add(time.Hour)
+	require.False(t, syncer.Run(context.Background()).HasErrors)
+
+	now = now.Add(time.Hour)
+	fetcher.keys["https://example.com/alice"] = "ssh-ed25519 BBBB two@host"
+	require.False(t, syncer.Run(context.Background()).HasErrors)
+
+	content, err := os.ReadFile(filepath.Join(sshDir, sshfile.ChangelogFileName))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(
+		"2024-06-01T12:00:00Z added %s source=https://example.com/alice\n"+
+			"2024-06-01T14:00:00Z added %s source=https://example.com/alice\n"+
+			"2024-06-01T14:00:00Z removed %s\n",
+		keyFingerprint("ssh-ed25519 AAAA one@host"),
+		keyFingerprint("ssh-ed25519 BBBB two@host"),
+		keyFingerprint("ssh-ed25519 AAAA one@host"),
+	), string(content))
+}
+
+func TestSyncUser_IncludeFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	includePath := filepath.Join(tempDir, "baseline_keys")
+	require.NoError(t, os.WriteFile(includePath, []byte("ssh-ed25519 AAAA key1@host\nssh-ed25519 CCCC baseline@host\n"), 0600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key1@host"))
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		Policy: config.Policy{IncludeFiles: []string{includePath}},
+		Users: []config.User{
+			{Username: "testuser", Sources: []config.Source{{URL: server.URL}}},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+	require.False(t, result.HasErrors)
+	assert.Equal(t, 2, result.Users[0].KeysWritten)
+
+	// The key also served remotely is only written once, in its source
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "# Source: "+server.URL+"\nssh-ed25519 AAAA key1@host\n")
+	assert.Contains(t, string(content), "# Included: "+includePath+"\nssh-ed25519 CCCC baseline@host\n")
+	assert.Equal(t, 1, strings.Count(string(content), "key1@host"))
+
+	// A missing include file fails the user instead of dropping its keys
+	require.NoError(t, os.Remove(includePath))
+	result = syncer.Run(context.Background())
+	require.True(t, result.HasErrors)
+	assert.ErrorContains(t, result.Users[0].Error, "failed to read include file")
+	content, err = os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "baseline@host")
+}
+
+func TestSyncUser_AlwaysKeys(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	authKeysPath := filepath.Join(sshDir, "authorized_keys")
+	require.NoError(t, os.WriteFile(authKeysPath, []byte("ssh-ed25519 LLLL local@host\n"), 0600))
+
+	preserveLocalKeys := false
+	cfg := &config.Config{
+		Policy: config.Policy{
+			PreserveLocalKeys: &preserveLocalKeys,
+			AlwaysKeys:        []string{"ssh-ed25519 ZZZZ breakglass@host", "ssh-ed25519 AAAA key1@host"},
+		},
+		Users: []config.User{
+			{Username: "testuser", Sources: []config.Source{{URL: "https://example.com/keys"}}},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	fetcher := &mockFetcher{keys: map[string]string{"https://example.com/keys": "ssh-ed25519 AAAA key1@host"}}
+	syncer.fetcher = fetcher
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: authKeysPath,
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	// Always keys come last, and a key also served remotely stays in its source
+	for range 2 {
+		result := syncer.Run(context.Background())
+		require.False(t, result.HasErrors)
+		assert.Equal(t, 2, result.Users[0].KeysWritten)
+
+		content, err := os.ReadFile(authKeysPath)
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(string(content), "\n# Source: https://example.com/keys\nssh-ed25519 AAAA key1@host\n\n# Always (policy)\nssh-ed25519 ZZZZ breakglass@host\n"), string(content))
+		assert.NotContains(t, string(content), "local@host")
+	}
+
+	// When the sources fail, the always keys are still written next to the
+	// existing keys, and the user fails
+	require.NoError(t, os.WriteFile(authKeysPath, []byte("ssh-ed25519 OOOO old@host\n"), 0600))
+	fetcher.err = errors.New("connection refused")
+	result := syncer.Run(context.Background())
+	require.True(t, result.HasErrors)
+	assert.ErrorContains(t, result.Users[0].Error, "failed to fetch keys: connection refused")
+	assert.True(t, result.Users[0].Changed)
+
+	content, err := os.ReadFile(authKeysPath)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(content), "\n# Local (preserved)\nssh-ed25519 OOOO old@host\n\n# Always (policy)\nssh-ed25519 ZZZZ breakglass@host\nssh-ed25519 AAAA key1@host\n"), string(content))
 }
 
 func TestSyncUser_UserNotFound(t *testing.T) {
@@ -118,59 +414,182 @@ func TestSyncUser_UserNotFound(t *testing.T) {
 	assert.Equal(t, "user not found in system", result.Users[0].SkipReason)
 }
 
-func TestSyncUser_SourceFetchFails(t *testing.T) {
-	tempDir := t.TempDir()
-	sshDir := filepath.Join(tempDir, ".ssh")
-	require.NoError(t, os.Mkdir(sshDir, 0700))
-
-	// Create test server that returns 500
+func TestSyncUser_CreateSSHDir(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host"))
 	}))
 	defer server.Close()
 
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	oneHour := 3600
+	tests := []struct {
+		name        string
+		create      bool
+		maxAge      *int
+		homeAge     time.Duration
+		missingHome bool
+		wantCreated bool
+		wantSkip    string
+	}{
+		{name: "disabled", wantSkip: ".ssh directory not found"},
+		{name: "enabled", create: true, wantCreated: true},
+		{name: "recent home", create: true, maxAge: &oneHour, homeAge: time.Minute, wantCreated: true},
+		{name: "old home", create: true, maxAge: &oneHour, homeAge: 48 * time.Hour, wantSkip: ".ssh directory not found"},
+		{name: "missing home", create: true, missingHome: true, wantSkip: "home directory not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			homeDir := filepath.Join(t.TempDir(), "home")
+			if !tt.missingHome {
+				require.NoError(t, os.Mkdir(homeDir, 0755))
+				modTime := now.Add(-tt.homeAge)
+				require.NoError(t, os.Chtimes(homeDir, modTime, modTime))
+			}
+
+			uid, gid := os.Getuid(), os.Getgid()
+			cfg := &config.Config{
+				Policy: config.Policy{
+					CreateSSHDir:                  &tt.create,
+					CreateSSHDirMaxHomeAgeSeconds: tt.maxAge,
+				},
+				Users: []config.User{
+					{Username: "newuser", UID: &uid, GID: &gid, HomeDir: homeDir, Sources: []config.Source{{URL: server.URL}}},
+				},
+			}
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			syncer := New(cfg, logger, false)
+			syncer.timeNow = func() time.Time { return now }
+
+			result := syncer.Run(context.Background())
+			require.False(t, result.HasErrors)
+			assert.Equal(t, tt.wantSkip, result.Users[0].SkipReason)
+
+			if !tt.wantCreated {
+				assert.NoDirExists(t, filepath.Join(homeDir, ".ssh"))
+				return
+			}
+			stat, err := os.Stat(filepath.Join(homeDir, ".ssh"))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+			assert.FileExists(t, filepath.Join(homeDir, ".ssh", "authorized_keys"))
+		})
+	}
+}
+
+func TestSyncUser_CreateSSHDirUnknownUser(t *testing.T) {
+	enabled := true
 	cfg := &config.Config{
-		Policy: config.Policy{},
+		Policy: config.Policy{CreateSSHDir: &enabled},
 		Users: []config.User{
-			{
-				Username: "testuser",
-				Sources: []config.Source{
-					{URL: server.URL},
-				},
-			},
+			{Username: "ghost", Sources: []config.Source{{URL: "https://example.com/ghost"}}},
 		},
 	}
 
 	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
 	syncer := New(cfg, logger, false)
-	syncer.userLookup = &mockUserLookup{
-		users: map[string]*userinfo.UserInfo{
-			"testuser": {
-				Username: "testuser",
-				UID:      os.Getuid(),
-				GID:      os.Getgid(),
-				HomeDir:  tempDir,
-				SSHDir:   sshDir,
-			},
-		},
-	}
+	syncer.userLookup = &mockUserLookup{users: map[string]*userinfo.UserInfo{}}
 
 	result := syncer.Run(context.Background())
 
+	// A user missing from the system is skipped, nothing is created for it
 	require.Len(t, result.Users, 1)
-	assert.True(t, result.HasErrors)
-	assert.Error(t, result.Users[0].Error)
-	assert.Contains(t, result.Users[0].Error.Error(), "failed to fetch keys")
+	assert.False(t, result.HasErrors)
+	assert.Equal(t, "user not found in system", result.Users[0].SkipReason)
 }
 
-func TestSyncUser_DryRun(t *testing.T) {
+func TestSyncUser_RequireSSHDirOwner(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		wantSkip string
+	}{
+		{name: "user", mode: config.SSHDirOwnerUser, wantSkip: ".ssh directory is not owned by the user"},
+		{name: "any", mode: config.SSHDirOwnerAny},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			homeDir := t.TempDir()
+			require.NoError(t, os.Mkdir(filepath.Join(homeDir, ".ssh"), 0700))
+
+			// .ssh belongs to the user running the test, not to this user
+			uid, gid := os.Getuid()+1, os.Getgid()
+			cfg := &config.Config{
+				Policy: config.Policy{RequireSSHDirOwner: tt.mode},
+				Users: []config.User{
+					{Username: "alice", UID: &uid, GID: &gid, HomeDir: homeDir, Sources: []config.Source{{URL: "https://example.com/alice"}}},
+				},
+			}
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			syncer := NewWithOptions(cfg, logger, Options{
+				DryRun: true,
+				Fetcher: &mockFetcher{keys: map[string]string{
+					"https://example.com/alice": "ssh-ed25519 AAAA alice@host",
+				}},
+			})
+
+			result := syncer.Run(context.Background())
+			require.Len(t, result.Users, 1)
+			assert.NoError(t, result.Users[0].Error)
+			assert.Equal(t, tt.wantSkip, result.Users[0].SkipReason)
+		})
+	}
+}
+
+func TestSyncUser_HomeDirNotFound(t *testing.T) {
+	skipMissingHome := false
+	tests := []struct {
+		name            string
+		skipMissingHome *bool
+		wantSkipped     bool
+	}{
+		{name: "skipped by default", skipMissingHome: nil, wantSkipped: true},
+		{name: "failed when not skipped", skipMissingHome: &skipMissingHome, wantSkipped: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Policy: config.Policy{SkipMissingHome: tt.skipMissingHome},
+				Users: []config.User{
+					{
+						Username: "nfsuser",
+						Sources: []config.Source{
+							{URL: "http://example.com/keys"},
+						},
+					},
+				},
+			}
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			syncer := New(cfg, logger, false)
+			syncer.userLookup = &mockUserLookup{err: fmt.Errorf("%w: /home/nfsuser", userinfo.ErrHomeDirNotFound)}
+
+			result := syncer.Run(context.Background())
+
+			require.Len(t, result.Users, 1)
+			assert.Equal(t, tt.wantSkipped, result.Users[0].Skipped)
+			assert.Equal(t, !tt.wantSkipped, result.HasErrors)
+			if tt.wantSkipped {
+				assert.Equal(t, "home directory not found", result.Users[0].SkipReason)
+			} else {
+				require.ErrorIs(t, result.Users[0].Error, userinfo.ErrHomeDirNotFound)
+			}
+		})
+	}
+}
+
+func TestSyncUser_SourceFetchFails(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
 	require.NoError(t, os.Mkdir(sshDir, 0700))
 
+	// Create test server that returns 500
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host"))
+		w.WriteHeader(http.StatusInternalServerError)
 	}))
 	defer server.Close()
 
@@ -187,7 +606,7 @@ func TestSyncUser_DryRun(t *testing.T) {
 	}
 
 	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-	syncer := New(cfg, logger, true) // dry-run = true
+	syncer := New(cfg, logger, false)
 	syncer.userLookup = &mockUserLookup{
 		users: map[string]*userinfo.UserInfo{
 			"testuser": {
@@ -203,37 +622,32 @@ func TestSyncUser_DryRun(t *testing.T) {
 	result := syncer.Run(context.Background())
 
 	require.Len(t, result.Users, 1)
-	assert.False(t, result.HasErrors)
-	assert.NoError(t, result.Users[0].Error)
-
-	// Verify no file was written
-	_, err := os.Stat(filepath.Join(sshDir, "authorized_keys"))
-	assert.True(t, os.IsNotExist(err))
+	assert.True(t, result.HasErrors)
+	assert.Error(t, result.Users[0].Error)
+	assert.Contains(t, result.Users[0].Error.Error(), "failed to fetch keys")
 }
 
-func TestSyncUser_PreserveLocalKeys(t *testing.T) {
+func TestSyncUser_MinKeys(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
 	require.NoError(t, os.Mkdir(sshDir, 0700))
 
-	// Create existing authorized_keys with local keys
-	existingContent := `ssh-ed25519 AAAA local@host
-ssh-rsa BBBB local2@host`
+	existingContent := "ssh-ed25519 AAAA local@host\n"
 	require.NoError(t, os.WriteFile(
 		filepath.Join(sshDir, "authorized_keys"),
 		[]byte(existingContent),
 		0600))
 
+	// A proxy answering 200 with an empty body
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ssh-ed25519 CCCC remote@host"))
 	}))
 	defer server.Close()
 
-	preserveLocalKeys := true
+	minKeys := 1
 	cfg := &config.Config{
 		Policy: config.Policy{
-			PreserveLocalKeys: &preserveLocalKeys,
+			MinKeys: &minKeys,
 		},
 		Users: []config.User{
 			{
@@ -261,45 +675,179 @@ ssh-rsa BBBB local2@host`
 		},
 	}
 
+	// The preserved local key does not count by default
 	result := syncer.Run(context.Background())
-
 	require.Len(t, result.Users, 1)
-	assert.False(t, result.HasErrors)
-	assert.Equal(t, 3, result.Users[0].KeysWritten)
-	assert.Equal(t, 2, result.Users[0].LocalKeys)
+	assert.True(t, result.HasErrors)
+	assert.True(t, result.Users[0].TooFewKeys)
+	require.ErrorIs(t, result.Users[0].Error, ErrTooFewKeys)
+	assert.Contains(t, result.Users[0].Error.Error(), "has 0 keys, min_keys is 1")
+
+	// The preserved key shows up as withheld in the decisions
+	require.Len(t, result.Users[0].Decisions, 1)
+	assert.Equal(t, VerdictWithheld, result.Users[0].Decisions[0].Verdict)
+	assert.Equal(t, "0 keys, min_keys is 1", result.Users[0].Decisions[0].Detail)
 
-	// Verify all keys are present
 	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
 	require.NoError(t, err)
-	assert.Contains(t, string(content), "ssh-ed25519 CCCC remote@host")
-	assert.Contains(t, string(content), "ssh-ed25519 AAAA local@host")
-	assert.Contains(t, string(content), "ssh-rsa BBBB local2@host")
-	assert.Contains(t, string(content), "# Local (preserved)")
+	assert.Equal(t, existingContent, string(content))
+
+	// With min_keys_include_local it does
+	includeLocal := true
+	cfg.Policy.MinKeysIncludeLocal = &includeLocal
+	result = syncer.Run(context.Background())
+	require.Len(t, result.Users, 1)
+	require.NoError(t, result.Users[0].Error)
+	assert.False(t, result.Users[0].TooFewKeys)
+	assert.Equal(t, 1, result.Users[0].LocalKeys)
 }
 
-func TestSyncUser_DoNotPreserveLocalKeys(t *testing.T) {
+func TestSyncUser_FirstRunPolicy(t *testing.T) {
+	// A proxy answering 200 with an empty body
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	run := func(t *testing.T, policy, existing string) UserResult {
+		tempDir := t.TempDir()
+		sshDir := filepath.Join(tempDir, ".ssh")
+		require.NoError(t, os.Mkdir(sshDir, 0700))
+		if existing != "" {
+			require.NoError(t, os.WriteFile(filepath.Join(sshDir, "authorized_keys"), []byte(existing), 0600))
+		}
+
+		minKeys := 1
+		includeLocal := true
+		cfg := &config.Config{
+			Policy: config.Policy{
+				MinKeys:             &minKeys,
+				MinKeysIncludeLocal: &includeLocal,
+				FirstRunPolicy:      policy,
+			},
+			Users: []config.User{
+				{Username: "testuser", Sources: []config.Source{{URL: server.URL}}},
+			},
+		}
+
+		syncer := New(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), false)
+		syncer.userLookup = &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"testuser": {
+					Username:     "testuser",
+					UID:          os.Getuid(),
+					GID:          os.Getgid(),
+					HomeDir:      tempDir,
+					SSHDir:       sshDir,
+					AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+					BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+				},
+			},
+		}
+
+		result := syncer.Run(context.Background())
+		require.Len(t, result.Users, 1)
+		return result.Users[0]
+	}
+
+	tests := []struct {
+		name       string
+		policy     string
+		existing   string
+		tooFewKeys bool
+	}{
+		{name: "keep on first run", policy: "", tooFewKeys: true},
+		{name: "relax on first run", policy: config.FirstRunRelax, tooFewKeys: false},
+		{name: "distrust on first run", policy: config.FirstRunDistrust, tooFewKeys: true},
+		{name: "relax with an existing file", policy: config.FirstRunRelax, existing: "ssh-ed25519 AAAA local@host\n", tooFewKeys: false},
+		{name: "distrust without state", policy: config.FirstRunDistrust, existing: "ssh-ed25519 AAAA local@host\n", tooFewKeys: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := run(t, tt.policy, tt.existing)
+			assert.Equal(t, tt.existing == "", result.FirstRun)
+			assert.Equal(t, tt.tooFewKeys, result.TooFewKeys)
+			if tt.tooFewKeys {
+				assert.ErrorIs(t, result.Error, ErrTooFewKeys)
+			} else {
+				assert.NoError(t, result.Error)
+			}
+		})
+	}
+
+	// Local keys of a file written by a previous sync still count
+	t.Run("distrust with state", func(t *testing.T) {
+		body := "ssh-ed25519 AAAA key1@host\n"
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, body)
+		}))
+		defer server.Close()
+
+		tempDir := t.TempDir()
+		sshDir := filepath.Join(tempDir, ".ssh")
+		require.NoError(t, os.Mkdir(sshDir, 0700))
+		authKeysPath := filepath.Join(sshDir, "authorized_keys")
+
+		minKeys := 1
+		includeLocal := true
+		cfg := &config.Config{
+			Policy: config.Policy{
+				MinKeys:             &minKeys,
+				MinKeysIncludeLocal: &includeLocal,
+				FirstRunPolicy:      config.FirstRunDistrust,
+			},
+			Users: []config.User{
+				{Username: "testuser", Sources: []config.Source{{URL: server.URL}}},
+			},
+		}
+		statePath := filepath.Join(tempDir, "state.json")
+		syncer := NewWithOptions(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), Options{ChangedOnly: true, StateFile: statePath})
+		syncer.userLookup = &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"testuser": {
+					Username:     "testuser",
+					UID:          os.Getuid(),
+					GID:          os.Getgid(),
+					HomeDir:      tempDir,
+					SSHDir:       sshDir,
+					AuthKeysPath: authKeysPath,
+					BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+				},
+			},
+		}
+
+		result := syncer.Run(context.Background())
+		require.NoError(t, result.Users[0].Error)
+
+		// Add a local key, then have the source answer empty
+		f, err := os.OpenFile(authKeysPath, os.O_APPEND|os.O_WRONLY, 0600)
+		require.NoError(t, err)
+		_, err = io.WriteString(f, "ssh-ed25519 CCCC local@host\n")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		body = ""
+
+		result = syncer.Run(context.Background())
+		require.NoError(t, result.Users[0].Error)
+		assert.False(t, result.Users[0].TooFewKeys)
+		// The key removed from the source is preserved as local too
+		assert.Equal(t, 2, result.Users[0].LocalKeys)
+	})
+}
+
+func TestSyncUser_Check(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
 	require.NoError(t, os.Mkdir(sshDir, 0700))
+	authKeysPath := filepath.Join(sshDir, "authorized_keys")
 
-	// Create existing authorized_keys with local keys
-	existingContent := `ssh-ed25519 AAAA local@host`
-	require.NoError(t, os.WriteFile(
-		filepath.Join(sshDir, "authorized_keys"),
-		[]byte(existingContent),
-		0600))
-
+	keys := "ssh-ed25519 AAAA key1@host\n"
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ssh-ed25519 CCCC remote@host"))
+		_, _ = io.WriteString(w, keys)
 	}))
 	defer server.Close()
 
-	preserveLocalKeys := false
 	cfg := &config.Config{
-		Policy: config.Policy{
-			PreserveLocalKeys: &preserveLocalKeys,
-		},
 		Users: []config.User{
 			{
 				Username: "testuser",
@@ -309,10 +857,7 @@ func TestSyncUser_DoNotPreserveLocalKeys(t *testing.T) {
 			},
 		},
 	}
-
-	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-	syncer := New(cfg, logger, false)
-	syncer.userLookup = &mockUserLookup{
+	lookup := &mockUserLookup{
 		users: map[string]*userinfo.UserInfo{
 			"testuser": {
 				Username:     "testuser",
@@ -320,51 +865,362 @@ func TestSyncUser_DoNotPreserveLocalKeys(t *testing.T) {
 				GID:          os.Getgid(),
 				HomeDir:      tempDir,
 				SSHDir:       sshDir,
-				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				AuthKeysPath: authKeysPath,
 				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
 			},
 		},
 	}
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	checker := NewWithOptions(cfg, logger, Options{Check: true, UserLookup: lookup})
 
-	result := syncer.Run(context.Background())
-
+	// A missing file would change
+	result := checker.Run(context.Background())
 	require.Len(t, result.Users, 1)
+	require.NoError(t, result.Users[0].Error)
+	assert.True(t, result.Users[0].WouldChange)
+	assert.NoFileExists(t, authKeysPath)
+
+	// A synced file only differs by its timestamp
+	syncer := NewWithOptions(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), Options{UserLookup: lookup})
+	require.False(t, syncer.Run(context.Background()).HasErrors)
+	written, err := os.ReadFile(authKeysPath)
+	require.NoError(t, err)
+
+	logs.Reset()
+	result = checker.Run(context.Background())
+	require.NoError(t, result.Users[0].Error)
+	assert.False(t, result.Users[0].WouldChange)
+	assert.Contains(t, logs.String(), "authorized_keys in sync")
+
+	// A new key is reported with a diff and nothing is written
+	keys = "ssh-ed25519 AAAA key1@host\nssh-ed25519 BBBB key2@host\n"
+	logs.Reset()
+	result = checker.Run(context.Background())
+	require.NoError(t, result.Users[0].Error)
+	assert.True(t, result.Users[0].WouldChange)
+	assert.False(t, result.Users[0].Changed)
+	assert.Contains(t, logs.String(), `+ssh-ed25519 BBBB key2@host`)
+
+	content, err := os.ReadFile(authKeysPath)
+	require.NoError(t, err)
+	assert.Equal(t, string(written), string(content))
+}
+
+func TestRestore(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	backupDir := filepath.Join(sshDir, "authorized_keys_backups")
+	require.NoError(t, os.MkdirAll(backupDir, 0700))
+	authKeysPath := filepath.Join(sshDir, "authorized_keys")
+
+	require.NoError(t, os.WriteFile(authKeysPath, []byte("ssh-ed25519 AAAA bad@push\n"), 0600))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(backupDir, "authorized_keys_20240101_100000_aaaaaa"),
+		[]byte("ssh-ed25519 AAAA oldest@host\n"), 0600))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(backupDir, "authorized_keys_20240102_100000_bbbbbb"),
+		[]byte("ssh-ed25519 AAAA newest@host\n"), 0600))
+	// A symlink planted by the user is never listed or restored
+	secret := filepath.Join(tempDir, "shadow")
+	require.NoError(t, os.WriteFile(secret, []byte("root:secret\n"), 0600))
+	require.NoError(t, os.Symlink(secret, filepath.Join(backupDir, "authorized_keys_99999999_999999_xxxxxx")))
+	require.NoError(t, os.Symlink(secret, filepath.Join(backupDir, "authorized_keys_20991231_235959_xxxxxx")))
+
+	cfg := &config.Config{
+		Users: []config.User{
+			{Username: "testuser", Sources: []config.Source{{URL: "https://example.com/keys"}}},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newSyncer := func(opts Options) *Syncer {
+		opts.UserLookup = &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"testuser": {
+					Username:     "testuser",
+					UID:          os.Getuid(),
+					GID:          os.Getgid(),
+					HomeDir:      tempDir,
+					SSHDir:       sshDir,
+					AuthKeysPath: authKeysPath,
+					BackupDir:    backupDir,
+				},
+			},
+		}
+		return NewWithOptions(cfg, logger, opts)
+	}
+	readKeys := func() string {
+		content, err := os.ReadFile(authKeysPath)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	dir, backups, err := newSyncer(Options{}).ListBackups("testuser")
+	require.NoError(t, err)
+	assert.Equal(t, backupDir, dir)
+	require.Len(t, backups, 2)
+
+	// A dry run writes nothing
+	result, err := newSyncer(Options{DryRun: true}).Restore("testuser", "")
+	require.NoError(t, err)
+	assert.Equal(t, "authorized_keys_20240102_100000_bbbbbb", result.Restored.Name)
+	assert.Equal(t, "ssh-ed25519 AAAA bad@push\n", readKeys())
+
+	// The newest backup is restored by default, after backing up the file
+	result, err = newSyncer(Options{}).Restore("testuser", "")
+	require.NoError(t, err)
+	assert.True(t, result.Changed)
+	assert.Equal(t, "ssh-ed25519 AAAA newest@host\n", readKeys())
+	require.NotEmpty(t, result.BackupPath)
+	replaced, err := os.ReadFile(result.BackupPath)
+	require.NoError(t, err)
+	assert.Equal(t, "ssh-ed25519 AAAA bad@push\n", string(replaced))
+
+	// A named backup
+	result, err = newSyncer(Options{NoBackup: true}).Restore("testuser", "authorized_keys_20240101_100000_aaaaaa")
+	require.NoError(t, err)
+	assert.Empty(t, result.BackupPath)
+	assert.Equal(t, "ssh-ed25519 AAAA oldest@host\n", readKeys())
+
+	// Names outside the backup directory never match
+	_, err = newSyncer(Options{}).Restore("testuser", "../authorized_keys")
+	require.ErrorIs(t, err, ErrNoBackup)
+	_, err = newSyncer(Options{}).Restore("testuser", "authorized_keys_20991231_235959_xxxxxx")
+	require.ErrorIs(t, err, ErrNoBackup)
+	assert.NotContains(t, readKeys(), "secret")
+
+	_, err = newSyncer(Options{}).Restore("unknown", "")
+	require.ErrorIs(t, err, ErrUserNotConfigured)
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	t.Run("equal", func(t *testing.T) {
+		assert.Empty(t, unifiedDiff("a", "b", []string{"x", "y"}, []string{"x", "y"}))
+		assert.Empty(t, unifiedDiff("a", "b", nil, nil))
+	})
+
+	t.Run("added to empty", func(t *testing.T) {
+		diff := unifiedDiff("a", "b", nil, []string{"x", "y"})
+		assert.Equal(t, "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n", diff)
+	})
+
+	t.Run("change with context", func(t *testing.T) {
+		old := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"}
+		updated := []string{"1", "2", "3", "4", "five", "6", "7", "8", "9"}
+		diff := unifiedDiff("a", "b", old, updated)
+		assert.Equal(t, "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n", diff)
+	})
+
+	t.Run("distant changes get separate hunks", func(t *testing.T) {
+		old := []string{"a", "1", "2", "3", "4", "5", "6", "7", "8", "z"}
+		updated := []string{"1", "2", "3", "4", "5", "6", "7", "8"}
+		diff := unifiedDiff("a", "b", old, updated)
+		assert.Equal(t, "--- a\n+++ b\n@@ -1,4 +1,3 @@\n-a\n 1\n 2\n 3\n@@ -7,4 +6,3 @@\n 6\n 7\n 8\n-z\n", diff)
+	})
+}
+
+func TestSyncUser_ManagedBlock(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	authKeysPath := filepath.Join(sshDir, "authorized_keys")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ssh-ed25519 AAAA remote@host\n")
+	}))
+	defer server.Close()
+
+	managedBlock := true
+	preserveLocalKeys := false
+	cfg := &config.Config{
+		Policy: config.Policy{
+			ManagedBlock:      &managedBlock,
+			PreserveLocalKeys: &preserveLocalKeys,
+		},
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: server.URL},
+				},
+			},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := NewWithOptions(cfg, logger, Options{
+		NoBackup: true,
+		UserLookup: &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"testuser": {
+					Username:     "testuser",
+					UID:          os.Getuid(),
+					GID:          os.Getgid(),
+					HomeDir:      tempDir,
+					SSHDir:       sshDir,
+					AuthKeysPath: authKeysPath,
+					BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+				},
+			},
+		},
+	})
+	readKeys := func() string {
+		content, err := os.ReadFile(authKeysPath)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	// Without markers, a block is appended after the user's own keys
+	own := "# my laptop\nssh-ed25519 BBBB own@laptop\n"
+	require.NoError(t, os.WriteFile(authKeysPath, []byte(own), 0600))
+	result := syncer.Run(context.Background())
+	require.NoError(t, result.Users[0].Error)
 	assert.Equal(t, 1, result.Users[0].KeysWritten)
-	assert.Equal(t, 0, result.Users[0].LocalKeys)
+	content := readKeys()
+	assert.True(t, strings.HasPrefix(content, own+sshfile.ManagedBlockBegin+"\n"))
+	assert.True(t, strings.HasSuffix(content, "ssh-ed25519 AAAA remote@host\n"+sshfile.ManagedBlockEnd+"\n"))
+
+	// Keys added inside the block are replaced, lines around it are kept
+	drifted := strings.Replace(content, sshfile.ManagedBlockEnd, "ssh-ed25519 CCCC drift@host\n"+sshfile.ManagedBlockEnd, 1)
+	drifted += "ssh-ed25519 DDDD after@host\n"
+	require.NoError(t, os.WriteFile(authKeysPath, []byte(drifted), 0600))
+	result = syncer.Run(context.Background())
+	require.NoError(t, result.Users[0].Error)
+	content = readKeys()
+	assert.NotContains(t, content, "drift@host")
+	assert.True(t, strings.HasPrefix(content, own))
+	assert.True(t, strings.HasSuffix(content, sshfile.ManagedBlockEnd+"\nssh-ed25519 DDDD after@host\n"))
+
+	// Two blocks fail the user and keep the file
+	broken := content + sshfile.ManagedBlockBegin + "\n" + sshfile.ManagedBlockEnd + "\n"
+	require.NoError(t, os.WriteFile(authKeysPath, []byte(broken), 0600))
+	result = syncer.Run(context.Background())
+	require.ErrorIs(t, result.Users[0].Error, sshfile.ErrInvalidManagedBlock)
+	assert.Equal(t, broken, readKeys())
+}
 
-	// Verify only remote key is present
-	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+func TestSyncUser_ManagedBlockChangelogAndBackup(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	authKeysPath := filepath.Join(sshDir, "authorized_keys")
+
+	enabled, preserveLocal := true, false
+	cfg := &config.Config{
+		Policy: config.Policy{
+			ManagedBlock:      &enabled,
+			Changelog:         &enabled,
+			BackupEnabled:     &enabled,
+			PreserveLocalKeys: &preserveLocal,
+		},
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	backups := &mockBackupManager{}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	syncer := NewWithOptions(cfg, logger, Options{
+		Fetcher:       &mockFetcher{keys: map[string]string{"https://example.com/alice": "ssh-ed25519 AAAA one@host"}},
+		BackupManager: backups,
+		UserLookup: &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"alice": {
+					Username:     "alice",
+					UID:          os.Getuid(),
+					GID:          os.Getgid(),
+					HomeDir:      tempDir,
+					SSHDir:       sshDir,
+					AuthKeysPath: authKeysPath,
+					BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+				},
+			},
+		},
+		Now: func() time.Time { return now },
+	})
+
+	// Keys outside the block are not logged as removed
+	require.NoError(t, os.WriteFile(authKeysPath, []byte("ssh-ed25519 BBBB own@laptop\n"), 0600))
+	require.False(t, syncer.Run(context.Background()).HasErrors)
+	content, err := os.ReadFile(filepath.Join(sshDir, sshfile.ChangelogFileName))
 	require.NoError(t, err)
-	assert.Contains(t, string(content), "ssh-ed25519 CCCC remote@host")
-	assert.NotContains(t, string(content), "local@host")
+	assert.Equal(t, fmt.Sprintf("2024-06-01T12:00:00Z added %s source=https://example.com/alice\n",
+		keyFingerprint("ssh-ed25519 AAAA one@host")), string(content))
+
+	// An unchanged block is not backed up, even with keys around it
+	backups.backups = nil
+	require.False(t, syncer.Run(context.Background()).HasErrors)
+	assert.Empty(t, backups.backups)
 }
 
-func TestSyncUser_Deduplication(t *testing.T) {
+func TestSyncUser_RootOwnedBackupInHome(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
 	require.NoError(t, os.Mkdir(sshDir, 0700))
+	authKeysPath := filepath.Join(sshDir, "authorized_keys")
+	require.NoError(t, os.WriteFile(authKeysPath, []byte("ssh-ed25519 BBBB old@host\n"), 0600))
 
-	// Two servers with overlapping keys
-	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host\nssh-rsa BBBB key2@host"))
+	enabled := true
+	cfg := &config.Config{
+		Policy: config.Policy{BackupEnabled: &enabled, BackupOwner: config.BackupOwnerRoot},
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	backups := &mockBackupManager{}
+	syncer := NewWithOptions(cfg, logger, Options{
+		Fetcher:       &mockFetcher{keys: map[string]string{"https://example.com/alice": "ssh-ed25519 AAAA one@host"}},
+		BackupManager: backups,
+		UserLookup: &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"alice": {
+					Username:     "alice",
+					UID:          os.Getuid(),
+					GID:          os.Getgid(),
+					HomeDir:      tempDir,
+					SSHDir:       sshDir,
+					AuthKeysPath: authKeysPath,
+					BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+				},
+			},
+		},
+	})
+
+	// The user could redirect the backup directory, so nothing is written
+	result := syncer.Run(context.Background())
+	require.Error(t, result.Users[0].Error)
+	assert.Contains(t, result.Users[0].Error.Error(), "inside the home directory of alice")
+	assert.Empty(t, backups.backups)
+	content, err := os.ReadFile(authKeysPath)
+	require.NoError(t, err)
+	assert.Equal(t, "ssh-ed25519 BBBB old@host\n", string(content))
+}
+
+func TestSyncUser_OptionalSourceFails(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
 	}))
-	defer server1.Close()
+	defer failing.Close()
 
-	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host\nssh-ed25519 CCCC key3@host")) // AAAA is duplicate
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA internal@host\n"))
 	}))
-	defer server2.Close()
+	defer working.Close()
 
+	optional := false
 	cfg := &config.Config{
-		Policy: config.Policy{},
 		Users: []config.User{
 			{
 				Username: "testuser",
 				Sources: []config.Source{
-					{URL: server1.URL},
-					{URL: server2.URL},
+					{URL: working.URL},
+					{URL: failing.URL, Required: &optional},
 				},
 			},
 		},
@@ -387,27 +1243,24 @@ func TestSyncUser_Deduplication(t *testing.T) {
 	}
 
 	result := syncer.Run(context.Background())
-
 	require.Len(t, result.Users, 1)
-	assert.False(t, result.HasErrors)
-	assert.Equal(t, 3, result.Users[0].KeysWritten) // 3 unique keys, not 4
+	require.NoError(t, result.Users[0].Error)
+	assert.Equal(t, 1, result.Users[0].KeysWritten)
+	require.Len(t, result.Warnings, 1)
+	assert.Contains(t, result.Warnings[0], "optional source "+failing.URL+" failed")
 
-	// Verify content
 	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
 	require.NoError(t, err)
-
-	// Count occurrences of AAAA - should be exactly 1
-	count := strings.Count(string(content), "ssh-ed25519 AAAA key@host")
-	assert.Equal(t, 1, count)
+	assert.Contains(t, string(content), "ssh-ed25519 AAAA internal@host")
+	assert.NotContains(t, string(content), failing.URL)
 }
 
-func TestSyncUser_BackupCreation(t *testing.T) {
+func TestSyncUser_MaxAuthKeysBytes(t *testing.T) {
 	tempDir := t.TempDir()
 	sshDir := filepath.Join(tempDir, ".ssh")
 	require.NoError(t, os.Mkdir(sshDir, 0700))
 
-	// Create existing authorized_keys
-	existingContent := `ssh-ed25519 AAAA old@host`
+	existingContent := "ssh-ed25519 AAAA old@host\n"
 	require.NoError(t, os.WriteFile(
 		filepath.Join(sshDir, "authorized_keys"),
 		[]byte(existingContent),
@@ -415,16 +1268,16 @@ func TestSyncUser_BackupCreation(t *testing.T) {
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ssh-ed25519 BBBB new@host"))
+		for i := range 100 {
+			_, _ = fmt.Fprintf(w, "ssh-ed25519 BBBB new%d@host\n", i)
+		}
 	}))
 	defer server.Close()
 
-	backupEnabled := true
-	preserveLocalKeys := false
+	maxBytes := 1024
 	cfg := &config.Config{
 		Policy: config.Policy{
-			BackupEnabled:     &backupEnabled,
-			PreserveLocalKeys: &preserveLocalKeys,
+			MaxAuthKeysBytes: &maxBytes,
 		},
 		Users: []config.User{
 			{
@@ -455,73 +1308,2157 @@ func TestSyncUser_BackupCreation(t *testing.T) {
 	result := syncer.Run(context.Background())
 
 	require.Len(t, result.Users, 1)
-	assert.False(t, result.HasErrors)
-	assert.NotEmpty(t, result.Users[0].BackupPath)
-
-	// Verify backup exists
-	_, err := os.Stat(result.Users[0].BackupPath)
-	require.NoError(t, err)
+	assert.True(t, result.HasErrors)
+	require.Error(t, result.Users[0].Error)
+	assert.Contains(t, result.Users[0].Error.Error(), "exceeding max_authorized_keys_bytes (1024)")
+	require.NotEmpty(t, result.Users[0].Decisions)
+	for _, d := range result.Users[0].Decisions {
+		assert.NotEqual(t, VerdictWritten, d.Verdict)
+	}
+	assert.Equal(t, VerdictWithheld, result.Users[0].Decisions[0].Verdict)
+	assert.Contains(t, result.Users[0].Decisions[0].Detail, "max_authorized_keys_bytes is 1024")
 
-	// Verify backup content
-	backupContent, err := os.ReadFile(result.Users[0].BackupPath)
+	// The existing file is left untouched
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
 	require.NoError(t, err)
-	assert.Equal(t, existingContent, string(backupContent))
+	assert.Equal(t, existingContent, string(content))
 }
 
-func TestNew(t *testing.T) {
-	cfg := &config.Config{}
-	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-
-	syncer := New(cfg, logger, false)
+func TestSyncUser_SourceTemplate(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
 
-	assert.NotNil(t, syncer)
-	assert.NotNil(t, syncer.fetcher)
-	assert.NotNil(t, syncer.backupManager)
-	assert.NotNil(t, syncer.fileWriter)
-	assert.NotNil(t, syncer.userLookup)
-	assert.False(t, syncer.dryRun)
-}
+	var requestedPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPath = r.URL.Path
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA testuser@host"))
+	}))
+	defer server.Close()
 
-func TestKeyFingerprint(t *testing.T) {
-	tests := []struct {
-		name     string
-		key      string
-		expected string // If not empty, expects exact match; otherwise expects SHA256:...
-	}{
-		{
-			name: "valid ed25519 key",
-			key:  "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host",
-		},
-		{
-			name: "valid rsa key",
-			key:  "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQ user@host",
-		},
-		{
-			name: "key with options",
-			key:  "restrict,port-forwarding ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGit user@host",
+	cfg := &config.Config{
+		Policy: config.Policy{
+			SourceTemplate: server.URL + "/{{.Username}}.keys",
 		},
-		{
-			name: "single field",
-			key:  "invalid",
+		Users: []config.User{
+			{Username: "testuser"},
 		},
-		{
-			name:     "empty key",
-			key:      "",
-			expected: "(empty)",
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := keyFingerprint(tt.key)
-			if tt.expected != "" {
-				assert.Equal(t, tt.expected, result)
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	require.NoError(t, result.Users[0].Error)
+	assert.Equal(t, "/testuser.keys", requestedPath)
+	assert.Equal(t, 1, result.Users[0].KeysWritten)
+
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "# Source: "+server.URL+"/testuser.keys\n")
+}
+
+func TestSyncUser_HEADSourceFails(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	cfg := &config.Config{
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: "https://example.com/keys", Method: "HEAD"},
+				},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username: "testuser",
+				UID:      os.Getuid(),
+				GID:      os.Getgid(),
+				HomeDir:  tempDir,
+				SSHDir:   sshDir,
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	require.Error(t, result.Users[0].Error)
+	assert.Contains(t, result.Users[0].Error.Error(), "uses method HEAD")
+	assert.NoFileExists(t, filepath.Join(sshDir, "authorized_keys"))
+}
+
+func TestSyncUser_DryRun(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host"))
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		Policy: config.Policy{},
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: server.URL},
+				},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, true) // dry-run = true
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username: "testuser",
+				UID:      os.Getuid(),
+				GID:      os.Getgid(),
+				HomeDir:  tempDir,
+				SSHDir:   sshDir,
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	assert.False(t, result.HasErrors)
+	assert.NoError(t, result.Users[0].Error)
+
+	// Verify no file was written
+	_, err := os.Stat(filepath.Join(sshDir, "authorized_keys"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSyncUser_PreserveLocalKeys(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	// Create existing authorized_keys with local keys
+	existingContent := `ssh-ed25519 AAAA local@host
+ssh-rsa BBBB local2@host`
+	require.NoError(t, os.WriteFile(
+		filepath.Join(sshDir, "authorized_keys"),
+		[]byte(existingContent),
+		0600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 CCCC remote@host"))
+	}))
+	defer server.Close()
+
+	preserveLocalKeys := true
+	cfg := &config.Config{
+		Policy: config.Policy{
+			PreserveLocalKeys: &preserveLocalKeys,
+		},
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: server.URL},
+				},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	assert.False(t, result.HasErrors)
+	assert.Equal(t, 3, result.Users[0].KeysWritten)
+	assert.Equal(t, 2, result.Users[0].LocalKeys)
+
+	// Verify all keys are present
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "ssh-ed25519 CCCC remote@host")
+	assert.Contains(t, string(content), "ssh-ed25519 AAAA local@host")
+	assert.Contains(t, string(content), "ssh-rsa BBBB local2@host")
+	assert.Contains(t, string(content), "# Local (preserved)")
+}
+
+func TestSyncUser_PreserveFormatting(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("  command=\"/bin/true\"  ssh-ed25519 AAAA remote@host\r\nssh-ed25519 AAAA remote@host\n"))
+	}))
+	defer server.Close()
+
+	preserveFormatting := true
+	cfg := &config.Config{
+		Policy: config.Policy{
+			PreserveFormatting: &preserveFormatting,
+		},
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: server.URL},
+				},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	assert.False(t, result.HasErrors)
+	assert.Equal(t, 2, result.Users[0].KeysWritten)
+
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "\n  command=\"/bin/true\"  ssh-ed25519 AAAA remote@host\n")
+	assert.NotContains(t, string(content), "\r")
+}
+
+func TestSyncUser_KeyProfileRejectsKeys(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	// Local key that the profile does not allow
+	require.NoError(t, os.WriteFile(
+		filepath.Join(sshDir, "authorized_keys"),
+		[]byte("ssh-rsa BBBB local@host\n"),
+		0600))
+
+	ed25519Key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW modern@host"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(ed25519Key + "\nssh-rsa AAAA legacy@host\n"))
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		Policy: config.Policy{
+			KeyProfile: "modern",
+		},
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: server.URL},
+				},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	assert.False(t, result.HasErrors)
+	assert.Equal(t, 1, result.Users[0].KeysWritten)
+	assert.Equal(t, 2, result.Users[0].KeysRejected)
+
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), ed25519Key)
+	assert.NotContains(t, string(content), "ssh-rsa")
+
+	decisions := result.Users[0].Decisions
+	require.Len(t, decisions, 3)
+	assert.Equal(t, VerdictRejected, decisions[1].Verdict)
+	assert.Contains(t, decisions[1].Detail, "key type not allowed")
+	assert.Equal(t, SourceLocal, decisions[2].Source)
+	assert.Equal(t, VerdictRejected, decisions[2].Verdict)
+}
+
+func TestSyncUser_DoNotPreserveLocalKeys(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	// Create existing authorized_keys with local keys
+	existingContent := `ssh-ed25519 AAAA local@host`
+	require.NoError(t, os.WriteFile(
+		filepath.Join(sshDir, "authorized_keys"),
+		[]byte(existingContent),
+		0600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 CCCC remote@host"))
+	}))
+	defer server.Close()
+
+	preserveLocalKeys := false
+	cfg := &config.Config{
+		Policy: config.Policy{
+			PreserveLocalKeys: &preserveLocalKeys,
+		},
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: server.URL},
+				},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	assert.Equal(t, 1, result.Users[0].KeysWritten)
+	assert.Equal(t, 0, result.Users[0].LocalKeys)
+
+	// Verify only remote key is present
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "ssh-ed25519 CCCC remote@host")
+	assert.NotContains(t, string(content), "local@host")
+}
+
+func TestSyncUser_Deduplication(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	// Two servers with overlapping keys
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host\nssh-rsa BBBB key2@host"))
+	}))
+	defer server1.Close()
+
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host\nssh-ed25519 CCCC key3@host")) // AAAA is duplicate
+	}))
+	defer server2.Close()
+
+	cfg := &config.Config{
+		Policy: config.Policy{},
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: server1.URL},
+					{URL: server2.URL},
+				},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	assert.False(t, result.HasErrors)
+	assert.Equal(t, 3, result.Users[0].KeysWritten) // 3 unique keys, not 4
+
+	// Verify content
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+
+	// Count occurrences of AAAA - should be exactly 1
+	count := strings.Count(string(content), "ssh-ed25519 AAAA key@host")
+	assert.Equal(t, 1, count)
+
+	// Decisions explain the duplicate
+	decisions := result.Users[0].Decisions
+	require.Len(t, decisions, 4)
+	assert.Equal(t, VerdictWritten, decisions[0].Verdict)
+	assert.Equal(t, server1.URL, decisions[0].Source)
+	assert.Equal(t, VerdictDeduped, decisions[2].Verdict)
+	assert.Equal(t, server2.URL, decisions[2].Source)
+	assert.Equal(t, "duplicate of "+server1.URL, decisions[2].Detail)
+	assert.Equal(t, keyFingerprint("ssh-ed25519 AAAA key@host"), decisions[2].Fingerprint)
+}
+
+func TestSyncUser_BackupCreation(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	// Create existing authorized_keys
+	existingContent := `ssh-ed25519 AAAA old@host`
+	require.NoError(t, os.WriteFile(
+		filepath.Join(sshDir, "authorized_keys"),
+		[]byte(existingContent),
+		0600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 BBBB new@host"))
+	}))
+	defer server.Close()
+
+	backupEnabled := true
+	preserveLocalKeys := false
+	cfg := &config.Config{
+		Policy: config.Policy{
+			BackupEnabled:     &backupEnabled,
+			PreserveLocalKeys: &preserveLocalKeys,
+		},
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: server.URL},
+				},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	assert.False(t, result.HasErrors)
+	assert.NotEmpty(t, result.Users[0].BackupPath)
+
+	// Verify backup exists
+	_, err := os.Stat(result.Users[0].BackupPath)
+	require.NoError(t, err)
+
+	// Verify backup content
+	backupContent, err := os.ReadFile(result.Users[0].BackupPath)
+	require.NoError(t, err)
+	assert.Equal(t, existingContent, string(backupContent))
+}
+
+func TestSyncUser_RollbackOnError(t *testing.T) {
+	tests := []struct {
+		name            string
+		rollbackOnError bool
+		wantContent     string
+	}{
+		{name: "enabled", rollbackOnError: true, wantContent: "ssh-ed25519 AAAA old@host"},
+		{name: "disabled", rollbackOnError: false, wantContent: "ssh-ed25519 BBBB new@host"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			sshDir := filepath.Join(tempDir, ".ssh")
+			require.NoError(t, os.Mkdir(sshDir, 0700))
+			authKeysPath := filepath.Join(sshDir, "authorized_keys")
+			require.NoError(t, os.WriteFile(authKeysPath, []byte("ssh-ed25519 AAAA old@host"), 0600))
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("ssh-ed25519 BBBB new@host"))
+			}))
+			defer server.Close()
+
+			preserveLocalKeys := false
+			cfg := &config.Config{
+				Policy: config.Policy{
+					PreserveLocalKeys: &preserveLocalKeys,
+					RollbackOnError:   &tt.rollbackOnError,
+				},
+				Users: []config.User{
+					{Username: "testuser", Sources: []config.Source{{URL: server.URL}}},
+				},
+			}
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			syncer := New(cfg, logger, false)
+			syncer.userLookup = &mockUserLookup{
+				users: map[string]*userinfo.UserInfo{
+					"testuser": {
+						Username:     "testuser",
+						UID:          os.Getuid(),
+						GID:          os.Getgid(),
+						HomeDir:      tempDir,
+						SSHDir:       sshDir,
+						AuthKeysPath: authKeysPath,
+						BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+					},
+				},
+			}
+			syncer.afterWrite = func(info *userinfo.UserInfo) error {
+				return errors.New("step failed")
+			}
+
+			result := syncer.Run(context.Background())
+			require.True(t, result.HasErrors)
+			assert.ErrorContains(t, result.Users[0].Error, "step failed")
+			assert.Equal(t, tt.rollbackOnError, result.Users[0].RolledBack)
+			assert.False(t, result.Users[0].Changed)
+
+			content, err := os.ReadFile(authKeysPath)
+			require.NoError(t, err)
+			assert.Contains(t, string(content), tt.wantContent)
+		})
+	}
+}
+
+func TestSyncUser_BackupDirTemplate(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	existingContent := `ssh-ed25519 AAAA old@host`
+	require.NoError(t, os.WriteFile(
+		filepath.Join(sshDir, "authorized_keys"),
+		[]byte(existingContent),
+		0600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 BBBB new@host"))
+	}))
+	defer server.Close()
+
+	backupEnabled := true
+	preserveLocalKeys := false
+	cfg := &config.Config{
+		Policy: config.Policy{
+			BackupEnabled:     &backupEnabled,
+			BackupDir:         filepath.Join(tempDir, "backups", "%u"),
+			PreserveLocalKeys: &preserveLocalKeys,
+		},
+		Users: []config.User{
+			{
+				Username: "testuser",
+				Sources: []config.Source{
+					{URL: server.URL},
+				},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, false)
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	assert.False(t, result.HasErrors)
+	assert.Equal(t, filepath.Join(tempDir, "backups", "testuser"), filepath.Dir(result.Users[0].BackupPath))
+
+	backupContent, err := os.ReadFile(result.Users[0].BackupPath)
+	require.NoError(t, err)
+	assert.Equal(t, existingContent, string(backupContent))
+
+	// Nothing is written to the default location inside .ssh
+	assert.NoDirExists(t, filepath.Join(sshDir, "authorized_keys_backups"))
+}
+
+func TestNew(t *testing.T) {
+	cfg := &config.Config{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	syncer := New(cfg, logger, false)
+
+	assert.NotNil(t, syncer)
+	assert.NotNil(t, syncer.fetcher)
+	assert.NotNil(t, syncer.backupManager)
+	assert.NotNil(t, syncer.fileWriter)
+	assert.NotNil(t, syncer.userLookup)
+	assert.False(t, syncer.dryRun)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	cfg := &config.Config{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	syncer := NewWithOptions(cfg, logger, Options{DryRun: true, NoBackup: true, NoRotate: true})
+
+	assert.True(t, syncer.dryRun)
+	assert.True(t, syncer.noBackup)
+	assert.True(t, syncer.noRotate)
+}
+
+func TestNewWithOptions_Dependencies(t *testing.T) {
+	cfg := &config.Config{
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Nothing below touches the network or a real .ssh directory
+	writer := &mockWriter{files: make(map[string][]byte)}
+	syncer := NewWithOptions(cfg, logger, Options{
+		Fetcher:       &mockFetcher{keys: map[string]string{"https://example.com/alice": "ssh-ed25519 AAAA alice@host"}},
+		BackupManager: &mockBackupManager{},
+		Writer:        writer,
+		UserLookup: &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"alice": {
+					Username:     "alice",
+					HomeDir:      "/nonexistent/alice",
+					SSHDir:       "/nonexistent/alice/.ssh",
+					AuthKeysPath: "/nonexistent/alice/.ssh/authorized_keys",
+					BackupDir:    "/nonexistent/alice/.ssh/authorized_keys_backups",
+				},
+			},
+		},
+		Now: func() time.Time { return time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC) },
+	})
+
+	result := syncer.Run(context.Background())
+	require.False(t, result.HasErrors)
+	assert.True(t, result.Users[0].Changed)
+
+	content := string(writer.files["/nonexistent/alice/.ssh/authorized_keys"])
+	assert.Contains(t, content, "# Last sync: 2024-06-01T12:00:00Z")
+	assert.Contains(t, content, "# Source: https://example.com/alice\nssh-ed25519 AAAA alice@host\n")
+}
+
+// eventWriter is a mockWriter that records every write in events
+type eventWriter struct {
+	mockWriter
+	events *[]string
+}
+
+func (w *eventWriter) WriteAtomic(path string, content []byte, uid, gid int) (*sshfile.WriteResult, error) {
+	*w.events = append(*w.events, "write "+filepath.Dir(path))
+	return w.mockWriter.WriteAtomic(path, content, uid, gid)
+}
+
+func TestSyncUser_DropPrivileges(t *testing.T) {
+	cfg := &config.Config{
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+			{Username: "bob", Sources: []config.Source{{URL: "https://example.com/bob"}}},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var events []string
+	newSyncer := func(switchErr error) *Syncer {
+		events = nil
+		syncer := NewWithOptions(cfg, logger, Options{
+			DropPrivileges: true,
+			Fetcher: &mockFetcher{keys: map[string]string{
+				"https://example.com/alice": "ssh-ed25519 AAAA alice@host",
+				"https://example.com/bob":   "ssh-ed25519 BBBB bob@host",
+			}},
+			BackupManager: &mockBackupManager{},
+			Writer:        &eventWriter{mockWriter: mockWriter{files: make(map[string][]byte)}, events: &events},
+			UserLookup: &mockUserLookup{
+				users: map[string]*userinfo.UserInfo{
+					"alice": {Username: "alice", UID: 1001, GID: 1001, SSHDir: "/nonexistent/alice/.ssh", AuthKeysPath: "/nonexistent/alice/.ssh/authorized_keys"},
+					"bob":   {Username: "bob", UID: 1002, GID: 1002, SSHDir: "/nonexistent/bob/.ssh", AuthKeysPath: "/nonexistent/bob/.ssh/authorized_keys"},
+				},
+			},
+		})
+		syncer.switchCredentials = func(uid, gid int) (func() error, error) {
+			if switchErr != nil {
+				return nil, switchErr
+			}
+			events = append(events, fmt.Sprintf("switch %d:%d", uid, gid))
+			return func() error {
+				events = append(events, "restore")
+				return nil
+			}, nil
+		}
+		return syncer
+	}
+
+	// Every write runs as its owner, with the credentials restored between users
+	result := newSyncer(nil).Run(context.Background())
+	require.False(t, result.HasErrors)
+	assert.Equal(t, []string{
+		"switch 1001:1001", "write /nonexistent/alice/.ssh", "restore",
+		"switch 1002:1002", "write /nonexistent/bob/.ssh", "restore",
+	}, events)
+
+	// Failing to switch never writes as root instead
+	result = newSyncer(errors.New("operation not permitted")).Run(context.Background())
+	require.True(t, result.HasErrors)
+	require.Error(t, result.Users[0].Error)
+	assert.Contains(t, result.Users[0].Error.Error(), "failed to drop privileges")
+	assert.Empty(t, events)
+}
+
+func TestSwitchCredentials(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing credentials requires root")
+	}
+
+	restore, err := switchCredentials(65534, 65534)
+	require.NoError(t, err)
+	assert.Equal(t, 65534, os.Geteuid())
+	assert.Equal(t, 65534, os.Getegid())
+
+	require.NoError(t, restore())
+	assert.Equal(t, 0, os.Geteuid())
+	assert.Equal(t, 0, os.Getegid())
+}
+
+func TestSyncUser_BackupOverrides(t *testing.T) {
+	keepThree := 3
+	tests := []struct {
+		name        string
+		opts        Options
+		wantBackup  bool
+		wantBackups int
+	}{
+		{name: "no overrides", opts: Options{}, wantBackup: true, wantBackups: 1},
+		{name: "no backup", opts: Options{NoBackup: true}, wantBackup: false, wantBackups: 1},
+		{name: "no rotate", opts: Options{NoRotate: true}, wantBackup: true, wantBackups: 2},
+		{name: "retention override", opts: Options{BackupRetention: &keepThree}, wantBackup: true, wantBackups: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			sshDir := filepath.Join(tempDir, ".ssh")
+			backupDir := filepath.Join(sshDir, "authorized_keys_backups")
+			require.NoError(t, os.MkdirAll(backupDir, 0700))
+			require.NoError(t, os.WriteFile(
+				filepath.Join(sshDir, "authorized_keys"),
+				[]byte("ssh-ed25519 AAAA old@host"),
+				0600))
+			require.NoError(t, os.WriteFile(
+				filepath.Join(backupDir, "authorized_keys_20240101_100000_aaaaaa"),
+				[]byte("ssh-ed25519 OLD older@host"),
+				0600))
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte("ssh-ed25519 BBBB new@host"))
+			}))
+			defer server.Close()
+
+			retention := 1
+			preserveLocalKeys := false
+			cfg := &config.Config{
+				Policy: config.Policy{
+					BackupRetentionCount: &retention,
+					PreserveLocalKeys:    &preserveLocalKeys,
+				},
+				Users: []config.User{
+					{Username: "testuser", Sources: []config.Source{{URL: server.URL}}},
+				},
+			}
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			syncer := NewWithOptions(cfg, logger, tt.opts)
+			syncer.userLookup = &mockUserLookup{
+				users: map[string]*userinfo.UserInfo{
+					"testuser": {
+						Username:     "testuser",
+						UID:          os.Getuid(),
+						GID:          os.Getgid(),
+						HomeDir:      tempDir,
+						SSHDir:       sshDir,
+						AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+						BackupDir:    backupDir,
+					},
+				},
+			}
+
+			result := syncer.Run(context.Background())
+
+			require.Len(t, result.Users, 1)
+			assert.False(t, result.HasErrors)
+			assert.True(t, result.Users[0].Changed)
+			assert.Equal(t, tt.wantBackup, result.Users[0].BackupPath != "")
+
+			entries, err := os.ReadDir(backupDir)
+			require.NoError(t, err)
+			assert.Len(t, entries, tt.wantBackups)
+
+			// The override never leaks into the caller's config
+			assert.Equal(t, 1, cfg.Policy.GetBackupRetentionCount())
+		})
+	}
+}
+
+func TestBuildContent_VerboseSourceComments(t *testing.T) {
+	fetchedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	fetchResults := []*keyfetcher.FetchResult{
+		{
+			Source:     config.Source{URL: "https://example.com/a"},
+			StatusCode: http.StatusOK,
+			FetchedAt:  fetchedAt,
+			Keys: []keyparser.ParsedKey{
+				{Line: "ssh-ed25519 AAAA a@host"},
+				{Line: "ssh-ed25519 BBBB b@host"},
+			},
+		},
+		{
+			Source:     config.Source{URL: "https://example.com/b"},
+			StatusCode: http.StatusOK,
+			FetchedAt:  fetchedAt,
+			Keys: []keyparser.ParsedKey{
+				{Line: "ssh-ed25519 AAAA a@host"},
+				{Line: "ssh-ed25519 CCCC c@host"},
+			},
+		},
+	}
+	info := &userinfo.UserInfo{SSHDir: t.TempDir()}
+
+	verbose := true
+	syncer := New(&config.Config{
+		Policy: config.Policy{VerboseSourceComments: &verbose},
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)), false)
+
+	content, _ := syncer.buildContent(info, fetchResults, nil, false, nil)
+	assert.Contains(t, string(content), "# Source: https://example.com/a (2 keys, HTTP 200, fetched 2024-06-01T12:00:00Z)\n")
+	assert.Contains(t, string(content), "# Source: https://example.com/b (1 key, HTTP 200, fetched 2024-06-01T12:00:00Z)\n")
+
+	// Disabled by default
+	syncer = New(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)), false)
+	content, _ = syncer.buildContent(info, fetchResults, nil, false, nil)
+	assert.Contains(t, string(content), "# Source: https://example.com/a\n")
+}
+
+func TestBuildContent_TimeZone(t *testing.T) {
+	info := &userinfo.UserInfo{SSHDir: t.TempDir()}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	syncer := New(&config.Config{}, logger, false)
+	syncer.timeNow = func() time.Time { return now }
+	content, _ := syncer.buildContent(info, nil, nil, false, nil)
+	assert.Contains(t, string(content), "# Last sync: 2024-06-01T12:00:00Z\n")
+
+	syncer = New(&config.Config{
+		Policy: config.Policy{TimeZone: "America/New_York"},
+	}, logger, false)
+	syncer.timeNow = func() time.Time { return now }
+	content, _ = syncer.buildContent(info, nil, nil, false, nil)
+	assert.Contains(t, string(content), "# Last sync: 2024-06-01T08:00:00-04:00\n")
+}
+
+func TestBuildContent_DeduplicateAcrossSources(t *testing.T) {
+	sshDir := t.TempDir()
+	info := &userinfo.UserInfo{SSHDir: sshDir, AuthKeysPath: filepath.Join(sshDir, "authorized_keys")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The local file already contains the shared key from a previous run
+	require.NoError(t, os.WriteFile(
+		filepath.Join(sshDir, "authorized_keys"),
+		[]byte("ssh-ed25519 AAAA shared@host\n"),
+		0600))
+
+	fetchResults := []*keyfetcher.FetchResult{
+		{
+			Source: config.Source{URL: "https://example.com/a"},
+			Keys: []keyparser.ParsedKey{
+				{Line: "ssh-ed25519 AAAA shared@host"},
+				{Line: "ssh-ed25519 BBBB a@host"},
+			},
+		},
+		{
+			Source: config.Source{URL: "https://example.com/b"},
+			Keys: []keyparser.ParsedKey{
+				{Line: "ssh-ed25519 AAAA shared@host"},
+				{Line: "ssh-ed25519 CCCC b@host"},
+				{Line: "ssh-ed25519 CCCC b@host"},
+			},
+		},
+	}
+
+	// Default: first source wins
+	syncer := New(&config.Config{}, logger, false)
+	content, stats := syncer.buildContent(info, fetchResults, nil, false, nil)
+	assert.Equal(t, 1, strings.Count(string(content), "ssh-ed25519 AAAA shared@host"))
+	assert.Equal(t, 3, stats.TotalKeys)
+	assert.Equal(t, []DuplicateInfo{
+		{Key: "ssh-ed25519 AAAA shared@host", FirstSource: "https://example.com/a", DuplicateSource: "https://example.com/b", CrossSource: true},
+		{Key: "ssh-ed25519 CCCC b@host", FirstSource: "https://example.com/b", DuplicateSource: "https://example.com/b"},
+		{Key: "ssh-ed25519 AAAA shared@host", FirstSource: "https://example.com/a", DuplicateSource: SourceLocal, CrossSource: true},
+	}, stats.Duplicates)
+
+	// Disabled: each source keeps its keys, the local copy is still dropped
+	dedup := false
+	syncer = New(&config.Config{
+		Policy: config.Policy{DeduplicateAcrossSources: &dedup},
+	}, logger, false)
+	content, stats = syncer.buildContent(info, fetchResults, nil, false, nil)
+	assert.Equal(t, 2, strings.Count(string(content), "ssh-ed25519 AAAA shared@host"))
+	assert.Equal(t, 1, strings.Count(string(content), "ssh-ed25519 CCCC b@host"))
+	assert.Equal(t, 4, stats.TotalKeys)
+	assert.Equal(t, []DuplicateInfo{
+		{Key: "ssh-ed25519 CCCC b@host", FirstSource: "https://example.com/b", DuplicateSource: "https://example.com/b"},
+		{Key: "ssh-ed25519 AAAA shared@host", FirstSource: "https://example.com/a", DuplicateSource: SourceLocal, CrossSource: true},
+	}, stats.Duplicates)
+}
+
+func TestBuildContent_DedupeByKeyMaterial(t *testing.T) {
+	sshDir := t.TempDir()
+	info := &userinfo.UserInfo{SSHDir: sshDir, AuthKeysPath: filepath.Join(sshDir, "authorized_keys")}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	require.NoError(t, os.WriteFile(
+		filepath.Join(sshDir, "authorized_keys"),
+		[]byte("no-pty ssh-ed25519 AAAA alice@old-laptop\n"),
+		0600))
+
+	fetchResults := []*keyfetcher.FetchResult{
+		{
+			Source: config.Source{URL: "https://example.com/a"},
+			Keys: []keyparser.ParsedKey{
+				{Line: "ssh-ed25519 AAAA alice@laptop"},
+				{Line: "ssh-ed25519 AAAA alice@laptop"},
+				{Line: "ssh-ed25519 AAAA alice@desktop"},
+			},
+		},
+	}
+
+	// Default: only identical lines are duplicates
+	syncer := New(&config.Config{}, logger, false)
+	_, stats := syncer.buildContent(info, fetchResults, nil, false, nil)
+	assert.Equal(t, 3, stats.TotalKeys)
+
+	// By key material: the first line is kept, whatever the comment or options
+	byMaterial := true
+	syncer = New(&config.Config{
+		Policy: config.Policy{DedupeByKeyMaterial: &byMaterial},
+	}, logger, false)
+	content, stats := syncer.buildContent(info, fetchResults, nil, false, nil)
+	assert.Equal(t, 1, stats.TotalKeys)
+	assert.Contains(t, string(content), "ssh-ed25519 AAAA alice@laptop\n")
+	assert.NotContains(t, string(content), "alice@desktop")
+	assert.NotContains(t, string(content), "alice@old-laptop")
+	assert.Equal(t, []DuplicateInfo{
+		{Key: "ssh-ed25519 AAAA alice@laptop", FirstSource: "https://example.com/a", DuplicateSource: "https://example.com/a"},
+		{Key: "ssh-ed25519 AAAA alice@desktop", FirstSource: "https://example.com/a", DuplicateSource: "https://example.com/a", KeyMaterial: true},
+		{Key: "no-pty ssh-ed25519 AAAA alice@old-laptop", FirstSource: "https://example.com/a", DuplicateSource: SourceLocal, CrossSource: true, KeyMaterial: true},
+	}, stats.Duplicates)
+}
+
+func TestBuildContent_SourcePriority(t *testing.T) {
+	info := &userinfo.UserInfo{SSHDir: t.TempDir()}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fetchResults := []*keyfetcher.FetchResult{
+		{
+			Source: config.Source{URL: "https://example.com/personal"},
+			Keys: []keyparser.ParsedKey{
+				{Line: "ssh-ed25519 AAAA shared@host"},
+				{Line: "ssh-ed25519 DDDD personal@host"},
+			},
+		},
+		{
+			Source: config.Source{URL: "https://example.com/team"},
+			Keys:   []keyparser.ParsedKey{{Line: "ssh-ed25519 BBBB team@host"}},
+		},
+		{
+			Source: config.Source{URL: "https://example.com/corp", Priority: 10},
+			Keys: []keyparser.ParsedKey{
+				{Line: "ssh-ed25519 AAAA shared@host"},
+				{Line: "ssh-ed25519 CCCC corp@host"},
+			},
+		},
+	}
+
+	syncer := New(&config.Config{}, logger, false)
+	content, stats := syncer.buildContent(info, fetchResults, nil, false, nil)
+
+	// corp comes first and wins the duplicate, equal priorities keep config order
+	corp := strings.Index(string(content), "# Source: https://example.com/corp")
+	personal := strings.Index(string(content), "# Source: https://example.com/personal")
+	team := strings.Index(string(content), "# Source: https://example.com/team")
+	assert.True(t, corp >= 0 && corp < personal && personal < team)
+	assert.Equal(t, []DuplicateInfo{
+		{Key: "ssh-ed25519 AAAA shared@host", FirstSource: "https://example.com/corp", DuplicateSource: "https://example.com/personal", CrossSource: true},
+	}, stats.Duplicates)
+
+	// The caller's slice is not reordered
+	assert.Equal(t, "https://example.com/personal", fetchResults[0].Source.URL)
+}
+
+func TestSyncUser_Incremental(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	keys := "ssh-ed25519 AAAA user@host"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(keys))
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		Users: []config.User{
+			{Username: "testuser", Sources: []config.Source{{URL: server.URL}}},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := NewWithOptions(cfg, logger, Options{Incremental: true})
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+			},
+		},
+	}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	syncer.timeNow = func() time.Time { return now }
+	result := syncer.Run(context.Background())
+	require.False(t, result.HasErrors)
+	assert.True(t, result.Users[0].Changed)
+
+	// Only the timestamp differs: the file is left untouched
+	now = now.Add(time.Hour)
+	result = syncer.Run(context.Background())
+	require.False(t, result.HasErrors)
+	assert.False(t, result.Users[0].Changed)
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "# Last sync: 2024-06-01T12:00:00Z")
+
+	// A key change is written
+	keys = "ssh-ed25519 BBBB user@host"
+	result = syncer.Run(context.Background())
+	require.False(t, result.HasErrors)
+	assert.True(t, result.Users[0].Changed)
+}
+
+func TestRun_ChangedOnly(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	authKeysPath := filepath.Join(sshDir, "authorized_keys")
+	statePath := filepath.Join(tempDir, "state", "state.json")
+
+	keys := "ssh-ed25519 AAAA user@host"
+	etag := `"v1"`
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(keys))
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		Users: []config.User{
+			{Username: "testuser", Sources: []config.Source{{URL: server.URL}}},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	// Every run uses a new Syncer, like separate cron runs
+	run := func() UserResult {
+		syncer := NewWithOptions(cfg, logger, Options{ChangedOnly: true, StateFile: statePath})
+		syncer.userLookup = &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"testuser": {
+					Username:     "testuser",
+					UID:          os.Getuid(),
+					GID:          os.Getgid(),
+					HomeDir:      tempDir,
+					SSHDir:       sshDir,
+					AuthKeysPath: authKeysPath,
+					BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+				},
+			},
+		}
+		result := syncer.Run(context.Background())
+		require.False(t, result.HasErrors)
+		return result.Users[0]
+	}
+
+	// The first run has no state and writes the file
+	result := run()
+	assert.True(t, result.Changed)
+	assert.False(t, result.NotModified)
+	assert.FileExists(t, statePath)
+
+	// The source answers 304 and the file is untouched: the user is skipped
+	result = run()
+	assert.True(t, result.NotModified)
+	assert.False(t, result.Changed)
+	assert.Equal(t, 2, requests)
+
+	// A modified file is rebuilt from the keys kept in the state file
+	require.NoError(t, os.WriteFile(authKeysPath, []byte("ssh-ed25519 XXXX local@host\n"), 0600))
+	result = run()
+	assert.False(t, result.NotModified)
+	assert.True(t, result.Changed)
+	content, err := os.ReadFile(authKeysPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), keys)
+	assert.Contains(t, string(content), "# Local (preserved)\nssh-ed25519 XXXX local@host")
+
+	// A new version of the source is written
+	keys = "ssh-ed25519 BBBB user@host"
+	etag = `"v2"`
+	result = run()
+	assert.False(t, result.NotModified)
+	assert.True(t, result.Changed)
+
+	// A config change rebuilds every user
+	durableWrites := true
+	cfg.Policy.DurableWrites = &durableWrites
+	result = run()
+	assert.False(t, result.NotModified)
+}
+
+func TestState_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "state.json")
+
+	state, err := LoadState(path)
+	require.NoError(t, err)
+	assert.Empty(t, state.Users)
+
+	state.Config = "abc"
+	state.Users["alice"] = "123"
+	state.Sources["key"] = keyfetcher.Validator{ETag: `"v1"`, Body: []byte("ssh-ed25519 AAAA")}
+	require.NoError(t, SaveState(path, state))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := LoadState(path)
+	require.NoError(t, err)
+	assert.Equal(t, state, loaded)
+
+	// A state file from another version is ignored
+	require.NoError(t, os.WriteFile(path, []byte(`{"version":99,"config":"abc"}`), 0600))
+	loaded, err = LoadState(path)
+	require.NoError(t, err)
+	assert.Empty(t, loaded.Config)
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0600))
+	_, err = LoadState(path)
+	assert.Error(t, err)
+}
+
+func TestStableContent(t *testing.T) {
+	a := "# Last sync: 2024-06-01T12:00:00Z\n\n# Source: https://example.com (1 key, HTTP 200, fetched 2024-06-01T12:00:00Z)\nssh-ed25519 AAAA\n"
+	b := "# Last sync: 2024-06-01T13:00:00Z\n\n# Source: https://example.com (1 key, HTTP 304, fetched 2024-06-01T13:00:00Z)\nssh-ed25519 AAAA\n"
+	c := "# Last sync: 2024-06-01T13:00:00Z\n\n# Source: https://example.com\nssh-ed25519 BBBB\n"
+
+	assert.Equal(t, stableContent([]byte(a)), stableContent([]byte(b)))
+	assert.NotEqual(t, stableContent([]byte(a)), stableContent([]byte(c)))
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	// Expected values from "ssh-keygen -l" and "ssh-keygen -l -E md5"
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBa966+beyFr9U/YL/Ubk8G82d+lp9Exo1pre2/RVVYW u@h"
+
+	tests := []struct {
+		name        string
+		key         string
+		expected    string
+		expectedMD5 string
+	}{
+		{
+			name:        "valid ed25519 key",
+			key:         key,
+			expected:    "SHA256:BlO5d3w0VSdK7aim1tmFmVqIId6ECOjwc2LkLZfENxI",
+			expectedMD5: "MD5:02:57:a1:4a:c8:5d:18:d4:25:14:25:e6:2c:6d:8a:2a",
+		},
+		{
+			name:        "options and comment do not change it",
+			key:         "restrict,port-forwarding " + strings.TrimSuffix(key, " u@h") + " other@host",
+			expected:    "SHA256:BlO5d3w0VSdK7aim1tmFmVqIId6ECOjwc2LkLZfENxI",
+			expectedMD5: "MD5:02:57:a1:4a:c8:5d:18:d4:25:14:25:e6:2c:6d:8a:2a",
+		},
+		{
+			name:     "invalid blob falls back to a line hash",
+			key:      "ssh-ed25519 !!! user@host",
+			expected: "line-sha256:",
+		},
+		{
+			name:     "single field",
+			key:      "invalid",
+			expected: "line-sha256:",
+		},
+		{
+			name:     "empty key",
+			key:      "",
+			expected: "(empty)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := keyFingerprint(tt.key)
+			if strings.HasPrefix(tt.expected, "line-sha256:") {
+				// line-sha256: followed by 16 hex characters (8 bytes)
+				assert.Regexp(t, `^line-sha256:[0-9a-f]{16}$`, result)
 			} else {
-				assert.True(t, strings.HasPrefix(result, "SHA256:"),
-					"expected SHA256: prefix, got: %s", result)
-				// SHA256: followed by 16 hex characters (8 bytes)
-				assert.Len(t, result, 23) // "SHA256:" (7) + 16 hex chars
+				assert.Equal(t, tt.expected, result)
+			}
+			assert.Equal(t, tt.expectedMD5, keyFingerprintMD5(tt.key))
+		})
+	}
+}
+
+// failingWriter is a mockWriter that fails the writes of some .ssh directories
+type failingWriter struct {
+	mockWriter
+	errs map[string]error
+}
+
+func (w *failingWriter) WriteAtomic(path string, content []byte, uid, gid int) (*sshfile.WriteResult, error) {
+	if err := w.errs[filepath.Dir(path)]; err != nil {
+		return nil, err
+	}
+	return w.mockWriter.WriteAtomic(path, content, uid, gid)
+}
+
+func TestRun_Warnings(t *testing.T) {
+	warningsAreErrors := true
+	cfg := &config.Config{
+		Policy: config.Policy{WarningsAreErrors: &warningsAreErrors},
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+			{Username: "bob", Sources: []config.Source{{URL: "https://example.com/bob"}}},
+		},
+		Warnings: []string{"config file is readable by others"},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	syncer := NewWithOptions(cfg, logger, Options{
+		Fetcher: &mockFetcher{keys: map[string]string{
+			"https://example.com/alice": "ssh-ed25519 AAAA alice@host\nnot a key\nssh-ed25519 AAAA alice@host",
+			"https://example.com/bob":   "ssh-ed25519 BBBB bob@host",
+		}},
+		BackupManager: &mockBackupManager{},
+		Writer:        &mockWriter{files: make(map[string][]byte)},
+		UserLookup: &mockUserLookup{users: map[string]*userinfo.UserInfo{
+			"alice": {Username: "alice", SSHDir: "/nonexistent/alice/.ssh"},
+		}},
+	})
+
+	result := syncer.Run(context.Background())
+	assert.False(t, result.HasErrors)
+	assert.True(t, result.WarningsAreErrors)
+
+	require.Len(t, result.Users, 2)
+	assert.Len(t, result.Users[0].Warnings, 2)
+	assert.Equal(t, []string{"skipped: user not found in system"}, result.Users[1].Warnings)
+
+	require.Len(t, result.Warnings, 4)
+	assert.Equal(t, "config: config file is readable by others", result.Warnings[0])
+	assert.Equal(t, "user alice: source https://example.com/alice: 1 lines discarded", result.Warnings[1])
+	assert.Contains(t, result.Warnings[2], "user alice: duplicate key")
+	assert.Equal(t, "user bob: skipped: user not found in system", result.Warnings[3])
+}
+
+// slowFetcher is a mockFetcher that takes a while and tracks how many
+// fetches run at the same time
+type slowFetcher struct {
+	mockFetcher
+	inFlight, peak atomic.Int32
+}
+
+func (m *slowFetcher) FetchAll(ctx context.Context, sources []config.Source) ([]*keyfetcher.FetchResult, error) {
+	n := m.inFlight.Add(1)
+	defer m.inFlight.Add(-1)
+	for {
+		peak := m.peak.Load()
+		if n <= peak || m.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return m.mockFetcher.FetchAll(ctx, sources)
+}
+
+func TestRun_ParallelUsers(t *testing.T) {
+	names := []string{"alice", "bob", "carol", "dave", "erin"}
+	maxParallel := 2
+	cfg := &config.Config{Policy: config.Policy{MaxParallelUsers: &maxParallel}}
+	keys := make(map[string]string)
+	users := make(map[string]*userinfo.UserInfo)
+	for _, name := range names {
+		url := "https://example.com/" + name
+		cfg.Users = append(cfg.Users, config.User{Username: name, Sources: []config.Source{{URL: url}}})
+		keys[url] = "ssh-ed25519 AAAA " + name + "@host"
+		users[name] = &userinfo.UserInfo{Username: name, SSHDir: "/nonexistent/" + name + "/.ssh", AuthKeysPath: "/nonexistent/" + name + "/.ssh/authorized_keys"}
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fetcher := &slowFetcher{mockFetcher: mockFetcher{keys: keys}}
+	syncer := NewWithOptions(cfg, logger, Options{
+		DryRun:     true,
+		Fetcher:    fetcher,
+		UserLookup: &mockUserLookup{users: users},
+	})
+
+	result := syncer.Run(context.Background())
+	assert.False(t, result.HasErrors)
+	assert.Equal(t, int32(2), fetcher.peak.Load())
+
+	// Results keep config order regardless of completion order
+	require.Len(t, result.Users, len(names))
+	for i, name := range names {
+		assert.Equal(t, name, result.Users[i].Username)
+		assert.Equal(t, 1, result.Users[i].KeysWritten)
+	}
+
+	// Users are synced one at a time by default
+	fetcher.peak.Store(0)
+	cfg.Policy.MaxParallelUsers = nil
+	result = NewWithOptions(cfg, logger, Options{
+		DryRun:     true,
+		Fetcher:    fetcher,
+		UserLookup: &mockUserLookup{users: users},
+	}).Run(context.Background())
+	assert.False(t, result.HasErrors)
+	assert.Equal(t, int32(1), fetcher.peak.Load())
+
+	// A cancelled run starts no further user
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = syncer.Run(ctx)
+	assert.True(t, result.HasErrors)
+	require.Len(t, result.Users, len(names))
+	for _, userResult := range result.Users {
+		require.ErrorIs(t, userResult.Error, context.Canceled)
+		assert.Contains(t, userResult.Error.Error(), "sync not started")
+	}
+}
+
+func TestRun_Err(t *testing.T) {
+	errDiskFull := errors.New("no space left on device")
+	cfg := &config.Config{
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+			{Username: "bob", Sources: []config.Source{{URL: "https://example.com/bob"}}},
+			{Username: "carol", Sources: []config.Source{{URL: "https://example.com/carol"}}},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	users := make(map[string]*userinfo.UserInfo)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		users[name] = &userinfo.UserInfo{Username: name, SSHDir: "/nonexistent/" + name + "/.ssh", AuthKeysPath: "/nonexistent/" + name + "/.ssh/authorized_keys"}
+	}
+	syncer := NewWithOptions(cfg, logger, Options{
+		Fetcher: &mockFetcher{keys: map[string]string{
+			"https://example.com/alice": "ssh-ed25519 AAAA alice@host",
+			"https://example.com/bob":   "ssh-ed25519 BBBB bob@host",
+			"https://example.com/carol": "ssh-ed25519 CCCC carol@host",
+		}},
+		BackupManager: &mockBackupManager{},
+		Writer: &failingWriter{
+			mockWriter: mockWriter{files: make(map[string][]byte)},
+			errs: map[string]error{
+				"/nonexistent/alice/.ssh": errDiskFull,
+				"/nonexistent/carol/.ssh": sshfile.ErrVerifyFailed,
+			},
+		},
+		UserLookup: &mockUserLookup{users: users},
+	})
+
+	result := syncer.Run(context.Background())
+	require.True(t, result.HasErrors)
+
+	err := result.Err()
+	require.Error(t, err)
+	assert.ErrorIs(t, err, errDiskFull)
+	assert.ErrorIs(t, err, sshfile.ErrVerifyFailed)
+	assert.Contains(t, err.Error(), "user alice: failed to write authorized_keys: no space left on device")
+	assert.Contains(t, err.Error(), "user carol: failed to write authorized_keys")
+	assert.NotContains(t, err.Error(), "user bob")
+
+	assert.NoError(t, (&SyncResult{Users: []UserResult{{Username: "bob"}}}).Err())
+}
+
+func TestAudit(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(sshDir, "authorized_keys"), []byte(
+		"# Source: https://example.com/alice\n"+
+			"ssh-ed25519 AAAA alice@host\n"+
+			"# Local (preserved)\n"+
+			"ssh-ed25519 BBBB backdoor@host\n"+
+			"ssh-rsa CCCC legacy@host\n"+
+			"ssh-ed25519 BBBB backdoor@host\n"), 0600))
+
+	cfg := &config.Config{
+		Policy: config.Policy{AllowedKeyTypes: []string{"ssh-ed25519"}},
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	fetcher := &mockFetcher{keys: map[string]string{"https://example.com/alice": "ssh-ed25519 AAAA alice@host"}}
+	writer := &mockWriter{files: make(map[string][]byte)}
+	syncer := NewWithOptions(cfg, logger, Options{
+		Fetcher: fetcher,
+		Writer:  writer,
+		UserLookup: &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"alice": {Username: "alice", HomeDir: tempDir, SSHDir: sshDir, AuthKeysPath: filepath.Join(sshDir, "authorized_keys")},
+			},
+		},
+	})
+
+	result := syncer.Audit(context.Background())
+	require.False(t, result.HasErrors)
+	require.Len(t, result.Users, 1)
+	assert.Equal(t, []UnexpectedKey{
+		{Key: "ssh-ed25519 BBBB backdoor@host", Fingerprint: keyFingerprint("ssh-ed25519 BBBB backdoor@host"), Type: "ssh-ed25519", Comment: "backdoor@host", Kept: true},
+		{Key: "ssh-rsa CCCC legacy@host", Fingerprint: keyFingerprint("ssh-rsa CCCC legacy@host"), Type: "ssh-rsa", Comment: "legacy@host", Kept: false},
+	}, result.Users[0].Unexpected)
+	assert.Empty(t, writer.files)
+
+	// A failing source fails the audit instead of flagging its keys
+	fetcher.err = errors.New("connection refused")
+	result = syncer.Audit(context.Background())
+	require.True(t, result.HasErrors)
+	assert.Empty(t, result.Users[0].Unexpected)
+}
+
+func TestRun_WildcardUsers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host"))
+	}))
+	defer server.Close()
+
+	minUID := 1000
+	cfg := &config.Config{
+		Policy: config.Policy{MinUID: &minUID},
+		Users: []config.User{
+			{
+				Username: "*",
+				Exclude:  []string{"nobody"},
+				Sources:  []config.Source{{URL: server.URL}},
+			},
+			{
+				Username: "alice",
+				Sources:  []config.Source{{URL: server.URL}},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, true)
+	syncer.userLister = &mockUserLister{
+		users: []userinfo.SystemUser{
+			{Username: "root", UID: 0},
+			{Username: "alice", UID: 1000},
+			{Username: "bob", UID: 1001},
+			{Username: "nobody", UID: 65534},
+		},
+	}
+	syncer.userLookup = &mockUserLookup{users: map[string]*userinfo.UserInfo{}}
+
+	result := syncer.Run(context.Background())
+
+	// root is below min_uid, nobody is excluded and alice is explicitly configured
+	require.Len(t, result.Users, 2)
+	assert.Equal(t, "bob", result.Users[0].Username)
+	assert.Equal(t, "alice", result.Users[1].Username)
+	assert.False(t, result.HasErrors)
+}
+
+func TestRun_OnlyUsers(t *testing.T) {
+	cfg := &config.Config{
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+			{Username: "dev-*", Sources: []config.Source{{URL: "https://example.com/dev"}}},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := NewWithOptions(cfg, logger, Options{
+		DryRun: true,
+		Users:  []string{"dev-bob"},
+		UserLister: &mockUserLister{
+			users: []userinfo.SystemUser{{Username: "alice"}, {Username: "dev-bob"}, {Username: "dev-carol"}},
+		},
+		UserLookup: &mockUserLookup{users: map[string]*userinfo.UserInfo{}},
+	})
+
+	result := syncer.Run(context.Background())
+
+	// Only the user given is synced, even when matched by a pattern
+	require.Len(t, result.Users, 1)
+	assert.Equal(t, "dev-bob", result.Users[0].Username)
+
+	usernames, failed := syncer.ConfiguredUsernames()
+	assert.Equal(t, []string{"alice", "dev-bob", "dev-carol"}, usernames)
+	assert.Empty(t, failed)
+
+	// A failing user still fails the run
+	syncer.userLookup = &mockUserLookup{err: errors.New("lookup failed")}
+	result = syncer.Run(context.Background())
+	require.Len(t, result.Users, 1)
+	assert.True(t, result.HasErrors)
+}
+
+func TestResolveUser(t *testing.T) {
+	cfg := &config.Config{
+		Policy: config.Policy{SourceTemplate: "https://github.com/{{.Username}}.keys"},
+		Users: []config.User{
+			{Username: "alice"},
+			{Username: "dev-*", Sources: []config.Source{{URL: "https://example.com/dev"}}},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := NewWithOptions(cfg, logger, Options{SourceTimeout: 3})
+	syncer.userLister = &mockUserLister{
+		users: []userinfo.SystemUser{{Username: "alice"}, {Username: "dev-bob"}},
+	}
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"alice": {Username: "alice", UID: 1000, GID: 1000, HomeDir: "/home/alice", SSHDir: "/home/alice/.ssh"},
+		},
+	}
+
+	resolved, err := syncer.ResolveUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", resolved.Entry)
+	require.Len(t, resolved.Sources, 1)
+	assert.Equal(t, "https://github.com/alice.keys", resolved.Sources[0].URL)
+	assert.Equal(t, 3, resolved.Sources[0].GetTimeoutSeconds())
+	require.NotNil(t, resolved.Info)
+	assert.Equal(t, 1000, resolved.Info.UID)
+	assert.NoError(t, resolved.LookupError)
+
+	// Matched by a pattern, but missing on the system
+	resolved, err = syncer.ResolveUser("dev-bob")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-*", resolved.Entry)
+	assert.Equal(t, "https://example.com/dev", resolved.Sources[0].URL)
+	assert.Nil(t, resolved.Info)
+	assert.ErrorIs(t, resolved.LookupError, userinfo.ErrUserNotFound)
+
+	_, err = syncer.ResolveUser("mallory")
+	assert.ErrorIs(t, err, ErrUserNotConfigured)
+}
+
+func TestResolveUsers(t *testing.T) {
+	cfg := &config.Config{
+		Users: []config.User{
+			{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}},
+			{Username: "dev-*", Sources: []config.Source{{URL: "https://example.com/dev"}}},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := NewWithOptions(cfg, logger, Options{})
+	syncer.userLister = &mockUserLister{
+		users: []userinfo.SystemUser{{Username: "alice"}, {Username: "dev-bob"}},
+	}
+	syncer.userLookup = &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"alice": {Username: "alice", UID: 1000, GID: 1000, HomeDir: "/home/alice", SSHDir: "/home/alice/.ssh"},
+		},
+	}
+
+	resolved, failed, err := syncer.ResolveUsers()
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+	require.Len(t, resolved, 2)
+	assert.Equal(t, "alice", resolved[0].Username)
+	assert.NoError(t, resolved[0].LookupError)
+	assert.Equal(t, "dev-bob", resolved[1].Username)
+	assert.Equal(t, "dev-*", resolved[1].Entry)
+	assert.ErrorIs(t, resolved[1].LookupError, userinfo.ErrUserNotFound)
+
+	// Entries that cannot be expanded are reported as failed
+	syncer.userLister = &mockUserLister{err: errors.New("passwd unavailable")}
+	resolved, failed, err = syncer.ResolveUsers()
+	require.NoError(t, err)
+	require.Len(t, resolved, 1)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "dev-*", failed[0].Username)
+	assert.Error(t, failed[0].Error)
+}
+
+func TestRun_WildcardUsersListError(t *testing.T) {
+	cfg := &config.Config{
+		Users: []config.User{
+			{
+				Username: "*",
+				Sources:  []config.Source{{URL: "http://example.com/keys"}},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, true)
+	syncer.userLister = &mockUserLister{err: errors.New("passwd unavailable")}
+
+	result := syncer.Run(context.Background())
+
+	require.Len(t, result.Users, 1)
+	assert.True(t, result.HasErrors)
+	assert.Equal(t, "*", result.Users[0].Username)
+	assert.ErrorContains(t, result.Users[0].Error, "failed to list system users")
+}
+
+func TestRun_GroupUsers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host"))
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		Users: []config.User{
+			{
+				Group:   "ssh-users",
+				Exclude: []string{"intern-*"},
+				Sources: []config.Source{{URL: server.URL}},
+			},
+			{
+				Username: "alice",
+				Sources:  []config.Source{{URL: server.URL}},
+			},
+			{
+				Group:   "missing",
+				Sources: []config.Source{{URL: server.URL}},
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	syncer := New(cfg, logger, true)
+	syncer.userLister = &mockUserLister{
+		users: []userinfo.SystemUser{
+			{Username: "alice", UID: 1000, GID: 1000},
+			{Username: "bob", UID: 1001, GID: 2000},
+			{Username: "carol", UID: 1002, GID: 1002},
+		},
+	}
+	syncer.groupLister = &mockGroupLister{
+		groups: []userinfo.SystemGroup{
+			{Name: "ssh-users", GID: 2000, Members: []string{"alice", "carol", "intern-joe"}},
+		},
+	}
+	syncer.userLookup = &mockUserLookup{users: map[string]*userinfo.UserInfo{}}
+
+	result := syncer.Run(context.Background())
+
+	// The missing group fails, bob is a primary member, carol a supplementary
+	// one, intern-joe is excluded and alice is explicitly configured
+	require.Len(t, result.Users, 4)
+	assert.Equal(t, "group:missing", result.Users[0].Username)
+	assert.ErrorContains(t, result.Users[0].Error, `group "missing" not found`)
+	assert.Equal(t, "bob", result.Users[1].Username)
+	assert.Equal(t, "carol", result.Users[2].Username)
+	assert.Equal(t, "alice", result.Users[3].Username)
+	assert.True(t, result.HasErrors)
+}
+
+func TestPruneBackups(t *testing.T) {
+	tempDir := t.TempDir()
+	sshDir := filepath.Join(tempDir, ".ssh")
+	backupDir := filepath.Join(sshDir, "authorized_keys_backups")
+	require.NoError(t, os.MkdirAll(backupDir, 0700))
+
+	authKeys := []byte("ssh-ed25519 AAAA user@host\n")
+	require.NoError(t, os.WriteFile(filepath.Join(sshDir, "authorized_keys"), authKeys, 0600))
+	for _, name := range []string{
+		"authorized_keys_20240101_100000_aaaaaa",
+		"authorized_keys_20240102_100000_bbbbbb",
+		"authorized_keys_20240103_100000_cccccc",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(backupDir, name), []byte("old"), 0600))
+	}
+
+	retention := 1
+	cfg := &config.Config{
+		Policy: config.Policy{BackupRetentionCount: &retention},
+		Users: []config.User{
+			{Username: "testuser", Sources: []config.Source{{URL: "http://127.0.0.1:1"}}},
+			{Username: "missing", Sources: []config.Source{{URL: "http://127.0.0.1:1"}}},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	lookup := &mockUserLookup{
+		users: map[string]*userinfo.UserInfo{
+			"testuser": {
+				Username:     "testuser",
+				UID:          os.Getuid(),
+				GID:          os.Getgid(),
+				HomeDir:      tempDir,
+				SSHDir:       sshDir,
+				AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+				BackupDir:    backupDir,
+			},
+		},
+	}
+
+	// Dry run deletes nothing
+	syncer := NewWithOptions(cfg, logger, Options{DryRun: true})
+	syncer.userLookup = lookup
+	result := syncer.PruneBackups()
+	require.Len(t, result.Users, 2)
+	assert.Empty(t, result.Users[0].Deleted)
+	entries, err := os.ReadDir(backupDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	syncer = New(cfg, logger, false)
+	syncer.userLookup = lookup
+	result = syncer.PruneBackups()
+
+	assert.False(t, result.HasErrors)
+	require.Len(t, result.Users, 2)
+	assert.Equal(t, []string{
+		"authorized_keys_20240101_100000_aaaaaa",
+		"authorized_keys_20240102_100000_bbbbbb",
+	}, result.Users[0].Deleted)
+	assert.True(t, result.Users[1].Skipped)
+
+	entries, err = os.ReadDir(backupDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// authorized_keys is never touched
+	content, err := os.ReadFile(filepath.Join(sshDir, "authorized_keys"))
+	require.NoError(t, err)
+	assert.Equal(t, authKeys, content)
+}
+
+func TestLookupUser(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("uid_offset shifts passwd ids", func(t *testing.T) {
+		offset := 100000
+		cfg := &config.Config{Policy: config.Policy{UIDOffset: &offset}}
+		syncer := New(cfg, logger, true)
+		syncer.userLookup = &mockUserLookup{
+			users: map[string]*userinfo.UserInfo{
+				"alice": {Username: "alice", UID: 1000, GID: 1001},
+			},
+		}
+
+		info, err := syncer.lookupUser(config.User{Username: "alice"})
+		require.NoError(t, err)
+		assert.Equal(t, 101000, info.UID)
+		assert.Equal(t, 101001, info.GID)
+	})
+
+	t.Run("explicit ids bypass passwd", func(t *testing.T) {
+		homeDir := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(homeDir, ".ssh"), 0700))
+
+		offset := 100000
+		cfg := &config.Config{Policy: config.Policy{UIDOffset: &offset}}
+		syncer := New(cfg, logger, true)
+		syncer.userLookup = &mockUserLookup{users: map[string]*userinfo.UserInfo{}}
+
+		uid, gid := 2000, 2001
+		info, err := syncer.lookupUser(config.User{Username: "alice", UID: &uid, GID: &gid, HomeDir: homeDir})
+		require.NoError(t, err)
+		assert.Equal(t, 2000, info.UID)
+		assert.Equal(t, 2001, info.GID)
+		assert.Equal(t, filepath.Join(homeDir, ".ssh", "authorized_keys"), info.AuthKeysPath)
+	})
+}
+
+func TestNewFetcher_RootCAs(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ssh-ed25519 AAAA key@host"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0644))
+
+	configPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf(`
+policy:
+  ca_file: %q
+users:
+  - username: "alice"
+    sources:
+      - url: %q
+`, caFile, server.URL)), 0600))
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	source := config.Source{URL: server.URL}
+
+	// The test server's certificate is not trusted by the system pool
+	result := NewFetcher(&config.Config{}, logger).Fetch(context.Background(), source)
+	require.Error(t, result.Error)
+
+	cfg, err := config.Load(configPath)
+	require.NoError(t, err)
+	result = NewFetcher(cfg, logger).Fetch(context.Background(), source)
+	require.NoError(t, result.Error)
+	assert.Len(t, result.Keys, 1)
+}
+
+func TestRun_SharedHome(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, "ssh-ed25519 AAAA %s@host", strings.TrimPrefix(r.URL.Path, "/"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		mode   string
+		assert func(t *testing.T, result *SyncResult, content string)
+	}{
+		{
+			name: "error by default",
+			mode: "",
+			assert: func(t *testing.T, result *SyncResult, content string) {
+				assert.True(t, result.HasErrors)
+				assert.ErrorIs(t, result.Users[0].Error, ErrSharedHome)
+				assert.ErrorIs(t, result.Users[1].Error, ErrSharedHome)
+				assert.NoError(t, result.Users[2].Error)
+				assert.Empty(t, content)
+			},
+		},
+		{
+			name: "first",
+			mode: config.SharedHomeFirst,
+			assert: func(t *testing.T, result *SyncResult, content string) {
+				assert.False(t, result.HasErrors)
+				assert.False(t, result.Users[0].Skipped)
+				assert.True(t, result.Users[1].Skipped)
+				assert.Equal(t, "shares .ssh directory with alice", result.Users[1].SkipReason)
+				assert.Contains(t, content, "alice@host")
+				assert.NotContains(t, content, "bob@host")
+			},
+		},
+		{
+			name: "merge",
+			mode: config.SharedHomeMerge,
+			assert: func(t *testing.T, result *SyncResult, content string) {
+				assert.False(t, result.HasErrors)
+				assert.Equal(t, 2, result.Users[0].KeysWritten)
+				assert.True(t, result.Users[1].Skipped)
+				assert.Contains(t, content, "alice@host")
+				assert.Contains(t, content, "bob@host")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sharedHome := t.TempDir()
+			sharedSSH := filepath.Join(sharedHome, ".ssh")
+			require.NoError(t, os.Mkdir(sharedSSH, 0700))
+			carolHome := t.TempDir()
+			carolSSH := filepath.Join(carolHome, ".ssh")
+			require.NoError(t, os.Mkdir(carolSSH, 0700))
+
+			cfg := &config.Config{
+				Policy: config.Policy{OnSharedHome: tt.mode},
+				Users: []config.User{
+					{Username: "alice", Sources: []config.Source{{URL: server.URL + "/alice"}}},
+					{Username: "bob", Sources: []config.Source{{URL: server.URL + "/bob"}}},
+					{Username: "carol", Sources: []config.Source{{URL: server.URL + "/carol"}}},
+				},
+			}
+
+			userInfo := func(username, home, sshDir string) *userinfo.UserInfo {
+				return &userinfo.UserInfo{
+					Username:     username,
+					UID:          os.Getuid(),
+					GID:          os.Getgid(),
+					HomeDir:      home,
+					SSHDir:       sshDir,
+					AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+					BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+				}
 			}
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			syncer := New(cfg, logger, false)
+			syncer.userLookup = &mockUserLookup{
+				users: map[string]*userinfo.UserInfo{
+					"alice": userInfo("alice", sharedHome, sharedSSH),
+					"bob":   userInfo("bob", sharedHome, sharedSSH),
+					"carol": userInfo("carol", carolHome, carolSSH),
+				},
+			}
+
+			result := syncer.Run(context.Background())
+			require.Len(t, result.Users, 3)
+			assert.Equal(t, []string{"alice", "bob", "carol"}, []string{
+				result.Users[0].Username, result.Users[1].Username, result.Users[2].Username,
+			})
+
+			content, _ := os.ReadFile(filepath.Join(sharedSSH, "authorized_keys"))
+			tt.assert(t, result, string(content))
+		})
+	}
+}
+
+func TestRun_Hooks(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "hooks.log")
+	t.Setenv("HOOK_LOG", logFile)
+
+	newSyncer := func(policy config.Policy, dryRun bool) *Syncer {
+		cfg := &config.Config{
+			Policy: policy,
+			Users: []config.User{
+				{Username: "alice", Sources: []config.Source{{URL: "https://example.com/alice"}}, OnChangeHook: `echo "change $AUTHKEYSYNC_USERNAME" >> "$HOOK_LOG"`},
+				{Username: "bob", Sources: []config.Source{{URL: "https://example.com/bob"}}},
+			},
+		}
+		return NewWithOptions(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), Options{
+			DryRun: dryRun,
+			Fetcher: &mockFetcher{keys: map[string]string{
+				"https://example.com/alice": "ssh-ed25519 AAAA alice@host",
+			}},
+			BackupManager: &mockBackupManager{},
+			Writer:        &mockWriter{files: make(map[string][]byte)},
+			UserLookup: &mockUserLookup{users: map[string]*userinfo.UserInfo{
+				"alice": {Username: "alice", SSHDir: "/nonexistent/alice/.ssh", AuthKeysPath: "/nonexistent/alice/.ssh/authorized_keys"},
+			}},
+		})
+	}
+	readLog := func() string {
+		content, err := os.ReadFile(logFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return ""
+		}
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(logFile))
+		return string(content)
+	}
+
+	t.Run("hooks run around each user", func(t *testing.T) {
+		result := newSyncer(config.Policy{
+			PreSyncHook:  `echo "pre $AUTHKEYSYNC_USERNAME" >> "$HOOK_LOG"`,
+			PostSyncHook: `echo "post $AUTHKEYSYNC_USERNAME $AUTHKEYSYNC_STATUS $AUTHKEYSYNC_CHANGED $AUTHKEYSYNC_KEYS_WRITTEN $AUTHKEYSYNC_AUTHORIZED_KEYS" >> "$HOOK_LOG"`,
+		}, false).Run(context.Background())
+
+		require.NoError(t, result.Err())
+		assert.Equal(t, "pre alice\npost alice ok true 1 /nonexistent/alice/.ssh/authorized_keys\nchange alice\npre bob\n", readLog())
+	})
+
+	t.Run("failing hook is a warning", func(t *testing.T) {
+		result := newSyncer(config.Policy{PostSyncHook: "echo broken >&2; exit 3"}, false).Run(context.Background())
+
+		require.NoError(t, result.Err())
+		assert.Contains(t, result.Users[0].Warnings, "post_sync_hook failed: exit status 3")
+		assert.True(t, result.Users[0].Changed)
+		readLog()
+	})
+
+	t.Run("failing hook fails the user with hook_fails_user", func(t *testing.T) {
+		failsUser := true
+		result := newSyncer(config.Policy{PreSyncHook: "exit 1", HookFailsUser: &failsUser}, false).Run(context.Background())
+
+		require.Error(t, result.Users[0].Error)
+		assert.Contains(t, result.Users[0].Error.Error(), "pre_sync_hook failed: exit status 1")
+		assert.False(t, result.Users[0].Changed)
+		assert.Empty(t, readLog())
+	})
+
+	t.Run("hooks time out", func(t *testing.T) {
+		timeout := 1
+		start := time.Now()
+		result := newSyncer(config.Policy{PreSyncHook: "sleep 10", HookTimeoutSeconds: &timeout}, false).Run(context.Background())
+
+		assert.Contains(t, result.Users[0].Warnings[0], "context deadline exceeded")
+		assert.Less(t, time.Since(start), 5*time.Second)
+		readLog()
+	})
+
+	t.Run("no hooks in dry-run mode", func(t *testing.T) {
+		result := newSyncer(config.Policy{PreSyncHook: `echo pre >> "$HOOK_LOG"`}, true).Run(context.Background())
+
+		require.NoError(t, result.Err())
+		assert.Empty(t, readLog())
+	})
+}
+
+func TestRun_SSHDConfigAuthorizedKeysFile(t *testing.T) {
+	tempDir := t.TempDir()
+	homeDir := filepath.Join(tempDir, "home")
+	require.NoError(t, os.Mkdir(homeDir, 0755))
+	keysDir := filepath.Join(tempDir, "keys")
+	sshdConfig := filepath.Join(tempDir, "sshd_config")
+	require.NoError(t, os.WriteFile(sshdConfig, []byte("AuthorizedKeysFile "+keysDir+"/%u .ssh/authorized_keys\n"), 0644))
+
+	newSyncer := func(sshdConfig string) *Syncer {
+		uid, gid := os.Getuid(), os.Getgid()
+		cfg := &config.Config{
+			Policy: config.Policy{SSHDConfig: sshdConfig},
+			Users: []config.User{
+				{Username: "alice", UID: &uid, GID: &gid, HomeDir: homeDir, Sources: []config.Source{{URL: "https://example.com/alice"}}},
+			},
+		}
+		return NewWithOptions(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), Options{
+			Fetcher: &mockFetcher{keys: map[string]string{
+				"https://example.com/alice": "ssh-ed25519 AAAA alice@host",
+			}},
 		})
 	}
+
+	t.Run("keys are written to the AuthorizedKeysFile of sshd_config", func(t *testing.T) {
+		result := newSyncer(sshdConfig).Run(context.Background())
+
+		// .ssh is missing, but the file lives elsewhere
+		require.NoError(t, result.Err())
+		require.Len(t, result.Users, 1)
+		assert.False(t, result.Users[0].Skipped)
+		content, err := os.ReadFile(filepath.Join(keysDir, "alice"))
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "ssh-ed25519 AAAA alice@host")
+		assert.FileExists(t, filepath.Join(keysDir, ".alice.lock"))
+		assert.NoDirExists(t, filepath.Join(homeDir, ".ssh"))
+	})
+
+	t.Run("falls back to .ssh/authorized_keys", func(t *testing.T) {
+		result := newSyncer(filepath.Join(tempDir, "missing_sshd_config")).Run(context.Background())
+
+		require.Len(t, result.Users, 1)
+		assert.Equal(t, ".ssh directory not found", result.Users[0].SkipReason)
+	})
 }
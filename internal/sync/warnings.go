@@ -0,0 +1,25 @@
+package sync
+
+import "fmt"
+
+// warningRecorder collects the non-fatal problems of a user sync, which are
+// logged as warnings as they happen. A nil recorder discards all warnings.
+type warningRecorder struct {
+	warnings []string
+}
+
+// record adds a warning, formatted like fmt.Sprintf
+func (r *warningRecorder) record(format string, args ...any) {
+	if r == nil {
+		return
+	}
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+// list returns the recorded warnings in the order they were recorded
+func (r *warningRecorder) list() []string {
+	if r == nil {
+		return nil
+	}
+	return r.warnings
+}
@@ -0,0 +1,68 @@
+// Package systemd implements the sd_notify protocol for services managed by systemd.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// StateReady tells systemd that the service finished starting up
+	StateReady = "READY=1"
+	// StateReloading tells systemd that the service is reloading its
+	// configuration; it must send StateReady when done
+	StateReloading = "RELOADING=1"
+	// StateStopping tells systemd that the service is shutting down
+	StateStopping = "STOPPING=1"
+	// StateWatchdog resets the service watchdog timer
+	StateWatchdog = "WATCHDOG=1"
+)
+
+// Status returns a STATUS= state with a free-form status message
+func Status(message string) string {
+	return "STATUS=" + message
+}
+
+// Notify sends a state to the socket in NOTIFY_SOCKET.
+// Returns false without an error if the process is not running under
+// systemd with notification support.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// A leading @ denotes a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often the service must send StateWatchdog:
+// half of the WATCHDOG_USEC timeout, as systemd recommends. Returns false if
+// the watchdog is not enabled for this process.
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
@@ -0,0 +1,57 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	sent, err := Notify(Status("Synced 39/40 users (1 failed)"))
+	require.NoError(t, err)
+	assert.True(t, sent)
+
+	buf := make([]byte, 256)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "STATUS=Synced 39/40 users (1 failed)", string(buf[:n]))
+}
+
+func TestNotify_NoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	sent, err := Notify(StateReady)
+	require.NoError(t, err)
+	assert.False(t, sent)
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	_, ok := WatchdogInterval()
+	assert.False(t, ok)
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	interval, ok := WatchdogInterval()
+	require.True(t, ok)
+	assert.Equal(t, 15*time.Second, interval)
+
+	// The watchdog is meant for another process
+	t.Setenv("WATCHDOG_PID", "1")
+	_, ok = WatchdogInterval()
+	assert.False(t, ok)
+}
@@ -0,0 +1,52 @@
+// Package tracing configures OpenTelemetry tracing for synchronization runs.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"github.com/eduardolat/authkeysync/internal/version"
+)
+
+// ServiceName is the default service name reported in traces
+const ServiceName = "authkeysync"
+
+// Setup installs a global tracer provider exporting spans via OTLP/HTTP.
+// The exporter is configured through the standard OTEL_* environment
+// variables (e.g. OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_SERVICE_NAME).
+//
+// Until Setup is called the global no-op provider is used, so instrumented
+// code has no tracing overhead when tracing is disabled.
+// The returned function flushes pending spans and must be called before exit.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", ServiceName),
+			attribute.String("service.version", version.Version),
+		),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,28 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestSetup(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://127.0.0.1:1")
+
+	shutdown, err := Setup(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, shutdown)
+
+	_, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	assert.True(t, ok)
+
+	// No spans were recorded, so shutdown must not try to export anything
+	assert.NoError(t, shutdown(context.Background()))
+}
@@ -0,0 +1,245 @@
+package userinfo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultSSHDConfigPath is the usual path of the sshd configuration
+const DefaultSSHDConfigPath = "/etc/ssh/sshd_config"
+
+// maxIncludeDepth bounds nested Include directives, so that a config
+// including itself cannot recurse forever
+const maxIncludeDepth = 16
+
+// ErrNoAuthorizedKeysFile indicates that an sshd configuration does not set
+// AuthorizedKeysFile, or sets it to none
+var ErrNoAuthorizedKeysFile = errors.New("sshd_config does not set AuthorizedKeysFile")
+
+// ReadAuthorizedKeysFile returns the first file listed by the
+// AuthorizedKeysFile directive of an sshd configuration, with its %-tokens
+// unexpanded (see ExpandAuthorizedKeysFile). Like sshd, the first value set
+// outside of a Match block wins, and Include directives are followed, with
+// relative paths resolved against the directory of path. Returns
+// ErrNoAuthorizedKeysFile if the directive is not set.
+func ReadAuthorizedKeysFile(path string) (string, error) {
+	file, err := readAuthorizedKeysFile(path, filepath.Dir(path), 0)
+	if err != nil {
+		return "", err
+	}
+	if file == "" {
+		return "", ErrNoAuthorizedKeysFile
+	}
+	if file == "none" {
+		return "", fmt.Errorf("%w: it is none", ErrNoAuthorizedKeysFile)
+	}
+	return file, nil
+}
+
+// readAuthorizedKeysFile reads the AuthorizedKeysFile of one configuration
+// file, returning "" if it is not set there
+func readAuthorizedKeysFile(path, baseDir string, depth int) (string, error) {
+	if depth > maxIncludeDepth {
+		return "", fmt.Errorf("too many nested Include directives in %s", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open sshd config: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		keyword, args, err := parseSSHDLine(scanner.Text())
+		if err != nil {
+			return "", fmt.Errorf("%s line %d: %w", path, lineNumber, err)
+		}
+
+		switch strings.ToLower(keyword) {
+		case "match":
+			// Everything after a Match line only applies to some
+			// connections, up to the end of the file
+			return "", nil
+		case "authorizedkeysfile":
+			if len(args) == 0 {
+				return "", fmt.Errorf("%s line %d: AuthorizedKeysFile without a value", path, lineNumber)
+			}
+			return args[0], nil
+		case "include":
+			for _, pattern := range args {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(baseDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return "", fmt.Errorf("%s line %d: invalid Include pattern %q: %w", path, lineNumber, pattern, err)
+				}
+				for _, match := range matches {
+					file, err := readAuthorizedKeysFile(match, baseDir, depth+1)
+					if err != nil || file != "" {
+						return file, err
+					}
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read sshd config: %w", err)
+	}
+	return "", nil
+}
+
+// parseSSHDLine splits an sshd_config line into its keyword and arguments.
+// The keyword may be followed by whitespace or "=", and arguments may be
+// double-quoted. Comments and empty lines have no keyword.
+func parseSSHDLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return line, nil, nil
+	}
+	keyword := line[:end]
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			return keyword, args, nil
+		}
+		if rest[0] == '"' {
+			closing := strings.IndexByte(rest[1:], '"')
+			if closing < 0 {
+				return "", nil, errors.New("unterminated quote")
+			}
+			args = append(args, rest[1:closing+1])
+			rest = rest[closing+2:]
+			continue
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = rest[end:]
+	}
+}
+
+// ExpandAuthorizedKeysFile expands the %% (a literal %), %h (home
+// directory), %u (username) and %U (uid) tokens of an AuthorizedKeysFile
+// value for a user. A relative result is relative to the home directory, as
+// for sshd.
+func ExpandAuthorizedKeysFile(pattern string, info *UserInfo) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		if i+1 == len(pattern) {
+			return "", fmt.Errorf("AuthorizedKeysFile %q ends with %%", pattern)
+		}
+		i++
+		switch pattern[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'h':
+			b.WriteString(info.HomeDir)
+		case 'u':
+			b.WriteString(info.Username)
+		case 'U':
+			b.WriteString(strconv.Itoa(info.UID))
+		default:
+			return "", fmt.Errorf("AuthorizedKeysFile %q has unsupported token %%%c", pattern, pattern[i])
+		}
+	}
+
+	path := b.String()
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(info.HomeDir, path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// SetAuthKeysPath points a user at another authorized_keys file, such as the
+// AuthorizedKeysFile of sshd_config. Backups are kept next to it.
+func (u *UserInfo) SetAuthKeysPath(path string) {
+	u.AuthKeysPath = path
+	u.BackupDir = path + "_backups"
+}
+
+// InSSHDir reports whether the authorized_keys file of the user is inside
+// its .ssh directory
+func (u *UserInfo) InSSHDir() bool {
+	return isWithin(u.SSHDir, u.AuthKeysPath)
+}
+
+// BackupDirInHome reports whether the backup directory of the user is inside
+// its home directory, where the user can replace any of its parents. A home
+// directory of "/" does not count, since the user does not own it.
+func (u *UserInfo) BackupDirInHome() bool {
+	return filepath.Clean(u.HomeDir) != "/" && isWithin(u.HomeDir, u.BackupDir)
+}
+
+// CreateKeysDir creates the missing directories leading to the
+// authorized_keys file of a user and returns them. Directories inside the
+// home directory are owned by the user with mode 0700, like .ssh; others are
+// left to the user running AuthKeySync with mode 0755, since sshd refuses
+// key files below directories writable by others. The home directory itself
+// is never created.
+func CreateKeysDir(info *UserInfo) ([]string, error) {
+	var missing []string
+	for dir := info.KeysDir(); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to stat %s: %w", dir, err)
+		}
+		if dir == info.HomeDir || dir == filepath.Dir(dir) {
+			return nil, fmt.Errorf("%w: %s", ErrHomeDirNotFound, info.HomeDir)
+		}
+		missing = append(missing, dir)
+	}
+
+	created := make([]string, 0, len(missing))
+	for i := len(missing) - 1; i >= 0; i-- {
+		dir := missing[i]
+		inHome := isWithin(info.HomeDir, dir)
+		mode := os.FileMode(0755)
+		if inHome {
+			mode = SSHDirMode
+		}
+
+		if err := os.Mkdir(dir, mode); err != nil {
+			return created, fmt.Errorf("failed to create directory: %w", err)
+		}
+		created = append(created, dir)
+		// Mkdir is subject to the umask
+		if err := os.Chmod(dir, mode); err != nil {
+			return created, fmt.Errorf("failed to set directory permissions: %w", err)
+		}
+		if inHome {
+			if err := os.Chown(dir, info.UID, info.GID); err != nil {
+				return created, fmt.Errorf("failed to set directory ownership: %w", err)
+			}
+		}
+	}
+	return created, nil
+}
+
+// isWithin reports whether path is dir or below it
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
@@ -0,0 +1,192 @@
+package userinfo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAuthorizedKeysFile(t *testing.T) {
+	writeConfig := func(t *testing.T, dir, name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "first file of the directive",
+			content: "Port 22\nAuthorizedKeysFile .ssh/authorized_keys2 .ssh/authorized_keys\n",
+			want:    ".ssh/authorized_keys2",
+		},
+		{
+			name:    "case-insensitive keyword with equals sign",
+			content: "authorizedkeysfile=/etc/ssh/keys/%u\n",
+			want:    "/etc/ssh/keys/%u",
+		},
+		{
+			name:    "quoted value and trailing comment",
+			content: "AuthorizedKeysFile \"/srv/ssh keys/%u\" # per user\n",
+			want:    "/srv/ssh keys/%u",
+		},
+		{
+			name:    "first value wins",
+			content: "AuthorizedKeysFile /first/%u\nAuthorizedKeysFile /second/%u\n",
+			want:    "/first/%u",
+		},
+		{
+			name:    "Match blocks are ignored",
+			content: "Match User git\n  AuthorizedKeysFile /git/keys\n",
+			wantErr: ErrNoAuthorizedKeysFile,
+		},
+		{
+			name:    "commented out",
+			content: "#AuthorizedKeysFile .ssh/authorized_keys .ssh/authorized_keys2\n",
+			wantErr: ErrNoAuthorizedKeysFile,
+		},
+		{
+			name:    "none",
+			content: "AuthorizedKeysFile none\n",
+			wantErr: ErrNoAuthorizedKeysFile,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, t.TempDir(), "sshd_config", tt.content)
+
+			got, err := ReadAuthorizedKeysFile(path)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("follows Include relative to the config directory", func(t *testing.T) {
+		dir := t.TempDir()
+		writeConfig(t, dir, "sshd_config.d/10-other.conf", "PasswordAuthentication no\n")
+		writeConfig(t, dir, "sshd_config.d/50-keys.conf", "AuthorizedKeysFile /etc/ssh/keys/%u\n")
+		path := writeConfig(t, dir, "sshd_config", "Include sshd_config.d/*.conf\nAuthorizedKeysFile .ssh/authorized_keys\n")
+
+		got, err := ReadAuthorizedKeysFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "/etc/ssh/keys/%u", got)
+	})
+
+	t.Run("include loop", func(t *testing.T) {
+		dir := t.TempDir()
+		path := writeConfig(t, dir, "sshd_config", "Include sshd_config\n")
+
+		_, err := ReadAuthorizedKeysFile(path)
+		assert.ErrorContains(t, err, "too many nested Include directives")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := ReadAuthorizedKeysFile(filepath.Join(t.TempDir(), "sshd_config"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestExpandAuthorizedKeysFile(t *testing.T) {
+	info := &UserInfo{Username: "alice", UID: 1000, HomeDir: "/home/alice"}
+
+	tests := []struct {
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{pattern: ".ssh/authorized_keys", want: "/home/alice/.ssh/authorized_keys"},
+		{pattern: "%h/.ssh/authorized_keys2", want: "/home/alice/.ssh/authorized_keys2"},
+		{pattern: "/etc/ssh/keys/%u", want: "/etc/ssh/keys/alice"},
+		{pattern: "/var/keys/%U/100%%", want: "/var/keys/1000/100%"},
+		{pattern: "/etc/ssh/keys/%i", wantErr: true},
+		{pattern: "/etc/ssh/keys/%", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, err := ExpandAuthorizedKeysFile(tt.pattern, info)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBackupDirInHome(t *testing.T) {
+	tests := []struct {
+		homeDir   string
+		backupDir string
+		want      bool
+	}{
+		{homeDir: "/home/alice", backupDir: "/home/alice/.ssh/authorized_keys_backups", want: true},
+		{homeDir: "/home/alice", backupDir: "/home/alice", want: true},
+		{homeDir: "/home/alice", backupDir: "/home/alice2/backups", want: false},
+		{homeDir: "/home/alice", backupDir: "/var/backups/authkeysync/alice", want: false},
+		{homeDir: "/", backupDir: "/var/backups/authkeysync/nobody", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.backupDir, func(t *testing.T) {
+			info := &UserInfo{HomeDir: tt.homeDir, BackupDir: tt.backupDir}
+			assert.Equal(t, tt.want, info.BackupDirInHome())
+		})
+	}
+}
+
+func TestCreateKeysDir(t *testing.T) {
+	t.Run("creates directories in the home directory", func(t *testing.T) {
+		homeDir := t.TempDir()
+		info := &UserInfo{UID: os.Getuid(), GID: os.Getgid(), HomeDir: homeDir, SSHDir: filepath.Join(homeDir, ".ssh")}
+		info.SetAuthKeysPath(filepath.Join(homeDir, ".config", "ssh", "authorized_keys"))
+		assert.False(t, info.InSSHDir())
+		assert.Equal(t, info.AuthKeysPath+"_backups", info.BackupDir)
+
+		created, err := CreateKeysDir(info)
+		require.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(homeDir, ".config"), filepath.Join(homeDir, ".config", "ssh")}, created)
+		for _, dir := range created {
+			stat, err := os.Stat(dir)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(SSHDirMode), stat.Mode().Perm())
+		}
+	})
+
+	t.Run("directories outside the home directory are not private", func(t *testing.T) {
+		keysDir := filepath.Join(t.TempDir(), "keys")
+		info := &UserInfo{HomeDir: t.TempDir()}
+		info.SetAuthKeysPath(filepath.Join(keysDir, "alice"))
+
+		_, err := CreateKeysDir(info)
+		require.NoError(t, err)
+		stat, err := os.Stat(keysDir)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+	})
+
+	t.Run("never creates the home directory", func(t *testing.T) {
+		homeDir := filepath.Join(t.TempDir(), "unmounted")
+		info := &UserInfo{HomeDir: homeDir}
+		info.SetAuthKeysPath(filepath.Join(homeDir, ".config", "ssh", "authorized_keys"))
+
+		_, err := CreateKeysDir(info)
+		require.ErrorIs(t, err, ErrHomeDirNotFound)
+		assert.NoDirExists(t, homeDir)
+	})
+}
@@ -2,23 +2,42 @@
 package userinfo
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 )
 
+// PasswdPath is the path of the system user database used for enumeration
+const PasswdPath = "/etc/passwd"
+
+// GroupPath is the path of the system group database used for enumeration
+const GroupPath = "/etc/group"
+
+// SSHDirMode is the permission mode of .ssh directories created by CreateSSHDir
+const SSHDirMode = 0700
+
 var (
 	// ErrUserNotFound indicates the user does not exist in the system
 	ErrUserNotFound = errors.New("user not found")
 	// ErrNoHomeDir indicates the user has no home directory
 	ErrNoHomeDir = errors.New("user has no home directory")
+	// ErrHomeDirNotFound indicates the user's home directory does not exist,
+	// e.g. because it lives on an unmounted network filesystem
+	ErrHomeDirNotFound = errors.New("home directory not found")
 	// ErrSSHDirNotFound indicates the .ssh directory does not exist
 	ErrSSHDirNotFound = errors.New(".ssh directory not found")
 	// ErrSSHDirNotDir indicates .ssh exists but is not a directory
 	ErrSSHDirNotDir = errors.New(".ssh exists but is not a directory")
+	// ErrSSHDirWrongOwner indicates .ssh is owned by someone other than the
+	// user, so sshd may ignore the keys written into it
+	ErrSSHDirWrongOwner = errors.New(".ssh directory is not owned by the user")
 )
 
 // UserInfo contains information about a system user
@@ -32,10 +51,18 @@ type UserInfo struct {
 	BackupDir    string
 }
 
+// KeysDir returns the directory of the authorized_keys file, which is SSHDir
+// unless sshd reads authorized_keys from elsewhere
+func (u *UserInfo) KeysDir() string {
+	return filepath.Dir(u.AuthKeysPath)
+}
+
 // Lookup looks up a user by username and returns their information.
 // Returns ErrUserNotFound if the user doesn't exist.
 // Returns ErrNoHomeDir if the user has no home directory.
-// Returns ErrSSHDirNotFound if the .ssh directory doesn't exist.
+// Returns ErrHomeDirNotFound if the home directory doesn't exist.
+// Returns ErrSSHDirNotFound, along with the user info, if the .ssh directory
+// doesn't exist, so that callers may create it (see CreateSSHDir).
 // Returns ErrSSHDirNotDir if .ssh exists but is not a directory.
 func Lookup(username string) (*UserInfo, error) {
 	u, err := user.Lookup(username)
@@ -61,11 +88,42 @@ func Lookup(username string) (*UserInfo, error) {
 		return nil, fmt.Errorf("%w: %s", ErrNoHomeDir, username)
 	}
 
-	sshDir := filepath.Join(u.HomeDir, ".ssh")
+	return resolveDirs(username, uid, gid, u.HomeDir)
+}
+
+// Resolve builds the UserInfo of a user from explicit ids and home directory,
+// without consulting the system user database. It reports missing or invalid
+// directories with the same errors as Lookup.
+func Resolve(username string, uid, gid int, homeDir string) (*UserInfo, error) {
+	return resolveDirs(username, uid, gid, homeDir)
+}
+
+// resolveDirs checks the home and .ssh directories of a user and builds its UserInfo
+func resolveDirs(username string, uid, gid int, homeDir string) (*UserInfo, error) {
+	// A missing home is reported separately from a missing .ssh, so that an
+	// unmounted home is never mistaken for a user without SSH setup
+	if _, err := os.Stat(homeDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrHomeDirNotFound, homeDir)
+		}
+		return nil, fmt.Errorf("failed to stat home directory for user %s: %w", username, err)
+	}
+
+	sshDir := filepath.Join(homeDir, ".ssh")
+	info := &UserInfo{
+		Username:     username,
+		UID:          uid,
+		GID:          gid,
+		HomeDir:      homeDir,
+		SSHDir:       sshDir,
+		AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
+		BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
+	}
+
 	stat, err := os.Stat(sshDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("%w: %s", ErrSSHDirNotFound, sshDir)
+			return info, fmt.Errorf("%w: %s", ErrSSHDirNotFound, sshDir)
 		}
 		return nil, fmt.Errorf("failed to stat .ssh directory for user %s: %w", username, err)
 	}
@@ -74,15 +132,206 @@ func Lookup(username string) (*UserInfo, error) {
 		return nil, fmt.Errorf("%w: %s", ErrSSHDirNotDir, sshDir)
 	}
 
-	return &UserInfo{
-		Username:     username,
-		UID:          uid,
-		GID:          gid,
-		HomeDir:      u.HomeDir,
-		SSHDir:       sshDir,
-		AuthKeysPath: filepath.Join(sshDir, "authorized_keys"),
-		BackupDir:    filepath.Join(sshDir, "authorized_keys_backups"),
-	}, nil
+	return info, nil
+}
+
+// CreateSSHDir creates the .ssh directory of a user with mode 0700, owned by
+// the user. The home directory is never created: if it is missing, for
+// example because it is not mounted yet, CreateSSHDir fails.
+func CreateSSHDir(info *UserInfo) error {
+	if err := os.Mkdir(info.SSHDir, SSHDirMode); err != nil {
+		return fmt.Errorf("failed to create .ssh directory: %w", err)
+	}
+
+	// Mkdir is subject to the umask and creates the directory as root
+	if err := os.Chmod(info.SSHDir, SSHDirMode); err != nil {
+		_ = os.Remove(info.SSHDir)
+		return fmt.Errorf("failed to set .ssh directory permissions: %w", err)
+	}
+	if err := os.Chown(info.SSHDir, info.UID, info.GID); err != nil {
+		_ = os.Remove(info.SSHDir)
+		return fmt.Errorf("failed to set .ssh directory ownership: %w", err)
+	}
+	return nil
+}
+
+// CheckSSHDirOwner returns an error wrapping ErrSSHDirWrongOwner if the .ssh
+// directory of a user is not owned by its uid, or by root when allowRoot is
+// set. A missing .ssh directory is not an error.
+func CheckSSHDirOwner(info *UserInfo, allowRoot bool) error {
+	stat, err := os.Stat(info.SSHDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat .ssh directory: %w", err)
+	}
+
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	owner := int(sys.Uid)
+	if owner == info.UID || (allowRoot && owner == 0) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is owned by uid %d, expected %d", ErrSSHDirWrongOwner, info.SSHDir, owner, info.UID)
+}
+
+// SystemUser is an entry of the system user database
+type SystemUser struct {
+	Username string
+	UID      int
+	GID      int
+	HomeDir  string
+}
+
+// ListUsers returns all users defined in the system user database.
+// Only the local passwd file is read, users provided by other name services
+// (LDAP, NIS, Directory Services) are not enumerated.
+func ListUsers() ([]SystemUser, error) {
+	f, err := os.Open(PasswdPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", PasswdPath, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	return ParsePasswd(f)
+}
+
+// ParsePasswd parses passwd(5) formatted content.
+// Comments, empty lines and malformed entries are ignored.
+func ParsePasswd(r io.Reader) ([]SystemUser, error) {
+	users := make([]SystemUser, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 || fields[0] == "" {
+			continue
+		}
+
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+
+		users = append(users, SystemUser{
+			Username: fields[0],
+			UID:      uid,
+			GID:      gid,
+			HomeDir:  fields[5],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read user database: %w", err)
+	}
+
+	return users, nil
+}
+
+// SystemGroup is an entry of the system group database
+type SystemGroup struct {
+	Name string
+	GID  int
+	// Members are the supplementary members listed in the group entry
+	Members []string
+}
+
+// ListGroups returns all groups defined in the system group database.
+// Only the local group file is read, like ListUsers.
+func ListGroups() ([]SystemGroup, error) {
+	f, err := os.Open(GroupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", GroupPath, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	return ParseGroup(f)
+}
+
+// ParseGroup parses group(5) formatted content.
+// Comments, empty lines and malformed entries are ignored.
+func ParseGroup(r io.Reader) ([]SystemGroup, error) {
+	groups := make([]SystemGroup, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// name:password:gid:member1,member2
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 || fields[0] == "" {
+			continue
+		}
+
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+
+		members := make([]string, 0)
+		for _, member := range strings.Split(fields[3], ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				members = append(members, member)
+			}
+		}
+
+		groups = append(groups, SystemGroup{
+			Name:    fields[0],
+			GID:     gid,
+			Members: members,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read group database: %w", err)
+	}
+
+	return groups, nil
+}
+
+// GroupMembers returns the usernames belonging to a group: users whose
+// primary group it is, followed by its supplementary members, without
+// duplicates. Supplementary members are kept even if they are not in users,
+// since they may come from another name service.
+func GroupMembers(group SystemGroup, users []SystemUser) []string {
+	supplementary := make(map[string]bool, len(group.Members))
+	for _, member := range group.Members {
+		supplementary[member] = true
+	}
+
+	seen := make(map[string]bool)
+	members := make([]string, 0)
+	for _, u := range users {
+		if (u.GID == group.GID || supplementary[u.Username]) && !seen[u.Username] {
+			seen[u.Username] = true
+			members = append(members, u.Username)
+		}
+	}
+	for _, member := range group.Members {
+		if !seen[member] {
+			seen[member] = true
+			members = append(members, member)
+		}
+	}
+
+	return members
 }
 
 // LookupProvider is an interface for looking up user information.
@@ -91,6 +340,18 @@ type LookupProvider interface {
 	Lookup(username string) (*UserInfo, error)
 }
 
+// ListProvider is an interface for enumerating system users.
+// This allows for dependency injection and easier testing.
+type ListProvider interface {
+	ListUsers() ([]SystemUser, error)
+}
+
+// GroupListProvider is an interface for enumerating system groups.
+// This allows for dependency injection and easier testing.
+type GroupListProvider interface {
+	ListGroups() ([]SystemGroup, error)
+}
+
 // SystemLookupProvider uses the real system user lookup
 type SystemLookupProvider struct{}
 
@@ -98,3 +359,13 @@ type SystemLookupProvider struct{}
 func (p *SystemLookupProvider) Lookup(username string) (*UserInfo, error) {
 	return Lookup(username)
 }
+
+// ListUsers implements ListProvider using the system
+func (p *SystemLookupProvider) ListUsers() ([]SystemUser, error) {
+	return ListUsers()
+}
+
+// ListGroups implements GroupListProvider using the system
+func (p *SystemLookupProvider) ListGroups() ([]SystemGroup, error) {
+	return ListGroups()
+}
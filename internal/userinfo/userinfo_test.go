@@ -2,9 +2,11 @@ package userinfo
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -69,6 +71,94 @@ func TestLookup_MissingSSHDir(t *testing.T) {
 	t.Skip("Requires mocking user.Lookup to test missing .ssh directory")
 }
 
+func TestResolveDirs(t *testing.T) {
+	t.Run("existing .ssh", func(t *testing.T) {
+		homeDir := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(homeDir, ".ssh"), 0700))
+
+		info, err := resolveDirs("alice", 1000, 1000, homeDir)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(homeDir, ".ssh"), info.SSHDir)
+		assert.Equal(t, filepath.Join(homeDir, ".ssh", "authorized_keys"), info.AuthKeysPath)
+	})
+
+	t.Run("missing home", func(t *testing.T) {
+		_, err := resolveDirs("alice", 1000, 1000, filepath.Join(t.TempDir(), "unmounted"))
+		require.ErrorIs(t, err, ErrHomeDirNotFound)
+	})
+
+	t.Run("missing .ssh", func(t *testing.T) {
+		homeDir := t.TempDir()
+		info, err := resolveDirs("alice", 1000, 1000, homeDir)
+		require.ErrorIs(t, err, ErrSSHDirNotFound)
+		require.NotNil(t, info)
+		assert.Equal(t, filepath.Join(homeDir, ".ssh"), info.SSHDir)
+	})
+
+	t.Run(".ssh is a file", func(t *testing.T) {
+		homeDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(homeDir, ".ssh"), nil, 0600))
+
+		_, err := resolveDirs("alice", 1000, 1000, homeDir)
+		require.ErrorIs(t, err, ErrSSHDirNotDir)
+	})
+}
+
+func TestCreateSSHDir(t *testing.T) {
+	t.Run("creates .ssh", func(t *testing.T) {
+		homeDir := t.TempDir()
+		info := &UserInfo{UID: os.Getuid(), GID: os.Getgid(), HomeDir: homeDir, SSHDir: filepath.Join(homeDir, ".ssh")}
+
+		require.NoError(t, CreateSSHDir(info))
+		stat, err := os.Stat(info.SSHDir)
+		require.NoError(t, err)
+		assert.True(t, stat.IsDir())
+		assert.Equal(t, os.FileMode(SSHDirMode), stat.Mode().Perm())
+	})
+
+	t.Run("never creates the home directory", func(t *testing.T) {
+		homeDir := filepath.Join(t.TempDir(), "unmounted")
+		info := &UserInfo{UID: os.Getuid(), GID: os.Getgid(), HomeDir: homeDir, SSHDir: filepath.Join(homeDir, ".ssh")}
+
+		require.Error(t, CreateSSHDir(info))
+		assert.NoDirExists(t, homeDir)
+	})
+}
+
+func TestCheckSSHDirOwner(t *testing.T) {
+	homeDir := t.TempDir()
+	sshDir := filepath.Join(homeDir, ".ssh")
+	require.NoError(t, os.Mkdir(sshDir, 0700))
+
+	info := &UserInfo{UID: os.Getuid(), HomeDir: homeDir, SSHDir: sshDir}
+	assert.NoError(t, CheckSSHDirOwner(info, false))
+
+	// The directory belongs to the user running the test, not to this user
+	other := &UserInfo{UID: os.Getuid() + 1, HomeDir: homeDir, SSHDir: sshDir}
+	err := CheckSSHDirOwner(other, false)
+	require.ErrorIs(t, err, ErrSSHDirWrongOwner)
+	assert.ErrorContains(t, err, fmt.Sprintf("owned by uid %d", os.Getuid()))
+	if os.Getuid() == 0 {
+		assert.NoError(t, CheckSSHDirOwner(other, true))
+	} else {
+		assert.ErrorIs(t, CheckSSHDirOwner(other, true), ErrSSHDirWrongOwner)
+	}
+
+	missing := &UserInfo{UID: os.Getuid() + 1, SSHDir: filepath.Join(t.TempDir(), ".ssh")}
+	assert.NoError(t, CheckSSHDirOwner(missing, false))
+}
+
+func TestResolve(t *testing.T) {
+	homeDir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(homeDir, ".ssh"), 0700))
+
+	info, err := Resolve("not_in_passwd_xyz123", 101000, 101001, homeDir)
+	require.NoError(t, err)
+	assert.Equal(t, 101000, info.UID)
+	assert.Equal(t, 101001, info.GID)
+	assert.Equal(t, filepath.Join(homeDir, ".ssh", "authorized_keys"), info.AuthKeysPath)
+}
+
 func TestSystemLookupProvider(t *testing.T) {
 	provider := &SystemLookupProvider{}
 
@@ -107,6 +197,7 @@ func TestErrorTypes(t *testing.T) {
 	}{
 		{name: "ErrUserNotFound", err: ErrUserNotFound},
 		{name: "ErrNoHomeDir", err: ErrNoHomeDir},
+		{name: "ErrHomeDirNotFound", err: ErrHomeDirNotFound},
 		{name: "ErrSSHDirNotFound", err: ErrSSHDirNotFound},
 		{name: "ErrSSHDirNotDir", err: ErrSSHDirNotDir},
 	}
@@ -178,3 +269,63 @@ func TestLookup_RootUser(t *testing.T) {
 	assert.Equal(t, 0, info.UID)
 	assert.NotEmpty(t, info.HomeDir)
 }
+
+func TestParsePasswd(t *testing.T) {
+	content := `# comment line
+root:x:0:0:root:/root:/bin/bash
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+
+alice:x:1000:1000:Alice,,,:/home/alice:/bin/bash
+malformed:x:1001
+baduid:x:abc:1002::/home/baduid:/bin/sh
+`
+
+	users, err := ParsePasswd(strings.NewReader(content))
+	require.NoError(t, err)
+	require.Len(t, users, 3)
+
+	assert.Equal(t, SystemUser{Username: "root", UID: 0, GID: 0, HomeDir: "/root"}, users[0])
+	assert.Equal(t, "nobody", users[1].Username)
+	assert.Equal(t, 65534, users[1].UID)
+	assert.Equal(t, SystemUser{Username: "alice", UID: 1000, GID: 1000, HomeDir: "/home/alice"}, users[2])
+}
+
+func TestParseGroup(t *testing.T) {
+	content := `# comment line
+root:x:0:
+ssh-users:x:2000:alice, bob,,carol
+
+malformed:x:2001
+badgid:x:abc:alice
+`
+
+	groups, err := ParseGroup(strings.NewReader(content))
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+
+	assert.Equal(t, SystemGroup{Name: "root", GID: 0, Members: []string{}}, groups[0])
+	assert.Equal(t, SystemGroup{Name: "ssh-users", GID: 2000, Members: []string{"alice", "bob", "carol"}}, groups[1])
+}
+
+func TestGroupMembers(t *testing.T) {
+	users := []SystemUser{
+		{Username: "root", UID: 0, GID: 0},
+		{Username: "bob", UID: 1001, GID: 1001},
+		{Username: "deploy", UID: 1002, GID: 2000},
+		{Username: "alice", UID: 1000, GID: 1000},
+	}
+	group := SystemGroup{Name: "ssh-users", GID: 2000, Members: []string{"alice", "bob", "ldapuser"}}
+
+	// Passwd order for local users, then members only known to other name services
+	assert.Equal(t, []string{"bob", "deploy", "alice", "ldapuser"}, GroupMembers(group, users))
+}
+
+func TestListUsers(t *testing.T) {
+	if _, err := os.Stat(PasswdPath); err != nil {
+		t.Skipf("Skipping test: %s not available", PasswdPath)
+	}
+
+	users, err := (&SystemLookupProvider{}).ListUsers()
+	require.NoError(t, err)
+	assert.NotEmpty(t, users)
+}